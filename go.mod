@@ -7,4 +7,5 @@ require (
 	github.com/mattermost/mattermost-server/v5 v5.36.0
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/net v0.0.0-20210316092652-d523dce5a7f4
 )
@@ -15,8 +15,20 @@ func (p *Plugin) OnActivate() error {
 		return err
 	}
 
+	if err := p.API.RegisterCommand(getCommand()); err != nil {
+		return errors.Wrap(err, "failed to register command")
+	}
+
 	p.router = p.InitAPI()
+	p.startJobWorker()
+	p.startSyncScheduler()
+
+	return nil
+}
 
+func (p *Plugin) OnDeactivate() error {
+	p.stopSyncScheduler()
+	p.stopJobWorker()
 	return nil
 }
 
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils"
+	"github.com/pkg/errors"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// Props of the posts mirroring announcements. The webapp shows the override username and icon of posts from webhooks in place of the bot's.
+const (
+	postPropFromWebhook      = "from_webhook"
+	postPropOverrideUsername = "override_username"
+	postPropAnnouncementID   = "moodle_announcement_id"
+	postPropMoodleUserID     = "moodle_user_id"
+)
+
+const announcementTruncatedSuffix = "\n\n_The announcement is too long to be shown in full._"
+
+func getAnnouncementKey(channelID, announcementID string) string {
+	return utils.GetKeyHash(constants.KeyPrefixAnnouncement, channelID+"/"+announcementID)
+}
+
+// getMirroredAnnouncement returns the post mirroring the announcement in the channel, or nil if there is none
+func (p *Plugin) getMirroredAnnouncement(channelID, announcementID string) (*serializer.MirroredAnnouncement, error) {
+	data, appErr := p.API.KVGet(getAnnouncementKey(channelID, announcementID))
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get mirrored announcement from KV store")
+	}
+
+	if data == nil {
+		return nil, nil
+	}
+
+	var mirrored *serializer.MirroredAnnouncement
+	if err := json.Unmarshal(data, &mirrored); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal mirrored announcement")
+	}
+
+	return mirrored, nil
+}
+
+// mirrorAnnouncement posts the announcement in the channel, or updates the post mirroring it if there is one.
+// If that post was deleted in Mattermost, the announcement is posted again. It returns true if a post was created.
+func (p *Plugin) mirrorAnnouncement(channelID string, announcement *serializer.Announcement) (*serializer.MirroredAnnouncement, bool, int, error) {
+	mirrored, err := p.getMirroredAnnouncement(channelID, announcement.ID)
+	if err != nil {
+		return nil, false, http.StatusInternalServerError, err
+	}
+
+	post := p.getAnnouncementPost(channelID, announcement)
+	if mirrored != nil {
+		existing, appErr := p.API.GetPost(mirrored.PostID)
+		if appErr != nil && appErr.StatusCode != http.StatusNotFound {
+			return nil, false, appErr.StatusCode, errors.Wrap(appErr, "failed to get mirrored post")
+		}
+
+		if appErr == nil && existing.DeleteAt == 0 {
+			existing.Message = post.Message
+			existing.SetProps(post.GetProps())
+			if _, appErr = p.API.UpdatePost(existing); appErr != nil {
+				return nil, false, appErr.StatusCode, errors.Wrap(appErr, "failed to update mirrored post")
+			}
+
+			return mirrored, false, 0, nil
+		}
+	}
+
+	createdPost, appErr := p.API.CreatePost(post)
+	if appErr != nil {
+		return nil, false, appErr.StatusCode, errors.Wrap(appErr, "failed to create post")
+	}
+
+	mirrored = &serializer.MirroredAnnouncement{
+		ID:        announcement.ID,
+		ChannelID: channelID,
+		PostID:    createdPost.Id,
+	}
+
+	// If the link to the post cannot be stored, the next update of the announcement creates another post
+	if appErr = p.API.KVSet(getAnnouncementKey(channelID, announcement.ID), []byte(mirrored.ToJSON())); appErr != nil {
+		return nil, false, http.StatusInternalServerError, errors.Wrap(appErr, "failed to store mirrored announcement in KV store")
+	}
+
+	return mirrored, true, 0, nil
+}
+
+// deleteMirroredAnnouncement deletes the post mirroring the announcement.
+// It returns false if the announcement was not mirrored in the channel.
+func (p *Plugin) deleteMirroredAnnouncement(channelID, announcementID string) (bool, int, error) {
+	mirrored, err := p.getMirroredAnnouncement(channelID, announcementID)
+	if err != nil {
+		return false, http.StatusInternalServerError, err
+	}
+
+	if mirrored == nil {
+		return false, 0, nil
+	}
+
+	if appErr := p.API.DeletePost(mirrored.PostID); appErr != nil && appErr.StatusCode != http.StatusNotFound {
+		return false, appErr.StatusCode, errors.Wrap(appErr, "failed to delete mirrored post")
+	}
+
+	if appErr := p.API.KVDelete(getAnnouncementKey(channelID, announcementID)); appErr != nil {
+		return false, http.StatusInternalServerError, errors.Wrap(appErr, "failed to delete mirrored announcement from KV store")
+	}
+
+	return true, 0, nil
+}
+
+// getAnnouncementPost returns the post mirroring the announcement, which is shown as posted by its author.
+// If the server does not allow overriding the username of posts, the author is named in the message.
+func (p *Plugin) getAnnouncementPost(channelID string, announcement *serializer.Announcement) *model.Post {
+	config := p.API.GetConfig()
+	overrideUsername := config != nil && config.ServiceSettings.EnablePostUsernameOverride != nil && *config.ServiceSettings.EnablePostUsernameOverride
+
+	post := &model.Post{
+		ChannelId: channelID,
+		UserId:    p.botID,
+		Message:   getAnnouncementMessage(announcement, !overrideUsername),
+	}
+
+	post.AddProp(postPropFromWebhook, "true")
+	post.AddProp(postPropOverrideUsername, announcement.Author.FullName)
+	if announcement.Author.PictureURL != "" {
+		post.AddProp(model.POST_PROPS_OVERRIDE_ICON_URL, announcement.Author.PictureURL)
+	}
+	post.AddProp(postPropAnnouncementID, announcement.ID)
+	if announcement.Author.MoodleUserID != "" {
+		post.AddProp(postPropMoodleUserID, announcement.Author.MoodleUserID)
+	}
+
+	return post
+}
+
+// getAnnouncementMessage converts the announcement to Markdown. Its body is truncated to fit in a post.
+func getAnnouncementMessage(announcement *serializer.Announcement, showAuthor bool) string {
+	header := "#### " + utils.EscapeMarkdown(announcement.Subject)
+	if showAuthor {
+		header += fmt.Sprintf("\n_Posted by %s_", utils.EscapeMarkdown(announcement.Author.FullName))
+	}
+
+	var footer []string
+	if len(announcement.Attachments) > 0 {
+		lines := []string{"**Attachments**"}
+		for _, attachment := range announcement.Attachments {
+			fileName := utils.EscapeMarkdown(attachment.FileName)
+			if attachmentURL, err := utils.EscapeURL(attachment.URL); err == nil {
+				fileName = fmt.Sprintf("[%s](%s)", fileName, attachmentURL)
+			}
+			lines = append(lines, "- "+fileName)
+		}
+		footer = append(footer, strings.Join(lines, "\n"))
+	}
+
+	if announcementURL, err := utils.EscapeURL(announcement.URL); err == nil {
+		footer = append(footer, fmt.Sprintf("[View in Moodle](%s)", announcementURL))
+	}
+
+	body := utils.HTMLToMarkdown(announcement.Message)
+	maxBodyLength := model.POST_MESSAGE_MAX_RUNES_V2 - utf8.RuneCountInString(header) - 2
+	for _, part := range footer {
+		maxBodyLength -= utf8.RuneCountInString(part) + 2
+	}
+	if utf8.RuneCountInString(body) > maxBodyLength {
+		keep := maxBodyLength - utf8.RuneCountInString(announcementTruncatedSuffix)
+		if keep < 0 {
+			keep = 0
+		}
+		body = string([]rune(body)[:keep]) + announcementTruncatedSuffix
+	}
+
+	parts := []string{header}
+	if body != "" {
+		parts = append(parts, body)
+	}
+
+	return strings.Join(append(parts, footer...), "\n\n")
+}
+
+// putAnnouncement posts an announcement of the Moodle course in the channel, or updates the post mirroring it
+func (p *Plugin) putAnnouncement(w http.ResponseWriter, r *http.Request) {
+	channelID, status, resolveErr := p.resolveMattermostID(r, courseChannelMapping, "channel_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
+		return
+	}
+
+	announcement := serializer.AnnouncementFromJSON(r.Body)
+	if announcement != nil {
+		announcement.ID = mux.Vars(r)["announcement_id"]
+	}
+
+	if err := announcement.Validate(); err != nil {
+		p.API.LogError(err.Error())
+		p.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	mirrored, created, status, err := p.mirrorAnnouncement(channelID, announcement)
+	if err != nil {
+		p.API.LogError(fmt.Sprintf("Failed to mirror announcement. Error: %v", err.Error()))
+		p.writeError(w, r, status, errors.Wrap(err, "failed to mirror announcement"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	_, _ = w.Write([]byte(mirrored.ToJSON()))
+}
+
+// removeAnnouncement deletes the post mirroring an announcement deleted in Moodle
+func (p *Plugin) removeAnnouncement(w http.ResponseWriter, r *http.Request) {
+	channelID, status, resolveErr := p.resolveMattermostID(r, courseChannelMapping, "channel_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
+		return
+	}
+
+	deleted, status, err := p.deleteMirroredAnnouncement(channelID, mux.Vars(r)["announcement_id"])
+	if err != nil {
+		p.API.LogError(fmt.Sprintf("Failed to delete mirrored announcement. Error: %v", err.Error()))
+		p.writeError(w, r, status, errors.Wrap(err, "failed to delete mirrored announcement"))
+		return
+	}
+
+	if !deleted {
+		p.writeError(w, r, http.StatusNotFound, serializer.NewError(serializer.ErrorCodeAnnouncementNotFound, "the announcement is not mirrored in the channel"))
+		return
+	}
+
+	returnStatusOK(w)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils/testutils"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getServerConfigWithUsernameOverride(enabled bool) *model.Config {
+	config := &model.Config{}
+	config.SetDefaults()
+	config.ServiceSettings.EnablePostUsernameOverride = model.NewBool(enabled)
+	return config
+}
+
+func TestPutAnnouncement(t *testing.T) {
+	requestURL := fmt.Sprintf("/api/v1/channels/%s/announcements/81?secret=%s", testutils.GetID(), testutils.GetSecret())
+	announcementKey := getAnnouncementKey(testutils.GetID(), "81")
+	postID := model.NewId()
+	mirroredData, err := json.Marshal(&serializer.MirroredAnnouncement{ID: "81", ChannelID: testutils.GetID(), PostID: postID})
+	require.NoError(t, err)
+
+	body := `{
+		"subject": "Exam moved",
+		"message": "<p>The exam is now on <strong>Friday</strong>.</p>",
+		"author": {"moodle_user_id": "7", "fullname": "Jane Doe", "picture_url": "https://moodle.example.com/user/pix.php/7/f1.jpg"},
+		"attachments": [{"filename": "schedule.pdf", "url": "https://moodle.example.com/pluginfile.php/1/schedule.pdf"}]
+	}`
+	isAnnouncementPost := mock.MatchedBy(func(post *model.Post) bool {
+		return post.ChannelId == testutils.GetID() &&
+			post.Message == "#### Exam moved\n\nThe exam is now on **Friday**.\n\n**Attachments**\n- [schedule.pdf](https://moodle.example.com/pluginfile.php/1/schedule.pdf)" &&
+			post.GetProp("override_username") == "Jane Doe" &&
+			post.GetProp(model.POST_PROPS_OVERRIDE_ICON_URL) == "https://moodle.example.com/user/pix.php/7/f1.jpg" &&
+			post.GetProp("from_webhook") == "true"
+	})
+
+	for name, test := range map[string]struct {
+		Body               string
+		SetupAPI           func(*plugintest.API) *plugintest.API
+		ExpectedStatusCode int
+	}{
+		"new announcement": {
+			Body: body,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", announcementKey).Return(nil, nil)
+				api.On("GetConfig").Return(getServerConfigWithUsernameOverride(true))
+				api.On("CreatePost", isAnnouncementPost).Return(&model.Post{Id: postID}, nil)
+				api.On("KVSet", announcementKey, mirroredData).Return(nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusCreated,
+		},
+		"edited announcement": {
+			Body: body,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", announcementKey).Return(mirroredData, nil)
+				api.On("GetConfig").Return(getServerConfigWithUsernameOverride(true))
+				api.On("GetPost", postID).Return(&model.Post{Id: postID, ChannelId: testutils.GetID(), Message: "old"}, nil)
+				api.On("UpdatePost", isAnnouncementPost).Return(&model.Post{Id: postID}, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"mirrored post deleted in Mattermost": {
+			Body: body,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", announcementKey).Return(mirroredData, nil)
+				api.On("GetConfig").Return(getServerConfigWithUsernameOverride(true))
+				api.On("GetPost", postID).Return(nil, testutils.GetNotFoundAppError())
+				api.On("CreatePost", isAnnouncementPost).Return(&model.Post{Id: postID}, nil)
+				api.On("KVSet", announcementKey, mirroredData).Return(nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusCreated,
+		},
+		"server configuration not available": {
+			Body: body,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", announcementKey).Return(nil, nil)
+				api.On("GetConfig").Return((*model.Config)(nil))
+				api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+					return strings.HasPrefix(post.Message, "#### Exam moved\n_Posted by Jane Doe_\n\n")
+				})).Return(&model.Post{Id: postID}, nil)
+				api.On("KVSet", announcementKey, mirroredData).Return(nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusCreated,
+		},
+		"missing author": {
+			Body: `{"subject": "Exam moved", "message": "<p>Friday</p>"}`,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+		"invalid attachment": {
+			Body: `{"subject": "Exam moved", "author": {"fullname": "Jane Doe"}, "attachments": [{"filename": "a.pdf", "url": "file:///etc/passwd"}]}`,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+		"failed to create post": {
+			Body: body,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", announcementKey).Return(nil, nil)
+				api.On("GetConfig").Return(getServerConfigWithUsernameOverride(true))
+				api.On("CreatePost", isAnnouncementPost).Return(nil, testutils.GetInternalServerAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+			test.SetupAPI(api)
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, requestURL, strings.NewReader(test.Body))
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+			assert.Equal(t, test.ExpectedStatusCode, result.StatusCode)
+			if test.ExpectedStatusCode != http.StatusOK && test.ExpectedStatusCode != http.StatusCreated {
+				return
+			}
+
+			var mirrored *serializer.MirroredAnnouncement
+			require.NoError(t, json.NewDecoder(result.Body).Decode(&mirrored))
+			assert.Equal(t, postID, mirrored.PostID)
+		})
+	}
+}
+
+func TestRemoveAnnouncement(t *testing.T) {
+	requestURL := fmt.Sprintf("/api/v1/channels/%s/announcements/81?secret=%s", testutils.GetID(), testutils.GetSecret())
+	announcementKey := getAnnouncementKey(testutils.GetID(), "81")
+	postID := model.NewId()
+	mirroredData, err := json.Marshal(&serializer.MirroredAnnouncement{ID: "81", ChannelID: testutils.GetID(), PostID: postID})
+	require.NoError(t, err)
+
+	for name, test := range map[string]struct {
+		SetupAPI           func(*plugintest.API) *plugintest.API
+		ExpectedStatusCode int
+	}{
+		"delete mirrored post": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", announcementKey).Return(mirroredData, nil)
+				api.On("DeletePost", postID).Return(nil)
+				api.On("KVDelete", announcementKey).Return(nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"mirrored post already deleted in Mattermost": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", announcementKey).Return(mirroredData, nil)
+				api.On("DeletePost", postID).Return(testutils.GetNotFoundAppError())
+				api.On("KVDelete", announcementKey).Return(nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"announcement not mirrored": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", announcementKey).Return(nil, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusNotFound,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+			test.SetupAPI(api)
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodDelete, requestURL, nil)
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+			assert.Equal(t, test.ExpectedStatusCode, result.StatusCode)
+		})
+	}
+}
+
+func TestGetAnnouncementMessage(t *testing.T) {
+	announcement := &serializer.Announcement{
+		Subject: "Week_1 *notes*",
+		Message: "<p>See the slides.</p>",
+		Author:  &serializer.AnnouncementAuthor{FullName: "Jane Doe"},
+		URL:     "https://moodle.example.com/mod/forum/discuss.php?d=12",
+	}
+
+	assert.Equal(t, "#### Week\\_1 \\*notes\\*\n_Posted by Jane Doe_\n\nSee the slides.\n\n[View in Moodle](https://moodle.example.com/mod/forum/discuss.php?d=12)", getAnnouncementMessage(announcement, true))
+
+	announcement.URL = "https://moodle.example.com/mod/forum/discuss.php?d=12#p(1)"
+	announcement.Attachments = []serializer.AnnouncementAttachment{{FileName: "notes.pdf", URL: "https://moodle.example.com/pluginfile.php/1/week 1 (draft).pdf"}}
+	assert.Equal(t, "#### Week\\_1 \\*notes\\*\n\nSee the slides.\n\n**Attachments**\n- [notes.pdf](https://moodle.example.com/pluginfile.php/1/week%201%20%28draft%29.pdf)\n\n[View in Moodle](https://moodle.example.com/mod/forum/discuss.php?d=12#p%281%29)", getAnnouncementMessage(announcement, false))
+
+	announcement.Attachments = nil
+	announcement.Message = "<p>" + strings.Repeat("a", model.POST_MESSAGE_MAX_RUNES_V2) + "</p>"
+	message := getAnnouncementMessage(announcement, false)
+	assert.Equal(t, model.POST_MESSAGE_MAX_RUNES_V2, utf8.RuneCountInString(message))
+	assert.Contains(t, message, announcementTruncatedSuffix+"\n\n[View in Moodle]")
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"runtime/debug"
+	"strconv"
+	"time"
 
 	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
 	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
@@ -21,24 +28,51 @@ import (
 func (p *Plugin) InitAPI() *mux.Router {
 	r := mux.NewRouter()
 	r.Use(p.withRecovery)
+	r.NotFoundHandler = http.HandlerFunc(p.handleNotFound)
+	r.MethodNotAllowedHandler = http.HandlerFunc(p.handleMethodNotAllowed)
 
 	p.handleStaticFiles(r)
 	s := r.PathPrefix("/api/v1").Subrouter()
 
 	// Add the custom plugin routes here
 	s.HandleFunc(constants.PathTest, p.handleAuthRequired(p.handleTest)).Methods(http.MethodPost)
-	s.HandleFunc(constants.CreateChannel, p.handleAuthRequired(p.createChannel)).Methods(http.MethodPost)
-	s.HandleFunc(constants.ArchiveChannel, p.handleAuthRequired(p.archiveChannel)).Methods(http.MethodDelete)
-	s.HandleFunc(constants.UnarchiveChannel, p.handleAuthRequired(p.unarchiveChannel)).Methods(http.MethodPost)
-	s.HandleFunc(constants.GetOrCreateUserInTeam, p.handleAuthRequired(p.getOrCreateUserInTeam)).Methods(http.MethodPost)
+	s.HandleFunc(constants.OpenAPISpec, p.getOpenAPISpec).Methods(http.MethodGet)
+	s.HandleFunc(constants.CreateChannel, p.handleAuthRequired(p.withIdempotencyKey(p.withAsyncNoRetry(p.createChannel)))).Methods(http.MethodPost)
+	s.HandleFunc(constants.ArchiveChannel, p.handleAuthRequired(p.withAsync(p.archiveChannel))).Methods(http.MethodDelete)
+	s.HandleFunc(constants.UnarchiveChannel, p.handleAuthRequired(p.withAsync(p.unarchiveChannel))).Methods(http.MethodPost)
+	s.HandleFunc(constants.GetOrCreateUserInTeam, p.handleAuthRequired(p.withIdempotencyKey(p.withAsync(p.getOrCreateUserInTeam)))).Methods(http.MethodPost)
 	s.HandleFunc(constants.GetUserByUsername, p.handleAuthRequired(p.GetUserByUsername)).Methods(http.MethodGet)
-	s.HandleFunc(constants.AddUserToChannel, p.handleAuthRequired(p.AddUserToChannel)).Methods(http.MethodPost)
-	s.HandleFunc(constants.RemoveUserFromChannel, p.handleAuthRequired(p.RemoveUserFromChannel)).Methods(http.MethodDelete)
-	s.HandleFunc(constants.UpdateChannelMemberRoles, p.handleAuthRequired(p.UpdateChannelMemberRoles)).Methods(http.MethodPatch)
+	s.HandleFunc(constants.AddUserToChannel, p.handleAuthRequired(p.withIdempotencyKey(p.withAsync(p.AddUserToChannel)))).Methods(http.MethodPost)
+	s.HandleFunc(constants.RemoveUserFromChannel, p.handleAuthRequired(p.withAsync(p.RemoveUserFromChannel))).Methods(http.MethodDelete)
+	s.HandleFunc(constants.UpdateChannelMemberRoles, p.handleAuthRequired(p.withAsync(p.UpdateChannelMemberRoles))).Methods(http.MethodPatch)
 	s.HandleFunc(constants.GetChannelMembers, p.handleAuthRequired(p.GetChannelMembers)).Methods(http.MethodGet)
-	s.HandleFunc(constants.UpdateUser, p.handleAuthRequired(p.updateUser)).Methods(http.MethodPatch)
-	s.HandleFunc(constants.DeleteUser, p.handleAuthRequired(p.deleteUser)).Methods(http.MethodDelete)
+	s.HandleFunc(constants.ExportChannelMembers, p.handleAuthRequired(p.ExportChannelMembers)).Methods(http.MethodGet)
+	s.HandleFunc(constants.UpdateChannelMembers, p.handleAuthRequired(p.UpdateChannelMembers)).Methods(http.MethodPatch)
+	s.HandleFunc(constants.ReconcileChannelMembers, p.handleAuthRequired(p.ReconcileChannelMembers)).Methods(http.MethodPut)
+	s.HandleFunc(constants.UpdateUser, p.handleAuthRequired(p.withAsync(p.updateUser))).Methods(http.MethodPatch)
+	s.HandleFunc(constants.DeleteUser, p.handleAuthRequired(p.withAsync(p.deleteUser))).Methods(http.MethodDelete)
+	s.HandleFunc(constants.SetProfileImage, p.handleAuthRequired(p.withAsync(p.setProfileImage))).Methods(http.MethodPut)
 	s.HandleFunc(constants.GetChannel, p.handleAuthRequired(p.GetChannel)).Methods(http.MethodGet)
+	s.HandleFunc(constants.UpdateChannel, p.handleAuthRequired(p.withAsync(p.updateChannel))).Methods(http.MethodPatch)
+	s.HandleFunc(constants.CreateGroupChannel, p.handleAuthRequired(p.withIdempotencyKey(p.withAsyncNoRetry(p.createGroupChannel)))).Methods(http.MethodPost)
+	s.HandleFunc(constants.GetJob, p.handleAuthRequired(p.GetJob)).Methods(http.MethodGet)
+	s.HandleFunc(constants.PendingDeactivations, p.handleAuthRequired(p.getPendingDeactivations)).Methods(http.MethodGet)
+	s.HandleFunc(constants.PendingDeactivation, p.handleAuthRequired(p.getPendingDeactivation)).Methods(http.MethodGet)
+	s.HandleFunc(constants.PendingDeactivation, p.handleAuthRequired(p.withAsync(p.cancelPendingDeactivation))).Methods(http.MethodDelete)
+	s.HandleFunc(constants.CourseMapping, p.handleAuthRequired(p.getMappingHandler(courseChannelMapping, true))).Methods(http.MethodGet)
+	s.HandleFunc(constants.CourseMapping, p.handleAuthRequired(p.withAsync(p.storeMappingHandler(courseChannelMapping)))).Methods(http.MethodPut)
+	s.HandleFunc(constants.ChannelMapping, p.handleAuthRequired(p.getMappingHandler(courseChannelMapping, false))).Methods(http.MethodGet)
+	s.HandleFunc(constants.MoodleUserMapping, p.handleAuthRequired(p.getMappingHandler(userMapping, true))).Methods(http.MethodGet)
+	s.HandleFunc(constants.MoodleUserMapping, p.handleAuthRequired(p.withAsync(p.storeMappingHandler(userMapping)))).Methods(http.MethodPut)
+	s.HandleFunc(constants.UserMapping, p.handleAuthRequired(p.getMappingHandler(userMapping, false))).Methods(http.MethodGet)
+	s.HandleFunc(constants.SiteMapping, p.handleAuthRequired(p.getMappingHandler(siteTeamMapping, true))).Methods(http.MethodGet)
+	s.HandleFunc(constants.SiteMapping, p.handleAuthRequired(p.withAsync(p.storeMappingHandler(siteTeamMapping)))).Methods(http.MethodPut)
+	s.HandleFunc(constants.TeamMapping, p.handleAuthRequired(p.getMappingHandler(siteTeamMapping, false))).Methods(http.MethodGet)
+	s.HandleFunc(constants.ChannelDeadlines, p.handleAuthRequired(p.getDeadlines)).Methods(http.MethodGet)
+	s.HandleFunc(constants.ChannelDeadline, p.handleAuthRequired(p.withAsync(p.putDeadline))).Methods(http.MethodPut)
+	s.HandleFunc(constants.ChannelDeadline, p.handleAuthRequired(p.withAsync(p.removeDeadline))).Methods(http.MethodDelete)
+	s.HandleFunc(constants.ChannelAnnouncement, p.handleAuthRequired(p.withAsync(p.putAnnouncement))).Methods(http.MethodPut)
+	s.HandleFunc(constants.ChannelAnnouncement, p.handleAuthRequired(p.withAsync(p.removeAnnouncement))).Methods(http.MethodDelete)
 
 	// 404 handler
 	r.Handle("{anything:.*}", http.NotFoundHandler())
@@ -48,9 +82,36 @@ func (p *Plugin) InitAPI() *mux.Router {
 // handleAuthRequired verifies if provided request is performed by an authorized source.
 func (p *Plugin) handleAuthRequired(handleFunc func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if status, err := verifyHTTPSecret(p.configuration.Secret, r.FormValue("secret")); err != nil {
-			p.API.LogError(fmt.Sprintf("Invalid Secret. Error: %v", err.Error()))
-			http.Error(w, err.Error(), status)
+		// Requests replayed by a job were authorized when the job was created
+		if getRequestJobID(r) != "" {
+			handleFunc(w, r)
+			return
+		}
+
+		config := p.getConfiguration()
+		switch {
+		case r.Header.Get(constants.HeaderSignature) != "":
+			if status, err := p.verifyHTTPSignature(w, config.Secret, r); err != nil {
+				p.API.LogError(fmt.Sprintf("Invalid signature. Error: %v", err.Error()))
+				p.writeError(w, r, status, err)
+				return
+			}
+		case config.isSecretInQueryAllowed():
+			// The secret is read from the query only, as r.FormValue would parse the whole body before the handlers limit its size
+			if status, err := verifyHTTPSecret(config.Secret, r.URL.Query().Get("secret")); err != nil {
+				p.API.LogError(fmt.Sprintf("Invalid Secret. Error: %v", err.Error()))
+				p.writeError(w, r, status, err)
+				return
+			}
+		default:
+			p.API.LogError("Received an unsigned request while the secret in query parameter is not allowed")
+			p.writeError(w, r, http.StatusForbidden, serializer.NewError(serializer.ErrorCodeRequestNotSigned, "request is not signed"))
+			return
+		}
+
+		if siteID := getRequestSiteID(r); siteID != "" && !serializer.IsValidMoodleID(siteID) {
+			p.API.LogError("site id is not valid")
+			p.writeError(w, r, http.StatusBadRequest, serializer.NewError(serializer.ErrorCodeInvalidMoodleID, "site id is not valid"))
 			return
 		}
 
@@ -66,50 +127,76 @@ func (p *Plugin) createChannel(w http.ResponseWriter, r *http.Request) {
 	channelObj := serializer.ChannelFromJSON(r.Body)
 	if err := channelObj.Validate(); err != nil {
 		p.API.LogError(err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		p.writeError(w, r, http.StatusBadRequest, err)
 		return
 	}
 
-	team, teamErr := p.API.GetTeamByName(channelObj.TeamName)
+	team, status, teamErr := p.getTeamByNameOrSite(channelObj.TeamName, channelObj.SiteID, channelObj.CategoryName)
 	if teamErr != nil {
-		p.API.LogError(fmt.Sprintf("Invalid team name. Error: %v", teamErr.Error()))
-		http.Error(w, fmt.Sprintf("Invalid team name. Error: %v", teamErr.Error()), teamErr.StatusCode)
+		p.API.LogError(fmt.Sprintf("Failed to get team. Error: %v", teamErr.Error()))
+		p.writeError(w, r, status, errors.Wrap(teamErr, "failed to get team"))
 		return
 	}
 
+	displayName := channelObj.DisplayName
+	if displayName == "" {
+		displayName = channelObj.Name
+	}
+
+	channelType := channelObj.Type
+	if channelType == "" {
+		channelType = p.getConfiguration().DefaultChannelType
+	}
+
 	channel := &model.Channel{
 		Name:        channelObj.Name,
 		TeamId:      team.Id,
-		Type:        model.CHANNEL_PRIVATE,
+		Type:        channelType,
 		CreatorId:   p.botID,
-		DisplayName: channelObj.Name,
+		DisplayName: displayName,
+		Purpose:     channelObj.Purpose,
+		Header:      channelObj.Header,
+	}
+
+	createdChannel, status, createErr := p.createChannelWithBot(channel)
+	if createErr != nil {
+		p.API.LogError(createErr.Error())
+		p.writeError(w, r, status, createErr)
+		return
+	}
+
+	if channelObj.CourseID != "" {
+		if storeErr := p.storeMapping(courseChannelMapping.forSite(getRequestSiteID(r)), channelObj.CourseID, createdChannel.Id); storeErr != nil {
+			p.API.LogError(fmt.Sprintf("Failed to store course mapping. Error: %v", storeErr.Error()))
+			p.writeError(w, r, http.StatusInternalServerError, errors.Wrap(storeErr, "failed to store course mapping"))
+			return
+		}
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write([]byte(createdChannel.ToJson()))
+}
+
+// createChannelWithBot creates the channel and adds the bot to it, along with its team
+func (p *Plugin) createChannelWithBot(channel *model.Channel) (*model.Channel, int, error) {
 	createdChannel, err := p.API.CreateChannel(channel)
 	if err != nil {
-		p.API.LogError(fmt.Sprintf("Failed to create channel. Error: %v", err.Error()))
-		http.Error(w, fmt.Sprintf("Failed to create channel. Error: %v", err.Error()), err.StatusCode)
-		return
+		return nil, err.StatusCode, errors.Wrap(err, "failed to create channel")
 	}
 
-	if _, err = p.API.CreateTeamMember(team.Id, p.botID); err != nil {
-		p.API.LogError(fmt.Sprintf("Failed to add bot to team. Error: %v", err.Error()))
-		http.Error(w, fmt.Sprintf("Failed to add bot to team. Error: %v", err.Error()), err.StatusCode)
-		return
+	if _, err = p.API.CreateTeamMember(channel.TeamId, p.botID); err != nil {
+		return nil, err.StatusCode, errors.Wrap(err, "failed to add bot to team")
 	}
 
 	if _, err = p.API.AddChannelMember(createdChannel.Id, p.botID); err != nil {
-		p.API.LogError(fmt.Sprintf("Failed to add bot to channel. Error: %v", err.Error()))
-		http.Error(w, fmt.Sprintf("Failed to add bot to channel. Error: %v", err.Error()), err.StatusCode)
-		return
+		return nil, err.StatusCode, errors.Wrap(err, "failed to add bot to channel")
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	_, _ = w.Write([]byte(createdChannel.ToJson()))
+	return createdChannel, 0, nil
 }
 
-func (p *Plugin) handleUserErrorAndActivateIfNeeded(w http.ResponseWriter, user *model.User, err *model.AppError) (conitnueUserCreation bool) {
+func (p *Plugin) handleUserErrorAndActivateIfNeeded(w http.ResponseWriter, r *http.Request, user *model.User, err *model.AppError, moodleUserID string) (conitnueUserCreation bool) {
 	if err != nil && err.StatusCode == http.StatusNotFound {
 		// If the user was not found, log the error and continue with user creation
 		p.API.LogWarn(fmt.Sprintf("Failed to get user by id. Error: %v", err.Error()))
@@ -121,71 +208,99 @@ func (p *Plugin) handleUserErrorAndActivateIfNeeded(w http.ResponseWriter, user
 		if err = p.API.UpdateUserActive(user.Id, true); err != nil {
 			// If user activation failed, return the error
 			p.API.LogError(fmt.Sprintf("Failed to activate user. Error: %s", err.Error()))
-			http.Error(w, fmt.Sprintf("Failed to activate user. Error: %s", err.Error()), err.StatusCode)
+			p.writeError(w, r, err.StatusCode, errors.Wrap(err, "failed to activate user"))
 			return false
 		}
 
-		// User was activated so update the DeleteAt field of the user and return it
+		// User was activated so update the DeleteAt field of the user
 		user.DeleteAt = 0
-		_, _ = w.Write([]byte(user.ToJson()))
+	}
+
+	// The user is enrolled again, so an earlier deletion by Moodle must not take effect
+	if deleteErr := p.deletePendingDeactivation(user.Id); deleteErr != nil {
+		p.API.LogError(fmt.Sprintf("Failed to cancel pending deactivation. Error: %v", deleteErr.Error()))
+		p.writeError(w, r, http.StatusInternalServerError, errors.Wrap(deleteErr, "failed to cancel pending deactivation"))
 		return false
 	}
 
+	if moodleUserID != "" {
+		if storeErr := p.storeMapping(userMapping.forSite(getRequestSiteID(r)), moodleUserID, user.Id); storeErr != nil {
+			p.API.LogError(fmt.Sprintf("Failed to store user mapping. Error: %v", storeErr.Error()))
+			p.writeError(w, r, http.StatusInternalServerError, errors.Wrap(storeErr, "failed to store user mapping"))
+			return false
+		}
+	}
+
 	_, _ = w.Write([]byte(user.ToJson()))
 	return false
 }
 
-// Unarchives a channel at Mattermost
+// Unarchives a channel at Mattermost, along with its group channels
 func (p *Plugin) unarchiveChannel(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	channelID := params["channel_id"]
-
-	if !model.IsValidId(channelID) {
-		p.API.LogError("channel id is not valid")
-		http.Error(w, "channel id is not valid", http.StatusBadRequest)
+	channelID, status, resolveErr := p.resolveMattermostID(r, courseChannelMapping, "channel_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
 		return
 	}
 
 	channel, channelErr := p.API.GetChannel(channelID)
 	if channelErr != nil {
-		http.Error(w, fmt.Sprintf("Invalid channel id. Error: %v", channelErr.Error()), channelErr.StatusCode)
+		p.writeError(w, r, channelErr.StatusCode, errors.Wrap(channelErr, "invalid channel id"))
+		return
+	}
+
+	if err := p.restoreChannel(channel); err != nil {
+		p.API.LogError(fmt.Sprintf("Failed to delete channel. Error: %v", err.Error()))
+		p.writeError(w, r, err.StatusCode, errors.Wrap(err, "failed to unarchive channel"))
+		return
+	}
+
+	if status, err := p.unarchiveGroupChannels(channel.Id); err != nil {
+		p.API.LogError(fmt.Sprintf("Failed to unarchive group channels. Error: %v", err.Error()))
+		p.writeError(w, r, status, errors.Wrap(err, "failed to unarchive group channels"))
 		return
 	}
 
+	returnStatusOK(w)
+}
+
+// restoreChannel unarchives the given channel
+func (p *Plugin) restoreChannel(channel *model.Channel) *model.AppError {
 	updateChannel := model.Channel{
 		Id:          channel.Id,
 		DisplayName: channel.DisplayName,
 		Name:        channel.Name,
-		Type:        model.CHANNEL_PRIVATE,
+		Purpose:     channel.Purpose,
+		Header:      channel.Header,
+		Type:        channel.Type,
 		TeamId:      channel.TeamId,
 		CreateAt:    channel.CreateAt,
 		DeleteAt:    0, // unarchives the channel
 	}
 
 	_, err := p.API.UpdateChannel(&updateChannel)
-	if err != nil {
-		p.API.LogError(fmt.Sprintf("Failed to delete channel. Error: %v", err.Error()))
-		http.Error(w, fmt.Sprintf("Failed to delete Error: %v", err.Error()), err.StatusCode)
-		return
-	}
-
-	returnStatusOK(w)
+	return err
 }
 
-// Archives/deletes a channel at Mattermost
+// Archives/deletes a channel at Mattermost, along with its group channels
 func (p *Plugin) archiveChannel(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	channelID := params["channel_id"]
-
-	if !model.IsValidId(channelID) {
-		p.API.LogError("channel id is not valid")
-		http.Error(w, "channel id is not valid", http.StatusBadRequest)
+	channelID, status, resolveErr := p.resolveMattermostID(r, courseChannelMapping, "channel_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
 		return
 	}
 
 	if err := p.API.DeleteChannel(channelID); err != nil {
 		p.API.LogError(fmt.Sprintf("Failed to archive channel. Error: %v", err.Error()))
-		http.Error(w, fmt.Sprintf("Failed to archive channel. Error: %v", err.Error()), err.StatusCode)
+		p.writeError(w, r, err.StatusCode, errors.Wrap(err, "failed to archive channel"))
+		return
+	}
+
+	if status, err := p.archiveGroupChannels(channelID); err != nil {
+		p.API.LogError(fmt.Sprintf("Failed to archive group channels. Error: %v", err.Error()))
+		p.writeError(w, r, status, errors.Wrap(err, "failed to archive group channels"))
 		return
 	}
 
@@ -196,46 +311,90 @@ func (p *Plugin) getOrCreateUserInTeam(w http.ResponseWriter, r *http.Request) {
 	userObj := serializer.UserFromJSON(r.Body)
 	if err := userObj.Validate(); err != nil {
 		p.API.LogError(err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		p.writeError(w, r, http.StatusBadRequest, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
+	// If only the Moodle user id is given, check if the user has already been mapped to a Mattermost user
+	if userObj.ID == "" && userObj.MoodleUserID != "" {
+		mapping, err := p.getMappingByMoodleID(userMapping.forSite(getRequestSiteID(r)), userObj.MoodleUserID)
+		if err != nil {
+			p.API.LogError(fmt.Sprintf("Failed to get user mapping. Error: %v", err.Error()))
+			p.writeError(w, r, http.StatusInternalServerError, errors.Wrap(err, "failed to get user mapping"))
+			return
+		}
+
+		if mapping != nil {
+			userObj.ID = mapping.MattermostID
+		}
+	}
+
 	// Check if id is given for the user
 	if userObj.ID != "" {
 		user, err := p.API.GetUser(userObj.ID)
-		if conitnueUserCreation := p.handleUserErrorAndActivateIfNeeded(w, user, err); !conitnueUserCreation {
+		if conitnueUserCreation := p.handleUserErrorAndActivateIfNeeded(w, r, user, err, userObj.MoodleUserID); !conitnueUserCreation {
 			return
 		}
 	}
 
 	user, err := p.API.GetUserByEmail(userObj.Email)
-	if conitnueUserCreation := p.handleUserErrorAndActivateIfNeeded(w, user, err); !conitnueUserCreation {
+	if conitnueUserCreation := p.handleUserErrorAndActivateIfNeeded(w, r, user, err, userObj.MoodleUserID); !conitnueUserCreation {
+		return
+	}
+
+	// The auth service only matters for new users, so existing users are returned even if their auth service has been disabled since
+	if err := p.validateAuthService(userObj.AuthService); err != nil {
+		p.API.LogError(err.Error())
+		p.writeError(w, r, http.StatusBadRequest, err)
 		return
 	}
 
-	team, teamErr := p.API.GetTeamByName(userObj.TeamName)
+	team, status, teamErr := p.getTeamByNameOrSite(userObj.TeamName, userObj.SiteID, userObj.CategoryName)
 	if teamErr != nil {
-		p.API.LogError(fmt.Sprintf("Invalid team name. Error: %v", teamErr.Error()))
-		http.Error(w, fmt.Sprintf("Invalid team name. Error: %v", teamErr.Error()), teamErr.StatusCode)
+		p.API.LogError(fmt.Sprintf("Failed to get team. Error: %v", teamErr.Error()))
+		p.writeError(w, r, status, errors.Wrap(teamErr, "failed to get team"))
+		return
+	}
+
+	username, status, usernameErr := p.resolveUsername(userObj)
+	if usernameErr != nil {
+		p.API.LogError(fmt.Sprintf("Failed to resolve username. Error: %v", usernameErr.Error()))
+		p.writeError(w, r, status, errors.Wrap(usernameErr, "failed to resolve username"))
 		return
 	}
 
 	user = userObj.ToMattermostUser()
+	user.Username = username
 	createdUser, err := p.API.CreateUser(user)
 	if err != nil {
 		p.API.LogError(fmt.Sprintf("Failed to create user. Error: %v", err.Error()))
-		http.Error(w, fmt.Sprintf("Failed to create user. Error: %v", err.Error()), err.StatusCode)
+		p.writeError(w, r, err.StatusCode, errors.Wrap(err, "failed to create user"))
 		return
 	}
 
 	if _, err = p.API.CreateTeamMember(team.Id, createdUser.Id); err != nil {
 		p.API.LogError(fmt.Sprintf("Failed to add user to team. Error: %v", err.Error()))
-		http.Error(w, fmt.Sprintf("Failed to add user to team. Error: %v", err.Error()), err.StatusCode)
+		p.writeError(w, r, err.StatusCode, errors.Wrap(err, "failed to add user to team"))
 		return
 	}
 
+	if userObj.MoodleUserID != "" {
+		if storeErr := p.storeMapping(userMapping.forSite(getRequestSiteID(r)), userObj.MoodleUserID, createdUser.Id); storeErr != nil {
+			p.API.LogError(fmt.Sprintf("Failed to store user mapping. Error: %v", storeErr.Error()))
+			p.writeError(w, r, http.StatusInternalServerError, errors.Wrap(storeErr, "failed to store user mapping"))
+			return
+		}
+	}
+
+	// The user is created even if the email cannot be sent, as they can still reset their password from the login page
+	if userObj.AuthService == model.USER_AUTH_SERVICE_EMAIL {
+		if mailErr := p.sendPasswordSetupEmail(createdUser, team); mailErr != nil {
+			p.API.LogWarn(fmt.Sprintf("Failed to send password setup email. Error: %v", mailErr.Error()))
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	_, _ = w.Write([]byte(createdUser.ToJson()))
@@ -246,14 +405,14 @@ func (p *Plugin) GetUserByUsername(w http.ResponseWriter, r *http.Request) {
 	username := params["username"]
 	if !model.IsValidUsername(username) {
 		p.API.LogError("username is not valid")
-		http.Error(w, "username is not valid", http.StatusBadRequest)
+		p.writeError(w, r, http.StatusBadRequest, serializer.NewError(serializer.ErrorCodeInvalidUsername, "username is not valid"))
 		return
 	}
 
 	user, err := p.API.GetUserByUsername(username)
 	if err != nil {
 		p.API.LogError(fmt.Sprintf("Invalid username. Error: %v", err.Error()))
-		http.Error(w, err.Error(), err.StatusCode)
+		p.writeError(w, r, err.StatusCode, err)
 		return
 	}
 
@@ -261,94 +420,129 @@ func (p *Plugin) GetUserByUsername(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte(user.ToJson()))
 }
 
+// GetChannel returns a channel along with the links to its group channels, or to its course channel if it is a group channel
 func (p *Plugin) GetChannel(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	channelID := params["channel_id"]
+	channelID, status, resolveErr := p.resolveMattermostID(r, courseChannelMapping, "channel_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
+		return
+	}
 
-	if !model.IsValidId(channelID) {
-		p.API.LogError("channel id is not valid")
-		http.Error(w, "channel id is not valid", http.StatusBadRequest)
+	channel, err := p.API.GetChannel(channelID)
+	if err != nil {
+		p.API.LogError(fmt.Sprintf("Invalid channel id. Error: %v", err.Error()))
+		p.writeError(w, r, err.StatusCode, err)
+		return
+	}
+
+	channelWithGroupChannels, linksErr := p.getChannelWithGroupChannels(channel)
+	if linksErr != nil {
+		p.API.LogError(fmt.Sprintf("Failed to get group channels. Error: %v", linksErr.Error()))
+		p.writeError(w, r, http.StatusInternalServerError, errors.Wrap(linksErr, "failed to get group channels"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(channelWithGroupChannels.ToJSON()))
+}
+
+// updateChannel updates the display name, purpose and header of a channel, e.g. when the course is renamed at Moodle
+func (p *Plugin) updateChannel(w http.ResponseWriter, r *http.Request) {
+	channelID, status, resolveErr := p.resolveMattermostID(r, courseChannelMapping, "channel_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
 		return
 	}
 
 	channel, err := p.API.GetChannel(channelID)
 	if err != nil {
 		p.API.LogError(fmt.Sprintf("Invalid channel id. Error: %v", err.Error()))
-		http.Error(w, err.Error(), err.StatusCode)
+		p.writeError(w, r, err.StatusCode, errors.Wrap(err, "invalid channel id"))
+		return
+	}
+
+	channelPatch := serializer.ChannelPatchFromJSON(r.Body)
+	channel, patchErr := channelPatch.ToMattermostChannel(channel)
+	if patchErr != nil {
+		p.API.LogError(patchErr.Error())
+		p.writeError(w, r, http.StatusBadRequest, patchErr)
+		return
+	}
+
+	updatedChannel, err := p.API.UpdateChannel(channel)
+	if err != nil {
+		p.API.LogError(fmt.Sprintf("Failed to update channel. Error: %v", err.Error()))
+		p.writeError(w, r, err.StatusCode, errors.Wrap(err, "failed to update channel"))
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	_, _ = w.Write([]byte(channel.ToJson()))
+	_, _ = w.Write([]byte(updatedChannel.ToJson()))
 }
 
 func (p *Plugin) AddUserToChannel(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	channelID := params["channel_id"]
-	if !model.IsValidId(channelID) {
-		p.API.LogError("channel id is not valid")
-		http.Error(w, "channel id is not valid", http.StatusBadRequest)
+	channelID, status, resolveErr := p.resolveMattermostID(r, courseChannelMapping, "channel_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
 		return
 	}
 
 	channelMember := serializer.ChannelMemberFromJSON(r.Body)
 	if err := channelMember.Validate(); err != nil {
 		p.API.LogError(err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		p.writeError(w, r, http.StatusBadRequest, err)
 		return
 	}
 
-	if _, err := p.API.AddUserToChannel(channelID, channelMember.UserID, p.botID); err != nil {
-		p.API.LogError(fmt.Sprintf("Failed to add user to channel. Error: %v", err.Error()))
-		http.Error(w, fmt.Sprintf("Failed to add user to channel. Error: %v", err.Error()), err.StatusCode)
+	// The other actions are only applied by the batch endpoint
+	if channelMember.Action != "" && channelMember.Action != serializer.ChannelMemberActionAdd {
+		p.API.LogError("action must be add")
+		p.writeError(w, r, http.StatusBadRequest, serializer.NewError(serializer.ErrorCodeInvalidAction, "action must be add"))
 		return
 	}
 
-	if channelMember.Role == "channel_admin" {
-		if _, err := p.API.UpdateChannelMemberRoles(channelID, channelMember.UserID, channelMember.Role); err != nil {
-			p.API.LogError(fmt.Sprintf("Failed to make user the channel admin. Error: %v", err.Error()))
-			http.Error(w, fmt.Sprintf("Failed to make user the channel admin. Error: %v", err.Error()), err.StatusCode)
-			return
-		}
+	if status, err := p.resolveChannelMemberUserID(getRequestSiteID(r), channelMember); err != nil {
+		p.API.LogError(err.Error())
+		p.writeError(w, r, status, err)
+		return
+	}
 
-		user, err := p.API.GetUser(channelMember.UserID)
-		if err != nil {
-			p.API.LogDebug(fmt.Sprintf("Failed to get user. Error: %v", err.Error()))
-			http.Error(w, fmt.Sprintf("Failed to get user. Error: %v", err.Error()), err.StatusCode)
-			return
-		}
+	if status, err := p.resolveChannelMemberRole(channelMember); err != nil {
+		p.API.LogError(err.Error())
+		p.writeError(w, r, status, err)
+		return
+	}
 
-		_, _ = p.API.CreatePost(&model.Post{
-			ChannelId: channelID,
-			UserId:    p.botID,
-			Message:   fmt.Sprintf("@%v was made channel admin.", user.Username),
-		})
+	if status, err := p.addChannelMember(channelID, channelMember); err != nil {
+		p.API.LogError(err.Error())
+		p.writeError(w, r, status, err)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
 	returnStatusOK(w)
 }
 
 func (p *Plugin) RemoveUserFromChannel(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	channelID := params["channel_id"]
-	userID := params["user_id"]
-
-	if !model.IsValidId(channelID) {
-		p.API.LogError("channel id is not valid")
-		http.Error(w, "channel id is not valid", http.StatusBadRequest)
+	channelID, status, resolveErr := p.resolveMattermostID(r, courseChannelMapping, "channel_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
 		return
 	}
 
-	if !model.IsValidId(userID) {
-		p.API.LogError("user id is not valid")
-		http.Error(w, "user id is not valid", http.StatusBadRequest)
+	userID, status, resolveErr := p.resolveMattermostID(r, userMapping, "user_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
 		return
 	}
 
-	if err := p.API.DeleteChannelMember(channelID, userID); err != nil {
-		p.API.LogError(fmt.Sprintf("Failed to remove user from channel. Error: %v", err.Error()))
-		http.Error(w, fmt.Sprintf("Failed to remove user from channel. Error: %v", err.Error()), err.StatusCode)
+	if status, err := p.removeChannelMember(channelID, userID); err != nil {
+		p.API.LogError(err.Error())
+		p.writeError(w, r, status, err)
 		return
 	}
 
@@ -356,47 +550,209 @@ func (p *Plugin) RemoveUserFromChannel(w http.ResponseWriter, r *http.Request) {
 }
 
 func (p *Plugin) UpdateChannelMemberRoles(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	channelID := params["channel_id"]
-
-	if !model.IsValidId(channelID) {
-		p.API.LogError("channel id is not valid")
-		http.Error(w, "channel id is not valid", http.StatusBadRequest)
+	channelID, status, resolveErr := p.resolveMattermostID(r, courseChannelMapping, "channel_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
 		return
 	}
 
 	channelMember := serializer.ChannelMemberFromJSON(r.Body)
 	if err := channelMember.Validate(); err != nil {
 		p.API.LogDebug(err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		p.writeError(w, r, http.StatusBadRequest, err)
 		return
 	}
 
-	if channelMember.Role == "" {
-		p.API.LogDebug("role cannot be empty")
-		http.Error(w, "role cannot be empty", http.StatusBadRequest)
+	if channelMember.Role == "" && channelMember.MoodleRole == "" {
+		p.API.LogDebug("either role or moodle_role is required")
+		p.writeError(w, r, http.StatusBadRequest, serializer.NewError(serializer.ErrorCodeInvalidRole, "either role or moodle_role is required"))
 		return
 	}
 
-	if _, err := p.API.UpdateChannelMemberRoles(channelID, channelMember.UserID, channelMember.Role); err != nil {
-		p.API.LogDebug(fmt.Sprintf("Failed to update roles for the user and channel. Error: %v", err.Error()))
-		http.Error(w, fmt.Sprintf("Failed to update roles for the user and channel. Error: %v", err.Error()), err.StatusCode)
+	if status, err := p.resolveChannelMemberUserID(getRequestSiteID(r), channelMember); err != nil {
+		p.API.LogDebug(err.Error())
+		p.writeError(w, r, status, err)
 		return
 	}
 
-	user, err := p.API.GetUser(channelMember.UserID)
+	if status, err := p.resolveChannelMemberRole(channelMember); err != nil {
+		p.API.LogDebug(err.Error())
+		p.writeError(w, r, status, err)
+		return
+	}
+
+	if status, err := p.updateChannelMemberRoles(channelID, channelMember); err != nil {
+		p.API.LogDebug(err.Error())
+		p.writeError(w, r, status, err)
+		return
+	}
+
+	returnStatusOK(w)
+}
+
+// UpdateChannelMembers applies a batch of membership changes to a channel.
+// Every change is applied independently and a result is returned for each of them, so a single invalid change does not fail the whole batch.
+// If the "async" query parameter is true, the changes are applied in the background and a job is returned instead.
+func (p *Plugin) UpdateChannelMembers(w http.ResponseWriter, r *http.Request) {
+	channelID, status, resolveErr := p.resolveMattermostID(r, courseChannelMapping, "channel_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
+		return
+	}
+
+	channelMembers := serializer.ChannelMembersFromJSON(r.Body)
+	if err := channelMembers.Validate(); err != nil {
+		p.API.LogError(err.Error())
+		p.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	if isAsyncRequest(r) {
+		p.writeAcceptedJob(w, r, serializer.JobTypeUpdateChannelMembers, map[string]string{serializer.JobParamChannelID: channelID, serializer.JobParamSiteID: getRequestSiteID(r)}, channelMembers)
+		return
+	}
+
+	results := make(serializer.ChannelMemberResults, 0, len(channelMembers))
+	for i := range channelMembers {
+		results = append(results, p.applyChannelMemberChange(getRequestSiteID(r), channelID, &channelMembers[i]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(results.ToJSON()))
+}
+
+// ReconcileChannelMembers makes the membership of a channel equal to the list of channel members in the request.
+// If the "dry_run" query parameter is true, the changes are returned without being applied.
+// An empty list is rejected unless the "allow_empty" query parameter is true.
+// If the "async" query parameter is true, the reconciliation is done in the background and a job is returned instead.
+func (p *Plugin) ReconcileChannelMembers(w http.ResponseWriter, r *http.Request) {
+	channelID, status, resolveErr := p.resolveMattermostID(r, courseChannelMapping, "channel_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
+		return
+	}
+
+	channelMembers := serializer.ChannelMembersFromJSON(r.Body)
+	if channelMembers == nil {
+		p.API.LogError("invalid request body")
+		p.writeError(w, r, http.StatusBadRequest, serializer.NewError(serializer.ErrorCodeInvalidRequestBody, "invalid request body"))
+		return
+	}
+
+	// An empty list removes every member of the channel, which is most likely a mistake of the caller
+	if allowEmpty, _ := strconv.ParseBool(r.URL.Query().Get("allow_empty")); len(channelMembers) == 0 && !allowEmpty {
+		p.API.LogError("channel members cannot be empty")
+		p.writeError(w, r, http.StatusBadRequest, serializer.NewError(serializer.ErrorCodeInvalidChannelMembers, "channel members cannot be empty unless allow_empty is true"))
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	if isAsyncRequest(r) {
+		params := map[string]string{
+			serializer.JobParamChannelID: channelID,
+			serializer.JobParamSiteID:    getRequestSiteID(r),
+			serializer.JobParamDryRun:    strconv.FormatBool(dryRun),
+		}
+		p.writeAcceptedJob(w, r, serializer.JobTypeReconcileChannelMembers, params, channelMembers)
+		return
+	}
+
+	reconciliation, status, err := p.reconcileChannelMembers(getRequestSiteID(r), channelID, channelMembers, false, dryRun)
 	if err != nil {
-		p.API.LogDebug(fmt.Sprintf("Failed to get user. Error: %v", err.Error()))
-		http.Error(w, fmt.Sprintf("Failed to get user. Error: %v", err.Error()), err.StatusCode)
+		p.API.LogError(fmt.Sprintf("Failed to reconcile channel members. Error: %v", err.Error()))
+		p.writeError(w, r, status, errors.Wrap(err, "failed to reconcile channel members"))
 		return
 	}
 
-	var roleDisplayName string
-	switch channelMember.Role {
-	case "channel_admin":
-		roleDisplayName = "channel admin"
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(reconciliation.ToJSON()))
+}
+
+func (p *Plugin) applyChannelMemberChange(siteID, channelID string, channelMember *serializer.ChannelMember) serializer.ChannelMemberResult {
+	result := serializer.ChannelMemberResult{
+		UserID:       channelMember.UserID,
+		MoodleUserID: channelMember.MoodleUserID,
+		Action:       channelMember.Action,
+		Status:       model.STATUS_OK,
+	}
+
+	status, err := p.applyChannelMemberAction(siteID, channelID, channelMember)
+	if err != nil {
+		p.API.LogWarn(fmt.Sprintf("Failed to apply channel member change. Error: %v", err.Error()))
+		result.Status = model.STATUS_FAIL
+		result.StatusCode = status
+		result.Error = err.Error()
+		result.ErrorCode = getErrorCode(status, err)
+	}
+
+	result.UserID = channelMember.UserID
+	return result
+}
+
+func (p *Plugin) applyChannelMemberAction(siteID, channelID string, channelMember *serializer.ChannelMember) (int, error) {
+	if err := channelMember.Validate(); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if status, err := p.resolveChannelMemberUserID(siteID, channelMember); err != nil {
+		return status, err
+	}
+
+	if status, err := p.resolveChannelMemberRole(channelMember); err != nil {
+		return status, err
+	}
+
+	switch channelMember.Action {
+	case serializer.ChannelMemberActionRemove:
+		return p.removeChannelMember(channelID, channelMember.UserID)
+	case serializer.ChannelMemberActionUpdateRole:
+		return p.updateChannelMemberRoles(channelID, channelMember)
 	default:
-		roleDisplayName = "member"
+		return p.addChannelMember(channelID, channelMember)
+	}
+}
+
+// addChannelMember adds the user to the channel and makes them channel admin and team admin if needed.
+// Users who are already channel admins are demoted if their Moodle role is mapped to channel_user.
+func (p *Plugin) addChannelMember(channelID string, channelMember *serializer.ChannelMember) (int, error) {
+	member, err := p.API.AddUserToChannel(channelID, channelMember.UserID, p.botID)
+	if err != nil {
+		return err.StatusCode, errors.Wrap(err, "failed to add user to channel")
+	}
+
+	if isChannelAdminRole(channelMember.Role) || (channelMember.MoodleRole != "" && member != nil && member.SchemeAdmin) {
+		return p.updateChannelMemberRoles(channelID, channelMember)
+	}
+
+	return p.applyMoodleTeamRole(channelID, channelMember)
+}
+
+func (p *Plugin) removeChannelMember(channelID, userID string) (int, error) {
+	if err := p.API.DeleteChannelMember(channelID, userID); err != nil {
+		return err.StatusCode, errors.Wrap(err, "failed to remove user from channel")
+	}
+
+	return 0, nil
+}
+
+// updateChannelMemberRoles updates the roles of the channel member and lets the channel know about it.
+// The channel member is made team admin too if their Moodle role is mapped to it.
+func (p *Plugin) updateChannelMemberRoles(channelID string, channelMember *serializer.ChannelMember) (int, error) {
+	if _, err := p.API.UpdateChannelMemberRoles(channelID, channelMember.UserID, channelMember.Role); err != nil {
+		return err.StatusCode, errors.Wrap(err, "failed to update roles for the user and channel")
+	}
+
+	user, err := p.API.GetUser(channelMember.UserID)
+	if err != nil {
+		return err.StatusCode, errors.Wrap(err, "failed to get user")
+	}
+
+	roleDisplayName := "member"
+	if isChannelAdminRole(channelMember.Role) {
+		roleDisplayName = "channel admin"
 	}
 
 	_, _ = p.API.CreatePost(&model.Post{
@@ -405,115 +761,280 @@ func (p *Plugin) UpdateChannelMemberRoles(w http.ResponseWriter, r *http.Request
 		Message:   fmt.Sprintf("@%v was made %v", user.Username, roleDisplayName),
 	})
 
-	returnStatusOK(w)
+	return p.applyMoodleTeamRole(channelID, channelMember)
 }
 
+// GetChannelMembers returns a page of the members of a channel along with their user info, ordered by username.
+// If the "include_profile" query parameter is true, the first name, last name, auth service and deactivation state of the users are included too.
 func (p *Plugin) GetChannelMembers(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	channelID := params["channel_id"]
-
-	if !model.IsValidId(channelID) {
-		p.API.LogError("channel id is not valid")
-		http.Error(w, "channel id is not valid", http.StatusBadRequest)
+	channelID, status, resolveErr := p.resolveMattermostID(r, courseChannelMapping, "channel_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
 		return
 	}
 
 	page, perPage := utils.GetPageAndPerPage(r)
-	channelMembers, err := p.API.GetChannelMembers(channelID, page, perPage)
+	includeProfile, _ := strconv.ParseBool(r.URL.Query().Get("include_profile"))
+	members, err := p.getChannelMembersWithUserInfo(channelID, page, perPage, includeProfile)
 	if err != nil {
 		p.API.LogError(fmt.Sprintf("Failed to fetch channel members. Error: %v", err.Error()))
-		http.Error(w, fmt.Sprintf("Failed to fetch channel members. Error: %v", err.Error()), err.StatusCode)
+		p.writeError(w, r, err.StatusCode, errors.Wrap(err, "failed to fetch channel members"))
 		return
 	}
 
-	var members serializer.ChannelMembersWithUserInfo
 	w.Header().Set("Content-Type", "application/json")
-	if channelMembers == nil {
-		_, _ = w.Write([]byte(members.ToJSON()))
-		return
+	_, _ = w.Write([]byte(members.ToJSON()))
+}
+
+// getChannelMembersWithUserInfo fetches a page of the users in the channel and their channel memberships in bulk.
+// Bots are left out, and so are users who left the channel between the two calls.
+func (p *Plugin) getChannelMembersWithUserInfo(channelID string, page, perPage int, includeProfile bool) (serializer.ChannelMembersWithUserInfo, *model.AppError) {
+	users, channelMembersByUserID, err := p.getUsersInChannelWithMembers(channelID, page, perPage)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, channelMember := range *channelMembers {
-		user, err := p.API.GetUser(channelMember.UserId)
-		if err != nil {
-			p.API.LogError(fmt.Sprintf("Failed to fetch user. Error: %v", err.Error()))
-			http.Error(w, fmt.Sprintf("Failed to fetch user. Error: %v", err.Error()), err.StatusCode)
-			return
+	members := serializer.ChannelMembersWithUserInfo{}
+	for _, user := range users {
+		if user.IsBot {
+			continue
 		}
 
-		if user.IsBot {
+		channelMember, ok := channelMembersByUserID[user.Id]
+		if !ok {
 			continue
 		}
 
-		channelMemberWithUserInfo := serializer.ChannelMemberWithUserInfo{
-			UserID:         channelMember.UserId,
-			ChannelID:      channelMember.ChannelId,
-			Email:          user.Email,
-			Username:       user.Username,
-			IsChannelAdmin: channelMember.SchemeAdmin,
+		members = append(members, newChannelMemberWithUserInfo(user, &channelMember, includeProfile))
+	}
+
+	return members, nil
+}
+
+// getUsersInChannelWithMembers fetches a page of the users in the channel, ordered by username, along with a map of their IDs to their channel memberships
+func (p *Plugin) getUsersInChannelWithMembers(channelID string, page, perPage int) ([]*model.User, map[string]model.ChannelMember, *model.AppError) {
+	users, err := p.API.GetUsersInChannel(channelID, model.CHANNEL_SORT_BY_USERNAME, page, perPage)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	channelMembersByUserID, err := p.getChannelMembersByUserID(channelID, users)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return users, channelMembersByUserID, nil
+}
+
+// getChannelMembersByUserID returns the channel memberships of the given users, by user ID
+func (p *Plugin) getChannelMembersByUserID(channelID string, users []*model.User) (map[string]model.ChannelMember, *model.AppError) {
+	if len(users) == 0 {
+		return map[string]model.ChannelMember{}, nil
+	}
+
+	userIDs := make([]string, 0, len(users))
+	for _, user := range users {
+		userIDs = append(userIDs, user.Id)
+	}
+
+	channelMembers, err := p.API.GetChannelMembersByIds(channelID, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	channelMembersByUserID := make(map[string]model.ChannelMember, len(userIDs))
+	if channelMembers != nil {
+		for _, channelMember := range *channelMembers {
+			channelMembersByUserID[channelMember.UserId] = channelMember
 		}
+	}
+
+	return channelMembersByUserID, nil
+}
 
-		members = append(members, channelMemberWithUserInfo)
+func newChannelMemberWithUserInfo(user *model.User, channelMember *model.ChannelMember, includeProfile bool) serializer.ChannelMemberWithUserInfo {
+	channelMemberWithUserInfo := serializer.ChannelMemberWithUserInfo{
+		UserID:         user.Id,
+		ChannelID:      channelMember.ChannelId,
+		Email:          user.Email,
+		Username:       user.Username,
+		IsChannelAdmin: channelMember.SchemeAdmin,
 	}
 
-	_, _ = w.Write([]byte(members.ToJSON()))
+	if includeProfile {
+		isDeactivated := user.DeleteAt != 0
+		channelMemberWithUserInfo.FirstName = user.FirstName
+		channelMemberWithUserInfo.LastName = user.LastName
+		channelMemberWithUserInfo.AuthService = user.AuthService
+		channelMemberWithUserInfo.IsDeactivated = &isDeactivated
+	}
+
+	return channelMemberWithUserInfo
 }
 
 func (p *Plugin) updateUser(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	userID := params["user_id"]
-
-	if !model.IsValidId(userID) {
-		p.API.LogError("user id is not valid")
-		http.Error(w, "user id is not valid", http.StatusBadRequest)
+	userID, status, resolveErr := p.resolveMattermostID(r, userMapping, "user_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
 		return
 	}
 
 	user, err := p.API.GetUser(userID)
 	if err != nil {
 		p.API.LogError(fmt.Sprintf("Failed to get user by id. Error: %v", err.Error()))
-		http.Error(w, fmt.Sprintf("Failed to get user by id. Error: %v", err.Error()), err.StatusCode)
+		p.writeError(w, r, err.StatusCode, errors.Wrap(err, "failed to get user by id"))
 		return
 	}
 
+	// The patch can contain a base64 encoded profile image, so its size is limited like the uploads of profile images
+	r.Body = http.MaxBytesReader(w, r.Body, profileImageMaxBodySize)
 	userPatch := serializer.UserPatchFromJSON(r.Body)
 	user, er := userPatch.ToMattermostUser(user)
 	if er != nil {
 		p.API.LogDebug(er.Error())
-		http.Error(w, er.Error(), http.StatusBadRequest)
+		p.writeError(w, r, http.StatusBadRequest, er)
 		return
 	}
 
+	// The image and the auth changes are validated before updating the user, so that invalid ones do not leave the user half updated
+	var profileImage []byte
+	if userPatch.ProfileImage != nil {
+		if profileImage, er = serializer.DecodeProfileImage(*userPatch.ProfileImage); er != nil {
+			p.API.LogDebug(er.Error())
+			p.writeError(w, r, http.StatusBadRequest, er)
+			return
+		}
+	}
+
+	userAuth, er := userPatch.ToUserAuth(user)
+	if er != nil {
+		p.API.LogDebug(er.Error())
+		p.writeError(w, r, http.StatusBadRequest, er)
+		return
+	}
+
+	// Users cannot be switched back to email, so the auth of users who sign in with email is only changed when nothing else can fail after it
+	if userAuth != nil && user.AuthService == "" && !userPatch.ChangesOnlyAuth() {
+		er = serializer.NewError(serializer.ErrorCodeInvalidAuthService, "error: users who sign in with email can only be switched to another auth service in a request which changes nothing else, as the change could not be undone if the rest of the update fails")
+		p.API.LogDebug(er.Error())
+		p.writeError(w, r, http.StatusBadRequest, er)
+		return
+	}
+
+	if userAuth != nil {
+		if er = p.validateUserAuthUpdate(userAuth); er != nil {
+			p.API.LogDebug(er.Error())
+			p.writeError(w, r, http.StatusBadRequest, er)
+			return
+		}
+	}
+
+	// The auth and the profile image are changed before updating the user, and restored if a later step fails, so that a failure does not leave the user half updated.
+	// Updating the user does not change its auth service and auth data, so they do not need to be set on the user.
+	if userAuth != nil {
+		if status, authErr := p.updateUserAuth(user.Id, userAuth); authErr != nil {
+			p.API.LogError(fmt.Sprintf("Failed to update user auth. Error: %v", authErr.Error()))
+			p.writeError(w, r, status, errors.Wrap(authErr, "failed to update user auth"))
+			return
+		}
+
+		// There is nothing else to update, so the user is not updated and the auth change cannot be left half done
+		if userPatch.ChangesOnlyAuth() {
+			user.AuthService = userAuth.AuthService
+			user.AuthData = userAuth.AuthData
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(user.ToJson()))
+			return
+		}
+	}
+
+	var previousProfileImage []byte
+	if profileImage != nil {
+		if previousProfileImage, err = p.getCustomProfileImage(user); err == nil {
+			err = p.API.SetProfileImage(user.Id, profileImage)
+		}
+
+		if err != nil {
+			if userAuth != nil {
+				p.restoreUserAuth(user)
+			}
+
+			p.API.LogError(fmt.Sprintf("Failed to set profile image. Error: %v", err.Error()))
+			p.writeError(w, r, err.StatusCode, errors.Wrap(err, "failed to set profile image"))
+			return
+		}
+	}
+
 	updatedUser, err := p.API.UpdateUser(user)
 	if err != nil {
+		if profileImage != nil {
+			p.restoreProfileImage(user.Id, previousProfileImage)
+		}
+
+		if userAuth != nil {
+			p.restoreUserAuth(user)
+		}
+
 		p.API.LogDebug(fmt.Sprintf("Failed to update user. Error: %v", err.Error()))
-		http.Error(w, fmt.Sprintf("Failed to update user. Error: %v", err.DetailedError), err.StatusCode)
+		p.writeError(w, r, err.StatusCode, errors.Wrap(err, "failed to update user"))
 		return
 	}
 
+	if userAuth != nil {
+		updatedUser.AuthService = userAuth.AuthService
+		updatedUser.AuthData = userAuth.AuthData
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	_, _ = w.Write([]byte(updatedUser.ToJson()))
 }
 
 func (p *Plugin) deleteUser(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	userID := params["user_id"]
-
-	if !model.IsValidId(userID) {
-		p.API.LogError("user id is not valid")
-		http.Error(w, "user id is not valid", http.StatusBadRequest)
+	userID, status, resolveErr := p.resolveMattermostID(r, userMapping, "user_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
 		return
 	}
 
-	if err := p.API.DeleteUser(userID); err != nil {
-		p.API.LogError(fmt.Sprintf("Failed to delete user. Error: %v", err.Error()))
-		http.Error(w, fmt.Sprintf("Failed to delete user. Error: %v", err.Error()), err.StatusCode)
+	switch p.getConfiguration().UserDeletionPolicy {
+	case userDeletionPolicyDeactivateAfterGracePeriod:
+		pendingDeactivation, err := p.scheduleDeactivation(userID)
+		if err != nil {
+			p.API.LogError(fmt.Sprintf("Failed to schedule user deactivation. Error: %v", err.Error()))
+			p.writeError(w, r, http.StatusInternalServerError, errors.Wrap(err, "failed to schedule user deactivation"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte(pendingDeactivation.ToJSON()))
 		return
+	case userDeletionPolicyRemoveFromChannels:
+		if status, err := p.removeUserFromCourseChannels(userID); err != nil {
+			p.API.LogError(fmt.Sprintf("Failed to remove user from course channels. Error: %v", err.Error()))
+			p.writeError(w, r, status, errors.Wrap(err, "failed to remove user from course channels"))
+			return
+		}
+	default:
+		if err := p.API.DeleteUser(userID); err != nil {
+			p.API.LogError(fmt.Sprintf("Failed to delete user. Error: %v", err.Error()))
+			p.writeError(w, r, err.StatusCode, errors.Wrap(err, "failed to delete user"))
+			return
+		}
 	}
 
 	returnStatusOK(w)
 }
 
+// isAsyncRequest checks if the request asks to be processed in the background.
+func isAsyncRequest(r *http.Request) bool {
+	async, _ := strconv.ParseBool(r.URL.Query().Get("async"))
+	return async
+}
+
 func returnStatusOK(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
 	m := make(map[string]string)
@@ -533,6 +1054,14 @@ func (p *Plugin) handleStaticFiles(r *mux.Router) {
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir(filepath.Join(bundlePath, "assets")))))
 }
 
+func (p *Plugin) handleNotFound(w http.ResponseWriter, r *http.Request) {
+	p.writeError(w, r, http.StatusNotFound, serializer.NewError(serializer.ErrorCodeNotFound, "page not found"))
+}
+
+func (p *Plugin) handleMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	p.writeError(w, r, http.StatusMethodNotAllowed, serializer.NewError(serializer.ErrorCodeMethodNotAllowed, "method not allowed"))
+}
+
 // withRecovery allows recovery from panics
 func (p *Plugin) withRecovery(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -542,6 +1071,7 @@ func (p *Plugin) withRecovery(next http.Handler) http.Handler {
 					"url", r.URL.String(),
 					"error", x,
 					"stack", string(debug.Stack()))
+				p.writeError(w, r, http.StatusInternalServerError, serializer.NewError(serializer.ErrorCodeInternalError, "internal server error"))
 			}
 		}()
 
@@ -558,10 +1088,66 @@ func verifyHTTPSecret(expected, got string) (status int, err error) {
 
 		unescaped, _ := url.QueryUnescape(got)
 		if unescaped == got {
-			return http.StatusForbidden, errors.New("request URL: secret did not match")
+			return http.StatusForbidden, serializer.NewError(serializer.ErrorCodeInvalidSecret, "request URL: secret did not match")
 		}
 		got = unescaped
 	}
 
 	return 0, nil
 }
+
+// signedRequestMaxBodySize is the maximum size in bytes of the body of a signed request, which is read before the request is authenticated.
+// It is the size of the largest requests, which set profile images.
+const signedRequestMaxBodySize = profileImageMaxBodySize
+
+// verifyHTTPSignature checks the HMAC signature of a request signed by Moodle.
+// The signature is calculated over the payload returned by utils.GetSignaturePayload using the webhook secret as the key.
+// Requests with a timestamp outside the allowed window or with an already used nonce are rejected to prevent replays.
+func (p *Plugin) verifyHTTPSignature(w http.ResponseWriter, secret string, r *http.Request) (status int, err error) {
+	signature, decodeErr := hex.DecodeString(r.Header.Get(constants.HeaderSignature))
+	if decodeErr != nil {
+		return http.StatusForbidden, serializer.NewError(serializer.ErrorCodeInvalidSignature, "request signature is not valid")
+	}
+
+	timestamp, parseErr := strconv.ParseInt(r.Header.Get(constants.HeaderTimestamp), 10, 64)
+	if parseErr != nil {
+		return http.StatusForbidden, serializer.NewError(serializer.ErrorCodeInvalidSignature, "request timestamp is not valid")
+	}
+
+	if age := time.Since(time.Unix(timestamp, 0)); age > constants.SignatureMaxAge || age < -constants.SignatureMaxAge {
+		return http.StatusForbidden, serializer.NewError(serializer.ErrorCodeInvalidSignature, "request timestamp is too old or too far in the future")
+	}
+
+	nonce := r.Header.Get(constants.HeaderNonce)
+	if nonce == "" || len(nonce) > constants.NonceMaxLength {
+		return http.StatusForbidden, serializer.NewError(serializer.ErrorCodeInvalidSignature, "request nonce is not valid")
+	}
+
+	body, readErr := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, signedRequestMaxBodySize))
+	if readErr != nil {
+		return http.StatusBadRequest, serializer.NewError(serializer.ErrorCodeInvalidRequestBody, "invalid request body")
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(utils.GetSignaturePayload(r, timestamp, nonce, body))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return http.StatusForbidden, serializer.NewError(serializer.ErrorCodeInvalidSignature, "request signature did not match")
+	}
+
+	// The nonce is stored for twice the allowed age so that it outlives every timestamp which would still be accepted
+	stored, appErr := p.API.KVSetWithOptions(utils.GetKeyHash(constants.KeyPrefixNonce, nonce), []byte{1}, model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: int64(2 * constants.SignatureMaxAge / time.Second),
+	})
+	if appErr != nil {
+		return appErr.StatusCode, errors.Wrap(appErr, "failed to store request nonce")
+	}
+
+	if !stored {
+		return http.StatusForbidden, serializer.NewError(serializer.ErrorCodeInvalidSignature, "request nonce has already been used")
+	}
+
+	return 0, nil
+}
@@ -4,13 +4,18 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
 	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
 	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils"
 	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils/testutils"
+	"github.com/mattermost/mattermost-server/v5/api4"
 	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
 	"github.com/mattermost/mattermost-server/v5/plugin/plugintest/mock"
@@ -31,11 +36,56 @@ func TestCreateChannel(t *testing.T) {
 				channel := testutils.GetSerializerChannel()
 				team := testutils.GetTeam()
 				modelChannel := testutils.GetModelChannel()
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetTeamByName", channel.TeamName).Return(team, nil)
+				api.On("CreateChannel", mock.MatchedBy(func(c *model.Channel) bool { return c.Type == model.CHANNEL_PRIVATE })).Return(modelChannel, nil)
+				api.On("CreateTeamMember", team.Id, mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("AddChannelMember", modelChannel.Id, mock.AnythingOfType("string")).Return(nil, nil)
+				return api, channel
+			},
+			ExpectedStatusCode: http.StatusCreated,
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}},
+		},
+		"success with public channel": {
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.Channel) {
+				channel := testutils.GetSerializerChannel()
+				channel.Type = model.CHANNEL_OPEN
+				team := testutils.GetTeam()
+				modelChannel := testutils.GetModelChannel()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetTeamByName", channel.TeamName).Return(team, nil)
+				api.On("CreateChannel", mock.MatchedBy(func(c *model.Channel) bool { return c.Type == model.CHANNEL_OPEN })).Return(modelChannel, nil)
+				api.On("CreateTeamMember", team.Id, mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("AddChannelMember", modelChannel.Id, mock.AnythingOfType("string")).Return(nil, nil)
+				return api, channel
+			},
+			ExpectedStatusCode: http.StatusCreated,
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}},
+		},
+		"invalid channel type": {
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.Channel) {
+				channel := testutils.GetSerializerChannel()
+				channel.Type = model.CHANNEL_DIRECT
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api, channel
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
+		},
+		"success with course id": {
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.Channel) {
+				channel := testutils.GetSerializerChannel()
+				channel.CourseID = "42"
+				team := testutils.GetTeam()
+				modelChannel := testutils.GetModelChannel()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("GetTeamByName", channel.TeamName).Return(team, nil)
 				api.On("CreateChannel", mock.AnythingOfType("*model.Channel")).Return(modelChannel, nil)
 				api.On("CreateTeamMember", team.Id, mock.AnythingOfType("string")).Return(nil, nil)
 				api.On("AddChannelMember", modelChannel.Id, mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("KVGet", mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("KVSetWithOptions", mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(true, nil).Times(2)
 				return api, channel
 			},
 			ExpectedStatusCode: http.StatusCreated,
@@ -44,33 +94,33 @@ func TestCreateChannel(t *testing.T) {
 		"team not present": {
 			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.Channel) {
 				channel := testutils.GetSerializerChannel()
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("GetTeamByName", channel.TeamName).Return(nil, testutils.GetBadRequestAppError())
 				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				return api, channel
 			},
 			ExpectedStatusCode: http.StatusBadRequest,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 		"failed to create channel": {
 			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.Channel) {
 				channel := testutils.GetSerializerChannel()
 				team := testutils.GetTeam()
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("GetTeamByName", channel.TeamName).Return(team, nil)
 				api.On("CreateChannel", mock.AnythingOfType("*model.Channel")).Return(nil, testutils.GetInternalServerAppError())
 				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				return api, channel
 			},
 			ExpectedStatusCode: http.StatusInternalServerError,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 		"failed to add user to team": {
 			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.Channel) {
 				channel := testutils.GetSerializerChannel()
 				team := testutils.GetTeam()
 				modelChannel := testutils.GetModelChannel()
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("GetTeamByName", channel.TeamName).Return(team, nil)
 				api.On("CreateChannel", mock.AnythingOfType("*model.Channel")).Return(modelChannel, nil)
 				api.On("CreateTeamMember", team.Id, mock.AnythingOfType("string")).Return(nil, testutils.GetInternalServerAppError())
@@ -78,14 +128,14 @@ func TestCreateChannel(t *testing.T) {
 				return api, channel
 			},
 			ExpectedStatusCode: http.StatusInternalServerError,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 		"failed to add bot to channel": {
 			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.Channel) {
 				channel := testutils.GetSerializerChannel()
 				team := testutils.GetTeam()
 				modelChannel := testutils.GetModelChannel()
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("GetTeamByName", channel.TeamName).Return(team, nil)
 				api.On("CreateChannel", mock.AnythingOfType("*model.Channel")).Return(modelChannel, nil)
 				api.On("CreateTeamMember", team.Id, mock.AnythingOfType("string")).Return(nil, nil)
@@ -94,7 +144,7 @@ func TestCreateChannel(t *testing.T) {
 				return api, channel
 			},
 			ExpectedStatusCode: http.StatusInternalServerError,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
@@ -116,6 +166,8 @@ func TestCreateChannel(t *testing.T) {
 			defer result.Body.Close()
 
 			assert.Equal(test.ExpectedStatusCode, result.StatusCode)
+			assert.NotEmpty(result.Header.Get("X-Request-Id"))
+			result.Header.Del("X-Request-Id")
 			assert.Equal(test.ExpectedHeader, result.Header)
 		})
 	}
@@ -132,8 +184,10 @@ func TestGetOrCreateUserInTeam(t *testing.T) {
 		"user id given and user found": {
 			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.User) {
 				user := testutils.GetSerializerUser()
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
-				api.On("GetUser", user.ID).Return(testutils.GetModelUser(), nil)
+				modelUser := testutils.GetModelUser()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetUser", user.ID).Return(modelUser, nil)
+				api.On("KVDelete", constants.KeyPrefixPendingDeactivation+modelUser.Id).Return(nil)
 				return api, user
 			},
 			ExpectedStatusCode: http.StatusOK,
@@ -142,10 +196,12 @@ func TestGetOrCreateUserInTeam(t *testing.T) {
 		"user not found by id but found by email": {
 			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.User) {
 				user := testutils.GetSerializerUser()
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				modelUser := testutils.GetModelUser()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("GetUser", user.ID).Return(nil, testutils.GetNotFoundAppError())
 				api.On("LogWarn", testutils.GetMockArgumentsWithType("string", 1)...).Return()
-				api.On("GetUserByEmail", user.Email).Return(testutils.GetModelUser(), nil)
+				api.On("GetUserByEmail", user.Email).Return(modelUser, nil)
+				api.On("KVDelete", constants.KeyPrefixPendingDeactivation+modelUser.Id).Return(nil)
 				return api, user
 			},
 			ExpectedStatusCode: http.StatusOK,
@@ -156,9 +212,10 @@ func TestGetOrCreateUserInTeam(t *testing.T) {
 				user := testutils.GetSerializerUser()
 				modelUser := testutils.GetModelUser()
 				modelUser.DeleteAt = model.GetMillis()
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("GetUser", user.ID).Return(modelUser, nil)
 				api.On("UpdateUserActive", modelUser.Id, true).Return(nil)
+				api.On("KVDelete", constants.KeyPrefixPendingDeactivation+modelUser.Id).Return(nil)
 				return api, user
 			},
 			ExpectedStatusCode: http.StatusOK,
@@ -169,19 +226,20 @@ func TestGetOrCreateUserInTeam(t *testing.T) {
 				user := testutils.GetSerializerUser()
 				modelUser := testutils.GetModelUser()
 				modelUser.DeleteAt = model.GetMillis()
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("GetUser", user.ID).Return(modelUser, nil)
 				api.On("UpdateUserActive", modelUser.Id, true).Return(testutils.GetInternalServerAppError())
 				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				return api, user
 			},
 			ExpectedStatusCode: http.StatusInternalServerError,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 		"user not found and team not present": {
 			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.User) {
 				user := testutils.GetSerializerUser()
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetConfig").Return(testutils.GetConfig())
 				api.On("GetUser", user.ID).Return(nil, testutils.GetNotFoundAppError())
 				api.On("LogWarn", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				api.On("GetUserByEmail", user.Email).Return(nil, testutils.GetNotFoundAppError())
@@ -190,51 +248,161 @@ func TestGetOrCreateUserInTeam(t *testing.T) {
 				return api, user
 			},
 			ExpectedStatusCode: http.StatusInternalServerError,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 		"create user failed": {
 			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.User) {
 				user := testutils.GetSerializerUser()
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetConfig").Return(testutils.GetConfig())
 				api.On("GetUser", user.ID).Return(nil, testutils.GetNotFoundAppError())
 				api.On("LogWarn", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				api.On("GetUserByEmail", user.Email).Return(nil, testutils.GetNotFoundAppError())
 				api.On("GetTeamByName", user.TeamName).Return(testutils.GetTeam(), nil)
+				api.On("GetUserByUsername", user.Username).Return(nil, testutils.GetNotFoundAppError())
 				api.On("CreateUser", mock.AnythingOfType("*model.User")).Return(nil, testutils.GetInternalServerAppError())
 				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				return api, user
 			},
 			ExpectedStatusCode: http.StatusInternalServerError,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 		"failed to add user to team": {
 			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.User) {
 				user := testutils.GetSerializerUser()
 				team := testutils.GetTeam()
 				modelUser := testutils.GetModelUser()
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetConfig").Return(testutils.GetConfig())
 				api.On("GetUser", user.ID).Return(nil, testutils.GetNotFoundAppError())
 				api.On("LogWarn", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				api.On("GetUserByEmail", user.Email).Return(nil, testutils.GetNotFoundAppError())
 				api.On("GetTeamByName", user.TeamName).Return(team, nil)
+				api.On("GetUserByUsername", user.Username).Return(nil, testutils.GetNotFoundAppError())
 				api.On("CreateUser", mock.AnythingOfType("*model.User")).Return(modelUser, nil)
 				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				api.On("CreateTeamMember", team.Id, modelUser.Id).Return(nil, testutils.GetInternalServerAppError())
 				return api, user
 			},
 			ExpectedStatusCode: http.StatusInternalServerError,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
+		},
+		"username belongs to another user": {
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.User) {
+				user := testutils.GetSerializerUser()
+				user.ID = ""
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetConfig").Return(testutils.GetConfig())
+				api.On("LogWarn", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				api.On("GetUserByEmail", user.Email).Return(nil, testutils.GetNotFoundAppError())
+				api.On("GetTeamByName", user.TeamName).Return(testutils.GetTeam(), nil)
+				api.On("GetUserByUsername", user.Username).Return(testutils.GetModelUser(), nil)
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api, user
+			},
+			ExpectedStatusCode: http.StatusConflict,
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
+		},
+		"auth service not enabled": {
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.User) {
+				user := testutils.GetSerializerUser()
+				user.AuthService = model.USER_AUTH_SERVICE_SAML
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetUser", user.ID).Return(nil, testutils.GetNotFoundAppError())
+				api.On("LogWarn", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				api.On("GetUserByEmail", user.Email).Return(nil, testutils.GetNotFoundAppError())
+				api.On("GetConfig").Return(testutils.GetConfig())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api, user
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
+		},
+		"existing user returned even if auth service not enabled": {
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.User) {
+				user := testutils.GetSerializerUser()
+				user.AuthService = model.USER_AUTH_SERVICE_SAML
+				modelUser := testutils.GetModelUser()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetUser", user.ID).Return(modelUser, nil)
+				api.On("KVDelete", constants.KeyPrefixPendingDeactivation+modelUser.Id).Return(nil)
+				return api, user
+			},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}},
+		},
+		"invalid timezone": {
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.User) {
+				user := testutils.GetSerializerUser()
+				user.Timezone = &serializer.Timezone{ManualTimezone: "Mars/Olympus_Mons"}
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api, user
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
+		},
+		"email user creation successful": {
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.User) {
+				user := testutils.GetSerializerUser()
+				user.ID = ""
+				user.AuthService = model.USER_AUTH_SERVICE_EMAIL
+				user.AuthData = ""
+				team := testutils.GetTeam()
+				modelUser := testutils.GetModelUser()
+				modelUser.Email = user.Email
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetConfig").Return(testutils.GetConfig())
+				api.On("LogWarn", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				api.On("GetUserByEmail", user.Email).Return(nil, testutils.GetNotFoundAppError())
+				api.On("GetTeamByName", user.TeamName).Return(team, nil)
+				api.On("GetUserByUsername", user.Username).Return(nil, testutils.GetNotFoundAppError())
+				api.On("CreateUser", mock.MatchedBy(func(u *model.User) bool {
+					return u.AuthService == "" && u.AuthData == nil && len(u.Password) == model.PASSWORD_MAXIMUM_LENGTH
+				})).Return(modelUser, nil)
+				api.On("CreateTeamMember", team.Id, modelUser.Id).Return(nil, nil)
+				api.On("SendMail", user.Email, mock.AnythingOfType("string"), mock.MatchedBy(func(body string) bool {
+					return strings.Contains(body, "http://localhost:8065/reset_password")
+				})).Return(nil)
+				return api, user
+			},
+			ExpectedStatusCode: http.StatusCreated,
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}},
+		},
+		"email user created but email not sent": {
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.User) {
+				user := testutils.GetSerializerUser()
+				user.ID = ""
+				user.AuthService = model.USER_AUTH_SERVICE_EMAIL
+				team := testutils.GetTeam()
+				modelUser := testutils.GetModelUser()
+				modelUser.Email = user.Email
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetConfig").Return(testutils.GetConfig())
+				api.On("LogWarn", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				api.On("GetUserByEmail", user.Email).Return(nil, testutils.GetNotFoundAppError())
+				api.On("GetTeamByName", user.TeamName).Return(team, nil)
+				api.On("GetUserByUsername", user.Username).Return(nil, testutils.GetNotFoundAppError())
+				api.On("CreateUser", mock.AnythingOfType("*model.User")).Return(modelUser, nil)
+				api.On("CreateTeamMember", team.Id, modelUser.Id).Return(nil, nil)
+				api.On("SendMail", user.Email, mock.AnythingOfType("string"), mock.AnythingOfType("string")).Return(testutils.GetInternalServerAppError())
+				return api, user
+			},
+			ExpectedStatusCode: http.StatusCreated,
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}},
 		},
 		"user creation successful": {
 			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.User) {
 				user := testutils.GetSerializerUser()
 				team := testutils.GetTeam()
 				modelUser := testutils.GetModelUser()
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetConfig").Return(testutils.GetConfig())
 				api.On("GetUser", user.ID).Return(nil, testutils.GetNotFoundAppError())
 				api.On("LogWarn", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				api.On("GetUserByEmail", user.Email).Return(nil, testutils.GetNotFoundAppError())
 				api.On("GetTeamByName", user.TeamName).Return(team, nil)
+				api.On("GetUserByUsername", user.Username).Return(nil, testutils.GetNotFoundAppError())
 				api.On("CreateUser", mock.AnythingOfType("*model.User")).Return(modelUser, nil)
 				api.On("CreateTeamMember", team.Id, modelUser.Id).Return(nil, nil)
 				return api, user
@@ -262,6 +430,8 @@ func TestGetOrCreateUserInTeam(t *testing.T) {
 			defer result.Body.Close()
 
 			assert.Equal(test.ExpectedStatusCode, result.StatusCode)
+			assert.NotEmpty(result.Header.Get("X-Request-Id"))
+			result.Header.Del("X-Request-Id")
 			assert.Equal(test.ExpectedHeader, result.Header)
 		})
 	}
@@ -279,7 +449,7 @@ func TestAddUserToChannel(t *testing.T) {
 			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members?secret=%s", testutils.GetID(), testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.ChannelMember) {
 				channelMember := testutils.GetChannelMemberWithRole()
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("AddUserToChannel", testutils.GetID(), channelMember.UserID, mock.AnythingOfType("string")).Return(nil, nil)
 				api.On("UpdateChannelMemberRoles", testutils.GetID(), channelMember.UserID, channelMember.Role).Return(nil, nil)
 				api.On("GetUser", channelMember.UserID).Return(testutils.GetModelUser(), nil)
@@ -293,50 +463,63 @@ func TestAddUserToChannel(t *testing.T) {
 			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members?secret=%s", "adfdf", testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.ChannelMember) {
 				channelMember := testutils.GetChannelMemberWithRole()
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api, channelMember
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
+		},
+		"action other than add": {
+			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members?secret=%s", testutils.GetID(), testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.ChannelMember) {
+				channelMember := testutils.GetChannelMemberWithRole()
+				channelMember.Action = serializer.ChannelMemberActionRemove
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				return api, channelMember
 			},
 			ExpectedStatusCode: http.StatusBadRequest,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 		"failed to add user to channel": {
 			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members?secret=%s", testutils.GetID(), testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.ChannelMember) {
 				channelMember := testutils.GetChannelMemberWithRole()
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("AddUserToChannel", testutils.GetID(), channelMember.UserID, mock.AnythingOfType("string")).Return(nil, testutils.GetBadRequestAppError())
 				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				return api, channelMember
 			},
 			ExpectedStatusCode: http.StatusBadRequest,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 		"failed to update role": {
 			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members?secret=%s", testutils.GetID(), testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.ChannelMember) {
 				channelMember := testutils.GetChannelMemberWithRole()
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("AddUserToChannel", testutils.GetID(), channelMember.UserID, mock.AnythingOfType("string")).Return(nil, nil)
 				api.On("UpdateChannelMemberRoles", testutils.GetID(), channelMember.UserID, channelMember.Role).Return(nil, testutils.GetInternalServerAppError())
 				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				return api, channelMember
 			},
 			ExpectedStatusCode: http.StatusInternalServerError,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 		"failed to get user": {
 			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members?secret=%s", testutils.GetID(), testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.ChannelMember) {
 				channelMember := testutils.GetChannelMemberWithRole()
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("AddUserToChannel", testutils.GetID(), channelMember.UserID, mock.AnythingOfType("string")).Return(nil, nil)
 				api.On("UpdateChannelMemberRoles", testutils.GetID(), channelMember.UserID, channelMember.Role).Return(nil, nil)
 				api.On("GetUser", channelMember.UserID).Return(nil, testutils.GetInternalServerAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				return api, channelMember
 			},
 			ExpectedStatusCode: http.StatusInternalServerError,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
@@ -358,11 +541,257 @@ func TestAddUserToChannel(t *testing.T) {
 			defer result.Body.Close()
 
 			assert.Equal(test.ExpectedStatusCode, result.StatusCode)
+			assert.NotEmpty(result.Header.Get("X-Request-Id"))
+			result.Header.Del("X-Request-Id")
 			assert.Equal(test.ExpectedHeader, result.Header)
 		})
 	}
 }
 
+func TestUpdateChannelMembers(t *testing.T) {
+	requestMethod := http.MethodPatch
+	userID := api4.GenerateTestId()
+	for name, test := range map[string]struct {
+		RequestURL         string
+		SetupAPI           func(*plugintest.API) (api *plugintest.API, payload serializer.ChannelMembers)
+		ExpectedStatusCode int
+		ExpectedStatuses   []string
+	}{
+		"every change is applied independently": {
+			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members?secret=%s", testutils.GetID(), testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.ChannelMembers) {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("AddUserToChannel", testutils.GetID(), userID, mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("DeleteChannelMember", testutils.GetID(), userID).Return(testutils.GetNotFoundAppError())
+				api.On("UpdateChannelMemberRoles", testutils.GetID(), userID, model.CHANNEL_ADMIN_ROLE_ID).Return(nil, nil)
+				api.On("GetUser", userID).Return(testutils.GetModelUser(), nil)
+				api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(nil, nil)
+				api.On("LogWarn", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api, serializer.ChannelMembers{
+					{UserID: userID, Action: serializer.ChannelMemberActionAdd},
+					{UserID: userID, Action: serializer.ChannelMemberActionRemove},
+					{UserID: "adfdf", Action: serializer.ChannelMemberActionAdd},
+					{UserID: userID, Role: model.CHANNEL_ADMIN_ROLE_ID, Action: serializer.ChannelMemberActionUpdateRole},
+				}
+			},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedStatuses:   []string{model.STATUS_OK, model.STATUS_FAIL, model.STATUS_FAIL, model.STATUS_OK},
+		},
+		"async request": {
+			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members?async=true&secret=%s", testutils.GetID(), testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.ChannelMembers) {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVSet", mock.AnythingOfType("string"), mock.Anything).Return(nil)
+				api.On("LogWarn", testutils.GetMockArgumentsWithType("string", 3)...).Return()
+				return api, serializer.ChannelMembers{{UserID: userID}}
+			},
+			ExpectedStatusCode: http.StatusAccepted,
+		},
+		"empty batch": {
+			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members?secret=%s", testutils.GetID(), testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.ChannelMembers) {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api, serializer.ChannelMembers{}
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+		"batch too large": {
+			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members?secret=%s", testutils.GetID(), testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.ChannelMembers) {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api, make(serializer.ChannelMembers, serializer.ChannelMembersMaxBatchSize+1)
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+		"channel id not valid": {
+			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members?secret=%s", "adfdf", testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.ChannelMembers) {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api, serializer.ChannelMembers{{UserID: userID}}
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			api, payload := test.SetupAPI(&plugintest.API{})
+			reqBody, err := json.Marshal(payload)
+			require.Nil(t, err)
+
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(requestMethod, test.RequestURL, bytes.NewBuffer(reqBody))
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+
+			assert.Equal(test.ExpectedStatusCode, result.StatusCode)
+			if test.ExpectedStatuses != nil {
+				var results serializer.ChannelMemberResults
+				require.Nil(t, json.NewDecoder(result.Body).Decode(&results))
+				require.Len(t, results, len(test.ExpectedStatuses))
+				for i, status := range test.ExpectedStatuses {
+					assert.Equal(status, results[i].Status)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileChannelMembers(t *testing.T) {
+	requestMethod := http.MethodPut
+	removedUserID, promotedUserID, demotedUserID, botUserID, addedUserID := api4.GenerateTestId(), api4.GenerateTestId(), api4.GenerateTestId(), api4.GenerateTestId(), api4.GenerateTestId()
+	currentMembers := &model.ChannelMembers{
+		{ChannelId: testutils.GetID(), UserId: removedUserID, SchemeAdmin: true},
+		{ChannelId: testutils.GetID(), UserId: promotedUserID},
+		{ChannelId: testutils.GetID(), UserId: demotedUserID, SchemeAdmin: true},
+		{ChannelId: testutils.GetID(), UserId: botUserID},
+	}
+	expectedMembers := serializer.ChannelMembers{
+		{UserID: promotedUserID, Role: model.CHANNEL_ADMIN_ROLE_ID},
+		{UserID: demotedUserID},
+		{UserID: addedUserID},
+		{UserID: "adfdf"},
+	}
+	expectedReconciliation := func(dryRun bool) *serializer.ChannelMembersReconciliation {
+		return &serializer.ChannelMembersReconciliation{
+			DryRun:   dryRun,
+			Added:    []string{addedUserID},
+			Removed:  []string{removedUserID},
+			Promoted: []string{promotedUserID},
+			Demoted:  []string{demotedUserID},
+		}
+	}
+	for name, test := range map[string]struct {
+		RequestURL             string
+		RequestBody            serializer.ChannelMembers
+		SetupAPI               func(*plugintest.API) *plugintest.API
+		ExpectedStatusCode     int
+		ExpectedReconciliation *serializer.ChannelMembersReconciliation
+	}{
+		"dry run": {
+			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members?dry_run=true&secret=%s", testutils.GetID(), testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannelMembers", testutils.GetID(), 0, utils.PerPageMaximum).Return(currentMembers, nil)
+				api.On("GetUser", removedUserID).Return(&model.User{Id: removedUserID}, nil)
+				api.On("GetUser", botUserID).Return(&model.User{Id: botUserID, IsBot: true}, nil)
+				return api
+			},
+			ExpectedStatusCode:     http.StatusOK,
+			ExpectedReconciliation: expectedReconciliation(true),
+		},
+		"changes are applied": {
+			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members?secret=%s", testutils.GetID(), testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannelMembers", testutils.GetID(), 0, utils.PerPageMaximum).Return(currentMembers, nil)
+				api.On("GetUser", removedUserID).Return(&model.User{Id: removedUserID}, nil)
+				api.On("GetUser", botUserID).Return(&model.User{Id: botUserID, IsBot: true}, nil)
+				api.On("DeleteChannelMember", testutils.GetID(), removedUserID).Return(nil)
+				api.On("UpdateChannelMemberRoles", testutils.GetID(), promotedUserID, model.CHANNEL_USER_ROLE_ID+" "+model.CHANNEL_ADMIN_ROLE_ID).Return(nil, nil)
+				api.On("GetUser", promotedUserID).Return(&model.User{Id: promotedUserID}, nil)
+				api.On("UpdateChannelMemberRoles", testutils.GetID(), demotedUserID, model.CHANNEL_USER_ROLE_ID).Return(nil, nil)
+				api.On("GetUser", demotedUserID).Return(&model.User{Id: demotedUserID}, nil)
+				api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(nil, nil)
+				api.On("AddUserToChannel", testutils.GetID(), addedUserID, mock.AnythingOfType("string")).Return(nil, nil)
+				return api
+			},
+			ExpectedStatusCode:     http.StatusOK,
+			ExpectedReconciliation: expectedReconciliation(false),
+		},
+		"failed to get channel members": {
+			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members?secret=%s", testutils.GetID(), testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannelMembers", testutils.GetID(), 0, utils.PerPageMaximum).Return(nil, testutils.GetInternalServerAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+		"empty list": {
+			RequestURL:  fmt.Sprintf("/api/v1/channels/%s/members?secret=%s", testutils.GetID(), testutils.GetSecret()),
+			RequestBody: serializer.ChannelMembers{},
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			api := test.SetupAPI(&plugintest.API{})
+			members := expectedMembers
+			if test.RequestBody != nil {
+				members = test.RequestBody
+			}
+			reqBody, err := json.Marshal(members)
+			require.Nil(t, err)
+
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(requestMethod, test.RequestURL, bytes.NewBuffer(reqBody))
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+
+			assert.Equal(test.ExpectedStatusCode, result.StatusCode)
+			if test.ExpectedReconciliation != nil {
+				var reconciliation serializer.ChannelMembersReconciliation
+				require.Nil(t, json.NewDecoder(result.Body).Decode(&reconciliation))
+				require.Len(t, reconciliation.Errors, 1)
+				assert.Equal(http.StatusBadRequest, reconciliation.Errors[0].StatusCode)
+				reconciliation.Errors = nil
+				assert.Equal(test.ExpectedReconciliation, &reconciliation)
+			}
+		})
+	}
+}
+
+func TestReconcileChannelMembersKeepsInvalidEntries(t *testing.T) {
+	channelID := testutils.GetID()
+	keptUserID, unmappedUserID, mappedUserID := model.NewId(), model.NewId(), model.NewId()
+
+	api := &plugintest.API{}
+	api.On("GetChannelMembers", channelID, 0, utils.PerPageMaximum).Return(&model.ChannelMembers{
+		{ChannelId: channelID, UserId: keptUserID, SchemeAdmin: true},
+		{ChannelId: channelID, UserId: unmappedUserID},
+		{ChannelId: channelID, UserId: mappedUserID},
+	}, nil)
+	api.On("KVGet", utils.GetKeyHash(constants.KeyPrefixMoodleUser, "7")).Return(nil, nil)
+	api.On("KVGet", utils.GetKeyHash(constants.KeyPrefixMattermostUser, unmappedUserID)).Return(nil, nil)
+	api.On("KVGet", utils.GetKeyHash(constants.KeyPrefixMattermostUser, mappedUserID)).Return(testutils.GetMappingJSON("8", mappedUserID), nil)
+	api.On("GetUser", mappedUserID).Return(&model.User{Id: mappedUserID}, nil)
+	defer api.AssertExpectations(t)
+	p := setupTestPlugin(api)
+
+	// The user of the invalid entry and the members who may be Moodle user 7 are kept
+	reconciliation, _, err := p.reconcileChannelMembers("", channelID, serializer.ChannelMembers{
+		{UserID: keptUserID, Action: "not_an_action"},
+		{MoodleUserID: "7"},
+	}, false, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{mappedUserID}, reconciliation.Removed)
+	assert.Empty(t, reconciliation.Demoted)
+	assert.Len(t, reconciliation.Errors, 2)
+}
+
 func TestRemoveUserFromChannel(t *testing.T) {
 	requestMethod := http.MethodDelete
 	for name, test := range map[string]struct {
@@ -374,7 +803,7 @@ func TestRemoveUserFromChannel(t *testing.T) {
 		"success": {
 			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members/%s?secret=%s", testutils.GetID(), testutils.GetID(), testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) *plugintest.API {
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("DeleteChannelMember", testutils.GetID(), testutils.GetID()).Return(nil)
 				return api
 			},
@@ -384,33 +813,33 @@ func TestRemoveUserFromChannel(t *testing.T) {
 		"channel id not valid": {
 			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members/%s?secret=%s", "adfdf", testutils.GetID(), testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) *plugintest.API {
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				return api
 			},
 			ExpectedStatusCode: http.StatusBadRequest,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 		"user id not valid": {
 			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members/%s?secret=%s", testutils.GetID(), "adfdf", testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) *plugintest.API {
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				return api
 			},
 			ExpectedStatusCode: http.StatusBadRequest,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 		"failed to delete channel member": {
 			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members/%s?secret=%s", testutils.GetID(), testutils.GetID(), testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) *plugintest.API {
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("DeleteChannelMember", testutils.GetID(), testutils.GetID()).Return(testutils.GetBadRequestAppError())
 				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				return api
 			},
 			ExpectedStatusCode: http.StatusBadRequest,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
@@ -429,6 +858,8 @@ func TestRemoveUserFromChannel(t *testing.T) {
 			defer result.Body.Close()
 
 			assert.Equal(test.ExpectedStatusCode, result.StatusCode)
+			assert.NotEmpty(result.Header.Get("X-Request-Id"))
+			result.Header.Del("X-Request-Id")
 			assert.Equal(test.ExpectedHeader, result.Header)
 		})
 	}
@@ -445,9 +876,20 @@ func TestGetChannelMembers(t *testing.T) {
 		"success": {
 			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members?secret=%s", testutils.GetID(), testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) *plugintest.API {
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
-				api.On("GetChannelMembers", testutils.GetID(), utils.PageDefault, utils.PerPageDefault).Return(testutils.GetChannelMembers(3), nil)
-				api.On("GetUser", testutils.GetMockArgumentsWithType("string", 1)...).Return(testutils.GetModelUser(), nil)
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetUsersInChannel", testutils.GetID(), model.CHANNEL_SORT_BY_USERNAME, utils.PageDefault, utils.PerPageDefault).Return([]*model.User{testutils.GetModelUser()}, nil)
+				api.On("GetChannelMembersByIds", testutils.GetID(), mock.AnythingOfType("[]string")).Return(testutils.GetChannelMembers(3), nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}},
+		},
+		"success with profile": {
+			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members?include_profile=true&secret=%s", testutils.GetID(), testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetUsersInChannel", testutils.GetID(), model.CHANNEL_SORT_BY_USERNAME, utils.PageDefault, utils.PerPageDefault).Return([]*model.User{testutils.GetModelUser()}, nil)
+				api.On("GetChannelMembersByIds", testutils.GetID(), mock.AnythingOfType("[]string")).Return(testutils.GetChannelMembers(3), nil)
 				return api
 			},
 			ExpectedStatusCode: http.StatusOK,
@@ -456,45 +898,45 @@ func TestGetChannelMembers(t *testing.T) {
 		"channel id not valid": {
 			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members?secret=%s", "adfdf", testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) *plugintest.API {
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				return api
 			},
 			ExpectedStatusCode: http.StatusBadRequest,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
-		"failed to get channel members": {
+		"failed to get users in channel": {
 			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members?secret=%s", testutils.GetID(), testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) *plugintest.API {
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
-				api.On("GetChannelMembers", testutils.GetID(), utils.PageDefault, utils.PerPageDefault).Return(nil, testutils.GetBadRequestAppError())
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetUsersInChannel", testutils.GetID(), model.CHANNEL_SORT_BY_USERNAME, utils.PageDefault, utils.PerPageDefault).Return(nil, testutils.GetBadRequestAppError())
 				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				return api
 			},
 			ExpectedStatusCode: http.StatusBadRequest,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 		"channel contains zero channel members": {
 			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members?secret=%s", testutils.GetID(), testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) *plugintest.API {
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
-				api.On("GetChannelMembers", testutils.GetID(), utils.PageDefault, utils.PerPageDefault).Return(nil, nil)
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetUsersInChannel", testutils.GetID(), model.CHANNEL_SORT_BY_USERNAME, utils.PageDefault, utils.PerPageDefault).Return([]*model.User{}, nil)
 				return api
 			},
 			ExpectedStatusCode: http.StatusOK,
 			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}},
 		},
-		"failed to get user": {
+		"failed to get channel members": {
 			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members?secret=%s", testutils.GetID(), testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) *plugintest.API {
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
-				api.On("GetChannelMembers", testutils.GetID(), utils.PageDefault, utils.PerPageDefault).Return(testutils.GetChannelMembers(2), nil)
-				api.On("GetUser", testutils.GetMockArgumentsWithType("string", 1)...).Return(nil, testutils.GetInternalServerAppError())
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetUsersInChannel", testutils.GetID(), model.CHANNEL_SORT_BY_USERNAME, utils.PageDefault, utils.PerPageDefault).Return([]*model.User{testutils.GetModelUser()}, nil)
+				api.On("GetChannelMembersByIds", testutils.GetID(), mock.AnythingOfType("[]string")).Return(nil, testutils.GetInternalServerAppError())
 				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				return api
 			},
 			ExpectedStatusCode: http.StatusInternalServerError,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
@@ -513,11 +955,286 @@ func TestGetChannelMembers(t *testing.T) {
 			defer result.Body.Close()
 
 			assert.Equal(test.ExpectedStatusCode, result.StatusCode)
+			assert.NotEmpty(result.Header.Get("X-Request-Id"))
+			result.Header.Del("X-Request-Id")
 			assert.Equal(test.ExpectedHeader, result.Header)
 		})
 	}
 }
 
+func TestGetChannelMembersWithUserInfo(t *testing.T) {
+	user := testutils.GetModelUser()
+	user.FirstName = "John"
+	user.DeleteAt = model.GetMillis()
+	missingUser := testutils.GetModelUser()
+	bot := testutils.GetModelUser()
+	bot.IsBot = true
+
+	api := &plugintest.API{}
+	defer api.AssertExpectations(t)
+	api.On("GetUsersInChannel", testutils.GetID(), model.CHANNEL_SORT_BY_USERNAME, 0, 3).Return([]*model.User{user, missingUser, bot}, nil)
+	api.On("GetChannelMembersByIds", testutils.GetID(), []string{user.Id, missingUser.Id, bot.Id}).Return(&model.ChannelMembers{
+		{ChannelId: testutils.GetID(), UserId: user.Id, SchemeAdmin: true},
+		{ChannelId: testutils.GetID(), UserId: bot.Id},
+	}, nil)
+	p := setupTestPlugin(api)
+
+	t.Run("without profile", func(t *testing.T) {
+		members, err := p.getChannelMembersWithUserInfo(testutils.GetID(), 0, 3, false)
+		require.Nil(t, err)
+		require.Len(t, members, 1)
+		assert.Equal(t, user.Id, members[0].UserID)
+		assert.True(t, members[0].IsChannelAdmin)
+		assert.Empty(t, members[0].FirstName)
+		assert.Nil(t, members[0].IsDeactivated)
+	})
+
+	t.Run("with profile", func(t *testing.T) {
+		members, err := p.getChannelMembersWithUserInfo(testutils.GetID(), 0, 3, true)
+		require.Nil(t, err)
+		require.Len(t, members, 1)
+		assert.Equal(t, "John", members[0].FirstName)
+		require.NotNil(t, members[0].IsDeactivated)
+		assert.True(t, *members[0].IsDeactivated)
+	})
+}
+
+func TestUpdateUser(t *testing.T) {
+	requestURL := fmt.Sprintf("/api/v1/users/%s?secret=%s", testutils.GetID(), testutils.GetSecret())
+	accessToken := model.NewId()
+	var userAuthUpdates int
+	mattermostServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != fmt.Sprintf("/api/v4/users/%s/auth", testutils.GetID()) || r.Header.Get(model.HEADER_AUTH) != model.HEADER_BEARER+" "+accessToken {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		userAuthUpdates++
+		_, _ = w.Write([]byte(model.UserAuthFromJson(r.Body).ToJson()))
+	}))
+	defer mattermostServer.Close()
+
+	locale := "fr"
+	invalidLocale := "not a locale"
+	position := "Physics department"
+	ldap := model.USER_AUTH_SERVICE_LDAP
+	saml := model.USER_AUTH_SERVICE_SAML
+	email := model.USER_AUTH_SERVICE_EMAIL
+	authData := "new-ldap-id"
+	largeProfileImage := strings.Repeat("a", profileImageMaxBodySize)
+	for name, test := range map[string]struct {
+		UserPatch               serializer.UserPatch
+		EmailUser               bool
+		AccessToken             string
+		SetupAPI                func(*plugintest.API, *model.User, *model.Config) *plugintest.API
+		ExpectedStatusCode      int
+		ExpectedErrorCode       string
+		ExpectedUserAuthUpdates int
+	}{
+		"locale, timezone and position updated": {
+			UserPatch: serializer.UserPatch{
+				Locale:   &locale,
+				Timezone: &serializer.Timezone{ManualTimezone: "Europe/Paris"},
+				Position: &position,
+			},
+			SetupAPI: func(api *plugintest.API, user *model.User, config *model.Config) *plugintest.API {
+				api.On("UpdateUser", mock.MatchedBy(func(u *model.User) bool {
+					return u.Locale == locale && u.Position == position && u.Timezone["useAutomaticTimezone"] == "false" && u.Timezone["manualTimezone"] == "Europe/Paris" && u.Timezone["automaticTimezone"] == "Europe/London"
+				})).Return(user, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"invalid locale": {
+			UserPatch: serializer.UserPatch{Locale: &invalidLocale},
+			SetupAPI: func(api *plugintest.API, user *model.User, config *model.Config) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedErrorCode:  serializer.ErrorCodeInvalidLocale,
+		},
+		"request body too large": {
+			UserPatch: serializer.UserPatch{ProfileImage: &largeProfileImage},
+			SetupAPI: func(api *plugintest.API, user *model.User, config *model.Config) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedErrorCode:  serializer.ErrorCodeInvalidRequestBody,
+		},
+		"invalid timezone": {
+			UserPatch: serializer.UserPatch{Timezone: &serializer.Timezone{ManualTimezone: "Mars/Olympus_Mons"}},
+			SetupAPI: func(api *plugintest.API, user *model.User, config *model.Config) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedErrorCode:  serializer.ErrorCodeInvalidTimezone,
+		},
+		"manual timezone missing": {
+			UserPatch: serializer.UserPatch{Timezone: &serializer.Timezone{}},
+			SetupAPI: func(api *plugintest.API, user *model.User, config *model.Config) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedErrorCode:  serializer.ErrorCodeInvalidTimezone,
+		},
+		"auth data updated": {
+			UserPatch:   serializer.UserPatch{AuthData: &authData},
+			AccessToken: accessToken,
+			SetupAPI: func(api *plugintest.API, user *model.User, config *model.Config) *plugintest.API {
+				api.On("GetConfig").Return(config)
+				return api
+			},
+			ExpectedStatusCode:      http.StatusOK,
+			ExpectedUserAuthUpdates: 1,
+		},
+		"auth data updated with other fields": {
+			UserPatch:   serializer.UserPatch{AuthData: &authData, Position: &position},
+			AccessToken: accessToken,
+			SetupAPI: func(api *plugintest.API, user *model.User, config *model.Config) *plugintest.API {
+				api.On("GetConfig").Return(config)
+				api.On("UpdateUser", mock.AnythingOfType("*model.User")).Return(user, nil)
+				return api
+			},
+			ExpectedStatusCode:      http.StatusOK,
+			ExpectedUserAuthUpdates: 1,
+		},
+		"email user switched to another auth service": {
+			UserPatch:   serializer.UserPatch{AuthService: &ldap, AuthData: &authData},
+			EmailUser:   true,
+			AccessToken: accessToken,
+			SetupAPI: func(api *plugintest.API, user *model.User, config *model.Config) *plugintest.API {
+				api.On("GetConfig").Return(config)
+				return api
+			},
+			ExpectedStatusCode:      http.StatusOK,
+			ExpectedUserAuthUpdates: 1,
+		},
+		"email user switched to another auth service with other fields": {
+			UserPatch:   serializer.UserPatch{AuthService: &ldap, AuthData: &authData, Position: &position},
+			EmailUser:   true,
+			AccessToken: accessToken,
+			SetupAPI: func(api *plugintest.API, user *model.User, config *model.Config) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedErrorCode:  serializer.ErrorCodeInvalidAuthService,
+		},
+		"auth service not enabled": {
+			UserPatch:   serializer.UserPatch{AuthService: &saml, AuthData: &authData},
+			AccessToken: accessToken,
+			SetupAPI: func(api *plugintest.API, user *model.User, config *model.Config) *plugintest.API {
+				api.On("GetConfig").Return(config)
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedErrorCode:  serializer.ErrorCodeInvalidAuthService,
+		},
+		"switched to email": {
+			UserPatch:   serializer.UserPatch{AuthService: &email},
+			AccessToken: accessToken,
+			SetupAPI: func(api *plugintest.API, user *model.User, config *model.Config) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedErrorCode:  serializer.ErrorCodeInvalidAuthService,
+		},
+		"auth unchanged": {
+			UserPatch: serializer.UserPatch{AuthService: &ldap},
+			SetupAPI: func(api *plugintest.API, user *model.User, config *model.Config) *plugintest.API {
+				api.On("UpdateUser", mock.AnythingOfType("*model.User")).Return(user, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"admin access token not set": {
+			UserPatch: serializer.UserPatch{AuthData: &authData},
+			SetupAPI: func(api *plugintest.API, user *model.User, config *model.Config) *plugintest.API {
+				api.On("GetConfig").Return(config)
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedErrorCode:  serializer.ErrorCodeAuthUpdateNotConfigured,
+		},
+		"failed to update user auth": {
+			UserPatch:   serializer.UserPatch{AuthData: &authData},
+			AccessToken: "wrongtoken",
+			SetupAPI: func(api *plugintest.API, user *model.User, config *model.Config) *plugintest.API {
+				api.On("GetConfig").Return(config)
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		"auth restored if the user update fails": {
+			UserPatch:   serializer.UserPatch{AuthData: &authData, Position: &position},
+			AccessToken: accessToken,
+			SetupAPI: func(api *plugintest.API, user *model.User, config *model.Config) *plugintest.API {
+				api.On("GetConfig").Return(config)
+				api.On("UpdateUser", mock.AnythingOfType("*model.User")).Return(nil, testutils.GetInternalServerAppError())
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode:      http.StatusInternalServerError,
+			ExpectedUserAuthUpdates: 2,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			userAuthUpdates = 0
+			oldAuthData := "old-ldap-id"
+			user := &model.User{
+				Id:          testutils.GetID(),
+				Username:    "jsmith",
+				AuthService: model.USER_AUTH_SERVICE_LDAP,
+				AuthData:    &oldAuthData,
+				Timezone:    model.StringMap{"useAutomaticTimezone": "true", "automaticTimezone": "Europe/London"},
+			}
+			if test.EmailUser {
+				user.AuthService = ""
+				user.AuthData = nil
+			}
+
+			mattermostConfig := testutils.GetConfig()
+			mattermostConfig.ServiceSettings.SiteURL = model.NewString(mattermostServer.URL)
+
+			api := &plugintest.API{}
+			api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+			api.On("GetUser", testutils.GetID()).Return(user, nil)
+			test.SetupAPI(api, user, mattermostConfig)
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+			config := p.getConfiguration().Clone()
+			config.AdminAccessToken = test.AccessToken
+			p.setConfiguration(config)
+
+			reqBody, err := json.Marshal(test.UserPatch)
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPatch, requestURL, bytes.NewBuffer(reqBody))
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+			assert.Equal(t, test.ExpectedStatusCode, result.StatusCode)
+			assert.Equal(t, test.ExpectedUserAuthUpdates, userAuthUpdates)
+			if test.ExpectedErrorCode != "" {
+				var errorBody *serializer.Error
+				require.NoError(t, json.NewDecoder(result.Body).Decode(&errorBody))
+				assert.Equal(t, test.ExpectedErrorCode, errorBody.Code)
+			}
+		})
+	}
+}
+
 func TestDeleteUser(t *testing.T) {
 	requestMethod := http.MethodDelete
 	for name, test := range map[string]struct {
@@ -529,7 +1246,7 @@ func TestDeleteUser(t *testing.T) {
 		"success": {
 			RequestURL: fmt.Sprintf("/api/v1/users/%s?secret=%s", testutils.GetID(), testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) *plugintest.API {
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("DeleteUser", testutils.GetID()).Return(nil)
 				return api
 			},
@@ -539,23 +1256,23 @@ func TestDeleteUser(t *testing.T) {
 		"user id not valid": {
 			RequestURL: fmt.Sprintf("/api/v1/users/%s?secret=%s", "adfdf", testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) *plugintest.API {
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				return api
 			},
 			ExpectedStatusCode: http.StatusBadRequest,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 		"failed to delete user": {
 			RequestURL: fmt.Sprintf("/api/v1/users/%s?secret=%s", testutils.GetID(), testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) *plugintest.API {
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("DeleteUser", testutils.GetID()).Return(testutils.GetInternalServerAppError())
 				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				return api
 			},
 			ExpectedStatusCode: http.StatusInternalServerError,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
@@ -574,6 +1291,8 @@ func TestDeleteUser(t *testing.T) {
 			defer result.Body.Close()
 
 			assert.Equal(test.ExpectedStatusCode, result.StatusCode)
+			assert.NotEmpty(result.Header.Get("X-Request-Id"))
+			result.Header.Del("X-Request-Id")
 			assert.Equal(test.ExpectedHeader, result.Header)
 		})
 	}
@@ -590,8 +1309,9 @@ func TestArchiveChannel(t *testing.T) {
 		"success": {
 			RequestURL: fmt.Sprintf("/api/v1/channels/%s?secret=%s", testutils.GetID(), testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) *plugintest.API {
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("DeleteChannel", testutils.GetID()).Return(nil)
+				api.On("KVGet", mock.AnythingOfType("string")).Return(nil, nil)
 				return api
 			},
 			ExpectedStatusCode: http.StatusOK,
@@ -600,23 +1320,23 @@ func TestArchiveChannel(t *testing.T) {
 		"channel id not valid": {
 			RequestURL: fmt.Sprintf("/api/v1/channels/%s?secret=%s", "adfdf", testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) *plugintest.API {
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				return api
 			},
 			ExpectedStatusCode: http.StatusBadRequest,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 		"failed to delete channel": {
 			RequestURL: fmt.Sprintf("/api/v1/channels/%s?secret=%s", testutils.GetID(), testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) *plugintest.API {
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("DeleteChannel", testutils.GetID()).Return(testutils.GetNotFoundAppError())
 				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				return api
 			},
 			ExpectedStatusCode: http.StatusNotFound,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
@@ -635,6 +1355,8 @@ func TestArchiveChannel(t *testing.T) {
 			defer result.Body.Close()
 
 			assert.Equal(test.ExpectedStatusCode, result.StatusCode)
+			assert.NotEmpty(result.Header.Get("X-Request-Id"))
+			result.Header.Del("X-Request-Id")
 			assert.Equal(test.ExpectedHeader, result.Header)
 		})
 	}
@@ -651,9 +1373,12 @@ func TestUnarchiveChannel(t *testing.T) {
 		"success": {
 			RequestURL: fmt.Sprintf("/api/v1/channels/%s/unarchive?secret=%s", testutils.GetID(), testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) *plugintest.API {
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
-				api.On("GetChannel", testutils.GetID()).Return(testutils.GetModelChannel(), nil)
-				api.On("UpdateChannel", mock.AnythingOfType("*model.Channel")).Return(nil, nil)
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				channel := testutils.GetModelChannel()
+				channel.Type = model.CHANNEL_OPEN
+				api.On("GetChannel", testutils.GetID()).Return(channel, nil)
+				api.On("UpdateChannel", mock.MatchedBy(func(c *model.Channel) bool { return c.Type == model.CHANNEL_OPEN && c.DeleteAt == 0 })).Return(nil, nil)
+				api.On("KVGet", mock.AnythingOfType("string")).Return(nil, nil)
 				return api
 			},
 			ExpectedStatusCode: http.StatusOK,
@@ -662,34 +1387,34 @@ func TestUnarchiveChannel(t *testing.T) {
 		"channel id not valid": {
 			RequestURL: fmt.Sprintf("/api/v1/channels/%s/unarchive?secret=%s", "adfdf", testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) *plugintest.API {
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				return api
 			},
 			ExpectedStatusCode: http.StatusBadRequest,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 		"failed to get channel": {
 			RequestURL: fmt.Sprintf("/api/v1/channels/%s/unarchive?secret=%s", testutils.GetID(), testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) *plugintest.API {
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("GetChannel", testutils.GetID()).Return(nil, testutils.GetNotFoundAppError())
 				return api
 			},
 			ExpectedStatusCode: http.StatusNotFound,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 		"failed to update channel": {
 			RequestURL: fmt.Sprintf("/api/v1/channels/%s/unarchive?secret=%s", testutils.GetID(), testutils.GetSecret()),
 			SetupAPI: func(api *plugintest.API) *plugintest.API {
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("GetChannel", testutils.GetID()).Return(testutils.GetModelChannel(), nil)
 				api.On("UpdateChannel", mock.AnythingOfType("*model.Channel")).Return(nil, testutils.GetInternalServerAppError())
 				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				return api
 			},
 			ExpectedStatusCode: http.StatusInternalServerError,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
@@ -708,7 +1433,282 @@ func TestUnarchiveChannel(t *testing.T) {
 			defer result.Body.Close()
 
 			assert.Equal(test.ExpectedStatusCode, result.StatusCode)
+			assert.NotEmpty(result.Header.Get("X-Request-Id"))
+			result.Header.Del("X-Request-Id")
+			assert.Equal(test.ExpectedHeader, result.Header)
+		})
+	}
+}
+
+func TestUpdateChannel(t *testing.T) {
+	requestURL := fmt.Sprintf("/api/v1/channels/%s?secret=%s", testutils.GetID(), testutils.GetSecret())
+	requestMethod := http.MethodPatch
+	for name, test := range map[string]struct {
+		RequestURL         string
+		Body               string
+		SetupAPI           func(*plugintest.API) *plugintest.API
+		ExpectedStatusCode int
+		ExpectedHeader     http.Header
+	}{
+		"success": {
+			RequestURL: requestURL,
+			Body:       `{"display_name": "Course 101", "header": "Schedule: https://moodle.example.com"}`,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				channel := testutils.GetModelChannel()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannel", testutils.GetID()).Return(channel, nil)
+				api.On("UpdateChannel", mock.MatchedBy(func(c *model.Channel) bool {
+					return c.DisplayName == "Course 101" && c.Header == "Schedule: https://moodle.example.com" && c.Purpose == channel.Purpose
+				})).Return(channel, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}},
+		},
+		"channel id not valid": {
+			RequestURL: fmt.Sprintf("/api/v1/channels/%s?secret=%s", "adfdf", testutils.GetSecret()),
+			Body:       `{"display_name": "Course 101"}`,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
+		},
+		"failed to get channel": {
+			RequestURL: requestURL,
+			Body:       `{"display_name": "Course 101"}`,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannel", testutils.GetID()).Return(nil, testutils.GetNotFoundAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusNotFound,
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
+		},
+		"empty patch": {
+			RequestURL: requestURL,
+			Body:       `{}`,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannel", testutils.GetID()).Return(testutils.GetModelChannel(), nil)
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
+		},
+		"purpose too long": {
+			RequestURL: requestURL,
+			Body:       fmt.Sprintf(`{"purpose": "%s"}`, strings.Repeat("a", model.CHANNEL_PURPOSE_MAX_RUNES+1)),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannel", testutils.GetID()).Return(testutils.GetModelChannel(), nil)
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
+		},
+		"failed to update channel": {
+			RequestURL: requestURL,
+			Body:       `{"purpose": "Introduction to programming"}`,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannel", testutils.GetID()).Return(testutils.GetModelChannel(), nil)
+				api.On("UpdateChannel", mock.AnythingOfType("*model.Channel")).Return(nil, testutils.GetInternalServerAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			api := test.SetupAPI(&plugintest.API{})
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(requestMethod, test.RequestURL, strings.NewReader(test.Body))
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+
+			assert.Equal(test.ExpectedStatusCode, result.StatusCode)
+			assert.NotEmpty(result.Header.Get("X-Request-Id"))
+			result.Header.Del("X-Request-Id")
 			assert.Equal(test.ExpectedHeader, result.Header)
 		})
 	}
 }
+
+func TestSignedRequests(t *testing.T) {
+	requestURL := "/api/v1/test"
+	requestMethod := http.MethodPost
+	body := []byte(`{"name":"course"}`)
+	for name, test := range map[string]struct {
+		SetupAPI           func(*plugintest.API) *plugintest.API
+		SetupRequest       func(*http.Request)
+		AllowSecretInQuery *bool
+		ExpectedStatusCode int
+	}{
+		"valid signature": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVSetWithOptions", mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(true, nil)
+				return api
+			},
+			SetupRequest: func(r *http.Request) {
+				testutils.SignRequest(r, body, time.Now().Unix(), model.NewId())
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"invalid signature": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			SetupRequest: func(r *http.Request) {
+				testutils.SignRequest(r, []byte(`{"name":"other"}`), time.Now().Unix(), model.NewId())
+			},
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		"signature of another path": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			SetupRequest: func(r *http.Request) {
+				signed := httptest.NewRequest(requestMethod, "/api/v1/channels", nil)
+				testutils.SignRequest(signed, body, time.Now().Unix(), model.NewId())
+				r.Header = signed.Header
+			},
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		"signature of another method": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			SetupRequest: func(r *http.Request) {
+				signed := httptest.NewRequest(http.MethodDelete, requestURL, nil)
+				testutils.SignRequest(signed, body, time.Now().Unix(), model.NewId())
+				r.Header = signed.Header
+			},
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		"signature of another query": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			SetupRequest: func(r *http.Request) {
+				testutils.SignRequest(r, body, time.Now().Unix(), model.NewId())
+				r.URL.RawQuery = "dry_run=true"
+			},
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		"timestamp too old": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			SetupRequest: func(r *http.Request) {
+				testutils.SignRequest(r, body, time.Now().Add(-time.Hour).Unix(), model.NewId())
+			},
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		"nonce already used": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVSetWithOptions", mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(false, nil)
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			SetupRequest: func(r *http.Request) {
+				testutils.SignRequest(r, body, time.Now().Unix(), model.NewId())
+			},
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		"unsigned request when secret in query is not allowed": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			SetupRequest: func(r *http.Request) {
+				r.URL.RawQuery = fmt.Sprintf("secret=%s", testutils.GetSecret())
+			},
+			AllowSecretInQuery: model.NewBool(false),
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		"unsigned request when secret in query is allowed": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				return api
+			},
+			SetupRequest: func(r *http.Request) {
+				r.URL.RawQuery = fmt.Sprintf("secret=%s", testutils.GetSecret())
+			},
+			AllowSecretInQuery: model.NewBool(true),
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"unsigned request when secret in query setting was never saved": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				return api
+			},
+			SetupRequest: func(r *http.Request) {
+				r.URL.RawQuery = fmt.Sprintf("secret=%s", testutils.GetSecret())
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"signed request body too large": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			SetupRequest: func(r *http.Request) {
+				largeBody := make([]byte, signedRequestMaxBodySize+1)
+				r.Body = ioutil.NopCloser(bytes.NewReader(largeBody))
+				testutils.SignRequest(r, largeBody, time.Now().Unix(), model.NewId())
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			api := test.SetupAPI(&plugintest.API{})
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+			config := p.getConfiguration().Clone()
+			config.AllowSecretInQuery = test.AllowSecretInQuery
+			p.setConfiguration(config)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(requestMethod, requestURL, bytes.NewBuffer(body))
+			test.SetupRequest(r)
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+
+			assert.Equal(test.ExpectedStatusCode, result.StatusCode)
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/pkg/errors"
+)
+
+type contextKey string
+
+// contextKeyJobID marks the requests replayed by a job. They were authorized when the job was created.
+const contextKeyJobID contextKey = "job_id"
+
+// asyncRequestHeaders are the headers of a request which are kept when it is processed in the background
+var asyncRequestHeaders = []string{"Content-Type", constants.HeaderRequestID}
+
+// withAsync processes the request in the background if the "async" query parameter is true.
+// The request is stored as a job and replayed through the router when the job is processed, and the job is returned instead.
+// The job is retried after a server error, so the handler must be idempotent.
+func (p *Plugin) withAsync(handleFunc func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return p.withAsyncJob(handleFunc, false)
+}
+
+// withAsyncNoRetry is withAsync for handlers which are not idempotent, whose jobs fail rather than being retried after a server error.
+func (p *Plugin) withAsyncNoRetry(handleFunc func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return p.withAsyncJob(handleFunc, true)
+}
+
+func (p *Plugin) withAsyncJob(handleFunc func(w http.ResponseWriter, r *http.Request), noRetry bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAsyncRequest(r) || getRequestJobID(r) != "" {
+			handleFunc(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			p.API.LogError(fmt.Sprintf("Failed to read request body. Error: %v", err.Error()))
+			p.writeError(w, r, http.StatusBadRequest, serializer.NewError(serializer.ErrorCodeInvalidRequestBody, "invalid request body"))
+			return
+		}
+
+		query := r.URL.Query()
+		query.Del("async")
+		query.Del("secret")
+		request := &serializer.HTTPRequest{
+			Method:  r.Method,
+			Path:    r.URL.Path,
+			Query:   query.Encode(),
+			Headers: map[string]string{},
+			Body:    body,
+			NoRetry: noRetry,
+		}
+		for _, header := range asyncRequestHeaders {
+			if value := r.Header.Get(header); value != "" {
+				request.Headers[header] = value
+			}
+		}
+
+		p.writeAcceptedJob(w, r, serializer.JobTypeHTTPRequest, nil, request)
+	}
+}
+
+// getRequestJobID returns the ID of the job replaying the request, or an empty string if the request was not sent by a job.
+func getRequestJobID(r *http.Request) string {
+	jobID, _ := r.Context().Value(contextKeyJobID).(string)
+	return jobID
+}
+
+// processHTTPRequestJob replays a request which was sent with the "async" query parameter.
+// Its result is the response of the request. The job is retried if the response is a server error, unless the request is not idempotent.
+func (p *Plugin) processHTTPRequestJob(job *serializer.Job) (interface{}, int, error) {
+	var request *serializer.HTTPRequest
+	if err := json.Unmarshal(job.Payload, &request); err != nil || request == nil {
+		return nil, http.StatusBadRequest, errors.New("invalid job payload")
+	}
+
+	ctx := context.WithValue(context.Background(), contextKeyJobID, job.ID)
+	r, err := http.NewRequestWithContext(ctx, request.Method, request.Path, bytes.NewReader(request.Body))
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.Wrap(err, "invalid job payload")
+	}
+	r.URL.RawQuery = request.Query
+	for header, value := range request.Headers {
+		r.Header.Set(header, value)
+	}
+
+	w := &responseRecorder{ResponseWriter: &discardResponseWriter{header: http.Header{}}}
+	p.router.ServeHTTP(w, r)
+
+	// Like net/http, a handler which writes nothing responds with 200 OK
+	statusCode := w.statusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+
+	response := &serializer.HTTPResponse{StatusCode: statusCode}
+	if body := w.body.Bytes(); json.Valid(body) {
+		response.Body = body
+	}
+
+	if statusCode >= http.StatusBadRequest {
+		err := errors.Errorf("request failed with status code %d", statusCode)
+		if request.NoRetry {
+			return response, 0, err
+		}
+
+		return response, statusCode, err
+	}
+
+	return response, 0, nil
+}
+
+// discardResponseWriter is written to by requests replayed by a job, whose response is only kept by a responseRecorder
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(int) {}
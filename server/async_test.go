@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils/testutils"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithAsync(t *testing.T) {
+	api := &plugintest.API{}
+	defer api.AssertExpectations(t)
+
+	var savedJob *serializer.Job
+	api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+	api.On("KVSet", mock.AnythingOfType("string"), mock.Anything).Run(func(args mock.Arguments) {
+		require.Nil(t, json.Unmarshal(args.Get(1).([]byte), &savedJob))
+	}).Return(nil)
+	api.On("LogWarn", testutils.GetMockArgumentsWithType("string", 3)...).Return()
+	p := setupTestPlugin(api)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/v1/channels/%s/unarchive?async=true&secret=%s", testutils.GetID(), testutils.GetSecret()), nil)
+	p.ServeHTTP(nil, w, r)
+
+	result := w.Result()
+	require.NotNil(t, result)
+	defer result.Body.Close()
+	assert.Equal(t, http.StatusAccepted, result.StatusCode)
+
+	require.NotNil(t, savedJob)
+	assert.Equal(t, serializer.JobTypeHTTPRequest, savedJob.Type)
+
+	var request *serializer.HTTPRequest
+	require.Nil(t, json.Unmarshal(savedJob.Payload, &request))
+	assert.Equal(t, http.MethodPost, request.Method)
+	assert.Equal(t, fmt.Sprintf("/api/v1/channels/%s/unarchive", testutils.GetID()), request.Path)
+	assert.Empty(t, request.Query)
+	assert.NotEmpty(t, request.Headers["X-Request-Id"])
+}
+
+func TestWithAsyncNoRetry(t *testing.T) {
+	api := &plugintest.API{}
+	defer api.AssertExpectations(t)
+
+	var savedJob *serializer.Job
+	api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+	api.On("KVSet", mock.AnythingOfType("string"), mock.Anything).Run(func(args mock.Arguments) {
+		require.Nil(t, json.Unmarshal(args.Get(1).([]byte), &savedJob))
+	}).Return(nil)
+	api.On("LogWarn", testutils.GetMockArgumentsWithType("string", 3)...).Return()
+	p := setupTestPlugin(api)
+
+	reqBody, err := json.Marshal(testutils.GetSerializerChannel())
+	require.Nil(t, err)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/v1/channels?async=true&secret=%s", testutils.GetSecret()), bytes.NewBuffer(reqBody))
+	p.ServeHTTP(nil, w, r)
+
+	result := w.Result()
+	require.NotNil(t, result)
+	defer result.Body.Close()
+	assert.Equal(t, http.StatusAccepted, result.StatusCode)
+
+	require.NotNil(t, savedJob)
+	var request *serializer.HTTPRequest
+	require.Nil(t, json.Unmarshal(savedJob.Payload, &request))
+	assert.True(t, request.NoRetry)
+}
+
+func TestProcessHTTPRequestJob(t *testing.T) {
+	for name, test := range map[string]struct {
+		NoRetry            bool
+		SetupAPI           func(*plugintest.API) *plugintest.API
+		ExpectedStatusCode int
+		ExpectedStatus     int
+		ExpectedError      bool
+	}{
+		"request succeeds": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("GetChannel", testutils.GetID()).Return(testutils.GetModelChannel(), nil)
+				api.On("UpdateChannel", mock.AnythingOfType("*model.Channel")).Return(nil, nil)
+				api.On("KVGet", mock.AnythingOfType("string")).Return(nil, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"request fails with a server error": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("GetChannel", testutils.GetID()).Return(testutils.GetModelChannel(), nil)
+				api.On("UpdateChannel", mock.AnythingOfType("*model.Channel")).Return(nil, testutils.GetInternalServerAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+			ExpectedStatus:     http.StatusInternalServerError,
+			ExpectedError:      true,
+		},
+		"request which is not idempotent fails with a server error": {
+			NoRetry: true,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("GetChannel", testutils.GetID()).Return(testutils.GetModelChannel(), nil)
+				api.On("UpdateChannel", mock.AnythingOfType("*model.Channel")).Return(nil, testutils.GetInternalServerAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+			ExpectedError:      true,
+		},
+		"request fails with a client error": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("GetChannel", testutils.GetID()).Return(nil, testutils.GetNotFoundAppError())
+				return api
+			},
+			ExpectedStatusCode: http.StatusNotFound,
+			ExpectedStatus:     http.StatusNotFound,
+			ExpectedError:      true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			job := testutils.GetJob(serializer.JobTypeHTTPRequest, nil, nil)
+			payload, err := json.Marshal(&serializer.HTTPRequest{
+				Method:  http.MethodPost,
+				Path:    fmt.Sprintf("/api/v1/channels/%s/unarchive", testutils.GetID()),
+				NoRetry: test.NoRetry,
+			})
+			require.Nil(t, err)
+			job.Payload = payload
+
+			api := test.SetupAPI(&plugintest.API{})
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			result, status, err := p.processHTTPRequestJob(job)
+			response, ok := result.(*serializer.HTTPResponse)
+			require.True(t, ok)
+			assert.Equal(test.ExpectedStatusCode, response.StatusCode)
+			if !test.ExpectedError {
+				assert.Nil(err)
+				assert.JSONEq(fmt.Sprintf(`{"status": "%s"}`, model.STATUS_OK), string(response.Body))
+				return
+			}
+
+			assert.NotNil(err)
+			assert.Equal(test.ExpectedStatus, status)
+		})
+	}
+}
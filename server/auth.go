@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// getEnabledAuthServices returns the auth services which users can sign in with, according to the server configuration
+func (p *Plugin) getEnabledAuthServices() []string {
+	config := p.API.GetConfig()
+	if config == nil {
+		return nil
+	}
+
+	authServices := []string{}
+	for _, authService := range []struct {
+		name    string
+		enabled *bool
+	}{
+		{name: model.USER_AUTH_SERVICE_EMAIL, enabled: config.EmailSettings.EnableSignInWithEmail},
+		{name: model.USER_AUTH_SERVICE_LDAP, enabled: config.LdapSettings.Enable},
+		{name: model.USER_AUTH_SERVICE_SAML, enabled: config.SamlSettings.Enable},
+		{name: model.SERVICE_GITLAB, enabled: config.GitLabSettings.Enable},
+		{name: model.SERVICE_GOOGLE, enabled: config.GoogleSettings.Enable},
+		{name: model.SERVICE_OFFICE365, enabled: config.Office365Settings.Enable},
+		{name: model.SERVICE_OPENID, enabled: config.OpenIdSettings.Enable},
+	} {
+		if authService.enabled != nil && *authService.enabled {
+			authServices = append(authServices, authService.name)
+		}
+	}
+
+	return authServices
+}
+
+// validateAuthService checks if users can sign in to the server with the given auth service
+func (p *Plugin) validateAuthService(authService string) error {
+	authServices := p.getEnabledAuthServices()
+	for _, enabledAuthService := range authServices {
+		if authService == enabledAuthService {
+			return nil
+		}
+	}
+
+	return serializer.NewError(serializer.ErrorCodeInvalidAuthService, fmt.Sprintf("error: auth_service %q is not enabled on the server, enabled auth services: %s", authService, strings.Join(authServices, ", ")))
+}
+
+// validateUserAuthUpdate checks if the auth service and auth data of a user can be changed to the given ones
+func (p *Plugin) validateUserAuthUpdate(userAuth *model.UserAuth) error {
+	if err := p.validateAuthService(userAuth.AuthService); err != nil {
+		return err
+	}
+
+	if p.getConfiguration().AdminAccessToken == "" {
+		return serializer.NewError(serializer.ErrorCodeAuthUpdateNotConfigured, "error: the auth service and auth data of users can only be changed once the Admin Access Token setting is set")
+	}
+
+	return nil
+}
+
+// updateUserAuth changes the auth service and auth data of a user.
+// The plugin API cannot change them, so the Mattermost REST API is called with the access token of a system admin.
+func (p *Plugin) updateUserAuth(userID string, userAuth *model.UserAuth) (int, error) {
+	config := p.API.GetConfig()
+	if config == nil || config.ServiceSettings.SiteURL == nil || *config.ServiceSettings.SiteURL == "" {
+		return http.StatusInternalServerError, errors.New("site URL is not set")
+	}
+
+	client := model.NewAPIv4Client(strings.TrimSuffix(*config.ServiceSettings.SiteURL, "/"))
+	client.SetToken(p.getConfiguration().AdminAccessToken)
+	if _, resp := client.UpdateUserAuth(userID, userAuth); resp.Error != nil {
+		status := resp.StatusCode
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+
+		return status, errors.Wrap(resp.Error, "failed to update user auth")
+	}
+
+	return 0, nil
+}
+
+// restoreUserAuth changes the auth service and auth data of a user back to the ones it had before a failed update.
+// Users cannot be switched back to email through the REST API, so updateUser never changes the auth of users who sign in with email together with anything else.
+func (p *Plugin) restoreUserAuth(user *model.User) {
+	if user.AuthService == "" || user.AuthData == nil || *user.AuthData == "" {
+		p.API.LogError("Unable to restore the auth service of a user who signed in with email", "UserID", user.Id)
+		return
+	}
+
+	if _, err := p.updateUserAuth(user.Id, &model.UserAuth{AuthService: user.AuthService, AuthData: user.AuthData}); err != nil {
+		p.API.LogError(fmt.Sprintf("Failed to restore user auth. Error: %v", err.Error()))
+	}
+}
+
+// sendPasswordSetupEmail lets a user who signs in with email know that their account was created, and how to set its password
+func (p *Plugin) sendPasswordSetupEmail(user *model.User, team *model.Team) error {
+	config := p.API.GetConfig()
+	if config == nil || config.ServiceSettings.SiteURL == nil || *config.ServiceSettings.SiteURL == "" {
+		return errors.New("site URL is not set")
+	}
+
+	siteName := model.TEAM_SETTINGS_DEFAULT_SITE_NAME
+	if config.TeamSettings.SiteName != nil && *config.TeamSettings.SiteName != "" {
+		siteName = *config.TeamSettings.SiteName
+	}
+
+	resetPasswordURL := strings.TrimSuffix(*config.ServiceSettings.SiteURL, "/") + "/reset_password"
+	subject := fmt.Sprintf("[%s] Your account has been created", siteName)
+	body := fmt.Sprintf(
+		"<p>Hello %s,</p><p>An account has been created for you on %s and added to the %s team.</p><p>To sign in, set a password for your account at <a href=\"%s\">%s</a> with the email address %s.</p>",
+		html.EscapeString(user.GetDisplayName(model.SHOW_FULLNAME)),
+		html.EscapeString(siteName),
+		html.EscapeString(team.DisplayName),
+		html.EscapeString(resetPasswordURL),
+		html.EscapeString(resetPasswordURL),
+		html.EscapeString(user.Email),
+	)
+
+	if appErr := p.API.SendMail(user.Email, subject, body); appErr != nil {
+		return errors.Wrap(appErr, "failed to send password setup email")
+	}
+
+	return nil
+}
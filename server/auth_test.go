@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils/testutils"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetEnabledAuthServices(t *testing.T) {
+	for name, test := range map[string]struct {
+		SetupConfig          func(*model.Config) *model.Config
+		ExpectedAuthServices []string
+	}{
+		"email and ldap": {
+			SetupConfig: func(config *model.Config) *model.Config {
+				return config
+			},
+			ExpectedAuthServices: []string{model.USER_AUTH_SERVICE_EMAIL, model.USER_AUTH_SERVICE_LDAP},
+		},
+		"sso only": {
+			SetupConfig: func(config *model.Config) *model.Config {
+				config.EmailSettings.EnableSignInWithEmail = model.NewBool(false)
+				config.LdapSettings.Enable = model.NewBool(false)
+				config.SamlSettings.Enable = model.NewBool(true)
+				config.GitLabSettings.Enable = model.NewBool(true)
+				config.OpenIdSettings.Enable = model.NewBool(true)
+				return config
+			},
+			ExpectedAuthServices: []string{model.USER_AUTH_SERVICE_SAML, model.SERVICE_GITLAB, model.SERVICE_OPENID},
+		},
+		"no config": {
+			SetupConfig: func(config *model.Config) *model.Config {
+				return nil
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			api.On("GetConfig").Return(test.SetupConfig(testutils.GetConfig()))
+			defer api.AssertExpectations(t)
+			p := &Plugin{}
+			p.SetAPI(api)
+
+			assert.Equal(t, test.ExpectedAuthServices, p.getEnabledAuthServices())
+		})
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+)
+
+const (
+	commandTrigger = "moodle"
+
+	commandHelp = "###### Sync of course channels with Moodle\n" +
+		"- `/moodle status` - Show the Moodle course of this channel and its last sync\n" +
+		"- `/moodle sync` - Sync the members of this channel with the roster of its Moodle course now\n" +
+		"- `/moodle link <courseid>` - Link this channel to a Moodle course\n" +
+		"- `/moodle unlink` - Unlink this channel from its Moodle course\n" +
+		"- `/moodle whois @user` - Show the Moodle identity of a user\n" +
+		"- `/moodle help` - Show this help\n\n" +
+		"Only system admins and channel admins can use these commands. Only system admins can link and unlink channels which were not created by Moodle."
+
+	commandNotLinked = "This channel is not linked to a Moodle course. Use `/moodle link <courseid>` to link it."
+
+	commandLinkNotAllowed = "Only system admins can link and unlink channels which were not created by Moodle."
+
+	commandTimeFormat = "Jan 2, 2006 15:04 MST"
+)
+
+// commandHandler handles a subcommand of the /moodle command and returns the message to respond with
+type commandHandler func(args *model.CommandArgs, params []string) string
+
+func (p *Plugin) getCommandHandlers() map[string]commandHandler {
+	return map[string]commandHandler{
+		"status": p.executeStatusCommand,
+		"sync":   p.executeSyncCommand,
+		"link":   p.executeLinkCommand,
+		"unlink": p.executeUnlinkCommand,
+		"whois":  p.executeWhoisCommand,
+	}
+}
+
+func getCommand() *model.Command {
+	return &model.Command{
+		Trigger:          commandTrigger,
+		DisplayName:      "Moodle",
+		Description:      "See and control the sync of course channels with Moodle.",
+		AutoComplete:     true,
+		AutoCompleteDesc: "Available commands: status, sync, link, unlink, whois, help",
+		AutoCompleteHint: "[command]",
+		AutocompleteData: getAutocompleteData(),
+	}
+}
+
+func getAutocompleteData() *model.AutocompleteData {
+	command := model.NewAutocompleteData(commandTrigger, "[command]", "Available commands: status, sync, link, unlink, whois, help")
+
+	command.AddCommand(model.NewAutocompleteData("status", "", "Show the Moodle course of this channel and its last sync"))
+	command.AddCommand(model.NewAutocompleteData("sync", "", "Sync the members of this channel with the roster of its Moodle course now"))
+
+	link := model.NewAutocompleteData("link", "[courseid]", "Link this channel to a Moodle course")
+	link.AddTextArgument("ID of the Moodle course", "[courseid]", "")
+	command.AddCommand(link)
+
+	command.AddCommand(model.NewAutocompleteData("unlink", "", "Unlink this channel from its Moodle course"))
+
+	whois := model.NewAutocompleteData("whois", "[@user]", "Show the Moodle identity of a user")
+	whois.AddTextArgument("Username of the user", "[@user]", "")
+	command.AddCommand(whois)
+
+	command.AddCommand(model.NewAutocompleteData("help", "", "Show the help"))
+	return command
+}
+
+// ExecuteCommand executes the /moodle command. Every subcommand except help is restricted to system admins and channel admins.
+func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
+	fields := strings.Fields(args.Command)
+	if len(fields) < 2 || fields[1] == "help" {
+		return getCommandResponse(commandHelp), nil
+	}
+
+	handler, ok := p.getCommandHandlers()[fields[1]]
+	if !ok {
+		return getCommandResponse(fmt.Sprintf("Unknown command: %s\n\n%s", fields[1], commandHelp)), nil
+	}
+
+	if !p.canManageChannelSync(args.UserId, args.ChannelId) {
+		return getCommandResponse("Only system admins and admins of this channel can use this command."), nil
+	}
+
+	return getCommandResponse(handler(args, fields[2:])), nil
+}
+
+func getCommandResponse(text string) *model.CommandResponse {
+	return &model.CommandResponse{
+		ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
+		Text:         text,
+	}
+}
+
+// canManageChannelSync checks if the user is a system admin or an admin of the channel.
+func (p *Plugin) canManageChannelSync(userID, channelID string) bool {
+	if p.API.HasPermissionTo(userID, model.PERMISSION_MANAGE_SYSTEM) {
+		return true
+	}
+
+	channelMember, appErr := p.API.GetChannelMember(channelID, userID)
+	return appErr == nil && channelMember.SchemeAdmin
+}
+
+// canManageChannelLink checks if the user can link the channel to a Moodle course or unlink it.
+// Linking a channel lets Moodle manage its members, so channel admins can only do it for the channels created by the plugin.
+func (p *Plugin) canManageChannelLink(userID, channelID string) bool {
+	if p.API.HasPermissionTo(userID, model.PERMISSION_MANAGE_SYSTEM) {
+		return true
+	}
+
+	channel, appErr := p.API.GetChannel(channelID)
+	return appErr == nil && channel.CreatorId == p.botID
+}
+
+func (p *Plugin) executeStatusCommand(args *model.CommandArgs, _ []string) string {
+	mapping, err := p.getMappingByMattermostID(courseChannelMapping, args.ChannelId)
+	if err != nil {
+		return p.getCommandErrorMessage("Failed to get the Moodle course of this channel.", err)
+	}
+
+	if mapping == nil {
+		return commandNotLinked
+	}
+
+	lines := []string{fmt.Sprintf("This channel is linked to Moodle course **%s**.", mapping.MoodleID)}
+
+	record, err := p.getChannelSync(args.ChannelId)
+	switch {
+	case err != nil:
+		return p.getCommandErrorMessage("Failed to get the last sync of this channel.", err)
+	case record == nil:
+		lines = append(lines, "It has not been synced with its Moodle roster yet.")
+	case record.Error != "":
+		lines = append(lines, fmt.Sprintf("The last sync, on %s, failed: %s", formatCommandTime(record.SyncAt), record.Error))
+	default:
+		lines = append(lines, fmt.Sprintf("Last sync on %s: %s", formatCommandTime(record.SyncAt), formatChannelSyncCounts(record)))
+	}
+
+	if interval := p.getConfiguration().SyncIntervalMinutes; interval > 0 {
+		lines = append(lines, fmt.Sprintf("Course channels are synced every %d minutes.", interval))
+	} else {
+		lines = append(lines, "The scheduled sync is disabled.")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (p *Plugin) executeSyncCommand(args *model.CommandArgs, _ []string) string {
+	mapping, err := p.getMappingByMattermostID(courseChannelMapping, args.ChannelId)
+	if err != nil {
+		return p.getCommandErrorMessage("Failed to get the Moodle course of this channel.", err)
+	}
+
+	if mapping == nil {
+		return commandNotLinked
+	}
+
+	client, err := p.getMoodleClient()
+	if err != nil {
+		return "The Moodle URL and Moodle Token settings must be set to sync channels with Moodle."
+	}
+
+	if mapping.SiteID != p.getConfiguration().MoodleSiteID {
+		return "This channel is linked to a course of another Moodle site than the one of the Moodle URL setting, so it cannot be synced."
+	}
+
+	// The channel is not synced while a scheduled sync runs, as both would change its members at the same time
+	locked, err := p.lockSync()
+	if err != nil {
+		return p.getCommandErrorMessage("Failed to lock the sync.", err)
+	}
+
+	if !locked {
+		return "A sync of the course channels is already running. Please try again once it has finished."
+	}
+
+	defer p.unlockSync()
+
+	reconciliation, err := p.syncChannel(client, mapping)
+	if errors.Is(err, errEmptyRoster) {
+		return fmt.Sprintf("Moodle course **%s** has no enrolled users, so the channel was not synced. Check that the Moodle token can see the course.", mapping.MoodleID)
+	}
+	if err != nil {
+		return p.getCommandErrorMessage("Failed to sync the channel.", err)
+	}
+
+	return fmt.Sprintf("Synced this channel with Moodle course **%s**: %s", mapping.MoodleID, formatChannelSyncCounts(&channelSync{
+		Added:       len(reconciliation.Added),
+		Removed:     len(reconciliation.Removed),
+		RoleChanges: len(reconciliation.Promoted) + len(reconciliation.Demoted),
+		Errors:      len(reconciliation.Errors),
+	}))
+}
+
+// executeLinkCommand links the channel to a Moodle course. If the Moodle web services are configured, the course must exist.
+func (p *Plugin) executeLinkCommand(args *model.CommandArgs, params []string) string {
+	if !p.canManageChannelLink(args.UserId, args.ChannelId) {
+		return commandLinkNotAllowed
+	}
+
+	if len(params) != 1 {
+		return "Please specify the ID of the Moodle course: `/moodle link <courseid>`"
+	}
+
+	courseID := params[0]
+	if !serializer.IsValidMoodleID(courseID) {
+		return fmt.Sprintf("%s is not a valid Moodle course ID.", courseID)
+	}
+
+	siteCourseMapping := courseChannelMapping.forSite(p.getConfiguration().MoodleSiteID)
+	mapping, err := p.getMappingByMoodleID(siteCourseMapping, courseID)
+	if err != nil {
+		return p.getCommandErrorMessage("Failed to get the channel of the Moodle course.", err)
+	}
+
+	if mapping != nil && mapping.MattermostID == args.ChannelId {
+		return fmt.Sprintf("This channel is already linked to Moodle course **%s**.", courseID)
+	}
+
+	if mapping != nil {
+		return fmt.Sprintf("Moodle course **%s** is already linked to another channel. Unlink it from that channel first.", courseID)
+	}
+
+	courseName := courseID
+	if client, clientErr := p.getMoodleClient(); clientErr == nil {
+		courses, err := client.GetCourses(courseID)
+		if err != nil {
+			return p.getCommandErrorMessage(fmt.Sprintf("Failed to get Moodle course %s.", courseID), err)
+		}
+
+		if len(courses) == 0 {
+			return fmt.Sprintf("Moodle course %s does not exist.", courseID)
+		}
+
+		courseName = fmt.Sprintf("%s (%s)", courses[0].FullName, courseID)
+	}
+
+	if err := p.storeMapping(siteCourseMapping, courseID, args.ChannelId); err != nil {
+		return p.getCommandErrorMessage("Failed to link this channel to the Moodle course.", err)
+	}
+
+	return fmt.Sprintf("Linked this channel to Moodle course **%s**.", courseName)
+}
+
+func (p *Plugin) executeUnlinkCommand(args *model.CommandArgs, _ []string) string {
+	if !p.canManageChannelLink(args.UserId, args.ChannelId) {
+		return commandLinkNotAllowed
+	}
+
+	mapping, err := p.getMappingByMattermostID(courseChannelMapping, args.ChannelId)
+	if err != nil {
+		return p.getCommandErrorMessage("Failed to get the Moodle course of this channel.", err)
+	}
+
+	if mapping == nil {
+		return "This channel is not linked to a Moodle course."
+	}
+
+	if err := p.deleteMapping(courseChannelMapping, mapping); err != nil {
+		return p.getCommandErrorMessage("Failed to unlink this channel from its Moodle course.", err)
+	}
+
+	if appErr := p.API.KVDelete(constants.KeyPrefixChannelSync + args.ChannelId); appErr != nil {
+		p.API.LogWarn("Failed to delete the sync of the channel.", "ChannelID", args.ChannelId, "Error", appErr.Error())
+	}
+
+	return fmt.Sprintf("Unlinked this channel from Moodle course **%s**.", mapping.MoodleID)
+}
+
+func (p *Plugin) executeWhoisCommand(_ *model.CommandArgs, params []string) string {
+	if len(params) != 1 {
+		return "Please specify a user: `/moodle whois @user`"
+	}
+
+	username := strings.TrimPrefix(params[0], "@")
+	user, appErr := p.API.GetUserByUsername(username)
+	if appErr != nil {
+		return fmt.Sprintf("User @%s does not exist.", username)
+	}
+
+	mapping, err := p.getMappingByMattermostID(userMapping, user.Id)
+	if err != nil {
+		return p.getCommandErrorMessage("Failed to get the Moodle user.", err)
+	}
+
+	authService := user.AuthService
+	if authService == "" {
+		authService = model.USER_AUTH_SERVICE_EMAIL
+	}
+
+	if mapping == nil {
+		return fmt.Sprintf("@%s is not linked to a Moodle user. They sign in with %s.", user.Username, authService)
+	}
+
+	return fmt.Sprintf("@%s is Moodle user **%s**. They sign in with %s.", user.Username, mapping.MoodleID, authService)
+}
+
+// getCommandErrorMessage logs the error and returns a message for the user, without the details of the error.
+func (p *Plugin) getCommandErrorMessage(message string, err error) string {
+	p.API.LogError(message, "Error", err.Error())
+	return message + " Please check the server logs for details."
+}
+
+func formatChannelSyncCounts(record *channelSync) string {
+	return fmt.Sprintf("%d users added, %d removed, %d role changes and %d errors.", record.Added, record.Removed, record.RoleChanges, record.Errors)
+}
+
+func formatCommandTime(millis int64) string {
+	return time.Unix(0, millis*int64(time.Millisecond)).UTC().Format(commandTimeFormat)
+}
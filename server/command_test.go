@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/moodle"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils/testutils"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecuteCommand(t *testing.T) {
+	userID := model.NewId()
+	channelID := testutils.GetID()
+	otherChannelID := model.NewId()
+	moodleUserID := model.NewId()
+	botID := model.NewId()
+	courseKey := utils.GetKeyHash(constants.KeyPrefixCourse, "42")
+	channelKey := utils.GetKeyHash(constants.KeyPrefixChannel, channelID)
+
+	moodleServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.FormValue("wsfunction") {
+		case moodle.FunctionGetCourses:
+			if r.FormValue("options[ids][0]") == "42" {
+				_, _ = w.Write([]byte(`[{"id": 42, "fullname": "Mathematics"}]`))
+				return
+			}
+			_, _ = w.Write([]byte(`[]`))
+		case moodle.FunctionGetEnrolledUsers:
+			_ = json.NewEncoder(w).Encode([]moodle.EnrolledUser{{ID: 7}})
+		}
+	}))
+	defer moodleServer.Close()
+
+	asSystemAdmin := func(api *plugintest.API) {
+		api.On("HasPermissionTo", userID, model.PERMISSION_MANAGE_SYSTEM).Return(true)
+	}
+
+	for name, test := range map[string]struct {
+		Command         string
+		SetupAPI        func(*plugintest.API)
+		ExpectedMessage string
+	}{
+		"help": {
+			Command:         "/moodle help",
+			SetupAPI:        func(api *plugintest.API) {},
+			ExpectedMessage: "`/moodle status`",
+		},
+		"no subcommand": {
+			Command:         "/moodle",
+			SetupAPI:        func(api *plugintest.API) {},
+			ExpectedMessage: "`/moodle status`",
+		},
+		"unknown subcommand": {
+			Command:         "/moodle enrol",
+			SetupAPI:        func(api *plugintest.API) {},
+			ExpectedMessage: "Unknown command: enrol",
+		},
+		"not an admin": {
+			Command: "/moodle status",
+			SetupAPI: func(api *plugintest.API) {
+				api.On("HasPermissionTo", userID, model.PERMISSION_MANAGE_SYSTEM).Return(false)
+				api.On("GetChannelMember", channelID, userID).Return(&model.ChannelMember{SchemeUser: true}, nil)
+			},
+			ExpectedMessage: "Only system admins and admins of this channel can use this command.",
+		},
+		"status of an unlinked channel as channel admin": {
+			Command: "/moodle status",
+			SetupAPI: func(api *plugintest.API) {
+				api.On("HasPermissionTo", userID, model.PERMISSION_MANAGE_SYSTEM).Return(false)
+				api.On("GetChannelMember", channelID, userID).Return(&model.ChannelMember{SchemeUser: true, SchemeAdmin: true}, nil)
+				api.On("KVGet", channelKey).Return(nil, nil)
+			},
+			ExpectedMessage: commandNotLinked,
+		},
+		"status of a synced channel": {
+			Command: "/moodle status",
+			SetupAPI: func(api *plugintest.API) {
+				asSystemAdmin(api)
+				api.On("KVGet", channelKey).Return(getMappingData(t, "42", channelID), nil)
+				data, err := json.Marshal(&channelSync{SyncAt: 1600000000000, Added: 2, Removed: 1})
+				require.NoError(t, err)
+				api.On("KVGet", constants.KeyPrefixChannelSync+channelID).Return(data, nil)
+			},
+			ExpectedMessage: "This channel is linked to Moodle course **42**.\nLast sync on Sep 13, 2020 12:26 UTC: 2 users added, 1 removed, 0 role changes and 0 errors.\nThe scheduled sync is disabled.",
+		},
+		"status of a channel whose last sync failed": {
+			Command: "/moodle status",
+			SetupAPI: func(api *plugintest.API) {
+				asSystemAdmin(api)
+				api.On("KVGet", channelKey).Return(getMappingData(t, "42", channelID), nil)
+				data, err := json.Marshal(&channelSync{SyncAt: 1600000000000, Error: channelSyncFailedMessage})
+				require.NoError(t, err)
+				api.On("KVGet", constants.KeyPrefixChannelSync+channelID).Return(data, nil)
+			},
+			ExpectedMessage: "This channel is linked to Moodle course **42**.\nThe last sync, on Sep 13, 2020 12:26 UTC, failed: an error occurred. Please check the server logs for details.\nThe scheduled sync is disabled.",
+		},
+		"sync": {
+			Command: "/moodle sync",
+			SetupAPI: func(api *plugintest.API) {
+				asSystemAdmin(api)
+				api.On("KVGet", channelKey).Return(getMappingData(t, "42", channelID), nil)
+				api.On("KVGet", utils.GetKeyHash(constants.KeyPrefixMoodleUser, "7")).Return(getMappingData(t, "7", moodleUserID), nil)
+				api.On("GetChannelMembers", channelID, 0, utils.PerPageMaximum).Return(&model.ChannelMembers{}, nil)
+				api.On("KVSetWithOptions", constants.KeySyncLock, mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(true, nil)
+				api.On("AddUserToChannel", channelID, moodleUserID, mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("KVSet", constants.KeyPrefixChannelSync+channelID, mock.Anything).Return(nil)
+				api.On("KVDelete", constants.KeySyncLock).Return(nil)
+			},
+			ExpectedMessage: "Synced this channel with Moodle course **42**: 1 users added, 0 removed, 0 role changes and 0 errors.",
+		},
+		"sync while another sync is running": {
+			Command: "/moodle sync",
+			SetupAPI: func(api *plugintest.API) {
+				asSystemAdmin(api)
+				api.On("KVGet", channelKey).Return(getMappingData(t, "42", channelID), nil)
+				api.On("KVSetWithOptions", constants.KeySyncLock, mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(false, nil)
+			},
+			ExpectedMessage: "A sync of the course channels is already running.",
+		},
+		"failed sync": {
+			Command: "/moodle sync",
+			SetupAPI: func(api *plugintest.API) {
+				asSystemAdmin(api)
+				api.On("KVGet", channelKey).Return(getMappingData(t, "42", channelID), nil)
+				api.On("KVSetWithOptions", constants.KeySyncLock, mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(true, nil)
+				api.On("KVGet", utils.GetKeyHash(constants.KeyPrefixMoodleUser, "7")).Return(getMappingData(t, "7", moodleUserID), nil)
+				api.On("GetChannelMembers", channelID, 0, utils.PerPageMaximum).Return(nil, testutils.GetInternalServerAppError())
+				api.On("KVSet", constants.KeyPrefixChannelSync+channelID, mock.Anything).Return(nil)
+				api.On("LogError", "Failed to sync the channel.", "Error", mock.AnythingOfType("string")).Return()
+				api.On("KVDelete", constants.KeySyncLock).Return(nil)
+			},
+			ExpectedMessage: "Failed to sync the channel. Please check the server logs for details.",
+		},
+		"link": {
+			Command: "/moodle link 42",
+			SetupAPI: func(api *plugintest.API) {
+				asSystemAdmin(api)
+				api.On("KVGet", courseKey).Return(nil, nil)
+				api.On("KVGet", channelKey).Return(nil, nil)
+				api.On("KVSetWithOptions", courseKey, mock.Anything, model.PluginKVSetOptions{Atomic: true}).Return(true, nil)
+				api.On("KVSetWithOptions", channelKey, mock.Anything, model.PluginKVSetOptions{Atomic: true}).Return(true, nil)
+			},
+			ExpectedMessage: "Linked this channel to Moodle course **Mathematics (42)**.",
+		},
+		"link a channel created by the plugin as channel admin": {
+			Command: "/moodle link 42",
+			SetupAPI: func(api *plugintest.API) {
+				api.On("HasPermissionTo", userID, model.PERMISSION_MANAGE_SYSTEM).Return(false)
+				api.On("GetChannelMember", channelID, userID).Return(&model.ChannelMember{SchemeUser: true, SchemeAdmin: true}, nil)
+				api.On("GetChannel", channelID).Return(&model.Channel{Id: channelID, CreatorId: botID}, nil)
+				api.On("KVGet", courseKey).Return(nil, nil)
+				api.On("KVGet", channelKey).Return(nil, nil)
+				api.On("KVSetWithOptions", courseKey, mock.Anything, model.PluginKVSetOptions{Atomic: true}).Return(true, nil)
+				api.On("KVSetWithOptions", channelKey, mock.Anything, model.PluginKVSetOptions{Atomic: true}).Return(true, nil)
+			},
+			ExpectedMessage: "Linked this channel to Moodle course **Mathematics (42)**.",
+		},
+		"link another channel as channel admin": {
+			Command: "/moodle link 42",
+			SetupAPI: func(api *plugintest.API) {
+				api.On("HasPermissionTo", userID, model.PERMISSION_MANAGE_SYSTEM).Return(false)
+				api.On("GetChannelMember", channelID, userID).Return(&model.ChannelMember{SchemeUser: true, SchemeAdmin: true}, nil)
+				api.On("GetChannel", channelID).Return(&model.Channel{Id: channelID, CreatorId: userID}, nil)
+			},
+			ExpectedMessage: commandLinkNotAllowed,
+		},
+		"unlink another channel as channel admin": {
+			Command: "/moodle unlink",
+			SetupAPI: func(api *plugintest.API) {
+				api.On("HasPermissionTo", userID, model.PERMISSION_MANAGE_SYSTEM).Return(false)
+				api.On("GetChannelMember", channelID, userID).Return(&model.ChannelMember{SchemeUser: true, SchemeAdmin: true}, nil)
+				api.On("GetChannel", channelID).Return(&model.Channel{Id: channelID, CreatorId: userID}, nil)
+			},
+			ExpectedMessage: commandLinkNotAllowed,
+		},
+		"link to a course which does not exist": {
+			Command: "/moodle link 43",
+			SetupAPI: func(api *plugintest.API) {
+				asSystemAdmin(api)
+				api.On("KVGet", utils.GetKeyHash(constants.KeyPrefixCourse, "43")).Return(nil, nil)
+			},
+			ExpectedMessage: "Moodle course 43 does not exist.",
+		},
+		"link to a course linked to another channel": {
+			Command: "/moodle link 42",
+			SetupAPI: func(api *plugintest.API) {
+				asSystemAdmin(api)
+				api.On("KVGet", courseKey).Return(getMappingData(t, "42", otherChannelID), nil)
+			},
+			ExpectedMessage: "Moodle course **42** is already linked to another channel. Unlink it from that channel first.",
+		},
+		"link without a course ID": {
+			Command: "/moodle link",
+			SetupAPI: func(api *plugintest.API) {
+				asSystemAdmin(api)
+			},
+			ExpectedMessage: "Please specify the ID of the Moodle course: `/moodle link <courseid>`",
+		},
+		"unlink": {
+			Command: "/moodle unlink",
+			SetupAPI: func(api *plugintest.API) {
+				asSystemAdmin(api)
+				api.On("KVGet", channelKey).Return(getMappingData(t, "42", channelID), nil)
+				api.On("KVDelete", courseKey).Return(nil)
+				api.On("KVDelete", channelKey).Return(nil)
+				api.On("KVDelete", constants.KeyPrefixChannelSync+channelID).Return(nil)
+			},
+			ExpectedMessage: "Unlinked this channel from Moodle course **42**.",
+		},
+		"whois": {
+			Command: "/moodle whois @jsmith",
+			SetupAPI: func(api *plugintest.API) {
+				asSystemAdmin(api)
+				api.On("GetUserByUsername", "jsmith").Return(&model.User{Id: moodleUserID, Username: "jsmith", AuthService: model.USER_AUTH_SERVICE_LDAP}, nil)
+				api.On("KVGet", utils.GetKeyHash(constants.KeyPrefixMattermostUser, moodleUserID)).Return(getMappingData(t, "7", moodleUserID), nil)
+			},
+			ExpectedMessage: "@jsmith is Moodle user **7**. They sign in with ldap.",
+		},
+		"whois of a user who does not exist": {
+			Command: "/moodle whois @nobody",
+			SetupAPI: func(api *plugintest.API) {
+				asSystemAdmin(api)
+				api.On("GetUserByUsername", "nobody").Return(nil, testutils.GetNotFoundAppError())
+			},
+			ExpectedMessage: "User @nobody does not exist.",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			test.SetupAPI(api)
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+			p.botID = botID
+
+			config := p.getConfiguration().Clone()
+			config.MoodleURL = moodleServer.URL
+			config.MoodleToken = "moodletoken"
+			p.setConfiguration(config)
+
+			response, appErr := p.ExecuteCommand(nil, &model.CommandArgs{
+				Command:   test.Command,
+				UserId:    userID,
+				ChannelId: channelID,
+			})
+			require.Nil(t, appErr)
+			assert.Equal(t, model.COMMAND_RESPONSE_TYPE_EPHEMERAL, response.ResponseType)
+			assert.Contains(t, response.Text, test.ExpectedMessage)
+		})
+	}
+}
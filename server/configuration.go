@@ -1,10 +1,15 @@
 package main
 
 import (
+	"net/url"
 	"reflect"
 	"strings"
+	"time"
 
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
 	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
 )
 
 // configuration captures the plugin's external configuration as exposed in the Mattermost server
@@ -19,10 +24,42 @@ import (
 // If you add non-reference types to your configuration struct, be sure to rewrite Clone as a deep
 // copy appropriate for your types.
 type configuration struct {
-	Secret         string `json:"Secret"`
-	BotUserName    string `json:"BotUserName"`
-	BotDisplayName string `json:"BotDisplayName"`
-	BotDescription string `json:"BotDescription"`
+	Secret string `json:"Secret"`
+	// AllowSecretInQuery is nil if the setting was never saved, such as after an upgrade from a version without it.
+	// The default of plugin.json, which allows the secret, then applies, so that existing Moodle sites keep working.
+	AllowSecretInQuery *bool  `json:"AllowSecretInQuery"`
+	BotUserName        string `json:"BotUserName"`
+	BotDisplayName     string `json:"BotDisplayName"`
+	BotDescription     string `json:"BotDescription"`
+	DefaultChannelType string `json:"DefaultChannelType"`
+
+	EnableTeamProvisioning  bool   `json:"EnableTeamProvisioning"`
+	TeamDisplayNameTemplate string `json:"TeamDisplayNameTemplate"`
+	ProvisionedTeamType     string `json:"ProvisionedTeamType"`
+
+	UsernameCollisionStrategy string `json:"UsernameCollisionStrategy"`
+	UsernameTemplate          string `json:"UsernameTemplate"`
+
+	UserDeletionPolicy          string `json:"UserDeletionPolicy"`
+	DeactivationGracePeriodDays int    `json:"DeactivationGracePeriodDays"`
+
+	AdminAccessToken string `json:"AdminAccessToken"`
+
+	RoleMapping string `json:"RoleMapping"`
+
+	MoodleURL    string `json:"MoodleURL"`
+	MoodleToken  string `json:"MoodleToken"`
+	MoodleSiteID string `json:"MoodleSiteID"`
+
+	SyncIntervalMinutes int    `json:"SyncIntervalMinutes"`
+	SyncReportChannelID string `json:"SyncReportChannelID"`
+
+	ReminderOffsets string `json:"ReminderOffsets"`
+
+	// roleMapping is parsed from RoleMapping, and maps Moodle role shortnames to Mattermost roles
+	roleMapping map[string]*moodleRoleMapping
+	// reminderOffsets is parsed from ReminderOffsets, and contains how long before a deadline its reminders are posted
+	reminderOffsets []time.Duration
 }
 
 // Clone shallow copies the configuration. Your implementation may require a deep copy if
@@ -32,12 +69,54 @@ func (c *configuration) Clone() *configuration {
 	return &clone
 }
 
+// isSecretInQueryAllowed checks if requests can be authenticated with the secret in the query instead of a signature
+func (c *configuration) isSecretInQueryAllowed() bool {
+	return c.AllowSecretInQuery == nil || *c.AllowSecretInQuery
+}
+
 // ProcessConfiguration processes the config.
 func (c *configuration) ProcessConfiguration() error {
 	c.Secret = strings.TrimSpace(c.Secret)
 	c.BotUserName = strings.TrimSpace(c.BotUserName)
 	c.BotDisplayName = strings.TrimSpace(c.BotDisplayName)
 	c.BotDescription = strings.TrimSpace(c.BotDescription)
+	c.AdminAccessToken = strings.TrimSpace(c.AdminAccessToken)
+	c.MoodleURL = strings.TrimRight(strings.TrimSpace(c.MoodleURL), "/")
+	c.MoodleToken = strings.TrimSpace(c.MoodleToken)
+	c.MoodleSiteID = strings.TrimSpace(c.MoodleSiteID)
+	c.SyncReportChannelID = strings.TrimSpace(c.SyncReportChannelID)
+	if c.DefaultChannelType == "" {
+		c.DefaultChannelType = model.CHANNEL_PRIVATE
+	}
+
+	c.TeamDisplayNameTemplate = strings.TrimSpace(c.TeamDisplayNameTemplate)
+	if c.TeamDisplayNameTemplate == "" {
+		c.TeamDisplayNameTemplate = teamDisplayNamePlaceholderCategoryName
+	}
+	if c.ProvisionedTeamType == "" {
+		c.ProvisionedTeamType = model.TEAM_INVITE
+	}
+
+	c.UsernameTemplate = strings.TrimSpace(c.UsernameTemplate)
+	if c.UsernameCollisionStrategy == "" {
+		c.UsernameCollisionStrategy = usernameCollisionStrategyFail
+	}
+
+	if c.UserDeletionPolicy == "" {
+		c.UserDeletionPolicy = userDeletionPolicyDeactivate
+	}
+
+	roleMapping, err := parseRoleMapping(c.RoleMapping)
+	if err != nil {
+		return err
+	}
+	c.roleMapping = roleMapping
+
+	reminderOffsets, err := parseReminderOffsets(c.ReminderOffsets)
+	if err != nil {
+		return err
+	}
+	c.reminderOffsets = reminderOffsets
 
 	return nil
 }
@@ -57,6 +136,52 @@ func (c *configuration) IsValid() error {
 	if len(c.BotDescription) == 0 {
 		return errors.New("bot Description cannot be empty")
 	}
+	if c.DefaultChannelType != model.CHANNEL_OPEN && c.DefaultChannelType != model.CHANNEL_PRIVATE {
+		return errors.New("default Channel Type must be either public or private")
+	}
+	if c.ProvisionedTeamType != model.TEAM_OPEN && c.ProvisionedTeamType != model.TEAM_INVITE {
+		return errors.New("provisioned Team Type must be either open or invite only")
+	}
+	switch c.UsernameCollisionStrategy {
+	case usernameCollisionStrategyFail, usernameCollisionStrategySuffix:
+	case usernameCollisionStrategyTemplate:
+		if len(c.UsernameTemplate) == 0 {
+			return errors.New("username Template cannot be empty when the template strategy is used")
+		}
+	default:
+		return errors.New("username Collision Strategy is not valid")
+	}
+	switch c.UserDeletionPolicy {
+	case userDeletionPolicyDeactivate, userDeletionPolicyRemoveFromChannels:
+	case userDeletionPolicyDeactivateAfterGracePeriod:
+		if c.DeactivationGracePeriodDays <= 0 {
+			return errors.New("deactivation Grace Period must be at least one day")
+		}
+	default:
+		return errors.New("user Deletion Policy is not valid")
+	}
+	for moodleRole, roleMapping := range c.roleMapping {
+		if err := roleMapping.IsValid(); err != nil {
+			return errors.Wrapf(err, "role Mapping of Moodle role %s is not valid", moodleRole)
+		}
+	}
+	if c.MoodleURL != "" {
+		if moodleURL, err := url.Parse(c.MoodleURL); err != nil || (moodleURL.Scheme != "http" && moodleURL.Scheme != "https") || moodleURL.Host == "" {
+			return errors.New("moodle URL must be an absolute http or https URL")
+		}
+	}
+	if c.MoodleSiteID != "" && !serializer.IsValidMoodleID(c.MoodleSiteID) {
+		return errors.New("moodle Site ID is not valid")
+	}
+	if c.SyncIntervalMinutes < 0 {
+		return errors.New("sync Interval cannot be negative")
+	}
+	if c.SyncIntervalMinutes > 0 && (c.MoodleURL == "" || c.MoodleToken == "") {
+		return errors.New("moodle URL and Moodle Token must be set to enable the scheduled sync")
+	}
+	if c.SyncReportChannelID != "" && !model.IsValidId(c.SyncReportChannelID) {
+		return errors.New("sync Report Channel ID is not valid")
+	}
 
 	return nil
 }
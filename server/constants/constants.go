@@ -0,0 +1,66 @@
+package constants
+
+import "time"
+
+const (
+	// HeaderSignature contains the hex encoded HMAC-SHA256 signature of a signed request
+	HeaderSignature = "X-Moodle-Signature"
+	// HeaderTimestamp contains the unix time (in seconds) at which a signed request was created
+	HeaderTimestamp = "X-Moodle-Timestamp"
+	// HeaderNonce contains a value unique to every signed request
+	HeaderNonce = "X-Moodle-Nonce"
+
+	// HeaderIdempotencyKey contains a key unique to an operation, which makes retries of the operation return the original result
+	HeaderIdempotencyKey = "Idempotency-Key"
+	// HeaderIdempotentReplayed is set on responses which were returned from a previous request with the same idempotency key
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+
+	// HeaderRequestID contains the ID of a request, which is returned in the body of error responses and logged.
+	// It is generated by the plugin unless the client sends a valid one.
+	HeaderRequestID = "X-Request-Id"
+
+	// HeaderTotalCount contains the total number of items in a streamed export
+	HeaderTotalCount = "X-Total-Count"
+
+	// SignatureMaxAge is the maximum allowed difference between the timestamp of a signed request and the current time
+	SignatureMaxAge = 5 * time.Minute
+	// NonceMaxLength is the maximum allowed length of the nonce of a signed request
+	NonceMaxLength = 64
+
+	// QueryParamIDType can be set to IDTypeMoodle to pass Moodle IDs in the path of a request in place of Mattermost IDs
+	QueryParamIDType = "id_type"
+	IDTypeMoodle     = "moodle"
+
+	// QueryParamSiteID contains the ID of the Moodle site a request comes from.
+	// Moodle course and user IDs are only unique within a site, so their mappings are stored per site.
+	QueryParamSiteID = "site_id"
+
+	// KVListPerPage is the number of keys fetched at once when listing the keys of the KV store
+	KVListPerPage = 100
+
+	KeyPrefixNonce          = "nonce_"
+	KeyPrefixJob            = "job_"
+	KeyPrefixIdempotency    = "idempotency_"
+	KeyPrefixCourse         = "course_"
+	KeyPrefixChannel        = "channel_"
+	KeyPrefixMoodleUser     = "moodle_user_"
+	KeyPrefixMattermostUser = "mm_user_"
+	KeyPrefixSite           = "site_"
+	KeyPrefixTeam           = "team_"
+	KeyPrefixGroupChannels  = "group_channels_"
+	KeyPrefixParentChannel  = "parent_channel_"
+
+	KeyPrefixPendingDeactivation = "pending_deactivation_"
+
+	// KeySyncLock is set while a scheduled sync is running, so that only one server of a cluster runs it at a time
+	KeySyncLock = "sync_lock"
+	// KeySyncLastRun contains the summary of the last scheduled sync
+	KeySyncLastRun = "sync_last_run"
+	// KeyPrefixChannelSync prefixes the outcome of the last sync of a course channel
+	KeyPrefixChannelSync = "channel_sync_"
+
+	// KeyPrefixDeadlines prefixes the upcoming deadlines of a course channel
+	KeyPrefixDeadlines = "deadlines_"
+	// KeyPrefixAnnouncement prefixes the link between a Moodle announcement and the post mirroring it in a course channel
+	KeyPrefixAnnouncement = "announcement_"
+)
@@ -2,6 +2,7 @@ package constants
 
 const (
 	PathTest                 = "/test"
+	OpenAPISpec              = "/openapi.json"
 	CreateChannel            = "/channels"
 	ArchiveChannel           = "/channels/{channel_id:[A-Za-z0-9]+}"
 	UnarchiveChannel         = "/channels/{channel_id:[A-Za-z0-9]+}/unarchive"
@@ -11,7 +12,25 @@ const (
 	GetUserByUsername        = "/users/{username}"
 	AddUserToChannel         = "/channels/{channel_id:[A-Za-z0-9]+}/members"
 	GetChannelMembers        = "/channels/{channel_id:[A-Za-z0-9]+}/members"
+	ExportChannelMembers     = "/channels/{channel_id:[A-Za-z0-9]+}/members/export"
+	UpdateChannelMembers     = "/channels/{channel_id:[A-Za-z0-9]+}/members"
+	ReconcileChannelMembers  = "/channels/{channel_id:[A-Za-z0-9]+}/members"
 	RemoveUserFromChannel    = "/channels/{channel_id:[A-Za-z0-9]+}/members/{user_id:[A-Za-z0-9]+}"
 	UpdateChannelMemberRoles = "/channels/{channel_id:[A-Za-z0-9]+}/members/roles"
 	GetChannel               = "/channels/{channel_id:[A-Za-z0-9]+}"
+	UpdateChannel            = "/channels/{channel_id:[A-Za-z0-9]+}"
+	CreateGroupChannel       = "/channels/{channel_id:[A-Za-z0-9]+}/groups"
+	GetJob                   = "/jobs/{job_id:[A-Za-z0-9]+}"
+	PendingDeactivations     = "/deactivations"
+	PendingDeactivation      = "/users/{user_id:[A-Za-z0-9]+}/deactivation"
+	SetProfileImage          = "/users/{user_id:[A-Za-z0-9]+}/image"
+	CourseMapping            = "/mappings/courses/{moodle_id}"
+	ChannelMapping           = "/mappings/channels/{mattermost_id:[A-Za-z0-9]+}"
+	MoodleUserMapping        = "/mappings/moodle_users/{moodle_id}"
+	UserMapping              = "/mappings/users/{mattermost_id:[A-Za-z0-9]+}"
+	SiteMapping              = "/mappings/sites/{moodle_id}"
+	TeamMapping              = "/mappings/teams/{mattermost_id:[A-Za-z0-9]+}"
+	ChannelDeadlines         = "/channels/{channel_id:[A-Za-z0-9]+}/deadlines"
+	ChannelDeadline          = "/channels/{channel_id:[A-Za-z0-9]+}/deadlines/{deadline_id}"
+	ChannelAnnouncement      = "/channels/{channel_id:[A-Za-z0-9]+}/announcements/{announcement_id}"
 )
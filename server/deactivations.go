@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/pkg/errors"
+)
+
+// Policies for handling the users deleted by Moodle
+const (
+	userDeletionPolicyDeactivate                 = "deactivate"
+	userDeletionPolicyDeactivateAfterGracePeriod = "deactivate_after_grace_period"
+	userDeletionPolicyRemoveFromChannels         = "remove_from_channels"
+)
+
+// scheduleDeactivation deactivates the user once the grace period is over, unless the deactivation is cancelled before.
+// If a deactivation is already pending for the user, it is returned as it is.
+func (p *Plugin) scheduleDeactivation(userID string) (*serializer.PendingDeactivation, error) {
+	pendingDeactivation, err := p.getPendingDeactivationByUserID(userID)
+	if err != nil || pendingDeactivation != nil {
+		return pendingDeactivation, err
+	}
+
+	gracePeriod := time.Duration(p.getConfiguration().DeactivationGracePeriodDays) * 24 * time.Hour
+	job, err := p.createDelayedJob(serializer.JobTypeDeactivateUser, map[string]string{serializer.JobParamUserID: userID}, nil, gracePeriod)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create job")
+	}
+
+	pendingDeactivation = &serializer.PendingDeactivation{
+		UserID:       userID,
+		JobID:        job.ID,
+		CreateAt:     job.CreateAt,
+		DeactivateAt: job.NextAttemptAt,
+	}
+
+	// If the pending deactivation cannot be stored, the job does nothing when it is processed
+	if appErr := p.API.KVSet(constants.KeyPrefixPendingDeactivation+userID, []byte(pendingDeactivation.ToJSON())); appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to store pending deactivation in KV store")
+	}
+
+	return pendingDeactivation, nil
+}
+
+func (p *Plugin) getPendingDeactivationByUserID(userID string) (*serializer.PendingDeactivation, error) {
+	data, appErr := p.API.KVGet(constants.KeyPrefixPendingDeactivation + userID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get pending deactivation from KV store")
+	}
+
+	if data == nil {
+		return nil, nil
+	}
+
+	var pendingDeactivation *serializer.PendingDeactivation
+	if err := json.Unmarshal(data, &pendingDeactivation); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal pending deactivation")
+	}
+
+	return pendingDeactivation, nil
+}
+
+// deletePendingDeactivation cancels the pending deactivation of the user, if there is one
+func (p *Plugin) deletePendingDeactivation(userID string) error {
+	if appErr := p.API.KVDelete(constants.KeyPrefixPendingDeactivation + userID); appErr != nil {
+		return errors.Wrap(appErr, "failed to delete pending deactivation from KV store")
+	}
+
+	return nil
+}
+
+// listPendingDeactivations returns all the pending deactivations stored in the KV store
+func (p *Plugin) listPendingDeactivations() (serializer.PendingDeactivations, error) {
+	pendingDeactivations := serializer.PendingDeactivations{}
+	for page := 0; ; page++ {
+		keys, appErr := p.API.KVList(page, constants.KVListPerPage)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "failed to list keys from KV store")
+		}
+
+		for _, key := range keys {
+			if !strings.HasPrefix(key, constants.KeyPrefixPendingDeactivation) {
+				continue
+			}
+
+			pendingDeactivation, err := p.getPendingDeactivationByUserID(strings.TrimPrefix(key, constants.KeyPrefixPendingDeactivation))
+			if err != nil {
+				return nil, err
+			}
+
+			if pendingDeactivation != nil {
+				pendingDeactivations = append(pendingDeactivations, pendingDeactivation)
+			}
+		}
+
+		if len(keys) < constants.KVListPerPage {
+			return pendingDeactivations, nil
+		}
+	}
+}
+
+// processDeactivateUserJob deactivates a user whose grace period is over.
+// Nothing is done if the deactivation was cancelled in the meantime.
+func (p *Plugin) processDeactivateUserJob(job *serializer.Job) (interface{}, int, error) {
+	userID := job.Params[serializer.JobParamUserID]
+	pendingDeactivation, err := p.getPendingDeactivationByUserID(userID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if pendingDeactivation == nil || pendingDeactivation.JobID != job.ID {
+		return nil, 0, nil
+	}
+
+	if appErr := p.API.DeleteUser(userID); appErr != nil && appErr.StatusCode != http.StatusNotFound {
+		return nil, appErr.StatusCode, errors.Wrap(appErr, "failed to deactivate user")
+	}
+
+	if err = p.deletePendingDeactivation(userID); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	p.API.LogInfo("Deactivated user after the grace period.", "UserID", userID)
+	return nil, 0, nil
+}
+
+// removeUserFromCourseChannels removes the user from every course channel and group channel, leaving their account and other channels as they are.
+// Channels are selected by their course mapping or group channel link rather than by their creator, so that channels linked with /moodle link are included.
+func (p *Plugin) removeUserFromCourseChannels(userID string) (int, error) {
+	teams, appErr := p.API.GetTeamsForUser(userID)
+	if appErr != nil {
+		return appErr.StatusCode, errors.Wrap(appErr, "failed to get teams for user")
+	}
+
+	for _, team := range teams {
+		channels, channelsErr := p.API.GetChannelsForTeamForUser(team.Id, userID, false)
+		if channelsErr != nil {
+			return channelsErr.StatusCode, errors.Wrap(channelsErr, "failed to get channels for user")
+		}
+
+		for _, channel := range channels {
+			isCourseChannel, err := p.isCourseOrGroupChannel(channel.Id)
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+
+			if !isCourseChannel {
+				continue
+			}
+
+			if deleteErr := p.API.DeleteChannelMember(channel.Id, userID); deleteErr != nil && deleteErr.StatusCode != http.StatusNotFound {
+				return deleteErr.StatusCode, errors.Wrap(deleteErr, fmt.Sprintf("failed to remove user from channel %s", channel.Id))
+			}
+		}
+	}
+
+	return 0, nil
+}
+
+// isCourseOrGroupChannel checks if the channel is linked to a Moodle course or is a group channel of a course channel
+func (p *Plugin) isCourseOrGroupChannel(channelID string) (bool, error) {
+	mapping, err := p.getMappingByMattermostID(courseChannelMapping, channelID)
+	if err != nil {
+		return false, err
+	}
+
+	if mapping != nil {
+		return true, nil
+	}
+
+	link, err := p.getParentChannelLink(channelID)
+	if err != nil {
+		return false, err
+	}
+
+	return link != nil, nil
+}
+
+func (p *Plugin) getPendingDeactivations(w http.ResponseWriter, r *http.Request) {
+	pendingDeactivations, err := p.listPendingDeactivations()
+	if err != nil {
+		p.API.LogError(fmt.Sprintf("Failed to list pending deactivations. Error: %v", err.Error()))
+		p.writeError(w, r, http.StatusInternalServerError, errors.Wrap(err, "failed to list pending deactivations"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(pendingDeactivations.ToJSON()))
+}
+
+func (p *Plugin) getPendingDeactivation(w http.ResponseWriter, r *http.Request) {
+	pendingDeactivation, ok := p.getPendingDeactivationForRequest(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(pendingDeactivation.ToJSON()))
+}
+
+// cancelPendingDeactivation keeps a user deleted by Moodle active
+func (p *Plugin) cancelPendingDeactivation(w http.ResponseWriter, r *http.Request) {
+	pendingDeactivation, ok := p.getPendingDeactivationForRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := p.deletePendingDeactivation(pendingDeactivation.UserID); err != nil {
+		p.API.LogError(fmt.Sprintf("Failed to cancel pending deactivation. Error: %v", err.Error()))
+		p.writeError(w, r, http.StatusInternalServerError, errors.Wrap(err, "failed to cancel pending deactivation"))
+		return
+	}
+
+	returnStatusOK(w)
+}
+
+// getPendingDeactivationForRequest returns the pending deactivation of the user in the path of the request.
+// If there is none, an error is written and false is returned.
+func (p *Plugin) getPendingDeactivationForRequest(w http.ResponseWriter, r *http.Request) (*serializer.PendingDeactivation, bool) {
+	userID, status, resolveErr := p.resolveMattermostID(r, userMapping, "user_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
+		return nil, false
+	}
+
+	pendingDeactivation, err := p.getPendingDeactivationByUserID(userID)
+	if err != nil {
+		p.API.LogError(fmt.Sprintf("Failed to get pending deactivation. Error: %v", err.Error()))
+		p.writeError(w, r, http.StatusInternalServerError, errors.Wrap(err, "failed to get pending deactivation"))
+		return nil, false
+	}
+
+	if pendingDeactivation == nil {
+		p.writeError(w, r, http.StatusNotFound, serializer.NewError(serializer.ErrorCodePendingDeactivationNotFound, "no deactivation is pending for the user"))
+		return nil, false
+	}
+
+	return pendingDeactivation, true
+}
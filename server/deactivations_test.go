@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils/testutils"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getPendingDeactivationJSON(userID, jobID string) []byte {
+	data, _ := json.Marshal(serializer.PendingDeactivation{
+		UserID:       userID,
+		JobID:        jobID,
+		CreateAt:     model.GetMillis(),
+		DeactivateAt: model.GetMillis() + int64(24*time.Hour/time.Millisecond),
+	})
+	return data
+}
+
+func getCourseMappingJSON(channelID string) []byte {
+	data, _ := json.Marshal(serializer.Mapping{MoodleID: "101", MattermostID: channelID})
+	return data
+}
+
+func getGroupChannelLinkJSON(parentChannelID, channelID string) []byte {
+	data, _ := json.Marshal(serializer.GroupChannelLink{ParentChannelID: parentChannelID, ChannelID: channelID})
+	return data
+}
+
+func TestDeleteUserWithDeletionPolicy(t *testing.T) {
+	requestURL := fmt.Sprintf("/api/v1/users/%s?secret=%s", testutils.GetID(), testutils.GetSecret())
+	pendingDeactivationKey := constants.KeyPrefixPendingDeactivation + testutils.GetID()
+	botID := model.NewId()
+	for name, test := range map[string]struct {
+		Policy             string
+		SetupAPI           func(*plugintest.API) *plugintest.API
+		ExpectedStatusCode int
+		ExpectedJobID      string
+	}{
+		"deactivate after grace period": {
+			Policy: userDeletionPolicyDeactivateAfterGracePeriod,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", pendingDeactivationKey).Return(nil, nil)
+				api.On("KVSet", mock.MatchedBy(func(key string) bool {
+					return strings.HasPrefix(key, constants.KeyPrefixJob)
+				}), mock.Anything).Return(nil)
+				api.On("KVSet", pendingDeactivationKey, mock.Anything).Return(nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusAccepted,
+		},
+		"deactivation already pending": {
+			Policy: userDeletionPolicyDeactivateAfterGracePeriod,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", pendingDeactivationKey).Return(getPendingDeactivationJSON(testutils.GetID(), "existingjobid"), nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusAccepted,
+			ExpectedJobID:      "existingjobid",
+		},
+		"failed to store pending deactivation": {
+			Policy: userDeletionPolicyDeactivateAfterGracePeriod,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", pendingDeactivationKey).Return(nil, nil)
+				api.On("KVSet", mock.MatchedBy(func(key string) bool {
+					return strings.HasPrefix(key, constants.KeyPrefixJob)
+				}), mock.Anything).Return(nil)
+				api.On("KVSet", pendingDeactivationKey, mock.Anything).Return(testutils.GetInternalServerAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+		"remove from course channels": {
+			Policy: userDeletionPolicyRemoveFromChannels,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				team := testutils.GetTeam()
+				// The course channel was linked with /moodle link, so it was not created by the bot
+				courseChannel := testutils.GetModelChannel()
+				courseChannel.CreatorId = model.NewId()
+				groupChannel := testutils.GetModelChannel()
+				groupChannel.CreatorId = botID
+				otherChannel := testutils.GetModelChannel()
+				otherChannel.CreatorId = botID
+				api.On("GetTeamsForUser", testutils.GetID()).Return([]*model.Team{team}, nil)
+				api.On("GetChannelsForTeamForUser", team.Id, testutils.GetID(), false).Return([]*model.Channel{courseChannel, groupChannel, otherChannel}, nil)
+				api.On("KVGet", courseChannelMapping.getMattermostKey(courseChannel.Id)).Return(getCourseMappingJSON(courseChannel.Id), nil)
+				api.On("KVGet", courseChannelMapping.getMattermostKey(groupChannel.Id)).Return(nil, nil)
+				api.On("KVGet", utils.GetKeyHash(constants.KeyPrefixParentChannel, groupChannel.Id)).Return(getGroupChannelLinkJSON(courseChannel.Id, groupChannel.Id), nil)
+				api.On("KVGet", courseChannelMapping.getMattermostKey(otherChannel.Id)).Return(nil, nil)
+				api.On("KVGet", utils.GetKeyHash(constants.KeyPrefixParentChannel, otherChannel.Id)).Return(nil, nil)
+				api.On("DeleteChannelMember", courseChannel.Id, testutils.GetID()).Return(nil)
+				api.On("DeleteChannelMember", groupChannel.Id, testutils.GetID()).Return(nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"failed to check if a channel is a course channel": {
+			Policy: userDeletionPolicyRemoveFromChannels,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				team := testutils.GetTeam()
+				courseChannel := testutils.GetModelChannel()
+				api.On("GetTeamsForUser", testutils.GetID()).Return([]*model.Team{team}, nil)
+				api.On("GetChannelsForTeamForUser", team.Id, testutils.GetID(), false).Return([]*model.Channel{courseChannel}, nil)
+				api.On("KVGet", courseChannelMapping.getMattermostKey(courseChannel.Id)).Return(nil, testutils.GetInternalServerAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+		"failed to remove from course channels": {
+			Policy: userDeletionPolicyRemoveFromChannels,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				team := testutils.GetTeam()
+				courseChannel := testutils.GetModelChannel()
+				api.On("GetTeamsForUser", testutils.GetID()).Return([]*model.Team{team}, nil)
+				api.On("GetChannelsForTeamForUser", team.Id, testutils.GetID(), false).Return([]*model.Channel{courseChannel}, nil)
+				api.On("KVGet", courseChannelMapping.getMattermostKey(courseChannel.Id)).Return(getCourseMappingJSON(courseChannel.Id), nil)
+				api.On("DeleteChannelMember", courseChannel.Id, testutils.GetID()).Return(testutils.GetInternalServerAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+			test.SetupAPI(api)
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+			p.botID = botID
+			config := p.getConfiguration().Clone()
+			config.UserDeletionPolicy = test.Policy
+			config.DeactivationGracePeriodDays = 7
+			p.setConfiguration(config)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodDelete, requestURL, nil)
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+			assert.Equal(t, test.ExpectedStatusCode, result.StatusCode)
+			if test.ExpectedStatusCode != http.StatusAccepted {
+				return
+			}
+
+			var pendingDeactivation *serializer.PendingDeactivation
+			require.NoError(t, json.NewDecoder(result.Body).Decode(&pendingDeactivation))
+			assert.Equal(t, testutils.GetID(), pendingDeactivation.UserID)
+			if test.ExpectedJobID != "" {
+				assert.Equal(t, test.ExpectedJobID, pendingDeactivation.JobID)
+				return
+			}
+
+			gracePeriod := int64(7 * 24 * time.Hour / time.Millisecond)
+			assert.InDelta(t, model.GetMillis()+gracePeriod, pendingDeactivation.DeactivateAt, float64(time.Minute/time.Millisecond))
+		})
+	}
+}
+
+func TestPendingDeactivation(t *testing.T) {
+	requestURL := fmt.Sprintf("/api/v1/users/%s/deactivation?secret=%s", testutils.GetID(), testutils.GetSecret())
+	pendingDeactivationKey := constants.KeyPrefixPendingDeactivation + testutils.GetID()
+	for name, test := range map[string]struct {
+		Method             string
+		SetupAPI           func(*plugintest.API) *plugintest.API
+		ExpectedStatusCode int
+	}{
+		"get pending deactivation": {
+			Method: http.MethodGet,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", pendingDeactivationKey).Return(getPendingDeactivationJSON(testutils.GetID(), model.NewId()), nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"get missing pending deactivation": {
+			Method: http.MethodGet,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", pendingDeactivationKey).Return(nil, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusNotFound,
+		},
+		"cancel pending deactivation": {
+			Method: http.MethodDelete,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", pendingDeactivationKey).Return(getPendingDeactivationJSON(testutils.GetID(), model.NewId()), nil)
+				api.On("KVDelete", pendingDeactivationKey).Return(nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"cancel missing pending deactivation": {
+			Method: http.MethodDelete,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", pendingDeactivationKey).Return(nil, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusNotFound,
+		},
+		"failed to get pending deactivation": {
+			Method: http.MethodDelete,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", pendingDeactivationKey).Return(nil, testutils.GetInternalServerAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+			test.SetupAPI(api)
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(test.Method, requestURL, nil)
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+			assert.Equal(t, test.ExpectedStatusCode, result.StatusCode)
+		})
+	}
+}
+
+func TestGetPendingDeactivations(t *testing.T) {
+	api := &plugintest.API{}
+	userID := model.NewId()
+	api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+	api.On("KVList", 0, constants.KVListPerPage).Return([]string{constants.KeyPrefixPendingDeactivation + userID, constants.KeyPrefixJob + model.NewId()}, nil)
+	api.On("KVGet", constants.KeyPrefixPendingDeactivation+userID).Return(getPendingDeactivationJSON(userID, model.NewId()), nil)
+	defer api.AssertExpectations(t)
+	p := setupTestPlugin(api)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/v1/deactivations?secret=%s", testutils.GetSecret()), nil)
+	p.ServeHTTP(nil, w, r)
+
+	result := w.Result()
+	require.NotNil(t, result)
+	defer result.Body.Close()
+	require.Equal(t, http.StatusOK, result.StatusCode)
+
+	var pendingDeactivations serializer.PendingDeactivations
+	require.NoError(t, json.NewDecoder(result.Body).Decode(&pendingDeactivations))
+	require.Len(t, pendingDeactivations, 1)
+	assert.Equal(t, userID, pendingDeactivations[0].UserID)
+}
+
+func TestProcessDeactivateUserJob(t *testing.T) {
+	job := &serializer.Job{
+		ID:     model.NewId(),
+		Type:   serializer.JobTypeDeactivateUser,
+		Params: map[string]string{serializer.JobParamUserID: testutils.GetID()},
+	}
+	pendingDeactivationKey := constants.KeyPrefixPendingDeactivation + testutils.GetID()
+	for name, test := range map[string]struct {
+		SetupAPI           func(*plugintest.API) *plugintest.API
+		ExpectedStatusCode int
+	}{
+		"user deactivated": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", pendingDeactivationKey).Return(getPendingDeactivationJSON(testutils.GetID(), job.ID), nil)
+				api.On("DeleteUser", testutils.GetID()).Return(nil)
+				api.On("KVDelete", pendingDeactivationKey).Return(nil)
+				api.On("LogInfo", testutils.GetMockArgumentsWithType("string", 3)...).Return()
+				return api
+			},
+		},
+		"deactivation cancelled": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", pendingDeactivationKey).Return(nil, nil)
+				return api
+			},
+		},
+		"deactivation replaced by a later one": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", pendingDeactivationKey).Return(getPendingDeactivationJSON(testutils.GetID(), model.NewId()), nil)
+				return api
+			},
+		},
+		"failed to deactivate user": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", pendingDeactivationKey).Return(getPendingDeactivationJSON(testutils.GetID(), job.ID), nil)
+				api.On("DeleteUser", testutils.GetID()).Return(testutils.GetInternalServerAppError())
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := test.SetupAPI(&plugintest.API{})
+			defer api.AssertExpectations(t)
+			p := &Plugin{}
+			p.SetAPI(api)
+
+			_, status, err := p.processDeactivateUserJob(job)
+			assert.Equal(t, test.ExpectedStatusCode, status)
+			if test.ExpectedStatusCode != 0 {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils"
+	"github.com/pkg/errors"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	deadlineTimeFormat = "Mon, Jan 2 at 15:04 MST"
+	// deadlinesStoreMaxAttempts is the number of times storing the deadlines of a channel is attempted when they change concurrently
+	deadlinesStoreMaxAttempts = 5
+)
+
+// channelDeadline is a deadline as stored in the KV store
+type channelDeadline struct {
+	serializer.Deadline
+	// ReminderID identifies the reminders scheduled for the current due date.
+	// Reminders scheduled with another ID were cancelled, as the deadline was rescheduled or deleted, and are not posted.
+	ReminderID string `json:"reminder_id"`
+}
+
+// errDeadlineNotFound is returned when deleting a deadline which the channel does not have
+var errDeadlineNotFound = errors.New("the channel has no such deadline")
+
+// parseReminderOffsets parses a comma separated list of durations such as "3d,24h".
+// Besides the units understood by time.ParseDuration, "d" can be used for days.
+func parseReminderOffsets(data string) ([]time.Duration, error) {
+	var offsets []time.Duration
+	for _, value := range strings.Split(data, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		offset, err := parseReminderOffset(value)
+		if err != nil || offset <= 0 {
+			return nil, errors.Errorf("reminder Offsets contains an invalid duration: %s", value)
+		}
+
+		offsets = append(offsets, offset)
+	}
+
+	return offsets, nil
+}
+
+func parseReminderOffset(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		return time.Duration(days) * 24 * time.Hour, err
+	}
+
+	return time.ParseDuration(value)
+}
+
+// getDeadlineKey returns the key of a deadline among the deadlines of its channel.
+// Moodle IDs are only unique for a type of item, so the key is made of the type and the ID.
+func getDeadlineKey(deadlineType, deadlineID string) string {
+	return deadlineType + "_" + deadlineID
+}
+
+// getChannelDeadlines returns the deadlines of the channel by key, along with the data they were read from
+func (p *Plugin) getChannelDeadlines(channelID string) (map[string]*channelDeadline, []byte, error) {
+	data, appErr := p.API.KVGet(constants.KeyPrefixDeadlines + channelID)
+	if appErr != nil {
+		return nil, nil, errors.Wrap(appErr, "failed to get deadlines from KV store")
+	}
+
+	deadlines := map[string]*channelDeadline{}
+	if data == nil {
+		return deadlines, nil, nil
+	}
+
+	if err := json.Unmarshal(data, &deadlines); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to unmarshal deadlines")
+	}
+
+	return deadlines, data, nil
+}
+
+// updateChannelDeadlines applies the update to the deadlines of the channel and stores them.
+// They are stored with a compare-and-set, and the update is applied again to the new deadlines if they changed in the meantime.
+func (p *Plugin) updateChannelDeadlines(channelID string, update func(deadlines map[string]*channelDeadline) error) error {
+	for attempt := 0; attempt < deadlinesStoreMaxAttempts; attempt++ {
+		deadlines, oldData, err := p.getChannelDeadlines(channelID)
+		if err != nil {
+			return err
+		}
+
+		if err = update(deadlines); err != nil {
+			return err
+		}
+
+		// Setting the key to nil deletes it
+		var data []byte
+		if len(deadlines) > 0 {
+			if data, err = json.Marshal(deadlines); err != nil {
+				return errors.Wrap(err, "failed to marshal deadlines")
+			}
+		}
+
+		stored, appErr := p.API.KVSetWithOptions(constants.KeyPrefixDeadlines+channelID, data, model.PluginKVSetOptions{
+			Atomic:   true,
+			OldValue: oldData,
+		})
+		if appErr != nil {
+			return errors.Wrap(appErr, "failed to store deadlines in KV store")
+		}
+
+		if stored {
+			return nil
+		}
+	}
+
+	return errors.New("the deadlines of the channel changed too many times while being stored")
+}
+
+// storeDeadline adds or updates a deadline of the channel. Its reminders are only rescheduled if its due date changed.
+// Deadlines which are over are removed from the channel at the same time.
+func (p *Plugin) storeDeadline(channelID string, deadline *serializer.Deadline) (*serializer.Deadline, error) {
+	key := getDeadlineKey(deadline.Type, deadline.ID)
+	var stored *channelDeadline
+	err := p.updateChannelDeadlines(channelID, func(deadlines map[string]*channelDeadline) error {
+		now := model.GetMillis()
+		for existingKey, existing := range deadlines {
+			if existing.DueAt <= now && existingKey != key {
+				delete(deadlines, existingKey)
+			}
+		}
+
+		// The reminders scheduled by a previous attempt are cancelled by the new reminder ID
+		stored = &channelDeadline{Deadline: *deadline}
+		if existing := deadlines[key]; existing != nil && existing.DueAt == deadline.DueAt {
+			stored.ReminderID = existing.ReminderID
+			stored.RemindAt = existing.RemindAt
+		} else if err := p.scheduleDeadlineReminders(channelID, stored); err != nil {
+			return err
+		}
+
+		deadlines[key] = stored
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &stored.Deadline, nil
+}
+
+// scheduleDeadlineReminders creates a job for every reminder offset which is not over yet.
+// The reminders previously scheduled for the deadline are cancelled, as they have another reminder ID.
+func (p *Plugin) scheduleDeadlineReminders(channelID string, deadline *channelDeadline) error {
+	deadline.ReminderID = model.NewId()
+	deadline.RemindAt = nil
+
+	dueAt := time.Unix(0, deadline.DueAt*int64(time.Millisecond))
+	for _, offset := range p.getConfiguration().reminderOffsets {
+		delay := time.Until(dueAt.Add(-offset))
+		if delay <= 0 {
+			continue
+		}
+
+		job, err := p.createDelayedJob(serializer.JobTypeSendDeadlineReminder, map[string]string{
+			serializer.JobParamChannelID:    channelID,
+			serializer.JobParamDeadlineType: deadline.Type,
+			serializer.JobParamDeadlineID:   deadline.ID,
+			serializer.JobParamReminderID:   deadline.ReminderID,
+		}, nil, delay)
+		if err != nil {
+			return errors.Wrap(err, "failed to create job")
+		}
+
+		deadline.RemindAt = append(deadline.RemindAt, job.NextAttemptAt)
+	}
+
+	sort.Slice(deadline.RemindAt, func(i, j int) bool { return deadline.RemindAt[i] < deadline.RemindAt[j] })
+	return nil
+}
+
+// deleteDeadline removes the deadline from the channel, which cancels its reminders.
+// If the type is empty, the deadlines of every type with the ID are removed.
+// It returns false if the channel has no such deadline.
+func (p *Plugin) deleteDeadline(channelID, deadlineType, deadlineID string) (bool, error) {
+	err := p.updateChannelDeadlines(channelID, func(deadlines map[string]*channelDeadline) error {
+		found := false
+		for key, deadline := range deadlines {
+			if deadline.ID == deadlineID && (deadlineType == "" || deadline.Type == deadlineType) {
+				delete(deadlines, key)
+				found = true
+			}
+		}
+
+		if !found {
+			return errDeadlineNotFound
+		}
+
+		return nil
+	})
+	if errors.Is(err, errDeadlineNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// processSendDeadlineReminderJob posts a reminder of a deadline in its channel.
+// Nothing is posted if the reminder was cancelled, if the deadline is already over or if the channel is archived.
+func (p *Plugin) processSendDeadlineReminderJob(job *serializer.Job) (interface{}, int, error) {
+	channelID := job.Params[serializer.JobParamChannelID]
+	deadlines, _, err := p.getChannelDeadlines(channelID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	deadline := deadlines[getDeadlineKey(job.Params[serializer.JobParamDeadlineType], job.Params[serializer.JobParamDeadlineID])]
+	if deadline == nil || deadline.ReminderID != job.Params[serializer.JobParamReminderID] {
+		return nil, 0, nil
+	}
+
+	now := time.Now()
+	dueAt := time.Unix(0, deadline.DueAt*int64(time.Millisecond))
+	if !dueAt.After(now) {
+		return nil, 0, nil
+	}
+
+	channel, appErr := p.API.GetChannel(channelID)
+	if appErr != nil && appErr.StatusCode == http.StatusNotFound {
+		return nil, 0, nil
+	}
+	if appErr != nil {
+		return nil, appErr.StatusCode, errors.Wrap(appErr, "failed to get channel")
+	}
+
+	if channel.DeleteAt != 0 {
+		return nil, 0, nil
+	}
+
+	if _, appErr = p.API.CreatePost(&model.Post{
+		ChannelId: channelID,
+		UserId:    p.botID,
+		Message:   getDeadlineReminderMessage(&deadline.Deadline, dueAt.Sub(now)),
+	}); appErr != nil {
+		return nil, appErr.StatusCode, errors.Wrap(appErr, "failed to post reminder")
+	}
+
+	return nil, 0, nil
+}
+
+func getDeadlineReminderMessage(deadline *serializer.Deadline, timeLeft time.Duration) string {
+	name := fmt.Sprintf("**%s**", utils.EscapeMarkdown(deadline.Name))
+	if deadlineURL, err := utils.EscapeURL(deadline.URL); err == nil {
+		name = fmt.Sprintf("[%s](%s)", name, deadlineURL)
+	}
+
+	item := deadline.Type
+	if deadline.Type == serializer.DeadlineTypeCalendar {
+		item = "event"
+	}
+
+	dueAt := time.Unix(0, deadline.DueAt*int64(time.Millisecond)).UTC()
+	return fmt.Sprintf("Reminder: the %s %s is due in %s, on %s.", item, name, formatTimeLeft(timeLeft), dueAt.Format(deadlineTimeFormat))
+}
+
+// formatTimeLeft rounds the duration to the nearest day, hour or minute, as the reminder job may not run right on time
+func formatTimeLeft(d time.Duration) string {
+	hours := int(math.Round(d.Hours()))
+	switch {
+	case hours >= 48:
+		return fmt.Sprintf("%d days", int(math.Round(float64(hours)/24)))
+	case hours >= 2:
+		return fmt.Sprintf("%d hours", hours)
+	case hours == 1:
+		return "1 hour"
+	}
+
+	minutes := int(math.Round(d.Minutes()))
+	if minutes <= 1 {
+		return "1 minute"
+	}
+
+	return fmt.Sprintf("%d minutes", minutes)
+}
+
+// getDeadlines returns the deadlines of a channel, ordered by due date
+func (p *Plugin) getDeadlines(w http.ResponseWriter, r *http.Request) {
+	channelID, status, resolveErr := p.resolveMattermostID(r, courseChannelMapping, "channel_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
+		return
+	}
+
+	deadlines, _, err := p.getChannelDeadlines(channelID)
+	if err != nil {
+		p.API.LogError(fmt.Sprintf("Failed to get deadlines. Error: %v", err.Error()))
+		p.writeError(w, r, http.StatusInternalServerError, errors.Wrap(err, "failed to get deadlines"))
+		return
+	}
+
+	list := serializer.Deadlines{}
+	for _, deadline := range deadlines {
+		list = append(list, &deadline.Deadline)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].DueAt != list[j].DueAt {
+			return list[i].DueAt < list[j].DueAt
+		}
+		if list[i].ID != list[j].ID {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].Type < list[j].Type
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(list.ToJSON()))
+}
+
+// putDeadline adds or reschedules a deadline of a channel
+func (p *Plugin) putDeadline(w http.ResponseWriter, r *http.Request) {
+	channelID, status, resolveErr := p.resolveMattermostID(r, courseChannelMapping, "channel_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
+		return
+	}
+
+	deadline := serializer.DeadlineFromJSON(r.Body)
+	if deadline != nil {
+		deadline.ID = mux.Vars(r)["deadline_id"]
+		deadline.RemindAt = nil
+	}
+
+	if err := deadline.Validate(); err != nil {
+		p.API.LogError(err.Error())
+		p.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	deadline, err := p.storeDeadline(channelID, deadline)
+	if err != nil {
+		p.API.LogError(fmt.Sprintf("Failed to store deadline. Error: %v", err.Error()))
+		p.writeError(w, r, http.StatusInternalServerError, errors.Wrap(err, "failed to store deadline"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(deadline.ToJSON()))
+}
+
+// removeDeadline deletes a deadline of a channel and cancels its reminders.
+// The "type" query parameter tells which deadline to delete when items of several types have the same ID.
+func (p *Plugin) removeDeadline(w http.ResponseWriter, r *http.Request) {
+	channelID, status, resolveErr := p.resolveMattermostID(r, courseChannelMapping, "channel_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
+		return
+	}
+
+	deleted, err := p.deleteDeadline(channelID, r.URL.Query().Get("type"), mux.Vars(r)["deadline_id"])
+	if err != nil {
+		p.API.LogError(fmt.Sprintf("Failed to delete deadline. Error: %v", err.Error()))
+		p.writeError(w, r, http.StatusInternalServerError, errors.Wrap(err, "failed to delete deadline"))
+		return
+	}
+
+	if !deleted {
+		p.writeError(w, r, http.StatusNotFound, serializer.NewError(serializer.ErrorCodeDeadlineNotFound, "the channel has no such deadline"))
+		return
+	}
+
+	returnStatusOK(w)
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils/testutils"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getChannelDeadlinesJSON(t *testing.T, deadlines ...*channelDeadline) []byte {
+	byKey := map[string]*channelDeadline{}
+	for _, deadline := range deadlines {
+		byKey[getDeadlineKey(deadline.Type, deadline.ID)] = deadline
+	}
+
+	data, err := json.Marshal(byKey)
+	require.NoError(t, err)
+	return data
+}
+
+func TestParseReminderOffsets(t *testing.T) {
+	offsets, err := parseReminderOffsets(" 3d, 24h,,90m ")
+	require.NoError(t, err)
+	assert.Equal(t, []time.Duration{72 * time.Hour, 24 * time.Hour, 90 * time.Minute}, offsets)
+
+	offsets, err = parseReminderOffsets("")
+	require.NoError(t, err)
+	assert.Empty(t, offsets)
+
+	for _, value := range []string{"3 days", "0h", "-1d", "d"} {
+		_, err = parseReminderOffsets(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestPutDeadline(t *testing.T) {
+	requestURL := fmt.Sprintf("/api/v1/channels/%s/deadlines/assign_12?secret=%s", testutils.GetID(), testutils.GetSecret())
+	deadlinesKey := constants.KeyPrefixDeadlines + testutils.GetID()
+	dueAt := model.GetMillis() + int64(5*24*time.Hour/time.Millisecond)
+	isJobKey := mock.MatchedBy(func(key string) bool { return strings.HasPrefix(key, constants.KeyPrefixJob) })
+	for name, test := range map[string]struct {
+		Body               string
+		SetupAPI           func(*plugintest.API) *plugintest.API
+		ExpectedStatusCode int
+		ExpectedReminders  int
+		ExpectedReminderID string
+		ExpectedDeadlines  int
+	}{
+		"new deadline": {
+			Body: fmt.Sprintf(`{"type": "assignment", "name": "Essay", "due_at": %d}`, dueAt),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", deadlinesKey).Return(nil, nil)
+				api.On("KVSet", isJobKey, mock.Anything).Return(nil).Twice()
+				api.On("KVSetWithOptions", deadlinesKey, mock.Anything, model.PluginKVSetOptions{Atomic: true}).Return(true, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedReminders:  2,
+		},
+		"deadlines changed while being stored": {
+			Body: fmt.Sprintf(`{"type": "assignment", "name": "Essay", "due_at": %d}`, dueAt),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				otherDeadlines := getChannelDeadlinesJSON(t, &channelDeadline{
+					Deadline: serializer.Deadline{ID: "quiz_3", Type: "quiz", Name: "Quiz", DueAt: dueAt},
+				})
+				api.On("KVGet", deadlinesKey).Return(nil, nil).Once()
+				api.On("KVSet", isJobKey, mock.Anything).Return(nil).Times(4)
+				api.On("KVSetWithOptions", deadlinesKey, mock.Anything, model.PluginKVSetOptions{Atomic: true}).Return(false, nil).Once()
+				api.On("KVGet", deadlinesKey).Return(otherDeadlines, nil).Once()
+				api.On("KVSetWithOptions", deadlinesKey, mock.Anything, model.PluginKVSetOptions{Atomic: true, OldValue: otherDeadlines}).Return(true, nil).Once()
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedReminders:  2,
+			ExpectedDeadlines:  2,
+		},
+		"quiz with the ID of an assignment": {
+			Body: fmt.Sprintf(`{"type": "quiz", "name": "Quiz", "due_at": %d}`, dueAt),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", deadlinesKey).Return(getChannelDeadlinesJSON(t, &channelDeadline{
+					Deadline:   serializer.Deadline{ID: "assign_12", Type: "assignment", Name: "Essay", DueAt: dueAt, RemindAt: []int64{1, 2}},
+					ReminderID: "existingreminderid",
+				}), nil)
+				api.On("KVSet", isJobKey, mock.Anything).Return(nil).Twice()
+				api.On("KVSetWithOptions", deadlinesKey, mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(true, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedReminders:  2,
+			ExpectedDeadlines:  2,
+		},
+		"deadline with the same due date": {
+			Body: fmt.Sprintf(`{"type": "assignment", "name": "Essay (final)", "due_at": %d}`, dueAt),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", deadlinesKey).Return(getChannelDeadlinesJSON(t, &channelDeadline{
+					Deadline:   serializer.Deadline{ID: "assign_12", Type: "assignment", Name: "Essay", DueAt: dueAt, RemindAt: []int64{1, 2}},
+					ReminderID: "existingreminderid",
+				}), nil)
+				api.On("KVSetWithOptions", deadlinesKey, mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(true, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedReminders:  2,
+			ExpectedReminderID: "existingreminderid",
+		},
+		"rescheduled deadline": {
+			Body: fmt.Sprintf(`{"type": "assignment", "name": "Essay", "due_at": %d}`, dueAt),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", deadlinesKey).Return(getChannelDeadlinesJSON(t, &channelDeadline{
+					Deadline:   serializer.Deadline{ID: "assign_12", Type: "assignment", Name: "Essay", DueAt: dueAt - 1000},
+					ReminderID: "existingreminderid",
+				}), nil)
+				api.On("KVSet", isJobKey, mock.Anything).Return(nil).Twice()
+				api.On("KVSetWithOptions", deadlinesKey, mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(true, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedReminders:  2,
+		},
+		"deadline too close for the first reminder": {
+			Body: fmt.Sprintf(`{"type": "quiz", "name": "Quiz 1", "due_at": %d}`, model.GetMillis()+int64(48*time.Hour/time.Millisecond)),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", deadlinesKey).Return(nil, nil)
+				api.On("KVSet", isJobKey, mock.Anything).Return(nil).Once()
+				api.On("KVSetWithOptions", deadlinesKey, mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(true, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedReminders:  1,
+		},
+		"invalid type": {
+			Body: fmt.Sprintf(`{"type": "forum", "name": "Essay", "due_at": %d}`, dueAt),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+		"invalid URL": {
+			Body: fmt.Sprintf(`{"type": "assignment", "name": "Essay", "url": "javascript:alert(1)", "due_at": %d}`, dueAt),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+		"failed to store deadline": {
+			Body: fmt.Sprintf(`{"type": "assignment", "name": "Essay", "due_at": %d}`, dueAt),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", deadlinesKey).Return(nil, nil)
+				api.On("KVSet", isJobKey, mock.Anything).Return(nil).Twice()
+				api.On("KVSetWithOptions", deadlinesKey, mock.Anything, model.PluginKVSetOptions{Atomic: true}).Return(false, testutils.GetInternalServerAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+			test.SetupAPI(api)
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+			config := p.getConfiguration().Clone()
+			config.reminderOffsets = []time.Duration{72 * time.Hour, 24 * time.Hour}
+			p.setConfiguration(config)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, requestURL, strings.NewReader(test.Body))
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+			assert.Equal(t, test.ExpectedStatusCode, result.StatusCode)
+			if test.ExpectedStatusCode != http.StatusOK {
+				return
+			}
+
+			var deadline *serializer.Deadline
+			require.NoError(t, json.NewDecoder(result.Body).Decode(&deadline))
+			assert.Equal(t, "assign_12", deadline.ID)
+			assert.Len(t, deadline.RemindAt, test.ExpectedReminders)
+
+			stored := map[string]*channelDeadline{}
+			for _, call := range api.Calls {
+				if call.Method == "KVSetWithOptions" && call.Arguments.Get(0) == deadlinesKey {
+					require.NoError(t, json.Unmarshal(call.Arguments.Get(1).([]byte), &stored))
+				}
+			}
+			expectedDeadlines := test.ExpectedDeadlines
+			if expectedDeadlines == 0 {
+				expectedDeadlines = 1
+			}
+			assert.Len(t, stored, expectedDeadlines)
+
+			key := getDeadlineKey(deadline.Type, deadline.ID)
+			require.NotNil(t, stored[key])
+			if test.ExpectedReminderID != "" {
+				assert.Equal(t, test.ExpectedReminderID, stored[key].ReminderID)
+			} else {
+				assert.True(t, model.IsValidId(stored[key].ReminderID))
+			}
+		})
+	}
+}
+
+func TestRemoveDeadline(t *testing.T) {
+	requestURL := fmt.Sprintf("/api/v1/channels/%s/deadlines/assign_12?secret=%s", testutils.GetID(), testutils.GetSecret())
+	deadlinesKey := constants.KeyPrefixDeadlines + testutils.GetID()
+	deadline := &channelDeadline{Deadline: serializer.Deadline{ID: "assign_12", Type: "assignment", Name: "Essay", DueAt: model.GetMillis()}}
+	otherDeadline := &channelDeadline{Deadline: serializer.Deadline{ID: "quiz_3", Type: "quiz", Name: "Quiz", DueAt: model.GetMillis()}}
+	quizWithSameID := &channelDeadline{Deadline: serializer.Deadline{ID: "assign_12", Type: "quiz", Name: "Quiz", DueAt: model.GetMillis()}}
+	for name, test := range map[string]struct {
+		Query              string
+		SetupAPI           func(*plugintest.API) *plugintest.API
+		ExpectedStatusCode int
+	}{
+		"delete the last deadline": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				data := getChannelDeadlinesJSON(t, deadline)
+				api.On("KVGet", deadlinesKey).Return(data, nil)
+				api.On("KVSetWithOptions", deadlinesKey, []byte(nil), model.PluginKVSetOptions{Atomic: true, OldValue: data}).Return(true, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"delete one of the deadlines": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				data := getChannelDeadlinesJSON(t, deadline, otherDeadline)
+				api.On("KVGet", deadlinesKey).Return(data, nil)
+				api.On("KVSetWithOptions", deadlinesKey, getChannelDeadlinesJSON(t, otherDeadline), model.PluginKVSetOptions{Atomic: true, OldValue: data}).Return(true, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"delete the deadline of a type": {
+			Query: "&type=quiz",
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				data := getChannelDeadlinesJSON(t, deadline, quizWithSameID)
+				api.On("KVGet", deadlinesKey).Return(data, nil)
+				api.On("KVSetWithOptions", deadlinesKey, getChannelDeadlinesJSON(t, deadline), model.PluginKVSetOptions{Atomic: true, OldValue: data}).Return(true, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"deadline not found": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", deadlinesKey).Return(getChannelDeadlinesJSON(t, otherDeadline), nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusNotFound,
+		},
+		"deadline of the type not found": {
+			Query: "&type=quiz",
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", deadlinesKey).Return(getChannelDeadlinesJSON(t, deadline), nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusNotFound,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+			test.SetupAPI(api)
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodDelete, requestURL+test.Query, nil)
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+			assert.Equal(t, test.ExpectedStatusCode, result.StatusCode)
+		})
+	}
+}
+
+func TestProcessSendDeadlineReminderJob(t *testing.T) {
+	channelID := testutils.GetID()
+	deadlinesKey := constants.KeyPrefixDeadlines + channelID
+	reminderID := model.NewId()
+	upcoming := &channelDeadline{
+		Deadline:   serializer.Deadline{ID: "assign_12", Type: "assignment", Name: "Essay", DueAt: model.GetMillis() + int64(24*time.Hour/time.Millisecond)},
+		ReminderID: reminderID,
+	}
+	over := &channelDeadline{
+		Deadline:   serializer.Deadline{ID: "assign_12", Type: "assignment", Name: "Essay", DueAt: model.GetMillis() - 1000},
+		ReminderID: reminderID,
+	}
+	for name, test := range map[string]struct {
+		SetupAPI       func(*plugintest.API) *plugintest.API
+		ExpectedStatus int
+		ExpectedError  bool
+	}{
+		"post reminder": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", deadlinesKey).Return(getChannelDeadlinesJSON(t, upcoming), nil)
+				api.On("GetChannel", channelID).Return(&model.Channel{Id: channelID}, nil)
+				api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+					return post.ChannelId == channelID && strings.HasPrefix(post.Message, "Reminder: the assignment **Essay** is due in 24 hours")
+				})).Return(nil, nil)
+				return api
+			},
+		},
+		"deadline deleted": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", deadlinesKey).Return(nil, nil)
+				return api
+			},
+		},
+		"deadline rescheduled": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				rescheduled := *upcoming
+				rescheduled.ReminderID = model.NewId()
+				api.On("KVGet", deadlinesKey).Return(getChannelDeadlinesJSON(t, &rescheduled), nil)
+				return api
+			},
+		},
+		"deadline over": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", deadlinesKey).Return(getChannelDeadlinesJSON(t, over), nil)
+				return api
+			},
+		},
+		"channel archived": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", deadlinesKey).Return(getChannelDeadlinesJSON(t, upcoming), nil)
+				api.On("GetChannel", channelID).Return(&model.Channel{Id: channelID, DeleteAt: model.GetMillis()}, nil)
+				return api
+			},
+		},
+		"failed to post reminder": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", deadlinesKey).Return(getChannelDeadlinesJSON(t, upcoming), nil)
+				api.On("GetChannel", channelID).Return(&model.Channel{Id: channelID}, nil)
+				api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(nil, testutils.GetInternalServerAppError())
+				return api
+			},
+			ExpectedStatus: http.StatusInternalServerError,
+			ExpectedError:  true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			test.SetupAPI(api)
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			_, status, err := p.processSendDeadlineReminderJob(&serializer.Job{
+				ID:   model.NewId(),
+				Type: serializer.JobTypeSendDeadlineReminder,
+				Params: map[string]string{
+					serializer.JobParamChannelID:    channelID,
+					serializer.JobParamDeadlineType: serializer.DeadlineTypeAssignment,
+					serializer.JobParamDeadlineID:   "assign_12",
+					serializer.JobParamReminderID:   reminderID,
+				},
+			})
+			assert.Equal(t, test.ExpectedStatus, status)
+			assert.Equal(t, test.ExpectedError, err != nil)
+		})
+	}
+}
+
+func TestGetDeadlineReminderMessage(t *testing.T) {
+	dueAt := time.Date(2020, time.September, 14, 12, 0, 0, 0, time.UTC)
+	deadline := &serializer.Deadline{
+		Type:  serializer.DeadlineTypeCalendar,
+		Name:  "Field trip",
+		URL:   "https://moodle.example.com/calendar/view.php?id=3",
+		DueAt: dueAt.UnixNano() / int64(time.Millisecond),
+	}
+
+	assert.Equal(t, "Reminder: the event [**Field trip**](https://moodle.example.com/calendar/view.php?id=3) is due in 3 days, on Mon, Sep 14 at 12:00 UTC.", getDeadlineReminderMessage(deadline, 71*time.Hour+50*time.Minute))
+
+	deadline.Name = "Quiz *1* [draft]"
+	deadline.URL = ""
+	assert.Equal(t, `Reminder: the event **Quiz \*1\* \[draft\]** is due in 3 days, on Mon, Sep 14 at 12:00 UTC.`, getDeadlineReminderMessage(deadline, 72*time.Hour))
+	assert.Equal(t, "5 hours", formatTimeLeft(5*time.Hour))
+	assert.Equal(t, "1 hour", formatTimeLeft(65*time.Minute))
+	assert.Equal(t, "20 minutes", formatTimeLeft(20*time.Minute))
+}
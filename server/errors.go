@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// mattermostErrorCodes maps the IDs of the Mattermost errors which the clients are expected to handle to error codes
+var mattermostErrorCodes = map[string]string{
+	"app.team.get.find.app_error":                              serializer.ErrorCodeTeamNotFound,
+	"app.team.get_by_name.missing.app_error":                   serializer.ErrorCodeTeamNotFound,
+	"app.team.get_member.missing.app_error":                    serializer.ErrorCodeTeamMemberNotFound,
+	"app.channel.get.find.app_error":                           serializer.ErrorCodeChannelNotFound,
+	"app.channel.get_by_name.missing.app_error":                serializer.ErrorCodeChannelNotFound,
+	"app.channel.get_member.missing.app_error":                 serializer.ErrorCodeChannelMemberNotFound,
+	"app.channel.save_member.exists.app_error":                 serializer.ErrorCodeChannelMemberExists,
+	"api.channel.add_user.to.channel.failed.deleted.app_error": serializer.ErrorCodeChannelArchived,
+	"api.channel.delete_channel.deleted.app_error":             serializer.ErrorCodeChannelArchived,
+	"api.channel.restore_channel.restored.app_error":           serializer.ErrorCodeChannelNotArchived,
+	"app.user.missing_account.const":                           serializer.ErrorCodeUserNotFound,
+	"app.user.save.username_exists.app_error":                  serializer.ErrorCodeUsernameExists,
+	"app.user.save.email_exists.app_error":                     serializer.ErrorCodeEmailExists,
+}
+
+// writeError writes the error as a JSON response along with the ID of the request and the ID of the Mattermost error it wraps, if any.
+func (p *Plugin) writeError(w http.ResponseWriter, r *http.Request, statusCode int, err error) {
+	errorResponse := serializer.NewError(getErrorCode(statusCode, err), err.Error())
+	errorResponse.RequestID = r.Header.Get(constants.HeaderRequestID)
+
+	var appErr *model.AppError
+	if errors.As(err, &appErr) {
+		errorResponse.MattermostErrorID = appErr.Id
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if errorResponse.RequestID != "" {
+		w.Header().Set(constants.HeaderRequestID, errorResponse.RequestID)
+	}
+	w.WriteHeader(statusCode)
+	_, _ = w.Write([]byte(errorResponse.ToJSON()))
+}
+
+// getErrorCode returns the code of the first serializer.Error or known Mattermost error wrapped by err.
+// If there is none, a generic code is derived from the status code.
+func getErrorCode(statusCode int, err error) string {
+	var codedErr *serializer.Error
+	if errors.As(err, &codedErr) {
+		return codedErr.Code
+	}
+
+	var appErr *model.AppError
+	if errors.As(err, &appErr) {
+		if code, ok := mattermostErrorCodes[appErr.Id]; ok {
+			return code
+		}
+	}
+
+	switch {
+	case statusCode == http.StatusForbidden || statusCode == http.StatusUnauthorized:
+		return serializer.ErrorCodeForbidden
+	case statusCode == http.StatusNotFound:
+		return serializer.ErrorCodeNotFound
+	case statusCode == http.StatusConflict:
+		return serializer.ErrorCodeConflict
+	case statusCode == http.StatusUnprocessableEntity:
+		return serializer.ErrorCodeUnprocessableEntity
+	case statusCode >= http.StatusInternalServerError:
+		return serializer.ErrorCodeInternalError
+	default:
+		return serializer.ErrorCodeBadRequest
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils/testutils"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetErrorCode(t *testing.T) {
+	for name, test := range map[string]struct {
+		StatusCode   int
+		Err          error
+		ExpectedCode string
+	}{
+		"coded error": {
+			StatusCode:   http.StatusBadRequest,
+			Err:          serializer.NewError(serializer.ErrorCodeInvalidUserID, "user id is not valid"),
+			ExpectedCode: serializer.ErrorCodeInvalidUserID,
+		},
+		"wrapped coded error": {
+			StatusCode:   http.StatusNotFound,
+			Err:          errors.Wrap(serializer.NewError(serializer.ErrorCodeMappingNotFound, "no mapping found"), "failed to get team"),
+			ExpectedCode: serializer.ErrorCodeMappingNotFound,
+		},
+		"known mattermost error": {
+			StatusCode:   http.StatusBadRequest,
+			Err:          errors.Wrap(model.NewAppError("AddUserToChannel", "api.channel.add_user.to.channel.failed.deleted.app_error", nil, "", http.StatusBadRequest), "failed to add user to channel"),
+			ExpectedCode: serializer.ErrorCodeChannelArchived,
+		},
+		"unknown mattermost error": {
+			StatusCode:   http.StatusInternalServerError,
+			Err:          testutils.GetInternalServerAppError(),
+			ExpectedCode: serializer.ErrorCodeInternalError,
+		},
+		"plain error": {
+			StatusCode:   http.StatusConflict,
+			Err:          errors.New("conflict"),
+			ExpectedCode: serializer.ErrorCodeConflict,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.ExpectedCode, getErrorCode(test.StatusCode, test.Err))
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	p := &Plugin{}
+	appErr := model.NewAppError("GetTeamByName", "app.team.get_by_name.missing.app_error", nil, "", http.StatusNotFound)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Request-Id", testutils.GetID())
+	p.writeError(w, r, appErr.StatusCode, errors.Wrap(appErr, "failed to get team"))
+
+	result := w.Result()
+	defer result.Body.Close()
+	assert.Equal(t, http.StatusNotFound, result.StatusCode)
+	assert.Equal(t, "application/json", result.Header.Get("Content-Type"))
+	assert.Equal(t, testutils.GetID(), result.Header.Get("X-Request-Id"))
+
+	var errorResponse serializer.Error
+	require.NoError(t, json.NewDecoder(result.Body).Decode(&errorResponse))
+	assert.Equal(t, serializer.ErrorCodeTeamNotFound, errorResponse.Code)
+	assert.Equal(t, "failed to get team: "+appErr.Error(), errorResponse.Message)
+	assert.Equal(t, appErr.Id, errorResponse.MattermostErrorID)
+	assert.Equal(t, testutils.GetID(), errorResponse.RequestID)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	exportFormatJSON   = "json"
+	exportFormatNDJSON = "ndjson"
+)
+
+// ExportChannelMembers exports the active members of a channel, including bots, ordered by user ID.
+// In the "json" format, a page of members is returned along with the cursor of the next page and the total count of members.
+// In the "ndjson" format, all the members from the cursor onwards are streamed one per line and the total count is sent in the "X-Total-Count" header.
+func (p *Plugin) ExportChannelMembers(w http.ResponseWriter, r *http.Request) {
+	channelID, status, resolveErr := p.resolveMattermostID(r, courseChannelMapping, "channel_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = exportFormatJSON
+	}
+
+	if format != exportFormatJSON && format != exportFormatNDJSON {
+		p.API.LogError(fmt.Sprintf("Invalid export format: %s", format))
+		p.writeError(w, r, http.StatusBadRequest, serializer.NewError(serializer.ErrorCodeInvalidFormat, fmt.Sprintf("format must be either %q or %q", exportFormatJSON, exportFormatNDJSON)))
+		return
+	}
+
+	cursor := &serializer.ChannelMembersCursor{}
+	if query.Get("cursor") != "" {
+		var cursorErr error
+		if cursor, cursorErr = serializer.ChannelMembersCursorFromString(query.Get("cursor")); cursorErr != nil {
+			p.API.LogError(cursorErr.Error())
+			p.writeError(w, r, http.StatusBadRequest, cursorErr)
+			return
+		}
+	} else {
+		_, cursor.PerPage = utils.GetPageAndPerPage(r)
+	}
+
+	switch {
+	case cursor.PerPage == 0:
+		cursor.PerPage = utils.PerPageDefault
+	case cursor.PerPage > utils.PerPageMaximum:
+		cursor.PerPage = utils.PerPageMaximum
+	}
+
+	stats, err := p.API.GetChannelStats(channelID)
+	if err != nil {
+		p.API.LogError(fmt.Sprintf("Failed to get channel stats. Error: %v", err.Error()))
+		p.writeError(w, r, err.StatusCode, errors.Wrap(err, "failed to get channel stats"))
+		return
+	}
+
+	if format == exportFormatNDJSON {
+		p.streamChannelMembers(w, r, channelID, cursor, stats.MemberCount)
+		return
+	}
+
+	users, err := p.getChannelUsersSortedByID(channelID)
+	if err != nil {
+		p.API.LogError(fmt.Sprintf("Failed to fetch channel members. Error: %v", err.Error()))
+		p.writeError(w, r, err.StatusCode, errors.Wrap(err, "failed to fetch channel members"))
+		return
+	}
+
+	members, nextCursor, err := p.getChannelMembersExportPage(channelID, users, cursor)
+	if err != nil {
+		p.API.LogError(fmt.Sprintf("Failed to fetch channel members. Error: %v", err.Error()))
+		p.writeError(w, r, err.StatusCode, errors.Wrap(err, "failed to fetch channel members"))
+		return
+	}
+
+	export := serializer.ChannelMembersExport{
+		Members:    members,
+		TotalCount: stats.MemberCount,
+	}
+	if nextCursor != nil {
+		export.NextCursor = nextCursor.ToString()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(export.ToJSON()))
+}
+
+// streamChannelMembers writes the channel members as newline delimited JSON, page by page, until the last page is written.
+// As the status code is already sent once the streaming starts, a failure is reported as a final line with an "error" field.
+func (p *Plugin) streamChannelMembers(w http.ResponseWriter, r *http.Request, channelID string, cursor *serializer.ChannelMembersCursor, totalCount int64) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set(constants.HeaderTotalCount, strconv.FormatInt(totalCount, 10))
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	writeError := func(err *model.AppError) {
+		p.API.LogError(fmt.Sprintf("Failed to fetch channel members. Error: %v", err.Error()))
+		errorResponse := serializer.NewError(getErrorCode(err.StatusCode, err), errors.Wrap(err, "failed to fetch channel members").Error())
+		errorResponse.MattermostErrorID = err.Id
+		errorResponse.RequestID = r.Header.Get(constants.HeaderRequestID)
+		_ = encoder.Encode(map[string]*serializer.Error{"error": errorResponse})
+	}
+
+	users, err := p.getChannelUsersSortedByID(channelID)
+	if err != nil {
+		writeError(err)
+		return
+	}
+
+	for {
+		members, nextCursor, err := p.getChannelMembersExportPage(channelID, users, cursor)
+		if err != nil {
+			writeError(err)
+			return
+		}
+
+		for _, member := range members {
+			if encodeErr := encoder.Encode(member); encodeErr != nil {
+				p.API.LogError(fmt.Sprintf("Failed to write channel member. Error: %v", encodeErr.Error()))
+				return
+			}
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if nextCursor == nil {
+			return
+		}
+
+		cursor = nextCursor
+	}
+}
+
+// getChannelUsersSortedByID fetches all the users in a channel, ordered by user ID.
+// The server orders users by username with the collation of its database, which does not match the byte order of Go strings,
+// so the users are sorted by the plugin instead, on a key which does not change.
+func (p *Plugin) getChannelUsersSortedByID(channelID string) ([]*model.User, *model.AppError) {
+	users := []*model.User{}
+	userIDs := map[string]bool{}
+	for page := 0; ; page++ {
+		pageUsers, err := p.API.GetUsersInChannel(channelID, model.CHANNEL_SORT_BY_USERNAME, page, utils.PerPageMaximum)
+		if err != nil {
+			return nil, err
+		}
+
+		// Members added during the fetch can move a user to the next page
+		for _, user := range pageUsers {
+			if !userIDs[user.Id] {
+				userIDs[user.Id] = true
+				users = append(users, user)
+			}
+		}
+
+		if len(pageUsers) < utils.PerPageMaximum {
+			break
+		}
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Id < users[j].Id
+	})
+
+	return users, nil
+}
+
+// getChannelMembersExportPage returns the page of channel members which comes after the cursor, along with the cursor of the next page.
+// The users must be sorted by ID. The cursor points to the last exported user rather than to a position, so that members added
+// or removed between two pages do not make the export skip or repeat other members. Deactivated users are left out,
+// so that the number of exported members matches the member count of the channel. The cursor of the next page is nil when there are no more pages.
+func (p *Plugin) getChannelMembersExportPage(channelID string, users []*model.User, cursor *serializer.ChannelMembersCursor) (serializer.ChannelMembersWithUserInfo, *serializer.ChannelMembersCursor, *model.AppError) {
+	start := sort.Search(len(users), func(i int) bool {
+		return cursor.IsAfter(users[i].Id)
+	})
+	end := start + cursor.PerPage
+	if end > len(users) {
+		end = len(users)
+	}
+	usersAfterCursor := users[start:end]
+
+	channelMembersByUserID, err := p.getChannelMembersByUserID(channelID, usersAfterCursor)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	members := serializer.ChannelMembersWithUserInfo{}
+	for _, user := range usersAfterCursor {
+		if user.DeleteAt != 0 {
+			continue
+		}
+
+		channelMember, ok := channelMembersByUserID[user.Id]
+		if !ok {
+			continue
+		}
+
+		member := newChannelMemberWithUserInfo(user, &channelMember, true)
+		member.IsBot = user.IsBot
+		members = append(members, member)
+	}
+
+	if end == len(users) {
+		return members, nil, nil
+	}
+
+	return members, &serializer.ChannelMembersCursor{
+		LastUserID: usersAfterCursor[len(usersAfterCursor)-1].Id,
+		PerPage:    cursor.PerPage,
+	}, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils/testutils"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// getUsersWithChannelMembers returns users named "user<n>", from "user<start>" onwards, along with their channel memberships.
+// Their IDs are in the same order as their usernames.
+func getUsersWithChannelMembers(start, count int) ([]*model.User, *model.ChannelMembers) {
+	users := make([]*model.User, 0, count)
+	channelMembers := make(model.ChannelMembers, 0, count)
+	for i := start; i < start+count; i++ {
+		user := testutils.GetModelUser()
+		user.Id = fmt.Sprintf("userid%020d", i)
+		user.Username = fmt.Sprintf("user%d", i)
+		users = append(users, user)
+		channelMembers = append(channelMembers, model.ChannelMember{ChannelId: testutils.GetID(), UserId: user.Id})
+	}
+
+	return users, &channelMembers
+}
+
+func TestExportChannelMembers(t *testing.T) {
+	requestMethod := http.MethodGet
+	users, channelMembers := getUsersWithChannelMembers(0, 3)
+	addedUser := testutils.GetModelUser()
+	addedUser.Id = "aaaaaaaaaaaaaaaaaaaaaaaaaa"
+	nextCursor := (&serializer.ChannelMembersCursor{LastUserID: users[1].Id, PerPage: 2}).ToString()
+	for name, test := range map[string]struct {
+		RequestURL          string
+		SetupAPI            func(*plugintest.API) *plugintest.API
+		ExpectedStatusCode  int
+		ExpectedContentType string
+		ExpectedMembers     int
+		ExpectedNextCursor  string
+	}{
+		"success with next cursor": {
+			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members/export?per_page=2&secret=%s", testutils.GetID(), testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannelStats", testutils.GetID()).Return(&model.ChannelStats{ChannelId: testutils.GetID(), MemberCount: 3}, nil)
+				api.On("GetUsersInChannel", testutils.GetID(), model.CHANNEL_SORT_BY_USERNAME, 0, 200).Return(users, nil)
+				api.On("GetChannelMembersByIds", testutils.GetID(), []string{users[0].Id, users[1].Id}).Return(channelMembers, nil)
+				return api
+			},
+			ExpectedStatusCode:  http.StatusOK,
+			ExpectedContentType: "application/json",
+			ExpectedMembers:     2,
+			ExpectedNextCursor:  nextCursor,
+		},
+		"success on last page": {
+			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members/export?cursor=%s&secret=%s", testutils.GetID(), nextCursor, testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannelStats", testutils.GetID()).Return(&model.ChannelStats{ChannelId: testutils.GetID(), MemberCount: 3}, nil)
+				api.On("GetUsersInChannel", testutils.GetID(), model.CHANNEL_SORT_BY_USERNAME, 0, 200).Return(users, nil)
+				api.On("GetChannelMembersByIds", testutils.GetID(), []string{users[2].Id}).Return(channelMembers, nil)
+				return api
+			},
+			ExpectedStatusCode:  http.StatusOK,
+			ExpectedContentType: "application/json",
+			ExpectedMembers:     1,
+		},
+		"member removed before the cursor": {
+			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members/export?cursor=%s&secret=%s", testutils.GetID(), nextCursor, testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannelStats", testutils.GetID()).Return(&model.ChannelStats{ChannelId: testutils.GetID(), MemberCount: 3}, nil)
+				api.On("GetUsersInChannel", testutils.GetID(), model.CHANNEL_SORT_BY_USERNAME, 0, 200).Return([]*model.User{users[0], users[2]}, nil)
+				api.On("GetChannelMembersByIds", testutils.GetID(), []string{users[2].Id}).Return(channelMembers, nil)
+				return api
+			},
+			ExpectedStatusCode:  http.StatusOK,
+			ExpectedContentType: "application/json",
+			ExpectedMembers:     1,
+		},
+		"member added before the cursor": {
+			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members/export?cursor=%s&secret=%s", testutils.GetID(), nextCursor, testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannelStats", testutils.GetID()).Return(&model.ChannelStats{ChannelId: testutils.GetID(), MemberCount: 3}, nil)
+				api.On("GetUsersInChannel", testutils.GetID(), model.CHANNEL_SORT_BY_USERNAME, 0, 200).Return(append([]*model.User{addedUser}, users...), nil)
+				api.On("GetChannelMembersByIds", testutils.GetID(), []string{users[2].Id}).Return(channelMembers, nil)
+				return api
+			},
+			ExpectedStatusCode:  http.StatusOK,
+			ExpectedContentType: "application/json",
+			ExpectedMembers:     1,
+		},
+		"success with ndjson": {
+			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members/export?format=ndjson&per_page=2&secret=%s", testutils.GetID(), testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannelStats", testutils.GetID()).Return(&model.ChannelStats{ChannelId: testutils.GetID(), MemberCount: 3}, nil)
+				api.On("GetUsersInChannel", testutils.GetID(), model.CHANNEL_SORT_BY_USERNAME, 0, 200).Return(users, nil)
+				api.On("GetChannelMembersByIds", testutils.GetID(), []string{users[0].Id, users[1].Id}).Return(channelMembers, nil)
+				api.On("GetChannelMembersByIds", testutils.GetID(), []string{users[2].Id}).Return(channelMembers, nil)
+				return api
+			},
+			ExpectedStatusCode:  http.StatusOK,
+			ExpectedContentType: "application/x-ndjson",
+			ExpectedMembers:     3,
+		},
+		"invalid format": {
+			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members/export?format=csv&secret=%s", testutils.GetID(), testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode:  http.StatusBadRequest,
+			ExpectedContentType: "application/json",
+		},
+		"invalid cursor": {
+			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members/export?cursor=abc&secret=%s", testutils.GetID(), testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode:  http.StatusBadRequest,
+			ExpectedContentType: "application/json",
+		},
+		"failed to get channel stats": {
+			RequestURL: fmt.Sprintf("/api/v1/channels/%s/members/export?secret=%s", testutils.GetID(), testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannelStats", testutils.GetID()).Return(nil, testutils.GetInternalServerAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode:  http.StatusInternalServerError,
+			ExpectedContentType: "application/json",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			api := test.SetupAPI(&plugintest.API{})
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(requestMethod, test.RequestURL, nil)
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+
+			assert.Equal(test.ExpectedStatusCode, result.StatusCode)
+			assert.Equal(test.ExpectedContentType, result.Header.Get("Content-Type"))
+			if test.ExpectedStatusCode != http.StatusOK {
+				return
+			}
+
+			if test.ExpectedContentType == "application/x-ndjson" {
+				assert.Equal("3", result.Header.Get("X-Total-Count"))
+				lines := 0
+				scanner := bufio.NewScanner(result.Body)
+				for scanner.Scan() {
+					var member serializer.ChannelMemberWithUserInfo
+					require.NoError(t, json.Unmarshal(scanner.Bytes(), &member))
+					assert.NotEmpty(member.UserID)
+					lines++
+				}
+				assert.Equal(test.ExpectedMembers, lines)
+				return
+			}
+
+			var export serializer.ChannelMembersExport
+			require.NoError(t, json.NewDecoder(result.Body).Decode(&export))
+			assert.Len(export.Members, test.ExpectedMembers)
+			assert.Equal(test.ExpectedNextCursor, export.NextCursor)
+			assert.Equal(int64(3), export.TotalCount)
+		})
+	}
+}
+
+func TestExportChannelMembersAcrossPages(t *testing.T) {
+	// The server orders usernames with the collation of its database, which ignores case and punctuation
+	users, channelMembers := getUsersWithChannelMembers(0, 5)
+	for i, username := range []string{"a.b", "A_c", "a-d", "alice", "Bob"} {
+		users[i].Username = username
+	}
+	users[0].Id, users[3].Id = users[3].Id, users[0].Id
+	users[1].Id, users[4].Id = users[4].Id, users[1].Id
+	for i := range *channelMembers {
+		(*channelMembers)[i].UserId = users[i].Id
+	}
+
+	api := &plugintest.API{}
+	defer api.AssertExpectations(t)
+	api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+	api.On("GetChannelStats", testutils.GetID()).Return(&model.ChannelStats{ChannelId: testutils.GetID(), MemberCount: 5}, nil)
+	api.On("GetUsersInChannel", testutils.GetID(), model.CHANNEL_SORT_BY_USERNAME, 0, 200).Return(users, nil)
+	api.On("GetChannelMembersByIds", testutils.GetID(), mock.AnythingOfType("[]string")).Return(channelMembers, nil)
+	p := setupTestPlugin(api)
+
+	exportedUsernames := []string{}
+	cursor := ""
+	for pages := 0; pages < len(users); pages++ {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/v1/channels/%s/members/export?per_page=2&cursor=%s&secret=%s", testutils.GetID(), cursor, testutils.GetSecret()), nil)
+		p.ServeHTTP(nil, w, r)
+
+		result := w.Result()
+		require.NotNil(t, result)
+		require.Equal(t, http.StatusOK, result.StatusCode)
+
+		var export serializer.ChannelMembersExport
+		require.NoError(t, json.NewDecoder(result.Body).Decode(&export))
+		result.Body.Close()
+		for _, member := range export.Members {
+			exportedUsernames = append(exportedUsernames, member.Username)
+		}
+
+		if cursor = export.NextCursor; cursor == "" {
+			break
+		}
+	}
+
+	assert.Empty(t, cursor)
+	assert.ElementsMatch(t, []string{"a.b", "A_c", "a-d", "alice", "Bob"}, exportedUsernames)
+	assert.Len(t, exportedUsernames, 5)
+}
+
+func TestGetChannelMembersExportPage(t *testing.T) {
+	users, channelMembers := getUsersWithChannelMembers(0, 4)
+	users[1].DeleteAt = model.GetMillis()
+	users[2].IsBot = true
+
+	api := &plugintest.API{}
+	defer api.AssertExpectations(t)
+	api.On("GetChannelMembersByIds", testutils.GetID(), []string{users[0].Id, users[1].Id, users[2].Id}).Return(channelMembers, nil)
+	p := setupTestPlugin(api)
+
+	members, nextCursor, err := p.getChannelMembersExportPage(testutils.GetID(), users, &serializer.ChannelMembersCursor{PerPage: 3})
+	require.Nil(t, err)
+	require.Len(t, members, 2)
+	assert.Equal(t, users[0].Id, members[0].UserID)
+	assert.False(t, members[0].IsBot)
+	assert.Equal(t, users[2].Id, members[1].UserID)
+	assert.True(t, members[1].IsBot)
+	assert.Equal(t, &serializer.ChannelMembersCursor{LastUserID: users[2].Id, PerPage: 3}, nextCursor)
+}
+
+func TestGetChannelUsersSortedByID(t *testing.T) {
+	users, _ := getUsersWithChannelMembers(0, 201)
+	firstPage := append([]*model.User{}, users[1:201]...)
+	firstPage[0], firstPage[199] = firstPage[199], firstPage[0]
+
+	api := &plugintest.API{}
+	defer api.AssertExpectations(t)
+	api.On("GetUsersInChannel", testutils.GetID(), model.CHANNEL_SORT_BY_USERNAME, 0, 200).Return(firstPage, nil)
+	api.On("GetUsersInChannel", testutils.GetID(), model.CHANNEL_SORT_BY_USERNAME, 1, 200).Return([]*model.User{users[200], users[0]}, nil)
+	p := setupTestPlugin(api)
+
+	sortedUsers, err := p.getChannelUsersSortedByID(testutils.GetID())
+	require.Nil(t, err)
+	assert.Equal(t, users, sortedUsers)
+}
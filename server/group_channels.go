@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// groupChannelLinkStoreMaxAttempts is the number of times storing a group channel link is attempted when the links of the course channel change concurrently
+const groupChannelLinkStoreMaxAttempts = 5
+
+// createGroupChannel creates a channel for a group or a grouping of a Moodle course under the channel of the course.
+// Only the members sent in the request are added to it, and it is archived and unarchived along with the course channel.
+func (p *Plugin) createGroupChannel(w http.ResponseWriter, r *http.Request) {
+	parentChannelID, status, resolveErr := p.resolveMattermostID(r, courseChannelMapping, "channel_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
+		return
+	}
+
+	groupChannel := serializer.GroupChannelFromJSON(r.Body)
+	if err := groupChannel.Validate(); err != nil {
+		p.API.LogError(err.Error())
+		p.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	parentChannel, err := p.API.GetChannel(parentChannelID)
+	if err != nil {
+		p.API.LogError(fmt.Sprintf("Invalid channel id. Error: %v", err.Error()))
+		p.writeError(w, r, err.StatusCode, errors.Wrap(err, "invalid channel id"))
+		return
+	}
+
+	if status, validateErr := p.validateParentChannel(parentChannel, groupChannel); validateErr != nil {
+		p.API.LogError(validateErr.Error())
+		p.writeError(w, r, status, validateErr)
+		return
+	}
+
+	displayName := groupChannel.DisplayName
+	if displayName == "" {
+		displayName = groupChannel.Name
+	}
+
+	// Group channels are as visible as their course channel unless Moodle asks otherwise
+	channelType := groupChannel.Type
+	if channelType == "" {
+		channelType = parentChannel.Type
+	}
+
+	createdChannel, status, createErr := p.createChannelWithBot(&model.Channel{
+		Name:        groupChannel.Name,
+		TeamId:      parentChannel.TeamId,
+		Type:        channelType,
+		CreatorId:   p.botID,
+		DisplayName: displayName,
+		Purpose:     groupChannel.Purpose,
+		Header:      groupChannel.Header,
+	})
+	if createErr != nil {
+		p.API.LogError(createErr.Error())
+		p.writeError(w, r, status, createErr)
+		return
+	}
+
+	link := &serializer.GroupChannelLink{
+		ChannelID:       createdChannel.Id,
+		ParentChannelID: parentChannel.Id,
+		GroupID:         groupChannel.GroupID,
+		GroupType:       groupChannel.GroupType,
+	}
+	if status, storeErr := p.storeGroupChannelLink(link); storeErr != nil {
+		// A channel created concurrently for the same group got linked first, so this one is archived instead of being left unlinked
+		if status == http.StatusConflict {
+			if appErr := p.API.DeleteChannel(createdChannel.Id); appErr != nil {
+				p.API.LogError(fmt.Sprintf("Failed to archive duplicate group channel. Error: %v", appErr.Error()))
+			}
+
+			p.API.LogError(storeErr.Error())
+			p.writeError(w, r, status, storeErr)
+			return
+		}
+
+		p.API.LogError(fmt.Sprintf("Failed to store group channel link. Error: %v", storeErr.Error()))
+		p.writeError(w, r, status, errors.Wrap(storeErr, "failed to store group channel link"))
+		return
+	}
+
+	result := &serializer.GroupChannelResult{
+		Channel: createdChannel,
+		Members: make(serializer.ChannelMemberResults, 0, len(groupChannel.Members)),
+	}
+	for i := range groupChannel.Members {
+		result.Members = append(result.Members, p.applyChannelMemberChange(getRequestSiteID(r), createdChannel.Id, &groupChannel.Members[i]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write([]byte(result.ToJSON()))
+}
+
+// validateParentChannel checks if a channel can be created for the given group under the given course channel.
+// It also fills in the default group type.
+func (p *Plugin) validateParentChannel(parentChannel *model.Channel, groupChannel *serializer.GroupChannel) (int, error) {
+	if parentChannel.DeleteAt != 0 {
+		return http.StatusBadRequest, serializer.NewError(serializer.ErrorCodeChannelArchived, "cannot create a group channel under an archived channel")
+	}
+
+	parentLink, err := p.getParentChannelLink(parentChannel.Id)
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "failed to get parent channel link")
+	}
+
+	if parentLink != nil {
+		return http.StatusBadRequest, serializer.NewError(serializer.ErrorCodeInvalidParentChannel, "cannot create a group channel under another group channel")
+	}
+
+	if groupChannel.GroupType == "" {
+		groupChannel.GroupType = serializer.GroupTypeGroup
+	}
+
+	links, err := p.getGroupChannelLinks(parentChannel.Id)
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "failed to get group channel links")
+	}
+
+	if err := checkGroupChannelNotLinked(links, groupChannel.GroupID, groupChannel.GroupType); err != nil {
+		return http.StatusConflict, err
+	}
+
+	return 0, nil
+}
+
+// checkGroupChannelNotLinked returns an error if one of the links is for the given group
+func checkGroupChannelNotLinked(links serializer.GroupChannelLinks, groupID, groupType string) error {
+	for _, link := range links {
+		if link.GroupID == groupID && link.GroupType == groupType {
+			return serializer.NewError(serializer.ErrorCodeGroupChannelExists, fmt.Sprintf("channel %s already exists for moodle %s %s", link.ChannelID, link.GroupType, link.GroupID))
+		}
+	}
+
+	return nil
+}
+
+// getChannelWithGroupChannels adds the links to the course channel above the given channel or the group channels below it
+func (p *Plugin) getChannelWithGroupChannels(channel *model.Channel) (*serializer.ChannelWithGroupChannels, error) {
+	links, err := p.getGroupChannelLinks(channel.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	parentLink, err := p.getParentChannelLink(channel.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	channelWithGroupChannels := &serializer.ChannelWithGroupChannels{
+		Channel:       channel,
+		GroupChannels: links,
+	}
+
+	if channelWithGroupChannels.GroupChannels == nil {
+		channelWithGroupChannels.GroupChannels = serializer.GroupChannelLinks{}
+	}
+
+	if parentLink != nil {
+		channelWithGroupChannels.ParentChannelID = parentLink.ParentChannelID
+	}
+
+	return channelWithGroupChannels, nil
+}
+
+// archiveGroupChannels archives the group channels under the given course channel which are not archived yet
+func (p *Plugin) archiveGroupChannels(parentChannelID string) (int, error) {
+	links, err := p.getGroupChannelLinks(parentChannelID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	for _, link := range links {
+		channel, appErr := p.API.GetChannel(link.ChannelID)
+		if appErr != nil {
+			// The group channel has been deleted permanently
+			if appErr.StatusCode == http.StatusNotFound {
+				continue
+			}
+
+			return appErr.StatusCode, errors.Wrap(appErr, "failed to get group channel")
+		}
+
+		if channel.DeleteAt != 0 {
+			continue
+		}
+
+		if appErr = p.API.DeleteChannel(channel.Id); appErr != nil {
+			return appErr.StatusCode, errors.Wrap(appErr, "failed to archive group channel")
+		}
+	}
+
+	return 0, nil
+}
+
+// unarchiveGroupChannels unarchives the group channels under the given course channel which are archived
+func (p *Plugin) unarchiveGroupChannels(parentChannelID string) (int, error) {
+	links, err := p.getGroupChannelLinks(parentChannelID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	for _, link := range links {
+		channel, appErr := p.API.GetChannel(link.ChannelID)
+		if appErr != nil {
+			// The group channel has been deleted permanently
+			if appErr.StatusCode == http.StatusNotFound {
+				continue
+			}
+
+			return appErr.StatusCode, errors.Wrap(appErr, "failed to get group channel")
+		}
+
+		if channel.DeleteAt == 0 {
+			continue
+		}
+
+		if appErr = p.restoreChannel(channel); appErr != nil {
+			return appErr.StatusCode, errors.Wrap(appErr, "failed to unarchive group channel")
+		}
+	}
+
+	return 0, nil
+}
+
+// getGroupChannelLinks returns the links to the group channels under the given course channel
+func (p *Plugin) getGroupChannelLinks(parentChannelID string) (serializer.GroupChannelLinks, error) {
+	data, appErr := p.API.KVGet(utils.GetKeyHash(constants.KeyPrefixGroupChannels, parentChannelID))
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get group channel links from KV store")
+	}
+
+	if data == nil {
+		return nil, nil
+	}
+
+	var links serializer.GroupChannelLinks
+	if err := json.Unmarshal(data, &links); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal group channel links")
+	}
+
+	return links, nil
+}
+
+// getParentChannelLink returns the link to the course channel above the given group channel or nil if it is not a group channel
+func (p *Plugin) getParentChannelLink(channelID string) (*serializer.GroupChannelLink, error) {
+	data, appErr := p.API.KVGet(utils.GetKeyHash(constants.KeyPrefixParentChannel, channelID))
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get parent channel link from KV store")
+	}
+
+	if data == nil {
+		return nil, nil
+	}
+
+	var link *serializer.GroupChannelLink
+	if err := json.Unmarshal(data, &link); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal parent channel link")
+	}
+
+	return link, nil
+}
+
+// storeGroupChannelLink stores the link under both the course channel and the group channel, so that it can be followed in both directions.
+// The links of the course channel are updated atomically, so that links stored concurrently for other groups are not lost,
+// and the group is checked again on every attempt, so that two channels stored concurrently for the same group are not both linked.
+func (p *Plugin) storeGroupChannelLink(link *serializer.GroupChannelLink) (int, error) {
+	linkData, err := json.Marshal(link)
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "failed to marshal parent channel link")
+	}
+
+	key := utils.GetKeyHash(constants.KeyPrefixGroupChannels, link.ParentChannelID)
+	for attempt := 0; attempt < groupChannelLinkStoreMaxAttempts; attempt++ {
+		oldData, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			return http.StatusInternalServerError, errors.Wrap(appErr, "failed to get group channel links from KV store")
+		}
+
+		var links serializer.GroupChannelLinks
+		if oldData != nil {
+			if err = json.Unmarshal(oldData, &links); err != nil {
+				return http.StatusInternalServerError, errors.Wrap(err, "failed to unmarshal group channel links")
+			}
+		}
+
+		if err = checkGroupChannelNotLinked(links, link.GroupID, link.GroupType); err != nil {
+			return http.StatusConflict, err
+		}
+
+		linksData, err := json.Marshal(append(links, *link))
+		if err != nil {
+			return http.StatusInternalServerError, errors.Wrap(err, "failed to marshal group channel links")
+		}
+
+		stored, appErr := p.API.KVSetWithOptions(key, linksData, model.PluginKVSetOptions{
+			Atomic:   true,
+			OldValue: oldData,
+		})
+		if appErr != nil {
+			return http.StatusInternalServerError, errors.Wrap(appErr, "failed to store group channel links in KV store")
+		}
+
+		if !stored {
+			continue
+		}
+
+		if appErr := p.API.KVSet(utils.GetKeyHash(constants.KeyPrefixParentChannel, link.ChannelID), linkData); appErr != nil {
+			return http.StatusInternalServerError, errors.Wrap(appErr, "failed to store parent channel link in KV store")
+		}
+
+		return 0, nil
+	}
+
+	return http.StatusInternalServerError, errors.Errorf("failed to store group channel links after %d attempts as they were changed concurrently", groupChannelLinkStoreMaxAttempts)
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils/testutils"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getGroupChannelLinksJSON(parentChannelID string, channelIDs ...string) []byte {
+	links := serializer.GroupChannelLinks{}
+	for i, channelID := range channelIDs {
+		links = append(links, serializer.GroupChannelLink{
+			ChannelID:       channelID,
+			ParentChannelID: parentChannelID,
+			GroupID:         fmt.Sprintf("%d", i+1),
+			GroupType:       serializer.GroupTypeGroup,
+		})
+	}
+
+	data, _ := json.Marshal(links)
+	return data
+}
+
+func TestCreateGroupChannel(t *testing.T) {
+	requestURL := fmt.Sprintf("/api/v1/channels/%s/groups?secret=%s", testutils.GetID(), testutils.GetSecret())
+	requestMethod := http.MethodPost
+	groupChannelsKey := utils.GetKeyHash(constants.KeyPrefixGroupChannels, testutils.GetID())
+	parentChannelKey := utils.GetKeyHash(constants.KeyPrefixParentChannel, testutils.GetID())
+	for name, test := range map[string]struct {
+		SetupAPI           func(*plugintest.API) (*plugintest.API, serializer.GroupChannel)
+		ExpectedStatusCode int
+		ExpectedMembers    int
+	}{
+		"success": {
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.GroupChannel) {
+				parentChannel := testutils.GetModelChannel()
+				parentChannel.Id = testutils.GetID()
+				parentChannel.TeamId = testutils.GetTeam().Id
+				parentChannel.Type = model.CHANNEL_OPEN
+				createdChannel := testutils.GetModelChannel()
+				member := testutils.GetChannelMemberWithRole()
+				member.Role = model.CHANNEL_USER_ROLE_ID
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannel", testutils.GetID()).Return(parentChannel, nil)
+				api.On("KVGet", parentChannelKey).Return(nil, nil)
+				api.On("KVGet", groupChannelsKey).Return(nil, nil)
+				api.On("CreateChannel", mock.MatchedBy(func(c *model.Channel) bool {
+					return c.TeamId == parentChannel.TeamId && c.Type == model.CHANNEL_OPEN
+				})).Return(createdChannel, nil)
+				api.On("CreateTeamMember", parentChannel.TeamId, mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("AddChannelMember", createdChannel.Id, mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("KVSetWithOptions", groupChannelsKey, mock.Anything, model.PluginKVSetOptions{Atomic: true}).Return(true, nil)
+				api.On("KVSet", utils.GetKeyHash(constants.KeyPrefixParentChannel, createdChannel.Id), mock.Anything).Return(nil)
+				api.On("AddUserToChannel", createdChannel.Id, member.UserID, mock.AnythingOfType("string")).Return(nil, nil)
+				return api, serializer.GroupChannel{
+					Name:    "lab-section-a",
+					GroupID: "1",
+					Members: serializer.ChannelMembers{member},
+				}
+			},
+			ExpectedStatusCode: http.StatusCreated,
+			ExpectedMembers:    1,
+		},
+		"invalid group id": {
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.GroupChannel) {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api, serializer.GroupChannel{Name: "lab-section-a"}
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+		"parent channel archived": {
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.GroupChannel) {
+				parentChannel := testutils.GetModelChannel()
+				parentChannel.DeleteAt = model.GetMillis()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannel", testutils.GetID()).Return(parentChannel, nil)
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api, serializer.GroupChannel{Name: "lab-section-a", GroupID: "1"}
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+		"parent channel is a group channel": {
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.GroupChannel) {
+				parentChannel := testutils.GetModelChannel()
+				parentChannel.Id = testutils.GetID()
+				link, _ := json.Marshal(serializer.GroupChannelLink{ChannelID: testutils.GetID(), ParentChannelID: testutils.GetModelChannel().Id, GroupID: "1"})
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannel", testutils.GetID()).Return(parentChannel, nil)
+				api.On("KVGet", parentChannelKey).Return(link, nil)
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api, serializer.GroupChannel{Name: "lab-section-a", GroupID: "2"}
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+		"group channel exists": {
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.GroupChannel) {
+				parentChannel := testutils.GetModelChannel()
+				parentChannel.Id = testutils.GetID()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannel", testutils.GetID()).Return(parentChannel, nil)
+				api.On("KVGet", parentChannelKey).Return(nil, nil)
+				api.On("KVGet", groupChannelsKey).Return(getGroupChannelLinksJSON(testutils.GetID(), testutils.GetModelChannel().Id), nil)
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api, serializer.GroupChannel{Name: "lab-section-a", GroupID: "1"}
+			},
+			ExpectedStatusCode: http.StatusConflict,
+		},
+		"group channel linked concurrently": {
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.GroupChannel) {
+				parentChannel := testutils.GetModelChannel()
+				parentChannel.Id = testutils.GetID()
+				createdChannel := testutils.GetModelChannel()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannel", testutils.GetID()).Return(parentChannel, nil)
+				api.On("KVGet", parentChannelKey).Return(nil, nil)
+				api.On("KVGet", groupChannelsKey).Return(nil, nil).Once()
+				api.On("CreateChannel", mock.AnythingOfType("*model.Channel")).Return(createdChannel, nil)
+				api.On("CreateTeamMember", parentChannel.TeamId, mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("AddChannelMember", createdChannel.Id, mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("KVGet", groupChannelsKey).Return(getGroupChannelLinksJSON(testutils.GetID(), testutils.GetModelChannel().Id), nil).Once()
+				api.On("DeleteChannel", createdChannel.Id).Return(nil)
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api, serializer.GroupChannel{Name: "lab-section-a", GroupID: "1"}
+			},
+			ExpectedStatusCode: http.StatusConflict,
+		},
+		"failed to create channel": {
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.GroupChannel) {
+				parentChannel := testutils.GetModelChannel()
+				parentChannel.Id = testutils.GetID()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannel", testutils.GetID()).Return(parentChannel, nil)
+				api.On("KVGet", parentChannelKey).Return(nil, nil)
+				api.On("KVGet", groupChannelsKey).Return(nil, nil)
+				api.On("CreateChannel", mock.AnythingOfType("*model.Channel")).Return(nil, testutils.GetInternalServerAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api, serializer.GroupChannel{Name: "lab-section-a", GroupID: "1"}
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			api, payload := test.SetupAPI(&plugintest.API{})
+			reqBody, err := json.Marshal(payload)
+			require.Nil(t, err)
+
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(requestMethod, requestURL, bytes.NewBuffer(reqBody))
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+
+			assert.Equal(test.ExpectedStatusCode, result.StatusCode)
+			if test.ExpectedStatusCode != http.StatusCreated {
+				return
+			}
+
+			var groupChannelResult *serializer.GroupChannelResult
+			require.NoError(t, json.NewDecoder(result.Body).Decode(&groupChannelResult))
+			require.NotNil(t, groupChannelResult.Channel)
+			assert.Len(groupChannelResult.Members, test.ExpectedMembers)
+			for _, member := range groupChannelResult.Members {
+				assert.Equal(model.STATUS_OK, member.Status)
+			}
+		})
+	}
+}
+
+func TestStoreGroupChannelLink(t *testing.T) {
+	groupChannelsKey := utils.GetKeyHash(constants.KeyPrefixGroupChannels, testutils.GetID())
+	link := &serializer.GroupChannelLink{ChannelID: testutils.GetModelChannel().Id, ParentChannelID: testutils.GetID(), GroupID: "2", GroupType: serializer.GroupTypeGroup}
+	for name, test := range map[string]struct {
+		SetupAPI           func(*plugintest.API) *plugintest.API
+		ExpectedStatusCode int
+	}{
+		"links changed concurrently": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				oldLinks := getGroupChannelLinksJSON(testutils.GetID(), testutils.GetModelChannel().Id)
+				api.On("KVGet", groupChannelsKey).Return(nil, nil).Once()
+				api.On("KVGet", groupChannelsKey).Return(oldLinks, nil).Once()
+				api.On("KVSetWithOptions", groupChannelsKey, mock.Anything, model.PluginKVSetOptions{Atomic: true}).Return(false, nil).Once()
+				api.On("KVSetWithOptions", groupChannelsKey, mock.MatchedBy(func(data []byte) bool {
+					var links serializer.GroupChannelLinks
+					return json.Unmarshal(data, &links) == nil && len(links) == 2 && links[1] == *link
+				}), model.PluginKVSetOptions{Atomic: true, OldValue: oldLinks}).Return(true, nil).Once()
+				api.On("KVSet", utils.GetKeyHash(constants.KeyPrefixParentChannel, link.ChannelID), mock.Anything).Return(nil)
+				return api
+			},
+		},
+		"group linked concurrently": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				oldLinks := getGroupChannelLinksJSON(testutils.GetID(), testutils.GetModelChannel().Id, testutils.GetModelChannel().Id)
+				api.On("KVGet", groupChannelsKey).Return(nil, nil).Once()
+				api.On("KVGet", groupChannelsKey).Return(oldLinks, nil).Once()
+				api.On("KVSetWithOptions", groupChannelsKey, mock.Anything, model.PluginKVSetOptions{Atomic: true}).Return(false, nil).Once()
+				return api
+			},
+			ExpectedStatusCode: http.StatusConflict,
+		},
+		"links always changed concurrently": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", groupChannelsKey).Return(nil, nil)
+				api.On("KVSetWithOptions", groupChannelsKey, mock.Anything, model.PluginKVSetOptions{Atomic: true}).Return(false, nil).Times(groupChannelLinkStoreMaxAttempts)
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := test.SetupAPI(&plugintest.API{})
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			status, err := p.storeGroupChannelLink(link)
+			assert.Equal(t, test.ExpectedStatusCode, status)
+			if test.ExpectedStatusCode != 0 {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestArchiveChannelWithGroupChannels(t *testing.T) {
+	api := &plugintest.API{}
+	activeChannel := testutils.GetModelChannel()
+	archivedChannel := testutils.GetModelChannel()
+	archivedChannel.DeleteAt = model.GetMillis()
+	deletedChannelID := testutils.GetModelChannel().Id
+	links := getGroupChannelLinksJSON(testutils.GetID(), activeChannel.Id, archivedChannel.Id, deletedChannelID)
+	api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+	api.On("DeleteChannel", testutils.GetID()).Return(nil).Once()
+	api.On("KVGet", utils.GetKeyHash(constants.KeyPrefixGroupChannels, testutils.GetID())).Return(links, nil)
+	api.On("GetChannel", activeChannel.Id).Return(activeChannel, nil)
+	api.On("GetChannel", archivedChannel.Id).Return(archivedChannel, nil)
+	api.On("GetChannel", deletedChannelID).Return(nil, testutils.GetNotFoundAppError())
+	api.On("DeleteChannel", activeChannel.Id).Return(nil).Once()
+	defer api.AssertExpectations(t)
+	p := setupTestPlugin(api)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/api/v1/channels/%s?secret=%s", testutils.GetID(), testutils.GetSecret()), nil)
+	p.ServeHTTP(nil, w, r)
+
+	result := w.Result()
+	require.NotNil(t, result)
+	defer result.Body.Close()
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+}
+
+func TestUnarchiveChannelWithGroupChannels(t *testing.T) {
+	api := &plugintest.API{}
+	parentChannel := testutils.GetModelChannel()
+	parentChannel.Id = testutils.GetID()
+	parentChannel.DeleteAt = model.GetMillis()
+	activeChannel := testutils.GetModelChannel()
+	archivedChannel := testutils.GetModelChannel()
+	archivedChannel.DeleteAt = model.GetMillis()
+	links := getGroupChannelLinksJSON(testutils.GetID(), activeChannel.Id, archivedChannel.Id)
+	api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+	api.On("GetChannel", testutils.GetID()).Return(parentChannel, nil)
+	api.On("UpdateChannel", mock.MatchedBy(func(c *model.Channel) bool { return c.Id == parentChannel.Id && c.DeleteAt == 0 })).Return(nil, nil).Once()
+	api.On("KVGet", utils.GetKeyHash(constants.KeyPrefixGroupChannels, testutils.GetID())).Return(links, nil)
+	api.On("GetChannel", activeChannel.Id).Return(activeChannel, nil)
+	api.On("GetChannel", archivedChannel.Id).Return(archivedChannel, nil)
+	api.On("UpdateChannel", mock.MatchedBy(func(c *model.Channel) bool { return c.Id == archivedChannel.Id && c.DeleteAt == 0 })).Return(nil, nil).Once()
+	defer api.AssertExpectations(t)
+	p := setupTestPlugin(api)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/v1/channels/%s/unarchive?secret=%s", testutils.GetID(), testutils.GetSecret()), nil)
+	p.ServeHTTP(nil, w, r)
+
+	result := w.Result()
+	require.NotNil(t, result)
+	defer result.Body.Close()
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+}
+
+func TestGetChannelWithGroupChannels(t *testing.T) {
+	requestURL := fmt.Sprintf("/api/v1/channels/%s?secret=%s", testutils.GetID(), testutils.GetSecret())
+	groupChannelsKey := utils.GetKeyHash(constants.KeyPrefixGroupChannels, testutils.GetID())
+	parentChannelKey := utils.GetKeyHash(constants.KeyPrefixParentChannel, testutils.GetID())
+	parentChannelID := testutils.GetModelChannel().Id
+	for name, test := range map[string]struct {
+		SetupAPI                func(*plugintest.API) *plugintest.API
+		ExpectedStatusCode      int
+		ExpectedGroupChannels   int
+		ExpectedParentChannelID string
+	}{
+		"course channel": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannel", testutils.GetID()).Return(&model.Channel{Id: testutils.GetID()}, nil)
+				api.On("KVGet", groupChannelsKey).Return(getGroupChannelLinksJSON(testutils.GetID(), testutils.GetModelChannel().Id, testutils.GetModelChannel().Id), nil)
+				api.On("KVGet", parentChannelKey).Return(nil, nil)
+				return api
+			},
+			ExpectedStatusCode:    http.StatusOK,
+			ExpectedGroupChannels: 2,
+		},
+		"group channel": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				link, _ := json.Marshal(serializer.GroupChannelLink{ChannelID: testutils.GetID(), ParentChannelID: parentChannelID, GroupID: "1"})
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannel", testutils.GetID()).Return(&model.Channel{Id: testutils.GetID()}, nil)
+				api.On("KVGet", groupChannelsKey).Return(nil, nil)
+				api.On("KVGet", parentChannelKey).Return(link, nil)
+				return api
+			},
+			ExpectedStatusCode:      http.StatusOK,
+			ExpectedParentChannelID: parentChannelID,
+		},
+		"failed to get group channels": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("GetChannel", testutils.GetID()).Return(&model.Channel{Id: testutils.GetID()}, nil)
+				api.On("KVGet", groupChannelsKey).Return(nil, testutils.GetInternalServerAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			api := test.SetupAPI(&plugintest.API{})
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, requestURL, nil)
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+
+			assert.Equal(test.ExpectedStatusCode, result.StatusCode)
+			if test.ExpectedStatusCode != http.StatusOK {
+				return
+			}
+
+			var channel *serializer.ChannelWithGroupChannels
+			require.NoError(t, json.NewDecoder(result.Body).Decode(&channel))
+			assert.Equal(testutils.GetID(), channel.Id)
+			assert.Len(channel.GroupChannels, test.ExpectedGroupChannels)
+			assert.Equal(test.ExpectedParentChannelID, channel.ParentChannelID)
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	idempotencyKeyMaxLength = 255
+	idempotencyKeyTTL       = 24 * time.Hour
+
+	// idempotentRequestMaxBodySize is the maximum size in bytes of the body of a request sending an idempotency key, which is read to fingerprint the request
+	idempotentRequestMaxBodySize = 1024 * 1024
+)
+
+// idempotencyRecord is stored in the KV store for every idempotency key.
+// While the request is being processed, only the fingerprint is stored. Once it succeeds or fails with a server error, its response is stored too.
+type idempotencyRecord struct {
+	Fingerprint string `json:"fingerprint"`
+	Completed   bool   `json:"completed"`
+	StatusCode  int    `json:"status_code,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// responseRecorder passes the response through to the underlying writer while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// withIdempotencyKey makes the handler idempotent for requests sending the "Idempotency-Key" header.
+// The response of the first request which is not rejected with a client error is stored,
+// and returned as it is for every later request with the same key, without running the handler again.
+func (p *Plugin) withIdempotencyKey(handleFunc func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		idempotencyKey := r.Header.Get(constants.HeaderIdempotencyKey)
+		if idempotencyKey == "" {
+			handleFunc(w, r)
+			return
+		}
+
+		if len(idempotencyKey) > idempotencyKeyMaxLength {
+			p.API.LogError("idempotency key is not valid")
+			p.writeError(w, r, http.StatusBadRequest, serializer.NewError(serializer.ErrorCodeInvalidIdempotencyKey, "idempotency key is not valid"))
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, idempotentRequestMaxBodySize))
+		if err != nil {
+			p.API.LogError(fmt.Sprintf("Failed to read request body. Error: %v", err.Error()))
+			p.writeError(w, r, http.StatusBadRequest, serializer.NewError(serializer.ErrorCodeInvalidRequestBody, "invalid request body"))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		// The key is scoped to the route, so that the same key can be used for different operations
+		key := utils.GetKeyHash(constants.KeyPrefixIdempotency, fmt.Sprintf("%s %s %s", r.Method, r.URL.Path, idempotencyKey))
+		record := &idempotencyRecord{
+			Fingerprint: getIdempotencyFingerprint(r.URL.Query(), body),
+		}
+
+		claimed, err := p.claimIdempotencyKey(key, record)
+		if err != nil {
+			p.API.LogError(fmt.Sprintf("Failed to store idempotency key. Error: %v", err.Error()))
+			p.writeError(w, r, http.StatusInternalServerError, errors.Wrap(err, "failed to store idempotency key"))
+			return
+		}
+
+		if !claimed {
+			p.replayIdempotentResponse(w, r, key, record.Fingerprint)
+			return
+		}
+
+		// The key is released if the handler panics, so that the request can be retried with the same key
+		defer func() {
+			if x := recover(); x != nil {
+				p.releaseIdempotencyKey(key)
+				panic(x)
+			}
+		}()
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		handleFunc(recorder, r)
+
+		// Requests rejected with a client error did not change anything, so they are not stored and can be retried with the same key.
+		// Server errors are stored, as the request may have been partially applied before failing.
+		if recorder.statusCode < http.StatusOK || (recorder.statusCode >= http.StatusMultipleChoices && recorder.statusCode < http.StatusInternalServerError) {
+			p.releaseIdempotencyKey(key)
+			return
+		}
+
+		record.Completed = true
+		record.StatusCode = recorder.statusCode
+		record.ContentType = recorder.Header().Get("Content-Type")
+		record.Body = recorder.body.Bytes()
+		if err := p.storeIdempotencyRecord(key, record); err != nil {
+			p.API.LogError("Failed to store idempotent response.", "Error", err.Error())
+		}
+	}
+}
+
+// getIdempotencyFingerprint returns the hash of the query parameters and the body of a request, which must not change when the request is retried.
+// The secret is left out, as it authenticates the request rather than being a part of it.
+func getIdempotencyFingerprint(query url.Values, body []byte) string {
+	query.Del("secret")
+	fingerprint := sha256.Sum256(append([]byte(query.Encode()+"\n"), body...))
+	return hex.EncodeToString(fingerprint[:])
+}
+
+// claimIdempotencyKey atomically stores the record if no request has used the key yet.
+func (p *Plugin) claimIdempotencyKey(key string, record *idempotencyRecord) (bool, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to marshal idempotency record")
+	}
+
+	claimed, appErr := p.API.KVSetWithOptions(key, data, model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: int64(idempotencyKeyTTL / time.Second),
+	})
+	if appErr != nil {
+		return false, appErr
+	}
+
+	return claimed, nil
+}
+
+func (p *Plugin) releaseIdempotencyKey(key string) {
+	if appErr := p.API.KVDelete(key); appErr != nil {
+		p.API.LogError("Failed to delete idempotency key.", "Error", appErr.Error())
+	}
+}
+
+func (p *Plugin) storeIdempotencyRecord(key string, record *idempotencyRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal idempotency record")
+	}
+
+	if appErr := p.API.KVSetWithExpiry(key, data, int64(idempotencyKeyTTL/time.Second)); appErr != nil {
+		return appErr
+	}
+
+	return nil
+}
+
+// replayIdempotentResponse responds with the stored response of the request which first used the key.
+func (p *Plugin) replayIdempotentResponse(w http.ResponseWriter, r *http.Request, key, fingerprint string) {
+	data, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		p.API.LogError(fmt.Sprintf("Failed to get idempotency key. Error: %v", appErr.Error()))
+		p.writeError(w, r, http.StatusInternalServerError, errors.Wrap(appErr, "failed to get idempotency key"))
+		return
+	}
+
+	var record *idempotencyRecord
+	if err := json.Unmarshal(data, &record); err != nil || record == nil {
+		// The key expired or was released between the two calls, so the client can safely retry
+		p.writeError(w, r, http.StatusConflict, serializer.NewError(serializer.ErrorCodeIdempotencyKeyInUse, "the request with this idempotency key is being processed, retry later"))
+		return
+	}
+
+	if record.Fingerprint != fingerprint {
+		p.API.LogError("idempotency key was already used with a different request")
+		p.writeError(w, r, http.StatusUnprocessableEntity, serializer.NewError(serializer.ErrorCodeIdempotencyKeyReused, "idempotency key was already used with a different request"))
+		return
+	}
+
+	if !record.Completed {
+		p.writeError(w, r, http.StatusConflict, serializer.NewError(serializer.ErrorCodeIdempotencyKeyInUse, "the request with this idempotency key is being processed, retry later"))
+		return
+	}
+
+	w.Header().Set("Content-Type", record.ContentType)
+	w.Header().Set(constants.HeaderIdempotentReplayed, "true")
+	w.WriteHeader(record.StatusCode)
+	_, _ = w.Write(record.Body)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils/testutils"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithIdempotencyKey(t *testing.T) {
+	requestURL := fmt.Sprintf("/api/v1/channels?secret=%s", testutils.GetSecret())
+	requestMethod := http.MethodPost
+	channel := testutils.GetSerializerChannel()
+	reqBody, err := json.Marshal(channel)
+	require.Nil(t, err)
+	fingerprint := getIdempotencyFingerprint(url.Values{}, reqBody)
+
+	getRecord := func(record *idempotencyRecord) []byte {
+		data, _ := json.Marshal(record)
+		return data
+	}
+
+	for name, test := range map[string]struct {
+		SetupAPI           func(*plugintest.API) *plugintest.API
+		ExpectedStatusCode int
+		ExpectedBody       string
+		ExpectedReplayed   bool
+	}{
+		"first request is processed and stored": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				team := testutils.GetTeam()
+				modelChannel := testutils.GetModelChannel()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVSetWithOptions", mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(true, nil)
+				api.On("GetTeamByName", channel.TeamName).Return(team, nil)
+				api.On("CreateChannel", mock.AnythingOfType("*model.Channel")).Return(modelChannel, nil)
+				api.On("CreateTeamMember", team.Id, mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("AddChannelMember", modelChannel.Id, mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("KVSetWithExpiry", mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("int64")).Return(nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusCreated,
+		},
+		"failed request releases the key": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVSetWithOptions", mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(true, nil)
+				api.On("GetTeamByName", channel.TeamName).Return(nil, testutils.GetBadRequestAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				api.On("KVDelete", mock.AnythingOfType("string")).Return(nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+		"request failed with a server error is stored": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				team := testutils.GetTeam()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVSetWithOptions", mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(true, nil)
+				api.On("GetTeamByName", channel.TeamName).Return(team, nil)
+				api.On("CreateChannel", mock.AnythingOfType("*model.Channel")).Return(nil, testutils.GetInternalServerAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				api.On("KVSetWithExpiry", mock.AnythingOfType("string"), mock.MatchedBy(func(data []byte) bool {
+					var record *idempotencyRecord
+					return json.Unmarshal(data, &record) == nil && record.Completed && record.StatusCode == http.StatusInternalServerError
+				}), mock.AnythingOfType("int64")).Return(nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+		"panicking request releases the key": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVSetWithOptions", mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(true, nil)
+				api.On("GetTeamByName", channel.TeamName).Run(func(mock.Arguments) {
+					panic("failed to get team")
+				}).Return(nil, nil)
+				api.On("KVDelete", mock.AnythingOfType("string")).Return(nil)
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+		"completed request is replayed": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVSetWithOptions", mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(false, nil)
+				api.On("KVGet", mock.AnythingOfType("string")).Return(getRecord(&idempotencyRecord{
+					Fingerprint: fingerprint,
+					Completed:   true,
+					StatusCode:  http.StatusCreated,
+					ContentType: "application/json",
+					Body:        []byte(`{"id":"abc"}`),
+				}), nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusCreated,
+			ExpectedBody:       `{"id":"abc"}`,
+			ExpectedReplayed:   true,
+		},
+		"request still being processed": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVSetWithOptions", mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(false, nil)
+				api.On("KVGet", mock.AnythingOfType("string")).Return(getRecord(&idempotencyRecord{
+					Fingerprint: fingerprint,
+				}), nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusConflict,
+		},
+		"key used with a different body": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVSetWithOptions", mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(false, nil)
+				api.On("KVGet", mock.AnythingOfType("string")).Return(getRecord(&idempotencyRecord{
+					Fingerprint: "other",
+					Completed:   true,
+				}), nil)
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusUnprocessableEntity,
+		},
+		"key used with different query parameters": {
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVSetWithOptions", mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(false, nil)
+				api.On("KVGet", mock.AnythingOfType("string")).Return(getRecord(&idempotencyRecord{
+					Fingerprint: getIdempotencyFingerprint(url.Values{"async": []string{"true"}}, reqBody),
+					Completed:   true,
+				}), nil)
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusUnprocessableEntity,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			api := test.SetupAPI(&plugintest.API{})
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(requestMethod, requestURL, bytes.NewBuffer(reqBody))
+			r.Header.Set(constants.HeaderIdempotencyKey, "create-channel-1")
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+
+			assert.Equal(test.ExpectedStatusCode, result.StatusCode)
+			if test.ExpectedReplayed {
+				body, err := ioutil.ReadAll(result.Body)
+				require.Nil(t, err)
+				assert.Equal(test.ExpectedBody, string(body))
+				assert.Equal("true", result.Header.Get(constants.HeaderIdempotentReplayed))
+			}
+		})
+	}
+}
+
+func TestWithIdempotencyKeyBodyTooLarge(t *testing.T) {
+	api := &plugintest.API{}
+	defer api.AssertExpectations(t)
+	api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+	api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+	p := setupTestPlugin(api)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/v1/channels?secret=%s", testutils.GetSecret()), bytes.NewReader(make([]byte, idempotentRequestMaxBodySize+1)))
+	r.Header.Set(constants.HeaderIdempotencyKey, "create-channel-1")
+	p.ServeHTTP(nil, w, r)
+
+	result := w.Result()
+	require.NotNil(t, result)
+	defer result.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, result.StatusCode)
+}
+
+func TestGetIdempotencyFingerprint(t *testing.T) {
+	body := []byte(`{"name":"maths"}`)
+	fingerprint := getIdempotencyFingerprint(url.Values{"site_id": []string{"site1"}}, body)
+
+	assert.Equal(t, fingerprint, getIdempotencyFingerprint(url.Values{"site_id": []string{"site1"}, "secret": []string{"secret"}}, body))
+	assert.NotEqual(t, fingerprint, getIdempotencyFingerprint(url.Values{"site_id": []string{"site2"}}, body))
+	assert.NotEqual(t, fingerprint, getIdempotencyFingerprint(url.Values{"site_id": []string{"site1"}, "async": []string{"true"}}, body))
+	assert.NotEqual(t, fingerprint, getIdempotencyFingerprint(url.Values{"site_id": []string{"site1"}}, []byte(`{"name":"physics"}`)))
+}
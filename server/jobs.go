@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/pkg/errors"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	jobQueueSize       = 1000
+	jobMaxAttempts     = 5
+	jobInitialBackoff  = 2 * time.Second
+	jobMaxBackoff      = 5 * time.Minute
+	jobRetentionPeriod = 7 * 24 * time.Hour
+	// jobQueueFullDelay is how long a job waits before being enqueued again when the queue is full
+	jobQueueFullDelay = 10 * time.Second
+	// jobClaimTimeout is how long a running job is left to the server processing it before another server can claim it,
+	// in case that server stopped while processing it
+	jobClaimTimeout = 30 * time.Minute
+)
+
+// jobProcessor processes a job and returns its result.
+// If an error is returned with a status code of 500 or above, the job is retried with exponential backoff.
+type jobProcessor func(job *serializer.Job) (result interface{}, status int, err error)
+
+func (p *Plugin) getJobProcessors() map[string]jobProcessor {
+	return map[string]jobProcessor{
+		serializer.JobTypeUpdateChannelMembers:    p.processUpdateChannelMembersJob,
+		serializer.JobTypeReconcileChannelMembers: p.processReconcileChannelMembersJob,
+		serializer.JobTypeDeactivateUser:          p.processDeactivateUserJob,
+		serializer.JobTypeSendDeadlineReminder:    p.processSendDeadlineReminderJob,
+		serializer.JobTypeHTTPRequest:             p.processHTTPRequestJob,
+	}
+}
+
+// startJobWorker starts processing jobs in the background, beginning with the ones left unfinished by a previous run of the plugin.
+func (p *Plugin) startJobWorker() {
+	p.jobQueue = make(chan string, jobQueueSize)
+	p.stopJobs = make(chan struct{})
+	p.jobTimersLock.Lock()
+	p.jobTimers = map[string]*time.Timer{}
+	p.jobTimersLock.Unlock()
+	p.jobsDone.Add(1)
+
+	go func() {
+		defer p.jobsDone.Done()
+		p.enqueueUnfinishedJobs()
+		for {
+			select {
+			case jobID := <-p.jobQueue:
+				p.processJob(jobID)
+			case <-p.stopJobs:
+				return
+			}
+		}
+	}()
+}
+
+// stopJobWorker stops processing jobs and waits for the job being processed to finish.
+// Unfinished jobs stay in the KV store and are picked up the next time the worker starts.
+func (p *Plugin) stopJobWorker() {
+	if p.stopJobs == nil {
+		return
+	}
+
+	p.jobTimersLock.Lock()
+	for _, timer := range p.jobTimers {
+		timer.Stop()
+	}
+	p.jobTimers = nil
+	p.jobTimersLock.Unlock()
+
+	close(p.stopJobs)
+	p.jobsDone.Wait()
+	p.stopJobs = nil
+}
+
+// enqueueJob enqueues the job for processing. If the queue is full, it is enqueued again after a delay.
+func (p *Plugin) enqueueJob(jobID string) {
+	select {
+	case p.jobQueue <- jobID:
+	default:
+		p.API.LogWarn("Job queue is full. The job will be enqueued again later.", "JobID", jobID)
+		p.enqueueJobAfter(jobID, jobQueueFullDelay)
+	}
+}
+
+// enqueueJobAfter enqueues the job once the delay has passed, unless the job worker is stopped in the meantime.
+func (p *Plugin) enqueueJobAfter(jobID string, delay time.Duration) {
+	p.jobTimersLock.Lock()
+	defer p.jobTimersLock.Unlock()
+
+	if p.jobTimers == nil {
+		return
+	}
+
+	if timer, ok := p.jobTimers[jobID]; ok {
+		timer.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		p.jobTimersLock.Lock()
+		stopped := p.jobTimers == nil
+		if !stopped && p.jobTimers[jobID] == timer {
+			delete(p.jobTimers, jobID)
+		}
+		p.jobTimersLock.Unlock()
+
+		if !stopped {
+			p.enqueueJob(jobID)
+		}
+	})
+	p.jobTimers[jobID] = timer
+}
+
+func (p *Plugin) enqueueUnfinishedJobs() {
+	for page := 0; ; page++ {
+		keys, err := p.API.KVList(page, constants.KVListPerPage)
+		if err != nil {
+			p.API.LogError("Failed to list keys from KV store.", "Error", err.Error())
+			return
+		}
+
+		for _, key := range keys {
+			if !strings.HasPrefix(key, constants.KeyPrefixJob) {
+				continue
+			}
+
+			job, err := p.getJob(strings.TrimPrefix(key, constants.KeyPrefixJob))
+			if err != nil || job == nil || job.IsFinished() {
+				continue
+			}
+
+			p.scheduleJob(job)
+		}
+
+		if len(keys) < constants.KVListPerPage {
+			return
+		}
+	}
+}
+
+// scheduleJob enqueues the job once its next attempt is due.
+func (p *Plugin) scheduleJob(job *serializer.Job) {
+	delay := time.Until(time.Unix(0, job.NextAttemptAt*int64(time.Millisecond)))
+	if delay <= 0 {
+		p.enqueueJob(job.ID)
+		return
+	}
+
+	p.enqueueJobAfter(job.ID, delay)
+}
+
+// createJob stores a new job and enqueues it for processing.
+func (p *Plugin) createJob(jobType string, params map[string]string, payload interface{}) (*serializer.Job, error) {
+	return p.createDelayedJob(jobType, params, payload, 0)
+}
+
+// createDelayedJob stores a new job and schedules it to be processed once the given delay has passed.
+func (p *Plugin) createDelayedJob(jobType string, params map[string]string, payload interface{}, delay time.Duration) (*serializer.Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal job payload")
+	}
+
+	now := model.GetMillis()
+	job := &serializer.Job{
+		ID:       model.NewId(),
+		Type:     jobType,
+		Params:   params,
+		Payload:  data,
+		Status:   serializer.JobStatusPending,
+		CreateAt: now,
+		UpdateAt: now,
+	}
+	if delay > 0 {
+		job.NextAttemptAt = now + int64(delay/time.Millisecond)
+	}
+
+	if err := p.saveJob(job); err != nil {
+		return nil, err
+	}
+
+	p.scheduleJob(job)
+	return job, nil
+}
+
+func (p *Plugin) getJob(jobID string) (*serializer.Job, error) {
+	job, _, err := p.getJobWithData(jobID)
+	return job, err
+}
+
+// getJobWithData returns the job along with the data it is stored as, which is needed to update it atomically.
+func (p *Plugin) getJobWithData(jobID string) (*serializer.Job, []byte, error) {
+	data, appErr := p.API.KVGet(constants.KeyPrefixJob + jobID)
+	if appErr != nil {
+		return nil, nil, errors.Wrap(appErr, "failed to get job from KV store")
+	}
+
+	if data == nil {
+		return nil, nil, nil
+	}
+
+	var job *serializer.Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to unmarshal job")
+	}
+
+	return job, data, nil
+}
+
+// claimJob marks the job as running, unless another server of the cluster claimed it since it was read.
+// It returns false if the job must not be processed by this server.
+func (p *Plugin) claimJob(job *serializer.Job, oldData []byte) (bool, error) {
+	if job.Status == serializer.JobStatusRunning && time.Since(time.Unix(0, job.UpdateAt*int64(time.Millisecond))) < jobClaimTimeout {
+		return false, nil
+	}
+
+	job.Status = serializer.JobStatusRunning
+	job.Attempts++
+	job.UpdateAt = model.GetMillis()
+	data, err := json.Marshal(job)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to marshal job")
+	}
+
+	claimed, appErr := p.API.KVSetWithOptions(constants.KeyPrefixJob+job.ID, data, model.PluginKVSetOptions{
+		Atomic:   true,
+		OldValue: oldData,
+	})
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "failed to store job in KV store")
+	}
+
+	return claimed, nil
+}
+
+// saveJob stores the job in the KV store. Finished jobs are only kept for a limited time.
+func (p *Plugin) saveJob(job *serializer.Job) error {
+	job.UpdateAt = model.GetMillis()
+	data, err := json.Marshal(job)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal job")
+	}
+
+	var appErr *model.AppError
+	if job.IsFinished() {
+		appErr = p.API.KVSetWithExpiry(constants.KeyPrefixJob+job.ID, data, int64(jobRetentionPeriod/time.Second))
+	} else {
+		appErr = p.API.KVSet(constants.KeyPrefixJob+job.ID, data)
+	}
+
+	if appErr != nil {
+		return errors.Wrap(appErr, "failed to store job in KV store")
+	}
+
+	return nil
+}
+
+// processJob processes the job if it is due. The job is claimed first, so that it is processed by a single server of the cluster.
+func (p *Plugin) processJob(jobID string) {
+	job, data, err := p.getJobWithData(jobID)
+	if err != nil {
+		p.API.LogError("Failed to get job.", "JobID", jobID, "Error", err.Error())
+		return
+	}
+
+	if job == nil || job.IsFinished() {
+		return
+	}
+
+	processor, ok := p.getJobProcessors()[job.Type]
+	if !ok {
+		job.Status = serializer.JobStatusFailed
+		job.Error = fmt.Sprintf("unknown job type %s", job.Type)
+		p.saveFinishedJob(job)
+		return
+	}
+
+	// Another server may have enqueued the job too, for example when both scanned the unfinished jobs at startup
+	if job.NextAttemptAt > model.GetMillis() {
+		p.scheduleJob(job)
+		return
+	}
+
+	claimed, err := p.claimJob(job, data)
+	if err != nil {
+		p.API.LogError("Failed to claim job.", "JobID", jobID, "Error", err.Error())
+		return
+	}
+
+	// The job is checked again later in case the server which claimed it stops before finishing it
+	if !claimed {
+		p.API.LogDebug("Skipping a job claimed by another server.", "JobID", jobID)
+		p.enqueueJobAfter(jobID, jobClaimTimeout)
+		return
+	}
+
+	result, status, err := processor(job)
+	if result != nil {
+		data, marshalErr := json.Marshal(result)
+		if marshalErr != nil {
+			p.API.LogError("Failed to marshal job result.", "JobID", jobID, "Error", marshalErr.Error())
+		}
+		job.Result = data
+	}
+
+	switch {
+	case err == nil:
+		job.Status = serializer.JobStatusSucceeded
+		job.Error = ""
+	case status >= http.StatusInternalServerError && job.Attempts < jobMaxAttempts:
+		job.Status = serializer.JobStatusPending
+		job.Error = err.Error()
+		job.NextAttemptAt = model.GetMillis() + int64(getJobBackoff(job.Attempts)/time.Millisecond)
+		if saveErr := p.saveJob(job); saveErr != nil {
+			p.API.LogError("Failed to update job.", "JobID", jobID, "Error", saveErr.Error())
+			return
+		}
+
+		p.scheduleJob(job)
+		return
+	default:
+		job.Status = serializer.JobStatusFailed
+		job.Error = err.Error()
+	}
+
+	p.saveFinishedJob(job)
+}
+
+func (p *Plugin) saveFinishedJob(job *serializer.Job) {
+	if err := p.saveJob(job); err != nil {
+		p.API.LogError("Failed to update job.", "JobID", job.ID, "Error", err.Error())
+	}
+}
+
+// getJobBackoff returns the delay before the next attempt of a job which has failed the given number of times.
+func getJobBackoff(attempts int) time.Duration {
+	backoff := jobInitialBackoff
+	for i := 1; i < attempts && backoff < jobMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > jobMaxBackoff {
+		return jobMaxBackoff
+	}
+
+	return backoff
+}
+
+// processUpdateChannelMembersJob applies a batch of channel member changes.
+// On retries, only the changes which previously failed with a server error are applied again.
+func (p *Plugin) processUpdateChannelMembersJob(job *serializer.Job) (interface{}, int, error) {
+	var channelMembers serializer.ChannelMembers
+	if err := json.Unmarshal(job.Payload, &channelMembers); err != nil {
+		return nil, http.StatusBadRequest, errors.Wrap(err, "failed to unmarshal job payload")
+	}
+
+	var results serializer.ChannelMemberResults
+	if job.Result != nil {
+		_ = json.Unmarshal(job.Result, &results)
+	}
+
+	if len(results) != len(channelMembers) {
+		results = make(serializer.ChannelMemberResults, len(channelMembers))
+	}
+
+	var failed int
+	for i := range channelMembers {
+		if results[i].Status == model.STATUS_OK || (results[i].Status == model.STATUS_FAIL && results[i].StatusCode < http.StatusInternalServerError) {
+			continue
+		}
+
+		results[i] = p.applyChannelMemberChange(job.Params[serializer.JobParamSiteID], job.Params[serializer.JobParamChannelID], &channelMembers[i])
+		if results[i].Status == model.STATUS_FAIL && results[i].StatusCode >= http.StatusInternalServerError {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return results, http.StatusInternalServerError, errors.Errorf("%d channel member changes failed with a server error", failed)
+	}
+
+	return results, 0, nil
+}
+
+// processReconcileChannelMembersJob reconciles the members of a channel.
+// As reconciliation is idempotent, the whole job is retried if any change failed with a server error.
+func (p *Plugin) processReconcileChannelMembersJob(job *serializer.Job) (interface{}, int, error) {
+	var channelMembers serializer.ChannelMembers
+	if err := json.Unmarshal(job.Payload, &channelMembers); err != nil {
+		return nil, http.StatusBadRequest, errors.Wrap(err, "failed to unmarshal job payload")
+	}
+
+	reconciliation, status, err := p.reconcileChannelMembers(job.Params[serializer.JobParamSiteID], job.Params[serializer.JobParamChannelID], channelMembers, false, job.Params[serializer.JobParamDryRun] == "true")
+	if err != nil {
+		return nil, status, err
+	}
+
+	for _, result := range reconciliation.Errors {
+		if result.StatusCode >= http.StatusInternalServerError {
+			return reconciliation, http.StatusInternalServerError, errors.New("some channel member changes failed with a server error")
+		}
+	}
+
+	return reconciliation, 0, nil
+}
+
+// writeAcceptedJob creates a job and responds with it, so that its status can be polled.
+func (p *Plugin) writeAcceptedJob(w http.ResponseWriter, r *http.Request, jobType string, params map[string]string, payload interface{}) {
+	job, err := p.createJob(jobType, params, payload)
+	if err != nil {
+		p.API.LogError(fmt.Sprintf("Failed to create job. Error: %v", err.Error()))
+		p.writeError(w, r, http.StatusInternalServerError, errors.Wrap(err, "failed to create job"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write([]byte(job.ToJSON()))
+}
+
+func (p *Plugin) GetJob(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["job_id"]
+	if !model.IsValidId(jobID) {
+		p.API.LogError("job id is not valid")
+		p.writeError(w, r, http.StatusBadRequest, serializer.NewError(serializer.ErrorCodeInvalidJobID, "job id is not valid"))
+		return
+	}
+
+	job, err := p.getJob(jobID)
+	if err != nil {
+		p.API.LogError(fmt.Sprintf("Failed to get job. Error: %v", err.Error()))
+		p.writeError(w, r, http.StatusInternalServerError, errors.Wrap(err, "failed to get job"))
+		return
+	}
+
+	if job == nil {
+		p.writeError(w, r, http.StatusNotFound, serializer.NewError(serializer.ErrorCodeJobNotFound, "job not found"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(job.ToJSON()))
+}
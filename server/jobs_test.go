@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils/testutils"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetJobBackoff(t *testing.T) {
+	assert.Equal(t, jobInitialBackoff, getJobBackoff(1))
+	assert.Equal(t, 2*jobInitialBackoff, getJobBackoff(2))
+	assert.Equal(t, 8*jobInitialBackoff, getJobBackoff(4))
+	assert.Equal(t, jobMaxBackoff, getJobBackoff(100))
+}
+
+func TestProcessJob(t *testing.T) {
+	userID := testutils.GetID()
+	for name, test := range map[string]struct {
+		Job              *serializer.Job
+		SetupAPI         func(*plugintest.API) *plugintest.API
+		ExpectedStatus   string
+		ExpectedAttempts int
+		ExpectedResults  []string
+	}{
+		"job succeeds": {
+			Job: testutils.GetJob(serializer.JobTypeUpdateChannelMembers, serializer.ChannelMembers{{UserID: userID}}, nil),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("AddUserToChannel", testutils.GetID(), userID, mock.AnythingOfType("string")).Return(nil, nil)
+				return api
+			},
+			ExpectedStatus:   serializer.JobStatusSucceeded,
+			ExpectedAttempts: 1,
+			ExpectedResults:  []string{model.STATUS_OK},
+		},
+		"job is retried after a server error": {
+			Job: testutils.GetJob(serializer.JobTypeUpdateChannelMembers, serializer.ChannelMembers{{UserID: userID}, {UserID: "adfdf"}}, nil),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("AddUserToChannel", testutils.GetID(), userID, mock.AnythingOfType("string")).Return(nil, testutils.GetInternalServerAppError())
+				api.On("LogWarn", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatus:   serializer.JobStatusPending,
+			ExpectedAttempts: 1,
+			ExpectedResults:  []string{model.STATUS_FAIL, model.STATUS_FAIL},
+		},
+		"only failed changes are retried": {
+			Job: testutils.GetJob(serializer.JobTypeUpdateChannelMembers, serializer.ChannelMembers{{UserID: userID}, {UserID: userID}}, serializer.ChannelMemberResults{
+				{UserID: userID, Status: model.STATUS_OK},
+				{UserID: userID, Status: model.STATUS_FAIL, StatusCode: http.StatusInternalServerError},
+			}),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("AddUserToChannel", testutils.GetID(), userID, mock.AnythingOfType("string")).Return(nil, nil).Once()
+				return api
+			},
+			ExpectedStatus:   serializer.JobStatusSucceeded,
+			ExpectedAttempts: 1,
+			ExpectedResults:  []string{model.STATUS_OK, model.STATUS_OK},
+		},
+		"job fails after the maximum number of attempts": {
+			Job: func() *serializer.Job {
+				job := testutils.GetJob(serializer.JobTypeUpdateChannelMembers, serializer.ChannelMembers{{UserID: userID}}, nil)
+				job.Attempts = jobMaxAttempts - 1
+				return job
+			}(),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("AddUserToChannel", testutils.GetID(), userID, mock.AnythingOfType("string")).Return(nil, testutils.GetInternalServerAppError())
+				api.On("LogWarn", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatus:   serializer.JobStatusFailed,
+			ExpectedAttempts: jobMaxAttempts,
+			ExpectedResults:  []string{model.STATUS_FAIL},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			api := test.SetupAPI(&plugintest.API{})
+			defer api.AssertExpectations(t)
+
+			var savedJob *serializer.Job
+			saveJob := func(args mock.Arguments) {
+				require.Nil(t, json.Unmarshal(args.Get(1).([]byte), &savedJob))
+			}
+			data, err := json.Marshal(test.Job)
+			require.Nil(t, err)
+			api.On("KVGet", constants.KeyPrefixJob+test.Job.ID).Return(data, nil)
+			api.On("KVSetWithOptions", constants.KeyPrefixJob+test.Job.ID, mock.Anything, model.PluginKVSetOptions{Atomic: true, OldValue: data}).Run(saveJob).Return(true, nil)
+			api.On("KVSet", constants.KeyPrefixJob+test.Job.ID, mock.Anything).Run(saveJob).Return(nil).Maybe()
+			api.On("KVSetWithExpiry", constants.KeyPrefixJob+test.Job.ID, mock.Anything, mock.AnythingOfType("int64")).Run(saveJob).Return(nil).Maybe()
+
+			p := setupTestPlugin(api)
+			p.processJob(test.Job.ID)
+
+			require.NotNil(t, savedJob)
+			assert.Equal(test.ExpectedStatus, savedJob.Status)
+			assert.Equal(test.ExpectedAttempts, savedJob.Attempts)
+
+			var results serializer.ChannelMemberResults
+			require.Nil(t, json.Unmarshal(savedJob.Result, &results))
+			require.Len(t, results, len(test.ExpectedResults))
+			for i, status := range test.ExpectedResults {
+				assert.Equal(status, results[i].Status)
+			}
+		})
+	}
+}
+
+func TestProcessJobClaimedByAnotherServer(t *testing.T) {
+	userID := testutils.GetID()
+	for name, test := range map[string]struct {
+		Job      *serializer.Job
+		SetupAPI func(*plugintest.API, []byte) *plugintest.API
+	}{
+		"job claimed since it was read": {
+			Job: testutils.GetJob(serializer.JobTypeUpdateChannelMembers, serializer.ChannelMembers{{UserID: userID}}, nil),
+			SetupAPI: func(api *plugintest.API, data []byte) *plugintest.API {
+				api.On("KVSetWithOptions", mock.AnythingOfType("string"), mock.Anything, model.PluginKVSetOptions{Atomic: true, OldValue: data}).Return(false, nil)
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 3)...).Return()
+				return api
+			},
+		},
+		"job running on another server": {
+			Job: func() *serializer.Job {
+				job := testutils.GetJob(serializer.JobTypeUpdateChannelMembers, serializer.ChannelMembers{{UserID: userID}}, nil)
+				job.Status = serializer.JobStatusRunning
+				job.UpdateAt = model.GetMillis()
+				return job
+			}(),
+			SetupAPI: func(api *plugintest.API, data []byte) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 3)...).Return()
+				return api
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			data, err := json.Marshal(test.Job)
+			require.Nil(t, err)
+
+			api := test.SetupAPI(&plugintest.API{}, data)
+			defer api.AssertExpectations(t)
+			api.On("KVGet", constants.KeyPrefixJob+test.Job.ID).Return(data, nil)
+
+			p := setupTestPlugin(api)
+			p.processJob(test.Job.ID)
+
+			api.AssertNotCalled(t, "AddUserToChannel", mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestGetJob(t *testing.T) {
+	requestMethod := http.MethodGet
+	job := testutils.GetJob(serializer.JobTypeReconcileChannelMembers, serializer.ChannelMembers{}, nil)
+	for name, test := range map[string]struct {
+		RequestURL         string
+		SetupAPI           func(*plugintest.API) *plugintest.API
+		ExpectedStatusCode int
+	}{
+		"job found": {
+			RequestURL: fmt.Sprintf("/api/v1/jobs/%s?secret=%s", job.ID, testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				data, _ := json.Marshal(job)
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVGet", constants.KeyPrefixJob+job.ID).Return(data, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"job not found": {
+			RequestURL: fmt.Sprintf("/api/v1/jobs/%s?secret=%s", job.ID, testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVGet", constants.KeyPrefixJob+job.ID).Return(nil, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusNotFound,
+		},
+		"job id not valid": {
+			RequestURL: fmt.Sprintf("/api/v1/jobs/%s?secret=%s", "adfdf", testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			api := test.SetupAPI(&plugintest.API{})
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(requestMethod, test.RequestURL, nil)
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+
+			assert.Equal(test.ExpectedStatusCode, result.StatusCode)
+		})
+	}
+}
+
+func TestJobWorker(t *testing.T) {
+	api := &plugintest.API{}
+	defer api.AssertExpectations(t)
+
+	userID := testutils.GetID()
+	job := testutils.GetJob(serializer.JobTypeUpdateChannelMembers, serializer.ChannelMembers{{UserID: userID}}, nil)
+	data, err := json.Marshal(job)
+	require.Nil(t, err)
+
+	processed := make(chan struct{})
+	api.On("KVList", 0, constants.KVListPerPage).Return([]string{constants.KeyPrefixJob + job.ID, constants.KeyPrefixNonce + "abc"}, nil)
+	api.On("KVGet", constants.KeyPrefixJob+job.ID).Return(data, nil)
+	api.On("KVSetWithOptions", constants.KeyPrefixJob+job.ID, mock.Anything, model.PluginKVSetOptions{Atomic: true, OldValue: data}).Return(true, nil)
+	api.On("AddUserToChannel", testutils.GetID(), userID, mock.AnythingOfType("string")).Return(nil, nil)
+	api.On("KVSetWithExpiry", constants.KeyPrefixJob+job.ID, mock.Anything, mock.AnythingOfType("int64")).Run(func(mock.Arguments) {
+		close(processed)
+	}).Return(nil)
+
+	p := setupTestPlugin(api)
+	p.startJobWorker()
+	defer p.stopJobWorker()
+
+	select {
+	case <-processed:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "unfinished job was not processed")
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"strings"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils"
+	"github.com/pkg/errors"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// mappingType describes a kind of entity which is linked between Moodle and Mattermost.
+// Every mapping is stored twice in the KV store, once under each side's ID, so that it can be looked up in both directions.
+type mappingType struct {
+	name             string
+	moodlePrefix     string
+	mattermostPrefix string
+	// perSite is true if the Moodle IDs are only unique within a Moodle site, in which case the mappings are stored per site
+	perSite bool
+	// siteID is the Moodle site the Moodle IDs belong to. It is set with forSite.
+	siteID string
+}
+
+var (
+	courseChannelMapping = mappingType{name: "course", moodlePrefix: constants.KeyPrefixCourse, mattermostPrefix: constants.KeyPrefixChannel, perSite: true}
+	userMapping          = mappingType{name: "user", moodlePrefix: constants.KeyPrefixMoodleUser, mattermostPrefix: constants.KeyPrefixMattermostUser, perSite: true}
+	siteTeamMapping      = mappingType{name: "site", moodlePrefix: constants.KeyPrefixSite, mattermostPrefix: constants.KeyPrefixTeam}
+)
+
+// mappingStoreMaxAttempts is the number of times storing a mapping is attempted when the mappings it replaces change concurrently
+const mappingStoreMaxAttempts = 5
+
+// forSite returns the mapping type for the Moodle IDs of the given site.
+// The mappings stored without a site are used by the requests which do not give one.
+func (mt mappingType) forSite(siteID string) mappingType {
+	if mt.perSite {
+		mt.siteID = siteID
+	}
+
+	return mt
+}
+
+func (mt mappingType) getMoodleKey(moodleID string) string {
+	if mt.siteID == "" {
+		return utils.GetKeyHash(mt.moodlePrefix, moodleID)
+	}
+
+	// Moodle IDs cannot contain "/", so site and Moodle IDs cannot be combined into the same key in two ways
+	return utils.GetKeyHash(mt.moodlePrefix, mt.siteID+"/"+moodleID)
+}
+
+func (mt mappingType) getMattermostKey(mattermostID string) string {
+	return utils.GetKeyHash(mt.mattermostPrefix, mattermostID)
+}
+
+// getRequestSiteID returns the Moodle site the request comes from, or an empty string if it does not give one.
+func getRequestSiteID(r *http.Request) string {
+	return r.URL.Query().Get(constants.QueryParamSiteID)
+}
+
+func (p *Plugin) getMapping(key string) (*serializer.Mapping, error) {
+	data, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get mapping from KV store")
+	}
+
+	return unmarshalMapping(data)
+}
+
+func unmarshalMapping(data []byte) (*serializer.Mapping, error) {
+	if data == nil {
+		return nil, nil
+	}
+
+	var mapping *serializer.Mapping
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal mapping")
+	}
+
+	return mapping, nil
+}
+
+// getMappingByMoodleID returns the mapping for the given Moodle ID or nil if there is none.
+func (p *Plugin) getMappingByMoodleID(mt mappingType, moodleID string) (*serializer.Mapping, error) {
+	return p.getMapping(mt.getMoodleKey(moodleID))
+}
+
+// getMappingByMattermostID returns the mapping for the given Mattermost ID or nil if there is none.
+func (p *Plugin) getMappingByMattermostID(mt mappingType, mattermostID string) (*serializer.Mapping, error) {
+	return p.getMapping(mt.getMattermostKey(mattermostID))
+}
+
+// storeMapping links the given Moodle and Mattermost IDs, replacing any existing mapping of either of them.
+// Both directions are written with compare-and-set, and the whole operation is retried if either of them changed concurrently,
+// so that concurrent calls cannot leave a direction pointing to a mapping which was replaced.
+// If the Mattermost direction changed after the Moodle direction was written, the Moodle direction is set back before retrying,
+// so that an operation which fails does not leave the two directions pointing to different mappings.
+func (p *Plugin) storeMapping(mt mappingType, moodleID, mattermostID string) error {
+	mapping := &serializer.Mapping{
+		MoodleID:     moodleID,
+		MattermostID: mattermostID,
+		SiteID:       mt.siteID,
+	}
+
+	data, err := json.Marshal(mapping)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal mapping")
+	}
+
+	moodleKey := mt.getMoodleKey(moodleID)
+	mattermostKey := mt.getMattermostKey(mattermostID)
+	for attempt := 0; attempt < mappingStoreMaxAttempts; attempt++ {
+		oldMoodleData, appErr := p.API.KVGet(moodleKey)
+		if appErr != nil {
+			return errors.Wrap(appErr, "failed to get mapping from KV store")
+		}
+
+		oldMattermostData, appErr := p.API.KVGet(mattermostKey)
+		if appErr != nil {
+			return errors.Wrap(appErr, "failed to get mapping from KV store")
+		}
+
+		// The mappings replaced by this one, whose other direction must be deleted
+		var replaced [][]byte
+		for _, oldData := range [][]byte{oldMoodleData, oldMattermostData} {
+			if oldData != nil && !bytes.Equal(oldData, data) {
+				replaced = append(replaced, oldData)
+			}
+		}
+
+		stored, err := p.compareAndSetMapping(moodleKey, oldMoodleData, data)
+		if err != nil {
+			return err
+		}
+
+		if !stored {
+			continue
+		}
+
+		stored, err = p.compareAndSetMapping(mattermostKey, oldMattermostData, data)
+		if err != nil || !stored {
+			// The Moodle direction is only set back if no other call replaced it in the meantime
+			if _, rollbackErr := p.compareAndSetMapping(moodleKey, data, oldMoodleData); rollbackErr != nil {
+				return rollbackErr
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		if !stored {
+			continue
+		}
+
+		for _, oldData := range replaced {
+			if err := p.deleteReplacedMapping(mt, oldData, moodleKey, mattermostKey); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return errors.Errorf("failed to store mapping after %d attempts as it was changed concurrently", mappingStoreMaxAttempts)
+}
+
+// compareAndSetMapping sets the key to the new value if it still has the old value.
+func (p *Plugin) compareAndSetMapping(key string, oldValue, newValue []byte) (bool, error) {
+	// Setting a key to the value it already has counts as no change in some databases, so that is not a failed comparison
+	if bytes.Equal(oldValue, newValue) {
+		return true, nil
+	}
+
+	stored, appErr := p.API.KVSetWithOptions(key, newValue, model.PluginKVSetOptions{
+		Atomic:   true,
+		OldValue: oldValue,
+	})
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "failed to store mapping in KV store")
+	}
+
+	return stored, nil
+}
+
+// deleteReplacedMapping deletes the keys of a replaced mapping, apart from the keys of the new mapping which replaced it.
+// The keys are only deleted if they still hold the replaced mapping.
+func (p *Plugin) deleteReplacedMapping(mt mappingType, oldData []byte, moodleKey, mattermostKey string) error {
+	old, err := unmarshalMapping(oldData)
+	if err != nil || old == nil {
+		return err
+	}
+
+	for _, key := range []string{mt.forSite(old.SiteID).getMoodleKey(old.MoodleID), mt.getMattermostKey(old.MattermostID)} {
+		if key == moodleKey || key == mattermostKey {
+			continue
+		}
+
+		if _, appErr := p.API.KVSetWithOptions(key, nil, model.PluginKVSetOptions{
+			Atomic:   true,
+			OldValue: oldData,
+		}); appErr != nil {
+			return errors.Wrap(appErr, "failed to delete mapping from KV store")
+		}
+	}
+
+	return nil
+}
+
+func (p *Plugin) deleteMapping(mt mappingType, mapping *serializer.Mapping) error {
+	if appErr := p.API.KVDelete(mt.forSite(mapping.SiteID).getMoodleKey(mapping.MoodleID)); appErr != nil {
+		return errors.Wrap(appErr, "failed to delete mapping from KV store")
+	}
+
+	if appErr := p.API.KVDelete(mt.getMattermostKey(mapping.MattermostID)); appErr != nil {
+		return errors.Wrap(appErr, "failed to delete mapping from KV store")
+	}
+
+	return nil
+}
+
+// listMappings returns every mapping of the given type.
+func (p *Plugin) listMappings(mt mappingType) ([]*serializer.Mapping, error) {
+	var mappings []*serializer.Mapping
+	for page := 0; ; page++ {
+		keys, appErr := p.API.KVList(page, constants.KVListPerPage)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "failed to list keys from KV store")
+		}
+
+		for _, key := range keys {
+			if !strings.HasPrefix(key, mt.moodlePrefix) {
+				continue
+			}
+
+			mapping, err := p.getMapping(key)
+			if err != nil {
+				return nil, err
+			}
+
+			if mapping != nil {
+				mappings = append(mappings, mapping)
+			}
+		}
+
+		if len(keys) < constants.KVListPerPage {
+			return mappings, nil
+		}
+	}
+}
+
+// resolveMattermostID returns the Mattermost ID passed in the given path variable of the request.
+// If the "id_type" query parameter is set to "moodle", the path variable is treated as a Moodle ID and resolved using the given mapping.
+func (p *Plugin) resolveMattermostID(r *http.Request, mt mappingType, varName string) (id string, status int, err error) {
+	id = mux.Vars(r)[varName]
+	if r.URL.Query().Get(constants.QueryParamIDType) != constants.IDTypeMoodle {
+		if !model.IsValidId(id) {
+			// The code matches serializer.ErrorCodeInvalidChannelID and serializer.ErrorCodeInvalidUserID for the path variables in use
+			return "", http.StatusBadRequest, serializer.NewError("invalid_"+varName, fmt.Sprintf("%s is not valid", strings.ReplaceAll(varName, "_", " ")))
+		}
+
+		return id, 0, nil
+	}
+
+	return p.resolveMoodleID(mt.forSite(getRequestSiteID(r)), id)
+}
+
+// resolveMoodleID returns the Mattermost ID mapped to the given Moodle ID.
+func (p *Plugin) resolveMoodleID(mt mappingType, moodleID string) (id string, status int, err error) {
+	if !serializer.IsValidMoodleID(moodleID) {
+		return "", http.StatusBadRequest, serializer.NewError(serializer.ErrorCodeInvalidMoodleID, fmt.Sprintf("moodle %s id is not valid", mt.name))
+	}
+
+	mapping, err := p.getMappingByMoodleID(mt, moodleID)
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+
+	if mapping == nil {
+		return "", http.StatusNotFound, serializer.NewError(serializer.ErrorCodeMappingNotFound, fmt.Sprintf("no mapping found for moodle %s id %s", mt.name, moodleID))
+	}
+
+	return mapping.MattermostID, 0, nil
+}
+
+// resolveChannelMemberUserID fills in the user ID of the channel member from its Moodle user ID of the given site, if needed.
+func (p *Plugin) resolveChannelMemberUserID(siteID string, channelMember *serializer.ChannelMember) (status int, err error) {
+	if channelMember.UserID != "" {
+		return 0, nil
+	}
+
+	channelMember.UserID, status, err = p.resolveMoodleID(userMapping.forSite(siteID), channelMember.MoodleUserID)
+	return status, err
+}
+
+// getTeamByNameOrSite returns the team with the given name, or else the team mapped to the given Moodle site.
+// When both are given, the site is mapped to the team. The team is provisioned if it does not exist and team provisioning is enabled.
+func (p *Plugin) getTeamByNameOrSite(teamName, siteID, categoryName string) (*model.Team, int, error) {
+	if teamName == "" {
+		teamID, status, err := p.resolveMoodleID(siteTeamMapping, siteID)
+		if err != nil {
+			return nil, status, err
+		}
+
+		team, appErr := p.API.GetTeam(teamID)
+		if appErr != nil {
+			return nil, appErr.StatusCode, errors.Wrap(appErr, "invalid team id")
+		}
+
+		return team, 0, nil
+	}
+
+	team, status, err := p.getOrProvisionTeam(teamName, categoryName)
+	if err != nil {
+		return nil, status, err
+	}
+
+	if siteID != "" {
+		if err := p.storeMapping(siteTeamMapping, siteID, team.Id); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+
+	return team, 0, nil
+}
+
+// getMappingHandler returns a handler which looks up a mapping by the ID in the path of the request.
+func (p *Plugin) getMappingHandler(mt mappingType, byMoodleID bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mt := mt.forSite(getRequestSiteID(r))
+		var mapping *serializer.Mapping
+		var err error
+		if byMoodleID {
+			moodleID := mux.Vars(r)["moodle_id"]
+			if !serializer.IsValidMoodleID(moodleID) {
+				p.API.LogError("moodle id is not valid")
+				p.writeError(w, r, http.StatusBadRequest, serializer.NewError(serializer.ErrorCodeInvalidMoodleID, "moodle id is not valid"))
+				return
+			}
+
+			mapping, err = p.getMappingByMoodleID(mt, moodleID)
+		} else {
+			mattermostID := mux.Vars(r)["mattermost_id"]
+			if !model.IsValidId(mattermostID) {
+				p.API.LogError("mattermost id is not valid")
+				p.writeError(w, r, http.StatusBadRequest, serializer.NewError(serializer.ErrorCodeInvalidMattermostID, "mattermost id is not valid"))
+				return
+			}
+
+			mapping, err = p.getMappingByMattermostID(mt, mattermostID)
+		}
+
+		if err != nil {
+			p.API.LogError(fmt.Sprintf("Failed to get %s mapping. Error: %v", mt.name, err.Error()))
+			p.writeError(w, r, http.StatusInternalServerError, errors.Wrapf(err, "failed to get %s mapping", mt.name))
+			return
+		}
+
+		if mapping == nil {
+			p.writeError(w, r, http.StatusNotFound, serializer.NewError(serializer.ErrorCodeMappingNotFound, fmt.Sprintf("no %s mapping found", mt.name)))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(mapping.ToJSON()))
+	}
+}
+
+// storeMappingHandler returns a handler which links the Moodle ID in the path of the request to the Mattermost ID in its body.
+// This allows Moodle to backfill the mappings of entities created before the plugin kept track of them.
+func (p *Plugin) storeMappingHandler(mt mappingType) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mt := mt.forSite(getRequestSiteID(r))
+		mapping := serializer.MappingFromJSON(r.Body)
+		if mapping != nil {
+			mapping.MoodleID = mux.Vars(r)["moodle_id"]
+			mapping.SiteID = mt.siteID
+		}
+
+		if err := mapping.Validate(); err != nil {
+			p.API.LogError(err.Error())
+			p.writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := p.storeMapping(mt, mapping.MoodleID, mapping.MattermostID); err != nil {
+			p.API.LogError(fmt.Sprintf("Failed to store %s mapping. Error: %v", mt.name, err.Error()))
+			p.writeError(w, r, http.StatusInternalServerError, errors.Wrapf(err, "failed to store %s mapping", mt.name))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(mapping.ToJSON()))
+	}
+}
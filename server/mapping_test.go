@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils/testutils"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetMapping(t *testing.T) {
+	requestMethod := http.MethodGet
+	for name, test := range map[string]struct {
+		RequestURL         string
+		SetupAPI           func(*plugintest.API) *plugintest.API
+		ExpectedStatusCode int
+		ExpectedMapping    *serializer.Mapping
+	}{
+		"course mapping found": {
+			RequestURL: fmt.Sprintf("/api/v1/mappings/courses/%s?secret=%s", "42", testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVGet", mock.AnythingOfType("string")).Return(testutils.GetMappingJSON("42", testutils.GetID()), nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedMapping:    &serializer.Mapping{MoodleID: "42", MattermostID: testutils.GetID()},
+		},
+		"channel mapping found": {
+			RequestURL: fmt.Sprintf("/api/v1/mappings/channels/%s?secret=%s", testutils.GetID(), testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVGet", mock.AnythingOfType("string")).Return(testutils.GetMappingJSON("42", testutils.GetID()), nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedMapping:    &serializer.Mapping{MoodleID: "42", MattermostID: testutils.GetID()},
+		},
+		"user mapping not found": {
+			RequestURL: fmt.Sprintf("/api/v1/mappings/moodle_users/%s?secret=%s", "7", testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVGet", mock.AnythingOfType("string")).Return(nil, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusNotFound,
+		},
+		"team id not valid": {
+			RequestURL: fmt.Sprintf("/api/v1/mappings/teams/%s?secret=%s", "adfdf", testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+		"failed to get site mapping": {
+			RequestURL: fmt.Sprintf("/api/v1/mappings/sites/%s?secret=%s", "moodle.example.com", testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVGet", mock.AnythingOfType("string")).Return(nil, testutils.GetInternalServerAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			api := test.SetupAPI(&plugintest.API{})
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(requestMethod, test.RequestURL, nil)
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+
+			assert.Equal(test.ExpectedStatusCode, result.StatusCode)
+			if test.ExpectedMapping != nil {
+				assert.Equal(test.ExpectedMapping, serializer.MappingFromJSON(result.Body))
+			}
+		})
+	}
+}
+
+func TestStoreMapping(t *testing.T) {
+	requestMethod := http.MethodPut
+	for name, test := range map[string]struct {
+		RequestURL         string
+		SetupAPI           func(*plugintest.API) (api *plugintest.API, payload serializer.Mapping)
+		ExpectedStatusCode int
+	}{
+		"success": {
+			RequestURL: fmt.Sprintf("/api/v1/mappings/courses/%s?secret=%s", "42", testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.Mapping) {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVGet", mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("KVSetWithOptions", mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(true, nil).Times(2)
+				return api, serializer.Mapping{MattermostID: testutils.GetID()}
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"existing mapping is replaced": {
+			RequestURL: fmt.Sprintf("/api/v1/mappings/courses/%s?secret=%s", "42", testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.Mapping) {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				// Course 42 was linked to another channel, whose mapping to the course is deleted
+				oldMapping := testutils.GetMappingJSON("42", model.NewId())
+				var old serializer.Mapping
+				require.NoError(t, json.Unmarshal(oldMapping, &old))
+				courseKey := utils.GetKeyHash(constants.KeyPrefixCourse, "42")
+				channelKey := utils.GetKeyHash(constants.KeyPrefixChannel, testutils.GetID())
+				api.On("KVGet", courseKey).Return(oldMapping, nil)
+				api.On("KVGet", channelKey).Return(nil, nil)
+				api.On("KVSetWithOptions", courseKey, mock.Anything, model.PluginKVSetOptions{Atomic: true, OldValue: oldMapping}).Return(true, nil)
+				api.On("KVSetWithOptions", channelKey, mock.Anything, model.PluginKVSetOptions{Atomic: true}).Return(true, nil)
+				api.On("KVSetWithOptions", utils.GetKeyHash(constants.KeyPrefixChannel, old.MattermostID), []byte(nil), model.PluginKVSetOptions{Atomic: true, OldValue: oldMapping}).Return(true, nil)
+				return api, serializer.Mapping{MattermostID: testutils.GetID()}
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"mattermost direction changed concurrently": {
+			RequestURL: fmt.Sprintf("/api/v1/mappings/courses/%s?secret=%s", "42", testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.Mapping) {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				// The channel was linked to course 40 when the mapping was read, and unlinked before it was written
+				newMapping := testutils.GetMappingJSON("42", testutils.GetID())
+				oldMapping := testutils.GetMappingJSON("40", testutils.GetID())
+				courseKey := utils.GetKeyHash(constants.KeyPrefixCourse, "42")
+				channelKey := utils.GetKeyHash(constants.KeyPrefixChannel, testutils.GetID())
+				api.On("KVGet", courseKey).Return(nil, nil)
+				api.On("KVGet", channelKey).Return(oldMapping, nil).Once()
+				api.On("KVGet", channelKey).Return(nil, nil).Once()
+				api.On("KVSetWithOptions", courseKey, newMapping, model.PluginKVSetOptions{Atomic: true}).Return(true, nil).Twice()
+				api.On("KVSetWithOptions", channelKey, newMapping, model.PluginKVSetOptions{Atomic: true, OldValue: oldMapping}).Return(false, nil).Once()
+				// The course direction is set back before retrying, and the mapping of course 40 read by the failed attempt is not deleted
+				api.On("KVSetWithOptions", courseKey, []byte(nil), model.PluginKVSetOptions{Atomic: true, OldValue: newMapping}).Return(true, nil).Once()
+				api.On("KVSetWithOptions", channelKey, newMapping, model.PluginKVSetOptions{Atomic: true}).Return(true, nil).Once()
+				return api, serializer.Mapping{MattermostID: testutils.GetID()}
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"mattermost direction failed to be stored": {
+			RequestURL: fmt.Sprintf("/api/v1/mappings/courses/%s?secret=%s", "42", testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.Mapping) {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				newMapping := testutils.GetMappingJSON("42", testutils.GetID())
+				courseKey := utils.GetKeyHash(constants.KeyPrefixCourse, "42")
+				channelKey := utils.GetKeyHash(constants.KeyPrefixChannel, testutils.GetID())
+				api.On("KVGet", mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("KVSetWithOptions", courseKey, newMapping, model.PluginKVSetOptions{Atomic: true}).Return(true, nil).Once()
+				api.On("KVSetWithOptions", channelKey, newMapping, model.PluginKVSetOptions{Atomic: true}).Return(false, testutils.GetInternalServerAppError()).Once()
+				api.On("KVSetWithOptions", courseKey, []byte(nil), model.PluginKVSetOptions{Atomic: true, OldValue: newMapping}).Return(true, nil).Once()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api, serializer.Mapping{MattermostID: testutils.GetID()}
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+		"mattermost id not valid": {
+			RequestURL: fmt.Sprintf("/api/v1/mappings/moodle_users/%s?secret=%s", "7", testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.Mapping) {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api, serializer.Mapping{MattermostID: "adfdf"}
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+		"failed to store mapping": {
+			RequestURL: fmt.Sprintf("/api/v1/mappings/sites/%s?secret=%s", "moodle.example.com", testutils.GetSecret()),
+			SetupAPI: func(api *plugintest.API) (*plugintest.API, serializer.Mapping) {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVGet", mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("KVSetWithOptions", mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(false, testutils.GetInternalServerAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api, serializer.Mapping{MattermostID: testutils.GetID()}
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			api, payload := test.SetupAPI(&plugintest.API{})
+			reqBody, err := json.Marshal(payload)
+			require.Nil(t, err)
+
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(requestMethod, test.RequestURL, bytes.NewBuffer(reqBody))
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+
+			assert.Equal(test.ExpectedStatusCode, result.StatusCode)
+		})
+	}
+}
+
+func TestMoodleIDsInPlaceOfMattermostIDs(t *testing.T) {
+	for name, test := range map[string]struct {
+		RequestURL         string
+		RequestMethod      string
+		SetupAPI           func(*plugintest.API) *plugintest.API
+		ExpectedStatusCode int
+	}{
+		"archive channel by course id": {
+			RequestURL:    fmt.Sprintf("/api/v1/channels/%s?id_type=moodle&secret=%s", "42", testutils.GetSecret()),
+			RequestMethod: http.MethodDelete,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVGet", utils.GetKeyHash(constants.KeyPrefixCourse, "42")).Return(testutils.GetMappingJSON("42", testutils.GetID()), nil)
+				api.On("KVGet", utils.GetKeyHash(constants.KeyPrefixGroupChannels, testutils.GetID())).Return(nil, nil)
+				api.On("DeleteChannel", testutils.GetID()).Return(nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"archive channel by course id of a site": {
+			RequestURL:    fmt.Sprintf("/api/v1/channels/%s?id_type=moodle&site_id=%s&secret=%s", "42", "moodle.example.com", testutils.GetSecret()),
+			RequestMethod: http.MethodDelete,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVGet", utils.GetKeyHash(constants.KeyPrefixCourse, "moodle.example.com/42")).Return(testutils.GetMappingJSON("42", testutils.GetID()), nil)
+				api.On("KVGet", utils.GetKeyHash(constants.KeyPrefixGroupChannels, testutils.GetID())).Return(nil, nil)
+				api.On("DeleteChannel", testutils.GetID()).Return(nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"site id not valid": {
+			RequestURL:    fmt.Sprintf("/api/v1/channels/%s?id_type=moodle&site_id=%s&secret=%s", "42", "a%2Fb", testutils.GetSecret()),
+			RequestMethod: http.MethodDelete,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+		"course not mapped": {
+			RequestURL:    fmt.Sprintf("/api/v1/channels/%s?id_type=moodle&secret=%s", "42", testutils.GetSecret()),
+			RequestMethod: http.MethodDelete,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVGet", mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusNotFound,
+		},
+		"delete user by moodle user id": {
+			RequestURL:    fmt.Sprintf("/api/v1/users/%s?id_type=moodle&secret=%s", "7", testutils.GetSecret()),
+			RequestMethod: http.MethodDelete,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+				api.On("KVGet", mock.AnythingOfType("string")).Return(testutils.GetMappingJSON("7", testutils.GetID()), nil)
+				api.On("DeleteUser", testutils.GetID()).Return(nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			api := test.SetupAPI(&plugintest.API{})
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(test.RequestMethod, test.RequestURL, nil)
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+
+			assert.Equal(test.ExpectedStatusCode, result.StatusCode)
+		})
+	}
+}
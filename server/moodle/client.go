@@ -0,0 +1,199 @@
+// Package moodle is a client for the REST web services of a Moodle site.
+package moodle
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// restPath is the path of the REST web services endpoint, relative to the base URL of the Moodle site
+	restPath = "/webservice/rest/server.php"
+
+	FunctionGetCourses       = "core_course_get_courses"
+	FunctionGetEnrolledUsers = "core_enrol_get_enrolled_users"
+
+	// EnrolledUsersPerPage is the number of enrolled users fetched at once
+	EnrolledUsersPerPage = 500
+
+	defaultTimeout = 30 * time.Second
+	// responseMaxSize is the maximum size of a response read from Moodle
+	responseMaxSize = 32 * 1024 * 1024
+)
+
+// Client calls the functions of the REST web services of a Moodle site with a web services token.
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// Error is the exception returned by Moodle when a web service function fails
+type Error struct {
+	Exception string `json:"exception"`
+	ErrorCode string `json:"errorcode"`
+	Message   string `json:"message"`
+	DebugInfo string `json:"debuginfo,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("moodle error %s: %s", e.ErrorCode, e.Message)
+}
+
+type Course struct {
+	ID         int64  `json:"id"`
+	ShortName  string `json:"shortname"`
+	FullName   string `json:"fullname"`
+	CategoryID int64  `json:"categoryid"`
+	IDNumber   string `json:"idnumber"`
+	Visible    int    `json:"visible"`
+	StartDate  int64  `json:"startdate"`
+	EndDate    int64  `json:"enddate"`
+}
+
+// EnrolledUser is a user enrolled in a course, along with their roles in the course
+type EnrolledUser struct {
+	ID        int64  `json:"id"`
+	Username  string `json:"username"`
+	FirstName string `json:"firstname"`
+	LastName  string `json:"lastname"`
+	FullName  string `json:"fullname"`
+	Email     string `json:"email"`
+	IDNumber  string `json:"idnumber"`
+	Roles     []Role `json:"roles"`
+}
+
+// Role is a role of a user in a course. Roles with a lower sort order have more permissions.
+type Role struct {
+	RoleID    int64  `json:"roleid"`
+	Name      string `json:"name"`
+	ShortName string `json:"shortname"`
+	SortOrder int    `json:"sortorder"`
+}
+
+// NewClient returns a client for the Moodle site at baseURL.
+// If httpClient is nil, a client with a default timeout is used.
+func NewClient(baseURL, token string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: defaultTimeout}
+	}
+
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		token:      token,
+		httpClient: httpClient,
+	}
+}
+
+// GetCourses returns the courses with the given IDs, or every course of the site if no ID is given.
+func (c *Client) GetCourses(courseIDs ...string) ([]Course, error) {
+	params := url.Values{}
+	for i, courseID := range courseIDs {
+		params.Set(fmt.Sprintf("options[ids][%d]", i), courseID)
+	}
+
+	var courses []Course
+	if err := c.call(FunctionGetCourses, params, &courses); err != nil {
+		return nil, err
+	}
+
+	return courses, nil
+}
+
+// GetEnrolledUsers returns every user with an active enrolment in the course, page by page.
+func (c *Client) GetEnrolledUsers(courseID string) ([]EnrolledUser, error) {
+	var users []EnrolledUser
+	for page := 0; ; page++ {
+		params := url.Values{}
+		params.Set("courseid", courseID)
+		setOptions(params, map[string]string{
+			"onlyactive":  "1",
+			"limitfrom":   strconv.Itoa(page * EnrolledUsersPerPage),
+			"limitnumber": strconv.Itoa(EnrolledUsersPerPage),
+		})
+
+		var pageUsers []EnrolledUser
+		if err := c.call(FunctionGetEnrolledUsers, params, &pageUsers); err != nil {
+			return nil, err
+		}
+
+		users = append(users, pageUsers...)
+		if len(pageUsers) < EnrolledUsersPerPage {
+			return users, nil
+		}
+	}
+}
+
+// GetPrimaryRole returns the role of the user with the most permissions, or nil if they have no role in the course.
+func (u *EnrolledUser) GetPrimaryRole() *Role {
+	var primaryRole *Role
+	for i := range u.Roles {
+		if primaryRole == nil || u.Roles[i].SortOrder < primaryRole.SortOrder {
+			primaryRole = &u.Roles[i]
+		}
+	}
+
+	return primaryRole
+}
+
+// setOptions sets the options of a web service function, which Moodle expects as a list of names and values.
+// The options are sorted by name, so that requests are the same every time.
+func setOptions(params url.Values, options map[string]string) {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		params.Set(fmt.Sprintf("options[%d][name]", i), name)
+		params.Set(fmt.Sprintf("options[%d][value]", i), options[name])
+	}
+}
+
+// call calls the web service function with the given parameters and decodes its result into result.
+func (c *Client) call(function string, params url.Values, result interface{}) error {
+	params.Set("wstoken", c.token)
+	params.Set("wsfunction", function)
+	params.Set("moodlewsrestformat", "json")
+
+	resp, err := c.httpClient.Post(c.baseURL+restPath, "application/x-www-form-urlencoded", strings.NewReader(params.Encode()))
+	if err != nil {
+		return errors.Wrapf(err, "failed to call %s", function)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, responseMaxSize))
+	if err != nil {
+		return errors.Wrapf(err, "failed to read the response of %s", function)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("failed to call %s: moodle responded with status %d", function, resp.StatusCode)
+	}
+
+	// Exceptions are returned with a successful status, as an object instead of the result
+	if trimmedBody := bytes.TrimSpace(body); len(trimmedBody) > 0 && trimmedBody[0] == '{' {
+		var moodleErr *Error
+		if err := json.Unmarshal(trimmedBody, &moodleErr); err == nil && moodleErr != nil && moodleErr.Exception != "" {
+			return errors.Wrapf(moodleErr, "failed to call %s", function)
+		}
+	}
+
+	if err := json.Unmarshal(body, result); err != nil {
+		return errors.Wrapf(err, "failed to decode the response of %s", function)
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package moodle
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testToken = "moodletoken"
+
+// newTestMoodleServer starts a stand-in Moodle site which answers web service calls with the given handler
+func newTestMoodleServer(t *testing.T, handler func(t *testing.T, r *http.Request) interface{}) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, restPath, r.URL.Path)
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, testToken, r.PostForm.Get("wstoken"))
+		assert.Equal(t, "json", r.PostForm.Get("moodlewsrestformat"))
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(handler(t, r))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func getEnrolledUsers(from, count int) []EnrolledUser {
+	users := make([]EnrolledUser, 0, count)
+	for i := from; i < from+count; i++ {
+		users = append(users, EnrolledUser{
+			ID:       int64(i + 1),
+			Username: fmt.Sprintf("user%d", i+1),
+			Roles:    []Role{{RoleID: 5, ShortName: "student", SortOrder: 5}},
+		})
+	}
+	return users
+}
+
+func TestGetCourses(t *testing.T) {
+	server := newTestMoodleServer(t, func(t *testing.T, r *http.Request) interface{} {
+		assert.Equal(t, FunctionGetCourses, r.PostForm.Get("wsfunction"))
+		assert.Equal(t, "2", r.PostForm.Get("options[ids][0]"))
+		assert.Equal(t, "3", r.PostForm.Get("options[ids][1]"))
+		return []Course{
+			{ID: 2, ShortName: "maths", FullName: "Mathematics", CategoryID: 1},
+			{ID: 3, ShortName: "physics", FullName: "Physics", CategoryID: 1},
+		}
+	})
+
+	courses, err := NewClient(server.URL+"/", testToken, nil).GetCourses("2", "3")
+	require.NoError(t, err)
+	require.Len(t, courses, 2)
+	assert.Equal(t, "maths", courses[0].ShortName)
+	assert.Equal(t, int64(3), courses[1].ID)
+}
+
+func TestGetEnrolledUsers(t *testing.T) {
+	for name, test := range map[string]struct {
+		TotalUsers    int
+		ExpectedCalls int
+	}{
+		"no users": {
+			TotalUsers:    0,
+			ExpectedCalls: 1,
+		},
+		"single page": {
+			TotalUsers:    3,
+			ExpectedCalls: 1,
+		},
+		"exactly one page": {
+			TotalUsers:    EnrolledUsersPerPage,
+			ExpectedCalls: 2,
+		},
+		"several pages": {
+			TotalUsers:    2*EnrolledUsersPerPage + 1,
+			ExpectedCalls: 3,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			calls := 0
+			server := newTestMoodleServer(t, func(t *testing.T, r *http.Request) interface{} {
+				calls++
+				assert.Equal(t, FunctionGetEnrolledUsers, r.PostForm.Get("wsfunction"))
+				assert.Equal(t, "42", r.PostForm.Get("courseid"))
+
+				options := map[string]string{}
+				for i := 0; r.PostForm.Get(fmt.Sprintf("options[%d][name]", i)) != ""; i++ {
+					options[r.PostForm.Get(fmt.Sprintf("options[%d][name]", i))] = r.PostForm.Get(fmt.Sprintf("options[%d][value]", i))
+				}
+				assert.Equal(t, "1", options["onlyactive"])
+
+				from, err := strconv.Atoi(options["limitfrom"])
+				require.NoError(t, err)
+				limit, err := strconv.Atoi(options["limitnumber"])
+				require.NoError(t, err)
+
+				count := test.TotalUsers - from
+				if count > limit {
+					count = limit
+				}
+				if count < 0 {
+					count = 0
+				}
+				return getEnrolledUsers(from, count)
+			})
+
+			users, err := NewClient(server.URL, testToken, nil).GetEnrolledUsers("42")
+			require.NoError(t, err)
+			assert.Len(t, users, test.TotalUsers)
+			assert.Equal(t, test.ExpectedCalls, calls)
+			for i, user := range users {
+				assert.Equal(t, int64(i+1), user.ID)
+			}
+		})
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	t.Run("moodle exception", func(t *testing.T) {
+		server := newTestMoodleServer(t, func(t *testing.T, r *http.Request) interface{} {
+			return Error{
+				Exception: "webservice_access_exception",
+				ErrorCode: "accessexception",
+				Message:   "Access control exception",
+			}
+		})
+
+		_, err := NewClient(server.URL, testToken, nil).GetEnrolledUsers("42")
+		require.Error(t, err)
+		var moodleErr *Error
+		require.True(t, errors.As(err, &moodleErr))
+		assert.Equal(t, "accessexception", moodleErr.ErrorCode)
+	})
+
+	t.Run("unexpected status", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		_, err := NewClient(server.URL, testToken, nil).GetCourses()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "503")
+	})
+
+	t.Run("invalid response", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("<html>Moodle is being upgraded</html>"))
+		}))
+		defer server.Close()
+
+		_, err := NewClient(server.URL, testToken, nil).GetCourses()
+		require.Error(t, err)
+	})
+
+	t.Run("moodle unreachable", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		server.Close()
+
+		_, err := NewClient(server.URL, testToken, nil).GetCourses()
+		require.Error(t, err)
+	})
+}
+
+func TestGetPrimaryRole(t *testing.T) {
+	user := EnrolledUser{
+		Roles: []Role{
+			{ShortName: "student", SortOrder: 5},
+			{ShortName: "editingteacher", SortOrder: 3},
+			{ShortName: "teacher", SortOrder: 4},
+		},
+	}
+	assert.Equal(t, "editingteacher", user.GetPrimaryRole().ShortName)
+	assert.Nil(t, (&EnrolledUser{}).GetPrimaryRole())
+}
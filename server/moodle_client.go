@@ -0,0 +1,16 @@
+package main
+
+import (
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/moodle"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+)
+
+// getMoodleClient returns a client for the web services of the Moodle site, so that the plugin can pull data from Moodle.
+func (p *Plugin) getMoodleClient() (*moodle.Client, error) {
+	config := p.getConfiguration()
+	if config.MoodleURL == "" || config.MoodleToken == "" {
+		return nil, serializer.NewError(serializer.ErrorCodeMoodleNotConfigured, "error: the Moodle URL and Moodle Token settings must be set to pull data from Moodle")
+	}
+
+	return moodle.NewClient(config.MoodleURL, config.MoodleToken, nil), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils/testutils"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetMoodleClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/moodle/webservice/rest/server.php", r.URL.Path)
+		assert.Equal(t, "moodletoken", r.FormValue("wstoken"))
+		_, _ = w.Write([]byte(`[{"id": 2, "shortname": "maths"}]`))
+	}))
+	defer server.Close()
+
+	p := setupTestPlugin(&plugintest.API{})
+	_, err := p.getMoodleClient()
+	require.Error(t, err)
+	assert.Equal(t, serializer.ErrorCodeMoodleNotConfigured, err.(*serializer.Error).Code)
+
+	config := p.getConfiguration().Clone()
+	config.MoodleURL = " " + server.URL + "/moodle/ "
+	config.MoodleToken = "moodletoken"
+	require.NoError(t, config.ProcessConfiguration())
+	p.setConfiguration(config)
+
+	client, err := p.getMoodleClient()
+	require.NoError(t, err)
+	courses, err := client.GetCourses("2")
+	require.NoError(t, err)
+	require.Len(t, courses, 1)
+	assert.Equal(t, "maths", courses[0].ShortName)
+}
+
+func TestMoodleURLConfiguration(t *testing.T) {
+	for moodleURL, valid := range map[string]bool{
+		"":                            true,
+		"https://moodle.example.com":  true,
+		"http://localhost/moodle/":    true,
+		"moodle.example.com":          false,
+		"ftp://moodle.example.com":    false,
+		"https://":                    false,
+		"https://moodle.example.com%": false,
+	} {
+		t.Run(moodleURL, func(t *testing.T) {
+			config := &configuration{
+				Secret:         testutils.GetSecret(),
+				BotUserName:    "moodle",
+				BotDisplayName: "Moodle",
+				BotDescription: "Moodle",
+				MoodleURL:      moodleURL,
+			}
+			require.NoError(t, config.ProcessConfiguration())
+			assert.Equal(t, valid, config.IsValid() == nil)
+		})
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	// Needed to embed the OpenAPI document
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec describes the REST API. It must be updated whenever a route or a serializer changes.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// getOpenAPISpec serves the OpenAPI document, without authentication, so that API clients and tools can fetch it
+func (p *Plugin) getOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(openAPISpec)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils/testutils"
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testOpenAPISpec struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+// pathVariableRegexp matches the variables in a path template, along with their optional pattern
+var pathVariableRegexp = regexp.MustCompile(`\{[^}:]+(:[^}]+)?\}`)
+
+// normalizeRoute drops the names and patterns of the path variables, as the router and the spec may name them differently
+func normalizeRoute(method, path string) string {
+	return strings.ToUpper(method) + " " + pathVariableRegexp.ReplaceAllString(path, "{}")
+}
+
+func getOpenAPISpecForTest(t *testing.T) *testOpenAPISpec {
+	var spec *testOpenAPISpec
+	require.NoError(t, json.Unmarshal(openAPISpec, &spec))
+	require.NotNil(t, spec)
+	return spec
+}
+
+func TestOpenAPISpecRoutes(t *testing.T) {
+	spec := getOpenAPISpecForTest(t)
+	specRoutes := map[string]bool{}
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			specRoutes[normalizeRoute(method, path)] = true
+		}
+	}
+
+	p := setupTestPlugin(&plugintest.API{})
+	routerRoutes := map[string]bool{}
+	err := p.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, pathErr := route.GetPathTemplate()
+		methods, methodsErr := route.GetMethods()
+		if pathErr != nil || methodsErr != nil || !strings.HasPrefix(path, "/api/v1/") {
+			return nil
+		}
+
+		for _, method := range methods {
+			routerRoutes[normalizeRoute(method, path)] = true
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, routerRoutes)
+
+	for route := range routerRoutes {
+		assert.True(t, specRoutes[route], "route %q is missing from openapi.json", route)
+	}
+
+	for route := range specRoutes {
+		assert.True(t, routerRoutes[route], "route %q in openapi.json is not registered in the router", route)
+	}
+}
+
+func TestOpenAPISpecSchemas(t *testing.T) {
+	spec := getOpenAPISpecForTest(t)
+	for name, test := range map[string]struct {
+		Value         interface{}
+		IgnoredFields []string
+	}{
+		"Error":                        {Value: serializer.Error{}},
+		"Channel":                      {Value: serializer.Channel{}},
+		"ChannelPatch":                 {Value: serializer.ChannelPatch{}},
+		"ChannelMember":                {Value: serializer.ChannelMember{}},
+		"ChannelMemberResult":          {Value: serializer.ChannelMemberResult{}},
+		"ChannelMembersReconciliation": {Value: serializer.ChannelMembersReconciliation{}},
+		"ChannelMemberWithUserInfo":    {Value: serializer.ChannelMemberWithUserInfo{}},
+		"ChannelMembersExport":         {Value: serializer.ChannelMembersExport{}},
+		"GroupChannel":                 {Value: serializer.GroupChannel{}},
+		"GroupChannelLink":             {Value: serializer.GroupChannelLink{}},
+		"GroupChannelResult":           {Value: serializer.GroupChannelResult{}},
+		"ChannelWithGroupChannels":     {Value: serializer.ChannelWithGroupChannels{}},
+		"Deadline":                     {Value: serializer.Deadline{}},
+		"Announcement":                 {Value: serializer.Announcement{}},
+		"AnnouncementAuthor":           {Value: serializer.AnnouncementAuthor{}},
+		"AnnouncementAttachment":       {Value: serializer.AnnouncementAttachment{}},
+		"MirroredAnnouncement":         {Value: serializer.MirroredAnnouncement{}},
+		"Mapping":                      {Value: serializer.Mapping{}},
+		"User":                         {Value: serializer.User{}},
+		"UserPatch":                    {Value: serializer.UserPatch{}},
+		"PendingDeactivation":          {Value: serializer.PendingDeactivation{}},
+		"ProfileImage":                 {Value: serializer.ProfileImage{}},
+		"Timezone":                     {Value: serializer.Timezone{}},
+		// The payload is left out of the responses by Job.ToJSON
+		"Job": {Value: serializer.Job{}, IgnoredFields: []string{"payload"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			schema, ok := spec.Components.Schemas[name]
+			require.True(t, ok, "schema %q is missing from openapi.json", name)
+
+			fields := map[string]bool{}
+			valueType := reflect.TypeOf(test.Value)
+			for i := 0; i < valueType.NumField(); i++ {
+				field := strings.Split(valueType.Field(i).Tag.Get("json"), ",")[0]
+				if field == "" || field == "-" {
+					continue
+				}
+
+				fields[field] = true
+			}
+
+			for _, field := range test.IgnoredFields {
+				delete(fields, field)
+			}
+
+			for field := range fields {
+				assert.Contains(t, schema.Properties, field, "field %q of schema %q is missing from openapi.json", field, name)
+			}
+
+			for field := range schema.Properties {
+				assert.True(t, fields[field], "field %q of schema %q in openapi.json does not exist in the serializer", field, name)
+			}
+		})
+	}
+}
+
+func TestGetOpenAPISpec(t *testing.T) {
+	api := &plugintest.API{}
+	api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+	defer api.AssertExpectations(t)
+	p := setupTestPlugin(api)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/openapi.json", nil)
+	p.ServeHTTP(nil, w, r)
+
+	result := w.Result()
+	require.NotNil(t, result)
+	defer result.Body.Close()
+
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, "application/json", result.Header.Get("Content-Type"))
+	assert.True(t, json.Valid(w.Body.Bytes()))
+}
@@ -3,8 +3,12 @@ package main
 import (
 	"net/http"
 	"sync"
+	"time"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
 
 	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/mattermost/mattermost-server/v5/plugin"
 )
 
@@ -20,11 +24,30 @@ type Plugin struct {
 	configuration *configuration
 	router        *mux.Router
 	botID         string
+
+	// jobQueue receives the IDs of the jobs to be processed by the job worker
+	jobQueue chan string
+	stopJobs chan struct{}
+	jobsDone sync.WaitGroup
+	// jobTimers contains the timers enqueueing the jobs whose next attempt is not due yet, by job ID
+	jobTimers     map[string]*time.Timer
+	jobTimersLock sync.Mutex
+
+	// stopSync stops the scheduler of the scheduled sync
+	stopSync chan struct{}
+	syncDone sync.WaitGroup
 }
 
 // ServeHTTP demonstrates a plugin that handles HTTP requests by greeting the world.
 func (p *Plugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
-	p.API.LogDebug("New plugin request:", "Host", r.Host, "RequestURI", r.RequestURI, "Method", r.Method)
+	requestID := r.Header.Get(constants.HeaderRequestID)
+	if !model.IsValidId(requestID) {
+		requestID = model.NewId()
+		r.Header.Set(constants.HeaderRequestID, requestID)
+	}
+	w.Header().Set(constants.HeaderRequestID, requestID)
+
+	p.API.LogDebug("New plugin request:", "Host", r.Host, "Path", r.URL.Path, "Method", r.Method, "RequestID", requestID)
 	p.router.ServeHTTP(w, r)
 }
 
@@ -9,6 +9,7 @@ import (
 	"testing"
 
 	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils/testutils"
+	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -17,7 +18,9 @@ import (
 func setupTestPlugin(api *plugintest.API) *Plugin {
 	p := &Plugin{}
 	p.setConfiguration(&configuration{
-		Secret: testutils.GetSecret(),
+		Secret:             testutils.GetSecret(),
+		AllowSecretInQuery: model.NewBool(true),
+		DefaultChannelType: model.CHANNEL_PRIVATE,
 	})
 
 	path, _ := filepath.Abs("../..")
@@ -42,24 +45,24 @@ func TestServeHTTP(t *testing.T) {
 			RequestURL: fmt.Sprintf("/api/v1/test?secret=%s", "1232323rsdsdf"),
 			Method:     "POST",
 			SetupAPI: func(api *plugintest.API) *plugintest.API {
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
 				return api
 			},
 			ExpectedStatusCode: http.StatusForbidden,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
-			ExpectedbodyString: "request URL: secret did not match\n",
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}, "X-Request-Id": []string{testutils.GetID()}},
+			ExpectedbodyString: fmt.Sprintf(`{"code":"invalid_secret","message":"request URL: secret did not match","request_id":"%s"}`, testutils.GetID()),
 		},
 		"InvalidRequestURL": {
 			RequestURL: "/not_found",
 			Method:     "GET",
 			SetupAPI: func(api *plugintest.API) *plugintest.API {
-				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
 				return api
 			},
 			ExpectedStatusCode: http.StatusNotFound,
-			ExpectedHeader:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "X-Content-Type-Options": []string{"nosniff"}},
-			ExpectedbodyString: "404 page not found\n",
+			ExpectedHeader:     http.Header{"Content-Type": []string{"application/json"}, "X-Content-Type-Options": []string{"nosniff"}, "X-Request-Id": []string{testutils.GetID()}},
+			ExpectedbodyString: fmt.Sprintf(`{"code":"not_found","message":"page not found","request_id":"%s"}`, testutils.GetID()),
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
@@ -71,6 +74,7 @@ func TestServeHTTP(t *testing.T) {
 
 			w := httptest.NewRecorder()
 			r := httptest.NewRequest(test.Method, test.RequestURL, nil)
+			r.Header.Set("X-Request-Id", testutils.GetID())
 			p.ServeHTTP(nil, w, r)
 
 			result := w.Result()
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+// profileImageFormField is the field of a multipart upload which contains the profile image
+const profileImageFormField = "image"
+
+// profileImageMaxBodySize is the maximum size in bytes of a request setting a profile image.
+// It leaves some room for the multipart headers or the JSON around the base64 data, so that images which are too large get a specific error.
+const profileImageMaxBodySize = 2 * serializer.ProfileImageMaxSize
+
+// setProfileImage sets the profile image of a user to the photo uploaded by Moodle
+func (p *Plugin) setProfileImage(w http.ResponseWriter, r *http.Request) {
+	userID, status, resolveErr := p.resolveMattermostID(r, userMapping, "user_id")
+	if resolveErr != nil {
+		p.API.LogError(resolveErr.Error())
+		p.writeError(w, r, status, resolveErr)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, profileImageMaxBodySize)
+	profileImage, err := readProfileImage(r)
+	if err != nil {
+		p.API.LogError(err.Error())
+		p.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	if _, appErr := p.API.GetUser(userID); appErr != nil {
+		p.API.LogError(fmt.Sprintf("Failed to get user by id. Error: %v", appErr.Error()))
+		p.writeError(w, r, appErr.StatusCode, errors.Wrap(appErr, "failed to get user by id"))
+		return
+	}
+
+	if appErr := p.API.SetProfileImage(userID, profileImage); appErr != nil {
+		p.API.LogError(fmt.Sprintf("Failed to set profile image. Error: %v", appErr.Error()))
+		p.writeError(w, r, appErr.StatusCode, errors.Wrap(appErr, "failed to set profile image"))
+		return
+	}
+
+	returnStatusOK(w)
+}
+
+// getCustomProfileImage returns the profile image uploaded for the user, or nil if the user has the default one
+func (p *Plugin) getCustomProfileImage(user *model.User) ([]byte, *model.AppError) {
+	if user.LastPictureUpdate <= 0 {
+		return nil, nil
+	}
+
+	return p.API.GetProfileImage(user.Id)
+}
+
+// restoreProfileImage sets the profile image of a user back to the one it had before a failed update.
+// The default profile image cannot be restored through the plugin API, so the uploaded image is kept in that case.
+func (p *Plugin) restoreProfileImage(userID string, profileImage []byte) {
+	if profileImage == nil {
+		p.API.LogWarn("Unable to restore the default profile image of the user", "UserID", userID)
+		return
+	}
+
+	if err := p.API.SetProfileImage(userID, profileImage); err != nil {
+		p.API.LogError(fmt.Sprintf("Failed to restore profile image. Error: %v", err.Error()))
+	}
+}
+
+// readProfileImage reads a profile image uploaded as a multipart form, or sent as base64 data in a JSON body, and validates it
+func readProfileImage(r *http.Request) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		profileImage := serializer.ProfileImageFromJSON(io.LimitReader(r.Body, profileImageMaxBodySize))
+		if profileImage == nil {
+			return nil, serializer.NewError(serializer.ErrorCodeInvalidRequestBody, "invalid request body")
+		}
+
+		return serializer.DecodeProfileImage(profileImage.Image)
+	}
+
+	// The parts which do not fit in memory are stored in temporary files, which are removed once the image is read
+	err := r.ParseMultipartForm(serializer.ProfileImageMaxSize)
+	if r.MultipartForm != nil {
+		defer func() {
+			_ = r.MultipartForm.RemoveAll()
+		}()
+	}
+
+	if err != nil {
+		return nil, serializer.NewError(serializer.ErrorCodeInvalidRequestBody, "error: request body is not a valid multipart form")
+	}
+
+	file, header, err := r.FormFile(profileImageFormField)
+	if err != nil {
+		return nil, serializer.NewError(serializer.ErrorCodeInvalidImage, fmt.Sprintf("error: %s is missing from the multipart form", profileImageFormField))
+	}
+	defer file.Close()
+
+	if header.Size > serializer.ProfileImageMaxSize {
+		return nil, serializer.NewError(serializer.ErrorCodeImageTooLarge, fmt.Sprintf("error: image is larger than %d bytes", serializer.ProfileImageMaxSize))
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(file, serializer.ProfileImageMaxSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read image")
+	}
+
+	if err = serializer.ValidateProfileImage(data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils/testutils"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getPNGImage(t *testing.T) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))))
+	return buf.Bytes()
+}
+
+func getMultipartImageBody(t *testing.T, field string, data []byte) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile(field, "profile.png")
+	require.NoError(t, err)
+	_, err = part.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return body, writer.FormDataContentType()
+}
+
+func getJSONImageBody(t *testing.T, encoded string) (*bytes.Buffer, string) {
+	data, err := json.Marshal(serializer.ProfileImage{Image: encoded})
+	require.NoError(t, err)
+	return bytes.NewBuffer(data), "application/json"
+}
+
+func TestSetProfileImage(t *testing.T) {
+	requestURL := fmt.Sprintf("/api/v1/users/%s/image?secret=%s", testutils.GetID(), testutils.GetSecret())
+	pngImage := getPNGImage(t)
+	for name, test := range map[string]struct {
+		GetBody            func(t *testing.T) (*bytes.Buffer, string)
+		SetupAPI           func(*plugintest.API) *plugintest.API
+		ExpectedStatusCode int
+		ExpectedErrorCode  string
+	}{
+		"multipart upload": {
+			GetBody: func(t *testing.T) (*bytes.Buffer, string) {
+				return getMultipartImageBody(t, profileImageFormField, pngImage)
+			},
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("GetUser", testutils.GetID()).Return(testutils.GetModelUser(), nil)
+				api.On("SetProfileImage", testutils.GetID(), pngImage).Return(nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"base64 data": {
+			GetBody: func(t *testing.T) (*bytes.Buffer, string) {
+				return getJSONImageBody(t, base64.StdEncoding.EncodeToString(pngImage))
+			},
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("GetUser", testutils.GetID()).Return(testutils.GetModelUser(), nil)
+				api.On("SetProfileImage", testutils.GetID(), pngImage).Return(nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"data URL": {
+			GetBody: func(t *testing.T) (*bytes.Buffer, string) {
+				return getJSONImageBody(t, "data:image/png;base64,"+base64.StdEncoding.EncodeToString(pngImage))
+			},
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("GetUser", testutils.GetID()).Return(testutils.GetModelUser(), nil)
+				api.On("SetProfileImage", testutils.GetID(), pngImage).Return(nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"invalid base64": {
+			GetBody: func(t *testing.T) (*bytes.Buffer, string) {
+				return getJSONImageBody(t, "not base64!")
+			},
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedErrorCode:  serializer.ErrorCodeInvalidImage,
+		},
+		"not an image": {
+			GetBody: func(t *testing.T) (*bytes.Buffer, string) {
+				return getMultipartImageBody(t, profileImageFormField, []byte("just some text"))
+			},
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedErrorCode:  serializer.ErrorCodeInvalidImage,
+		},
+		"corrupted image": {
+			GetBody: func(t *testing.T) (*bytes.Buffer, string) {
+				return getMultipartImageBody(t, profileImageFormField, pngImage[:20])
+			},
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedErrorCode:  serializer.ErrorCodeInvalidImage,
+		},
+		"image too large": {
+			GetBody: func(t *testing.T) (*bytes.Buffer, string) {
+				return getJSONImageBody(t, strings.Repeat("A", base64.StdEncoding.EncodedLen(serializer.ProfileImageMaxSize)+4))
+			},
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedErrorCode:  serializer.ErrorCodeImageTooLarge,
+		},
+		"multipart body too large": {
+			GetBody: func(t *testing.T) (*bytes.Buffer, string) {
+				return getMultipartImageBody(t, profileImageFormField, make([]byte, profileImageMaxBodySize))
+			},
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedErrorCode:  serializer.ErrorCodeInvalidRequestBody,
+		},
+		"image missing from multipart form": {
+			GetBody: func(t *testing.T) (*bytes.Buffer, string) {
+				return getMultipartImageBody(t, "photo", pngImage)
+			},
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedErrorCode:  serializer.ErrorCodeInvalidImage,
+		},
+		"user not found": {
+			GetBody: func(t *testing.T) (*bytes.Buffer, string) {
+				return getMultipartImageBody(t, profileImageFormField, pngImage)
+			},
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("GetUser", testutils.GetID()).Return(nil, testutils.GetNotFoundAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusNotFound,
+		},
+		"failed to set profile image": {
+			GetBody: func(t *testing.T) (*bytes.Buffer, string) {
+				return getMultipartImageBody(t, profileImageFormField, pngImage)
+			},
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("GetUser", testutils.GetID()).Return(testutils.GetModelUser(), nil)
+				api.On("SetProfileImage", testutils.GetID(), pngImage).Return(testutils.GetInternalServerAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+			test.SetupAPI(api)
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			body, contentType := test.GetBody(t)
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, requestURL, body)
+			r.Header.Set("Content-Type", contentType)
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+			assert.Equal(t, test.ExpectedStatusCode, result.StatusCode)
+			if test.ExpectedErrorCode != "" {
+				var errorBody *serializer.Error
+				require.NoError(t, json.NewDecoder(result.Body).Decode(&errorBody))
+				assert.Equal(t, test.ExpectedErrorCode, errorBody.Code)
+			}
+		})
+	}
+}
+
+func TestUpdateUserWithProfileImage(t *testing.T) {
+	requestURL := fmt.Sprintf("/api/v1/users/%s?secret=%s", testutils.GetID(), testutils.GetSecret())
+	pngImage := getPNGImage(t)
+	for name, test := range map[string]struct {
+		ProfileImage       string
+		SetupAPI           func(*plugintest.API) *plugintest.API
+		ExpectedStatusCode int
+	}{
+		"profile image set": {
+			ProfileImage: base64.StdEncoding.EncodeToString(pngImage),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				user := testutils.GetModelUser()
+				user.Id = testutils.GetID()
+				api.On("GetUser", testutils.GetID()).Return(user, nil)
+				api.On("UpdateUser", mock.AnythingOfType("*model.User")).Return(user, nil)
+				api.On("SetProfileImage", testutils.GetID(), pngImage).Return(nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"previous profile image restored if the user update fails": {
+			ProfileImage: base64.StdEncoding.EncodeToString(pngImage),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				user := testutils.GetModelUser()
+				user.Id = testutils.GetID()
+				user.LastPictureUpdate = model.GetMillis()
+				previousImage := []byte("previous image")
+				api.On("GetUser", testutils.GetID()).Return(user, nil)
+				api.On("GetProfileImage", testutils.GetID()).Return(previousImage, nil)
+				api.On("SetProfileImage", testutils.GetID(), pngImage).Return(nil).Once()
+				api.On("UpdateUser", mock.AnythingOfType("*model.User")).Return(nil, testutils.GetInternalServerAppError())
+				api.On("SetProfileImage", testutils.GetID(), previousImage).Return(nil).Once()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+		"default profile image not restored if the user update fails": {
+			ProfileImage: base64.StdEncoding.EncodeToString(pngImage),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				user := testutils.GetModelUser()
+				user.Id = testutils.GetID()
+				api.On("GetUser", testutils.GetID()).Return(user, nil)
+				api.On("SetProfileImage", testutils.GetID(), pngImage).Return(nil).Once()
+				api.On("UpdateUser", mock.AnythingOfType("*model.User")).Return(nil, testutils.GetInternalServerAppError())
+				api.On("LogWarn", testutils.GetMockArgumentsWithType("string", 3)...).Return()
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+		"user not updated if the profile image cannot be set": {
+			ProfileImage: base64.StdEncoding.EncodeToString(pngImage),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				user := testutils.GetModelUser()
+				user.Id = testutils.GetID()
+				api.On("GetUser", testutils.GetID()).Return(user, nil)
+				api.On("SetProfileImage", testutils.GetID(), pngImage).Return(testutils.GetInternalServerAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+		"invalid profile image": {
+			ProfileImage: base64.StdEncoding.EncodeToString([]byte("just some text")),
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("GetUser", testutils.GetID()).Return(testutils.GetModelUser(), nil)
+				api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+			test.SetupAPI(api)
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			firstName := "John"
+			reqBody, err := json.Marshal(serializer.UserPatch{FirstName: &firstName, ProfileImage: &test.ProfileImage})
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPatch, requestURL, bytes.NewBuffer(reqBody))
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+			assert.Equal(t, test.ExpectedStatusCode, result.StatusCode)
+		})
+	}
+}
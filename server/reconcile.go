@@ -0,0 +1,240 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// reconcileChannelMembers makes the membership of the channel equal to the given list of channel members.
+// Missing users are added, users not present in the list are removed and the channel admin role is fixed where needed.
+// Users whose entry in the list is invalid are left as they are.
+// The Moodle user IDs of the channel members are those of the given Moodle site.
+// When keepUnmappedMembers is true, the members who are not mapped to a Moodle user are never removed, as the list cannot contain them.
+// When dryRun is true, the changes are only computed and returned without being applied.
+func (p *Plugin) reconcileChannelMembers(siteID, channelID string, channelMembers serializer.ChannelMembers, keepUnmappedMembers, dryRun bool) (*serializer.ChannelMembersReconciliation, int, error) {
+	reconciliation := &serializer.ChannelMembersReconciliation{
+		DryRun:   dryRun,
+		Added:    []string{},
+		Removed:  []string{},
+		Promoted: []string{},
+		Demoted:  []string{},
+		Errors:   serializer.ChannelMemberResults{},
+	}
+
+	// Maps the ID of every user who should be a member of the channel to whether they should be a channel admin
+	expectedMembers := make(map[string]bool, len(channelMembers))
+	// IDs of the users whose Moodle role makes them team admins
+	teamAdmins := map[string]bool{}
+	// IDs of the users whose entry is invalid or whose Moodle role is not mapped. They are left as they are rather than removed from the channel.
+	keptMembers := map[string]bool{}
+	// Whether some Moodle user IDs have no mapping. Those users cannot be told apart from the members who are not mapped to a Moodle user,
+	// so these members are kept as well.
+	hasUnresolvedMembers := false
+	for i := range channelMembers {
+		channelMember := &channelMembers[i]
+		if err := channelMember.Validate(); err != nil {
+			if model.IsValidId(channelMember.UserID) {
+				keptMembers[channelMember.UserID] = true
+			}
+			reconciliation.Errors = append(reconciliation.Errors, newFailedChannelMemberResult(channelMember, "", http.StatusBadRequest, err))
+			continue
+		}
+
+		if status, err := p.resolveChannelMemberUserID(siteID, channelMember); err != nil {
+			hasUnresolvedMembers = true
+			reconciliation.Errors = append(reconciliation.Errors, newFailedChannelMemberResult(channelMember, "", status, err))
+			continue
+		}
+
+		roleMapping, status, err := p.getMoodleRoleMapping(channelMember)
+		if err != nil {
+			keptMembers[channelMember.UserID] = true
+			reconciliation.Errors = append(reconciliation.Errors, newFailedChannelMemberResult(channelMember, "", status, err))
+			continue
+		}
+
+		if roleMapping != nil {
+			channelMember.Role = roleMapping.getChannelRoles()
+			if roleMapping.isTeamAdmin() {
+				teamAdmins[channelMember.UserID] = true
+			}
+		}
+
+		expectedMembers[channelMember.UserID] = expectedMembers[channelMember.UserID] || isChannelAdminRole(channelMember.Role)
+	}
+
+	currentMembers, err := p.getAllChannelMembers(channelID)
+	if err != nil {
+		return nil, err.StatusCode, errors.Wrap(err, "failed to fetch channel members")
+	}
+
+	for _, currentMember := range currentMembers {
+		if currentMember.UserId == p.botID {
+			continue
+		}
+
+		isChannelAdmin, ok := expectedMembers[currentMember.UserId]
+		delete(expectedMembers, currentMember.UserId)
+		switch {
+		case !ok && (keptMembers[currentMember.UserId] || ((keepUnmappedMembers || hasUnresolvedMembers) && p.isUnmappedUser(siteID, currentMember.UserId))):
+		case !ok:
+			p.reconcileRemovedMember(channelID, currentMember.UserId, reconciliation)
+		case isChannelAdmin && !currentMember.SchemeAdmin:
+			p.reconcileMemberRoles(channelID, currentMember.UserId, model.CHANNEL_USER_ROLE_ID+" "+model.CHANNEL_ADMIN_ROLE_ID, reconciliation)
+		case !isChannelAdmin && currentMember.SchemeAdmin:
+			p.reconcileMemberRoles(channelID, currentMember.UserId, model.CHANNEL_USER_ROLE_ID, reconciliation)
+		}
+	}
+
+	// The remaining expected members are not yet members of the channel
+	for userID, isChannelAdmin := range expectedMembers {
+		channelMember := &serializer.ChannelMember{
+			UserID: userID,
+		}
+		if isChannelAdmin {
+			channelMember.Role = model.CHANNEL_ADMIN_ROLE_ID
+		}
+
+		if !dryRun {
+			if status, err := p.addChannelMember(channelID, channelMember); err != nil {
+				reconciliation.Errors = append(reconciliation.Errors, newFailedChannelMemberResult(channelMember, serializer.ChannelMemberActionAdd, status, err))
+				continue
+			}
+		}
+
+		reconciliation.Added = append(reconciliation.Added, userID)
+	}
+
+	if !dryRun {
+		p.reconcileTeamAdmins(channelID, teamAdmins, reconciliation)
+	}
+
+	return reconciliation, 0, nil
+}
+
+// reconcileTeamAdmins makes the users team admins of the team of the channel, as their Moodle role is mapped to it.
+// Users who failed to be added to the channel are skipped.
+func (p *Plugin) reconcileTeamAdmins(channelID string, teamAdmins map[string]bool, reconciliation *serializer.ChannelMembersReconciliation) {
+	failedUserIDs := make(map[string]bool, len(reconciliation.Errors))
+	for _, result := range reconciliation.Errors {
+		failedUserIDs[result.UserID] = true
+	}
+
+	for userID := range teamAdmins {
+		if failedUserIDs[userID] {
+			continue
+		}
+
+		if status, err := p.ensureTeamAdmin(channelID, userID); err != nil {
+			channelMember := &serializer.ChannelMember{
+				UserID: userID,
+			}
+			reconciliation.Errors = append(reconciliation.Errors, newFailedChannelMemberResult(channelMember, serializer.ChannelMemberActionUpdateRole, status, err))
+		}
+	}
+}
+
+// isUnmappedUser checks if the user is not mapped to a user of the given Moodle site. Users whose mapping cannot be fetched are treated as unmapped.
+func (p *Plugin) isUnmappedUser(siteID, userID string) bool {
+	mapping, err := p.getMappingByMattermostID(userMapping.forSite(siteID), userID)
+	if err != nil {
+		p.API.LogWarn("Failed to get the user mapping.", "UserID", userID, "Error", err.Error())
+		return true
+	}
+
+	return mapping == nil || mapping.SiteID != siteID
+}
+
+func (p *Plugin) reconcileRemovedMember(channelID, userID string, reconciliation *serializer.ChannelMembersReconciliation) {
+	// Bots are added to channels from within Mattermost, so they are never removed
+	channelMember := &serializer.ChannelMember{
+		UserID: userID,
+	}
+
+	user, err := p.API.GetUser(userID)
+	if err != nil {
+		reconciliation.Errors = append(reconciliation.Errors, newFailedChannelMemberResult(channelMember, serializer.ChannelMemberActionRemove, err.StatusCode, errors.Wrap(err, "failed to get user")))
+		return
+	}
+
+	if user.IsBot {
+		return
+	}
+
+	if !reconciliation.DryRun {
+		if status, err := p.removeChannelMember(channelID, userID); err != nil {
+			reconciliation.Errors = append(reconciliation.Errors, newFailedChannelMemberResult(channelMember, serializer.ChannelMemberActionRemove, status, err))
+			return
+		}
+	}
+
+	reconciliation.Removed = append(reconciliation.Removed, userID)
+}
+
+func (p *Plugin) reconcileMemberRoles(channelID, userID, roles string, reconciliation *serializer.ChannelMembersReconciliation) {
+	if !reconciliation.DryRun {
+		channelMember := &serializer.ChannelMember{
+			UserID: userID,
+			Role:   roles,
+		}
+		if status, err := p.updateChannelMemberRoles(channelID, channelMember); err != nil {
+			reconciliation.Errors = append(reconciliation.Errors, newFailedChannelMemberResult(channelMember, serializer.ChannelMemberActionUpdateRole, status, err))
+			return
+		}
+	}
+
+	if isChannelAdminRole(roles) {
+		reconciliation.Promoted = append(reconciliation.Promoted, userID)
+	} else {
+		reconciliation.Demoted = append(reconciliation.Demoted, userID)
+	}
+}
+
+// getAllChannelMembers fetches every member of the channel, page by page.
+func (p *Plugin) getAllChannelMembers(channelID string) ([]model.ChannelMember, *model.AppError) {
+	var members []model.ChannelMember
+	for page := 0; ; page++ {
+		channelMembers, err := p.API.GetChannelMembers(channelID, page, utils.PerPageMaximum)
+		if err != nil {
+			return nil, err
+		}
+
+		if channelMembers == nil {
+			return members, nil
+		}
+
+		members = append(members, *channelMembers...)
+		if len(*channelMembers) < utils.PerPageMaximum {
+			return members, nil
+		}
+	}
+}
+
+func newFailedChannelMemberResult(channelMember *serializer.ChannelMember, action string, status int, err error) serializer.ChannelMemberResult {
+	return serializer.ChannelMemberResult{
+		UserID:       channelMember.UserID,
+		MoodleUserID: channelMember.MoodleUserID,
+		Action:       action,
+		Status:       model.STATUS_FAIL,
+		StatusCode:   status,
+		Error:        err.Error(),
+		ErrorCode:    getErrorCode(status, err),
+	}
+}
+
+// isChannelAdminRole checks if the given space separated list of roles contains the channel admin role.
+func isChannelAdminRole(roles string) bool {
+	for _, role := range strings.Fields(roles) {
+		if role == model.CHANNEL_ADMIN_ROLE_ID {
+			return true
+		}
+	}
+
+	return false
+}
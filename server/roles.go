@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// moodleRoleMapping contains the Mattermost roles given to users who have a Moodle role in a course
+type moodleRoleMapping struct {
+	// ChannelRole is either channel_user or channel_admin
+	ChannelRole string `json:"channel_role"`
+	// TeamRole is either empty, team_user or team_admin.
+	// Team admins are never demoted, as the user can be a team admin because of another course.
+	TeamRole string `json:"team_role,omitempty"`
+}
+
+// parseRoleMapping parses the role mapping setting, a JSON object from Moodle role shortnames to Mattermost roles.
+func parseRoleMapping(data string) (map[string]*moodleRoleMapping, error) {
+	roleMapping := map[string]*moodleRoleMapping{}
+	if strings.TrimSpace(data) == "" {
+		return roleMapping, nil
+	}
+
+	if err := json.Unmarshal([]byte(data), &roleMapping); err != nil {
+		return nil, errors.Wrap(err, "role Mapping is not valid JSON")
+	}
+
+	return roleMapping, nil
+}
+
+func (m *moodleRoleMapping) IsValid() error {
+	if m == nil {
+		return errors.New("cannot be empty")
+	}
+
+	if m.ChannelRole != model.CHANNEL_USER_ROLE_ID && m.ChannelRole != model.CHANNEL_ADMIN_ROLE_ID {
+		return errors.New("channel_role must be either channel_user or channel_admin")
+	}
+
+	switch m.TeamRole {
+	case "", model.TEAM_USER_ROLE_ID, model.TEAM_ADMIN_ROLE_ID:
+	default:
+		return errors.New("team_role must be either team_user or team_admin")
+	}
+
+	return nil
+}
+
+// getChannelRoles returns the roles of the channel member, in the format used to update them.
+func (m *moodleRoleMapping) getChannelRoles() string {
+	if m.ChannelRole == model.CHANNEL_ADMIN_ROLE_ID {
+		return model.CHANNEL_USER_ROLE_ID + " " + model.CHANNEL_ADMIN_ROLE_ID
+	}
+
+	return model.CHANNEL_USER_ROLE_ID
+}
+
+func (m *moodleRoleMapping) isTeamAdmin() bool {
+	return m.TeamRole == model.TEAM_ADMIN_ROLE_ID
+}
+
+// getMoodleRoleMapping returns the mapping of the Moodle role of the channel member, or nil if they have no Moodle role.
+func (p *Plugin) getMoodleRoleMapping(channelMember *serializer.ChannelMember) (*moodleRoleMapping, int, error) {
+	if channelMember.MoodleRole == "" {
+		return nil, 0, nil
+	}
+
+	roleMapping, ok := p.getConfiguration().roleMapping[channelMember.MoodleRole]
+	if !ok {
+		return nil, http.StatusBadRequest, serializer.NewError(serializer.ErrorCodeRoleMappingNotFound, fmt.Sprintf("no role mapping found for moodle role %s", channelMember.MoodleRole))
+	}
+
+	return roleMapping, 0, nil
+}
+
+// resolveChannelMemberRole fills in the channel roles of the channel member from its Moodle role, if needed.
+func (p *Plugin) resolveChannelMemberRole(channelMember *serializer.ChannelMember) (int, error) {
+	roleMapping, status, err := p.getMoodleRoleMapping(channelMember)
+	if err != nil || roleMapping == nil {
+		return status, err
+	}
+
+	channelMember.Role = roleMapping.getChannelRoles()
+	return 0, nil
+}
+
+// applyMoodleTeamRole makes the channel member a team admin of the team of the channel, if their Moodle role is mapped to it.
+func (p *Plugin) applyMoodleTeamRole(channelID string, channelMember *serializer.ChannelMember) (int, error) {
+	roleMapping, status, err := p.getMoodleRoleMapping(channelMember)
+	if err != nil || roleMapping == nil || !roleMapping.isTeamAdmin() {
+		return status, err
+	}
+
+	return p.ensureTeamAdmin(channelID, channelMember.UserID)
+}
+
+// ensureTeamAdmin makes the user a team admin of the team of the channel, unless they already are.
+func (p *Plugin) ensureTeamAdmin(channelID, userID string) (int, error) {
+	channel, err := p.API.GetChannel(channelID)
+	if err != nil {
+		return err.StatusCode, errors.Wrap(err, "failed to get channel")
+	}
+
+	teamMember, err := p.API.GetTeamMember(channel.TeamId, userID)
+	if err != nil {
+		return err.StatusCode, errors.Wrap(err, "failed to get team member")
+	}
+
+	if teamMember.SchemeAdmin {
+		return 0, nil
+	}
+
+	if _, err := p.API.UpdateTeamMemberRoles(channel.TeamId, userID, model.TEAM_USER_ROLE_ID+" "+model.TEAM_ADMIN_ROLE_ID); err != nil {
+		return err.StatusCode, errors.Wrap(err, "failed to update roles for the user and team")
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils/testutils"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRoleMapping = `{
+	"teacher": {"channel_role": "channel_admin"},
+	"student": {"channel_role": "channel_user"},
+	"manager": {"channel_role": "channel_admin", "team_role": "team_admin"}
+}`
+
+func setupTestPluginWithRoleMapping(t *testing.T, api *plugintest.API) *Plugin {
+	p := setupTestPlugin(api)
+	config := p.getConfiguration().Clone()
+	config.RoleMapping = testRoleMapping
+	require.NoError(t, config.ProcessConfiguration())
+	p.setConfiguration(config)
+	return p
+}
+
+func TestRoleMappingConfiguration(t *testing.T) {
+	for name, test := range map[string]struct {
+		RoleMapping     string
+		ExpectedError   bool
+		ExpectedMapping map[string]*moodleRoleMapping
+	}{
+		"empty": {
+			RoleMapping:     "",
+			ExpectedMapping: map[string]*moodleRoleMapping{},
+		},
+		"valid": {
+			RoleMapping: testRoleMapping,
+			ExpectedMapping: map[string]*moodleRoleMapping{
+				"teacher": {ChannelRole: model.CHANNEL_ADMIN_ROLE_ID},
+				"student": {ChannelRole: model.CHANNEL_USER_ROLE_ID},
+				"manager": {ChannelRole: model.CHANNEL_ADMIN_ROLE_ID, TeamRole: model.TEAM_ADMIN_ROLE_ID},
+			},
+		},
+		"invalid JSON": {
+			RoleMapping:   `{"teacher": "channel_admin"}`,
+			ExpectedError: true,
+		},
+		"invalid channel role": {
+			RoleMapping:   `{"teacher": {"channel_role": "system_admin"}}`,
+			ExpectedError: true,
+		},
+		"invalid team role": {
+			RoleMapping:   `{"teacher": {"channel_role": "channel_admin", "team_role": "channel_admin"}}`,
+			ExpectedError: true,
+		},
+		"empty mapping": {
+			RoleMapping:   `{"teacher": null}`,
+			ExpectedError: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config := &configuration{
+				Secret:         testutils.GetSecret(),
+				BotUserName:    "moodle",
+				BotDisplayName: "Moodle",
+				BotDescription: "Moodle",
+				RoleMapping:    test.RoleMapping,
+			}
+
+			err := config.ProcessConfiguration()
+			if err == nil {
+				err = config.IsValid()
+			}
+
+			if test.ExpectedError {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.ExpectedMapping, config.roleMapping)
+		})
+	}
+}
+
+func TestAddUserToChannelWithMoodleRole(t *testing.T) {
+	requestURL := fmt.Sprintf("/api/v1/channels/%s/members?secret=%s", testutils.GetID(), testutils.GetSecret())
+	userID := model.NewId()
+	teamID := model.NewId()
+	for name, test := range map[string]struct {
+		ChannelMember      serializer.ChannelMember
+		SetupAPI           func(*plugintest.API) *plugintest.API
+		ExpectedStatusCode int
+		ExpectedErrorCode  string
+	}{
+		"mapped to channel member": {
+			ChannelMember: serializer.ChannelMember{UserID: userID, MoodleRole: "student"},
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("AddUserToChannel", testutils.GetID(), userID, mock.AnythingOfType("string")).Return(nil, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"existing channel admin mapped to channel member": {
+			ChannelMember: serializer.ChannelMember{UserID: userID, MoodleRole: "student"},
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("AddUserToChannel", testutils.GetID(), userID, mock.AnythingOfType("string")).Return(&model.ChannelMember{ChannelId: testutils.GetID(), UserId: userID, SchemeUser: true, SchemeAdmin: true}, nil)
+				api.On("UpdateChannelMemberRoles", testutils.GetID(), userID, "channel_user").Return(nil, nil)
+				api.On("GetUser", userID).Return(testutils.GetModelUser(), nil)
+				api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(nil, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"mapped to channel admin": {
+			ChannelMember: serializer.ChannelMember{UserID: userID, MoodleRole: "teacher"},
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("AddUserToChannel", testutils.GetID(), userID, mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("UpdateChannelMemberRoles", testutils.GetID(), userID, "channel_user channel_admin").Return(nil, nil)
+				api.On("GetUser", userID).Return(testutils.GetModelUser(), nil)
+				api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(nil, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"mapped to team admin": {
+			ChannelMember: serializer.ChannelMember{UserID: userID, MoodleRole: "manager"},
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("AddUserToChannel", testutils.GetID(), userID, mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("UpdateChannelMemberRoles", testutils.GetID(), userID, "channel_user channel_admin").Return(nil, nil)
+				api.On("GetUser", userID).Return(testutils.GetModelUser(), nil)
+				api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(nil, nil)
+				api.On("GetChannel", testutils.GetID()).Return(&model.Channel{Id: testutils.GetID(), TeamId: teamID}, nil)
+				api.On("GetTeamMember", teamID, userID).Return(&model.TeamMember{TeamId: teamID, UserId: userID, SchemeUser: true}, nil)
+				api.On("UpdateTeamMemberRoles", teamID, userID, "team_user team_admin").Return(nil, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"already team admin": {
+			ChannelMember: serializer.ChannelMember{UserID: userID, MoodleRole: "manager"},
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("AddUserToChannel", testutils.GetID(), userID, mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("UpdateChannelMemberRoles", testutils.GetID(), userID, "channel_user channel_admin").Return(nil, nil)
+				api.On("GetUser", userID).Return(testutils.GetModelUser(), nil)
+				api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(nil, nil)
+				api.On("GetChannel", testutils.GetID()).Return(&model.Channel{Id: testutils.GetID(), TeamId: teamID}, nil)
+				api.On("GetTeamMember", teamID, userID).Return(&model.TeamMember{TeamId: teamID, UserId: userID, SchemeUser: true, SchemeAdmin: true}, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		"failed to update team roles": {
+			ChannelMember: serializer.ChannelMember{UserID: userID, MoodleRole: "manager"},
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("AddUserToChannel", testutils.GetID(), userID, mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("UpdateChannelMemberRoles", testutils.GetID(), userID, "channel_user channel_admin").Return(nil, nil)
+				api.On("GetUser", userID).Return(testutils.GetModelUser(), nil)
+				api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(nil, nil)
+				api.On("GetChannel", testutils.GetID()).Return(&model.Channel{Id: testutils.GetID(), TeamId: teamID}, nil)
+				api.On("GetTeamMember", teamID, userID).Return(&model.TeamMember{TeamId: teamID, UserId: userID, SchemeUser: true}, nil)
+				api.On("UpdateTeamMemberRoles", teamID, userID, "team_user team_admin").Return(nil, testutils.GetInternalServerAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+		"unmapped Moodle role": {
+			ChannelMember: serializer.ChannelMember{UserID: userID, MoodleRole: "guest"},
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedErrorCode:  serializer.ErrorCodeRoleMappingNotFound,
+		},
+		"both role and Moodle role": {
+			ChannelMember: serializer.ChannelMember{UserID: userID, Role: model.CHANNEL_ADMIN_ROLE_ID, MoodleRole: "teacher"},
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedErrorCode:  serializer.ErrorCodeInvalidRole,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+			test.SetupAPI(api)
+			defer api.AssertExpectations(t)
+			p := setupTestPluginWithRoleMapping(t, api)
+
+			reqBody, err := json.Marshal(test.ChannelMember)
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, requestURL, bytes.NewBuffer(reqBody))
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+			assert.Equal(t, test.ExpectedStatusCode, result.StatusCode)
+			if test.ExpectedErrorCode != "" {
+				var errorBody *serializer.Error
+				require.NoError(t, json.NewDecoder(result.Body).Decode(&errorBody))
+				assert.Equal(t, test.ExpectedErrorCode, errorBody.Code)
+			}
+		})
+	}
+}
+
+func TestReconcileChannelMembersWithMoodleRoles(t *testing.T) {
+	channelID := testutils.GetID()
+	teamID := model.NewId()
+	managerID := model.NewId()
+	studentID := model.NewId()
+	guestID := model.NewId()
+
+	api := &plugintest.API{}
+	api.On("GetChannelMembers", channelID, 0, mock.AnythingOfType("int")).Return(&model.ChannelMembers{
+		{ChannelId: channelID, UserId: managerID, SchemeUser: true},
+		{ChannelId: channelID, UserId: studentID, SchemeUser: true, SchemeAdmin: true},
+		{ChannelId: channelID, UserId: guestID, SchemeUser: true},
+	}, nil)
+	api.On("UpdateChannelMemberRoles", channelID, managerID, "channel_user channel_admin").Return(nil, nil)
+	api.On("UpdateChannelMemberRoles", channelID, studentID, "channel_user").Return(nil, nil)
+	api.On("GetUser", mock.AnythingOfType("string")).Return(testutils.GetModelUser(), nil)
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(nil, nil)
+	api.On("GetChannel", channelID).Return(&model.Channel{Id: channelID, TeamId: teamID}, nil)
+	api.On("GetTeamMember", teamID, managerID).Return(&model.TeamMember{TeamId: teamID, UserId: managerID, SchemeUser: true}, nil)
+	api.On("UpdateTeamMemberRoles", teamID, managerID, "team_user team_admin").Return(nil, nil)
+	defer api.AssertExpectations(t)
+	p := setupTestPluginWithRoleMapping(t, api)
+
+	reconciliation, _, err := p.reconcileChannelMembers("", channelID, serializer.ChannelMembers{
+		{UserID: managerID, MoodleRole: "manager"},
+		{UserID: studentID, MoodleRole: "student"},
+		{UserID: guestID, MoodleRole: "guest"},
+	}, false, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{managerID}, reconciliation.Promoted)
+	assert.Equal(t, []string{studentID}, reconciliation.Demoted)
+	assert.Empty(t, reconciliation.Removed)
+	require.Len(t, reconciliation.Errors, 1)
+	assert.Equal(t, guestID, reconciliation.Errors[0].UserID)
+	assert.Equal(t, serializer.ErrorCodeRoleMappingNotFound, reconciliation.Errors[0].ErrorCode)
+}
+
+func TestUpdateChannelMembersWithMoodleRoles(t *testing.T) {
+	channelID := testutils.GetID()
+	studentID := model.NewId()
+
+	api := &plugintest.API{}
+	api.On("AddUserToChannel", channelID, studentID, mock.AnythingOfType("string")).Return(&model.ChannelMember{ChannelId: channelID, UserId: studentID, SchemeUser: true, SchemeAdmin: true}, nil)
+	api.On("UpdateChannelMemberRoles", channelID, studentID, "channel_user").Return(nil, nil)
+	api.On("GetUser", studentID).Return(testutils.GetModelUser(), nil)
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(nil, nil)
+	defer api.AssertExpectations(t)
+	p := setupTestPluginWithRoleMapping(t, api)
+
+	result := p.applyChannelMemberChange("", channelID, &serializer.ChannelMember{UserID: studentID, MoodleRole: "student", Action: serializer.ChannelMemberActionAdd})
+	assert.Equal(t, model.STATUS_OK, result.Status)
+}
@@ -0,0 +1,88 @@
+package serializer
+
+import (
+	"encoding/json"
+	"io"
+)
+
+const announcementSubjectMaxLength = 255
+
+// Announcement is a post of the news forum of a Moodle course, which is mirrored in the course channel
+type Announcement struct {
+	ID          string                   `json:"id"`
+	Subject     string                   `json:"subject"`
+	Message     string                   `json:"message"`
+	Author      *AnnouncementAuthor      `json:"author"`
+	Attachments []AnnouncementAttachment `json:"attachments,omitempty"`
+	URL         string                   `json:"url,omitempty"`
+}
+
+// AnnouncementAuthor is the Moodle user who wrote an announcement
+type AnnouncementAuthor struct {
+	MoodleUserID string `json:"moodle_user_id,omitempty"`
+	FullName     string `json:"fullname"`
+	PictureURL   string `json:"picture_url,omitempty"`
+}
+
+// AnnouncementAttachment is a file attached to an announcement, which is linked to from the mirrored post
+type AnnouncementAttachment struct {
+	FileName string `json:"filename"`
+	URL      string `json:"url"`
+}
+
+// MirroredAnnouncement links an announcement to the post mirroring it
+type MirroredAnnouncement struct {
+	ID        string `json:"id"`
+	ChannelID string `json:"channel_id"`
+	PostID    string `json:"post_id"`
+}
+
+func AnnouncementFromJSON(data io.Reader) *Announcement {
+	var a *Announcement
+	_ = json.NewDecoder(data).Decode(&a)
+	return a
+}
+
+// ToJSON converts a MirroredAnnouncement to a json string
+func (m *MirroredAnnouncement) ToJSON() string {
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+func (a *Announcement) Validate() error {
+	if a == nil {
+		return NewError(ErrorCodeInvalidRequestBody, "invalid request body")
+	}
+
+	if !IsValidMoodleID(a.ID) {
+		return NewError(ErrorCodeInvalidAnnouncement, "error: id is not valid")
+	}
+
+	if a.Subject == "" || len(a.Subject) > announcementSubjectMaxLength {
+		return NewError(ErrorCodeInvalidAnnouncement, "error: subject is not valid")
+	}
+
+	if a.Author == nil || a.Author.FullName == "" {
+		return NewError(ErrorCodeInvalidAnnouncement, "error: author.fullname is required")
+	}
+
+	if a.Author.MoodleUserID != "" && !IsValidMoodleID(a.Author.MoodleUserID) {
+		return NewError(ErrorCodeInvalidAnnouncement, "error: author.moodle_user_id is not valid")
+	}
+
+	if a.Author.PictureURL != "" && !isValidHTTPURL(a.Author.PictureURL) {
+		return NewError(ErrorCodeInvalidAnnouncement, "error: author.picture_url must be an absolute http or https URL")
+	}
+
+	for _, attachment := range a.Attachments {
+		if attachment.FileName == "" || !isValidHTTPURL(attachment.URL) {
+			return NewError(ErrorCodeInvalidAnnouncement, "error: every attachment needs a filename and an absolute http or https url")
+		}
+	}
+
+	if a.URL != "" && !isValidHTTPURL(a.URL) {
+		return NewError(ErrorCodeInvalidAnnouncement, "error: url must be an absolute http or https URL")
+	}
+
+	return nil
+}
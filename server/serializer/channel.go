@@ -1,21 +1,77 @@
 package serializer
 
 import (
+	"encoding/base64"
 	"encoding/json"
-	"errors"
+	"fmt"
 	"io"
+	"unicode/utf8"
 
 	"github.com/mattermost/mattermost-server/v5/model"
 )
 
 type Channel struct {
-	Name     string `json:"name"`
-	TeamName string `json:"team_name"`
+	Name         string `json:"name"`
+	DisplayName  string `json:"display_name,omitempty"`
+	Purpose      string `json:"purpose,omitempty"`
+	Header       string `json:"header,omitempty"`
+	Type         string `json:"type,omitempty"`
+	TeamName     string `json:"team_name,omitempty"`
+	CourseID     string `json:"course_id,omitempty"`
+	SiteID       string `json:"site_id,omitempty"`
+	CategoryName string `json:"category_name,omitempty"`
 }
 
+// ChannelPatch contains the fields of a channel which can be updated. Missing fields are left unchanged.
+type ChannelPatch struct {
+	DisplayName *string `json:"display_name"`
+	Purpose     *string `json:"purpose"`
+	Header      *string `json:"header"`
+}
+
+const (
+	ChannelMemberActionAdd        = "add"
+	ChannelMemberActionRemove     = "remove"
+	ChannelMemberActionUpdateRole = "update_role"
+
+	// ChannelMembersMaxBatchSize is the maximum number of channel members which can be updated in a single request
+	ChannelMembersMaxBatchSize = 1000
+)
+
 type ChannelMember struct {
-	UserID string `json:"user_id"`
-	Role   string `json:"role"`
+	UserID       string `json:"user_id,omitempty"`
+	MoodleUserID string `json:"moodle_user_id,omitempty"`
+	Role         string `json:"role"`
+	Action       string `json:"action,omitempty"`
+
+	// MoodleRole is the shortname of the user's role in Moodle, which is mapped to Mattermost roles by the plugin.
+	// It cannot be combined with Role.
+	MoodleRole string `json:"moodle_role,omitempty"`
+}
+
+type ChannelMembers []ChannelMember
+
+// ChannelMemberResult is the outcome of a single change in a batch of channel member changes
+type ChannelMemberResult struct {
+	UserID       string `json:"user_id,omitempty"`
+	MoodleUserID string `json:"moodle_user_id,omitempty"`
+	Action       string `json:"action,omitempty"`
+	Status       string `json:"status"`
+	StatusCode   int    `json:"status_code,omitempty"`
+	Error        string `json:"error,omitempty"`
+	ErrorCode    string `json:"error_code,omitempty"`
+}
+
+type ChannelMemberResults []ChannelMemberResult
+
+// ChannelMembersReconciliation is the diff between the expected and the actual members of a channel
+type ChannelMembersReconciliation struct {
+	DryRun   bool                 `json:"dry_run"`
+	Added    []string             `json:"added"`
+	Removed  []string             `json:"removed"`
+	Promoted []string             `json:"promoted"`
+	Demoted  []string             `json:"demoted"`
+	Errors   ChannelMemberResults `json:"errors"`
 }
 
 type ChannelMemberWithUserInfo struct {
@@ -24,10 +80,29 @@ type ChannelMemberWithUserInfo struct {
 	Email          string `json:"email"`
 	Username       string `json:"username"`
 	IsChannelAdmin bool   `json:"is_channel_admin"`
+	FirstName      string `json:"first_name,omitempty"`
+	LastName       string `json:"last_name,omitempty"`
+	AuthService    string `json:"auth_service,omitempty"`
+	IsDeactivated  *bool  `json:"is_deactivated,omitempty"`
+	IsBot          bool   `json:"is_bot,omitempty"`
 }
 
 type ChannelMembersWithUserInfo []ChannelMemberWithUserInfo
 
+// ChannelMembersExport is a page of an export of all the members of a channel
+type ChannelMembersExport struct {
+	Members    ChannelMembersWithUserInfo `json:"members"`
+	NextCursor string                     `json:"next_cursor"`
+	TotalCount int64                      `json:"total_count"`
+}
+
+// ChannelMembersCursor points to the last channel member returned by an export, after which the export continues.
+// The export is ordered by user ID, which the plugin sorts itself, so that the order does not depend on the collation of the database.
+type ChannelMembersCursor struct {
+	LastUserID string `json:"last_user_id,omitempty"`
+	PerPage    int    `json:"per_page"`
+}
+
 // ToJSON converts a ChannelMembersWithUserInfo to a json string
 func (o *ChannelMembersWithUserInfo) ToJSON() string {
 	b, err := json.Marshal(o)
@@ -37,6 +112,53 @@ func (o *ChannelMembersWithUserInfo) ToJSON() string {
 	return string(b)
 }
 
+// ToJSON converts a ChannelMembersExport to a json string
+func (o *ChannelMembersExport) ToJSON() string {
+	b, _ := json.Marshal(o)
+	return string(b)
+}
+
+// IsAfter checks if the user comes after the last member pointed to by the cursor, in the order of the export
+func (o *ChannelMembersCursor) IsAfter(userID string) bool {
+	return userID > o.LastUserID
+}
+
+// ToString encodes a ChannelMembersCursor to the opaque string which is sent to the client
+func (o *ChannelMembersCursor) ToString() string {
+	b, _ := json.Marshal(o)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ChannelMembersCursorFromString decodes a ChannelMembersCursor from the string sent by the client
+func ChannelMembersCursorFromString(cursor string) (*ChannelMembersCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, NewError(ErrorCodeInvalidCursor, "cursor is not valid")
+	}
+
+	var o *ChannelMembersCursor
+	if json.Unmarshal(b, &o) != nil || o == nil || !model.IsValidId(o.LastUserID) || o.PerPage <= 0 {
+		return nil, NewError(ErrorCodeInvalidCursor, "cursor is not valid")
+	}
+
+	return o, nil
+}
+
+// ToJSON converts a ChannelMemberResults to a json string
+func (o *ChannelMemberResults) ToJSON() string {
+	b, err := json.Marshal(o)
+	if err != nil || string(b) == "null" {
+		return "[]"
+	}
+	return string(b)
+}
+
+// ToJSON converts a ChannelMembersReconciliation to a json string
+func (o *ChannelMembersReconciliation) ToJSON() string {
+	b, _ := json.Marshal(o)
+	return string(b)
+}
+
 func ChannelFromJSON(data io.Reader) *Channel {
 	var o *Channel
 	_ = json.NewDecoder(data).Decode(&o)
@@ -49,17 +171,89 @@ func ChannelMemberFromJSON(data io.Reader) *ChannelMember {
 	return o
 }
 
+func ChannelPatchFromJSON(data io.Reader) *ChannelPatch {
+	var o *ChannelPatch
+	_ = json.NewDecoder(data).Decode(&o)
+	return o
+}
+
+func ChannelMembersFromJSON(data io.Reader) ChannelMembers {
+	var o ChannelMembers
+	_ = json.NewDecoder(data).Decode(&o)
+	return o
+}
+
 func (c *Channel) Validate() error {
 	if c == nil {
-		return errors.New("invalid request body")
+		return NewError(ErrorCodeInvalidRequestBody, "invalid request body")
 	}
 
 	if !model.IsValidChannelIdentifier(c.Name) {
-		return errors.New("error: name is not valid")
+		return NewError(ErrorCodeInvalidChannelName, "error: name is not valid")
+	}
+
+	if c.TeamName == "" && c.SiteID == "" {
+		return NewError(ErrorCodeMissingTeam, "error: either team_name or site_id is required")
+	}
+
+	if c.TeamName != "" && !model.IsValidTeamName(c.TeamName) {
+		return NewError(ErrorCodeInvalidTeamName, "error: team_name is not valid")
+	}
+
+	if c.SiteID != "" && !IsValidMoodleID(c.SiteID) {
+		return NewError(ErrorCodeInvalidSiteID, "error: site_id is not valid")
+	}
+
+	if c.CourseID != "" && !IsValidMoodleID(c.CourseID) {
+		return NewError(ErrorCodeInvalidCourseID, "error: course_id is not valid")
+	}
+
+	if c.Type != "" && c.Type != model.CHANNEL_OPEN && c.Type != model.CHANNEL_PRIVATE {
+		return NewError(ErrorCodeInvalidChannelType, "error: type can only be 'O' or 'P'")
+	}
+
+	return validateChannelDetails(c.DisplayName, c.Purpose, c.Header)
+}
+
+// ToMattermostChannel applies the patch to the given channel
+func (c *ChannelPatch) ToMattermostChannel(channel *model.Channel) (*model.Channel, error) {
+	if c == nil || (c.DisplayName == nil && c.Purpose == nil && c.Header == nil) {
+		return nil, NewError(ErrorCodeInvalidRequestBody, "invalid request body")
+	}
+
+	if c.DisplayName != nil {
+		if *c.DisplayName == "" {
+			return nil, NewError(ErrorCodeInvalidDisplayName, "error: display_name cannot be empty")
+		}
+		channel.DisplayName = *c.DisplayName
+	}
+
+	if c.Purpose != nil {
+		channel.Purpose = *c.Purpose
 	}
 
-	if !model.IsValidTeamName(c.TeamName) {
-		return errors.New("error: team_name is not valid")
+	if c.Header != nil {
+		channel.Header = *c.Header
+	}
+
+	if err := validateChannelDetails(channel.DisplayName, channel.Purpose, channel.Header); err != nil {
+		return nil, err
+	}
+
+	return channel, nil
+}
+
+func validateChannelDetails(displayName, purpose, header string) error {
+	if utf8.RuneCountInString(displayName) > model.CHANNEL_DISPLAY_NAME_MAX_RUNES {
+		return NewError(ErrorCodeInvalidDisplayName, fmt.Sprintf("error: display_name cannot be longer than %d characters", model.CHANNEL_DISPLAY_NAME_MAX_RUNES))
+	}
+
+	if utf8.RuneCountInString(purpose) > model.CHANNEL_PURPOSE_MAX_RUNES {
+		return NewError(ErrorCodeInvalidPurpose, fmt.Sprintf("error: purpose cannot be longer than %d characters", model.CHANNEL_PURPOSE_MAX_RUNES))
+	}
+
+	if utf8.RuneCountInString(header) > model.CHANNEL_HEADER_MAX_RUNES {
+		return NewError(ErrorCodeInvalidHeader, fmt.Sprintf("error: header cannot be longer than %d characters", model.CHANNEL_HEADER_MAX_RUNES))
 	}
 
 	return nil
@@ -67,15 +261,50 @@ func (c *Channel) Validate() error {
 
 func (c *ChannelMember) Validate() error {
 	if c == nil {
-		return errors.New("invalid request body")
+		return NewError(ErrorCodeInvalidRequestBody, "invalid request body")
 	}
 
-	if !model.IsValidId(c.UserID) {
-		return errors.New("error: user_id is not valid")
+	switch {
+	case c.UserID != "":
+		if !model.IsValidId(c.UserID) {
+			return NewError(ErrorCodeInvalidUserID, "error: user_id is not valid")
+		}
+	case c.MoodleUserID != "":
+		if !IsValidMoodleID(c.MoodleUserID) {
+			return NewError(ErrorCodeInvalidMoodleUserID, "error: moodle_user_id is not valid")
+		}
+	default:
+		return NewError(ErrorCodeMissingUser, "error: either user_id or moodle_user_id is required")
 	}
 
 	if c.Role != "" && !model.IsValidUserRoles(c.Role) {
-		return errors.New("error: role is not valid")
+		return NewError(ErrorCodeInvalidRole, "error: role is not valid")
+	}
+
+	if c.Role != "" && c.MoodleRole != "" {
+		return NewError(ErrorCodeInvalidRole, "error: role and moodle_role cannot both be set")
+	}
+
+	switch c.Action {
+	case "", ChannelMemberActionAdd, ChannelMemberActionRemove:
+	case ChannelMemberActionUpdateRole:
+		if c.Role == "" && c.MoodleRole == "" {
+			return NewError(ErrorCodeInvalidRole, "error: either role or moodle_role is required")
+		}
+	default:
+		return NewError(ErrorCodeInvalidAction, "error: action is not valid")
+	}
+
+	return nil
+}
+
+func (c ChannelMembers) Validate() error {
+	if len(c) == 0 {
+		return NewError(ErrorCodeInvalidChannelMembers, "error: channel members cannot be empty")
+	}
+
+	if len(c) > ChannelMembersMaxBatchSize {
+		return NewError(ErrorCodeInvalidChannelMembers, fmt.Sprintf("error: at most %d channel members can be updated at once", ChannelMembersMaxBatchSize))
 	}
 
 	return nil
@@ -0,0 +1,27 @@
+package serializer
+
+import (
+	"encoding/json"
+)
+
+// PendingDeactivation is a user deactivation which takes effect once the grace period after the user was deleted by Moodle is over
+type PendingDeactivation struct {
+	UserID       string `json:"user_id"`
+	JobID        string `json:"job_id"`
+	CreateAt     int64  `json:"create_at"`
+	DeactivateAt int64  `json:"deactivate_at"`
+}
+
+type PendingDeactivations []*PendingDeactivation
+
+// ToJSON converts a PendingDeactivation to a json string
+func (d *PendingDeactivation) ToJSON() string {
+	b, _ := json.Marshal(d)
+	return string(b)
+}
+
+// ToJSON converts PendingDeactivations to a json string
+func (d PendingDeactivations) ToJSON() string {
+	b, _ := json.Marshal(d)
+	return string(b)
+}
@@ -0,0 +1,84 @@
+package serializer
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+)
+
+// Types of the Moodle items which have a deadline
+const (
+	DeadlineTypeAssignment = "assignment"
+	DeadlineTypeQuiz       = "quiz"
+	DeadlineTypeCalendar   = "calendar"
+)
+
+const deadlineNameMaxLength = 255
+
+// Deadline is the due date of a Moodle assignment, quiz or calendar event of a course.
+// Reminders of it are posted in the course channel before it is due.
+type Deadline struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	URL   string `json:"url,omitempty"`
+	DueAt int64  `json:"due_at"`
+	// RemindAt contains the times at which reminders of the deadline are posted, set by the plugin
+	RemindAt []int64 `json:"remind_at,omitempty"`
+}
+
+type Deadlines []*Deadline
+
+func DeadlineFromJSON(data io.Reader) *Deadline {
+	var d *Deadline
+	_ = json.NewDecoder(data).Decode(&d)
+	return d
+}
+
+// ToJSON converts a Deadline to a json string
+func (d *Deadline) ToJSON() string {
+	b, _ := json.Marshal(d)
+	return string(b)
+}
+
+// ToJSON converts Deadlines to a json string
+func (d Deadlines) ToJSON() string {
+	b, _ := json.Marshal(d)
+	return string(b)
+}
+
+func (d *Deadline) Validate() error {
+	if d == nil {
+		return NewError(ErrorCodeInvalidRequestBody, "invalid request body")
+	}
+
+	if !IsValidMoodleID(d.ID) {
+		return NewError(ErrorCodeInvalidDeadline, "error: id is not valid")
+	}
+
+	switch d.Type {
+	case DeadlineTypeAssignment, DeadlineTypeQuiz, DeadlineTypeCalendar:
+	default:
+		return NewError(ErrorCodeInvalidDeadline, "error: type must be one of assignment, quiz or calendar")
+	}
+
+	if d.Name == "" || len(d.Name) > deadlineNameMaxLength {
+		return NewError(ErrorCodeInvalidDeadline, "error: name is not valid")
+	}
+
+	if d.DueAt <= 0 {
+		return NewError(ErrorCodeInvalidDeadline, "error: due_at is not valid")
+	}
+
+	if d.URL != "" && !isValidHTTPURL(d.URL) {
+		return NewError(ErrorCodeInvalidDeadline, "error: url must be an absolute http or https URL")
+	}
+
+	return nil
+}
+
+// isValidHTTPURL checks if the given string is an absolute http or https URL, which can be linked to in a post
+func isValidHTTPURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
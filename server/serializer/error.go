@@ -0,0 +1,109 @@
+package serializer
+
+import (
+	"encoding/json"
+)
+
+// Error codes returned in the body of failed requests.
+// They are part of the API, so existing codes must not be renamed.
+const (
+	ErrorCodeBadRequest          = "bad_request"
+	ErrorCodeForbidden           = "forbidden"
+	ErrorCodeNotFound            = "not_found"
+	ErrorCodeMethodNotAllowed    = "method_not_allowed"
+	ErrorCodeConflict            = "conflict"
+	ErrorCodeUnprocessableEntity = "unprocessable_entity"
+	ErrorCodeInternalError       = "internal_error"
+
+	ErrorCodeInvalidRequestBody    = "invalid_request_body"
+	ErrorCodeInvalidSecret         = "invalid_secret"
+	ErrorCodeInvalidSignature      = "invalid_signature"
+	ErrorCodeRequestNotSigned      = "request_not_signed"
+	ErrorCodeInvalidChannelID      = "invalid_channel_id"
+	ErrorCodeInvalidChannelName    = "invalid_channel_name"
+	ErrorCodeInvalidChannelType    = "invalid_channel_type"
+	ErrorCodeInvalidDisplayName    = "invalid_display_name"
+	ErrorCodeInvalidPurpose        = "invalid_purpose"
+	ErrorCodeInvalidHeader         = "invalid_header"
+	ErrorCodeInvalidUserID         = "invalid_user_id"
+	ErrorCodeInvalidUsername       = "invalid_username"
+	ErrorCodeInvalidEmail          = "invalid_email"
+	ErrorCodeInvalidAuthService    = "invalid_auth_service"
+	ErrorCodeInvalidAuthData       = "invalid_auth_data"
+	ErrorCodeInvalidLocale         = "invalid_locale"
+	ErrorCodeInvalidTimezone       = "invalid_timezone"
+	ErrorCodeInvalidPosition       = "invalid_position"
+	ErrorCodeInvalidTeamName       = "invalid_team_name"
+	ErrorCodeInvalidSiteID         = "invalid_site_id"
+	ErrorCodeInvalidCourseID       = "invalid_course_id"
+	ErrorCodeInvalidMoodleID       = "invalid_moodle_id"
+	ErrorCodeInvalidMoodleUserID   = "invalid_moodle_user_id"
+	ErrorCodeInvalidMattermostID   = "invalid_mattermost_id"
+	ErrorCodeInvalidRole           = "invalid_role"
+	ErrorCodeInvalidAction         = "invalid_action"
+	ErrorCodeInvalidChannelMembers = "invalid_channel_members"
+	ErrorCodeInvalidJobID          = "invalid_job_id"
+	ErrorCodeInvalidCursor         = "invalid_cursor"
+	ErrorCodeInvalidFormat         = "invalid_format"
+	ErrorCodeInvalidIdempotencyKey = "invalid_idempotency_key"
+	ErrorCodeInvalidGroupID        = "invalid_group_id"
+	ErrorCodeInvalidGroupType      = "invalid_group_type"
+	ErrorCodeInvalidParentChannel  = "invalid_parent_channel"
+	ErrorCodeInvalidImage          = "invalid_image"
+	ErrorCodeInvalidDeadline       = "invalid_deadline"
+	ErrorCodeInvalidAnnouncement   = "invalid_announcement"
+	ErrorCodeImageTooLarge         = "image_too_large"
+	ErrorCodeMissingTeam           = "missing_team"
+	ErrorCodeMissingUser           = "missing_user"
+
+	ErrorCodeTeamNotFound          = "team_not_found"
+	ErrorCodeTeamMemberNotFound    = "team_member_not_found"
+	ErrorCodeChannelNotFound       = "channel_not_found"
+	ErrorCodeChannelMemberNotFound = "channel_member_not_found"
+	ErrorCodeChannelMemberExists   = "channel_member_exists"
+	ErrorCodeChannelArchived       = "channel_archived"
+	ErrorCodeChannelNotArchived    = "channel_not_archived"
+	ErrorCodeUserNotFound          = "user_not_found"
+	ErrorCodeUsernameExists        = "username_exists"
+	ErrorCodeEmailExists           = "email_exists"
+	ErrorCodeMappingNotFound       = "mapping_not_found"
+	ErrorCodeRoleMappingNotFound   = "role_mapping_not_found"
+	ErrorCodeJobNotFound           = "job_not_found"
+	ErrorCodeGroupChannelExists    = "group_channel_exists"
+	ErrorCodeDeadlineNotFound      = "deadline_not_found"
+	ErrorCodeAnnouncementNotFound  = "announcement_not_found"
+
+	ErrorCodePendingDeactivationNotFound = "pending_deactivation_not_found"
+
+	ErrorCodeIdempotencyKeyInUse  = "idempotency_key_in_use"
+	ErrorCodeIdempotencyKeyReused = "idempotency_key_reused"
+
+	ErrorCodeAuthUpdateNotConfigured = "auth_update_not_configured"
+	ErrorCodeMoodleNotConfigured     = "moodle_not_configured"
+)
+
+// Error is the body of a failed request.
+// It can also be returned as an error to attach a code to it.
+type Error struct {
+	Code              string `json:"code"`
+	Message           string `json:"message"`
+	MattermostErrorID string `json:"mattermost_error_id,omitempty"`
+	RequestID         string `json:"request_id,omitempty"`
+}
+
+func NewError(code, message string) *Error {
+	return &Error{
+		Code:    code,
+		Message: message,
+	}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ToJSON converts an Error to a json string
+func (e *Error) ToJSON() string {
+	b, _ := json.Marshal(e)
+	return string(b)
+}
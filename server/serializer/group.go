@@ -0,0 +1,100 @@
+package serializer
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	GroupTypeGroup    = "group"
+	GroupTypeGrouping = "grouping"
+)
+
+// GroupChannel is a channel created for a group or a grouping of a Moodle course, under the channel of the course
+type GroupChannel struct {
+	Name        string         `json:"name"`
+	DisplayName string         `json:"display_name,omitempty"`
+	Purpose     string         `json:"purpose,omitempty"`
+	Header      string         `json:"header,omitempty"`
+	Type        string         `json:"type,omitempty"`
+	GroupID     string         `json:"group_id"`
+	GroupType   string         `json:"group_type,omitempty"`
+	Members     ChannelMembers `json:"members,omitempty"`
+}
+
+// GroupChannelLink links a group channel to the course channel it was created under
+type GroupChannelLink struct {
+	ChannelID       string `json:"channel_id"`
+	ParentChannelID string `json:"parent_channel_id"`
+	GroupID         string `json:"group_id"`
+	GroupType       string `json:"group_type"`
+}
+
+type GroupChannelLinks []GroupChannelLink
+
+// GroupChannelResult is the response of creating a group channel
+type GroupChannelResult struct {
+	Channel *model.Channel       `json:"channel"`
+	Members ChannelMemberResults `json:"members"`
+}
+
+// ChannelWithGroupChannels is a channel along with its links to the course channel above it or the group channels below it
+type ChannelWithGroupChannels struct {
+	*model.Channel
+	ParentChannelID string            `json:"parent_channel_id,omitempty"`
+	GroupChannels   GroupChannelLinks `json:"group_channels"`
+}
+
+func GroupChannelFromJSON(data io.Reader) *GroupChannel {
+	var o *GroupChannel
+	_ = json.NewDecoder(data).Decode(&o)
+	return o
+}
+
+// ToJSON converts a GroupChannelResult to a json string
+func (o *GroupChannelResult) ToJSON() string {
+	b, _ := json.Marshal(o)
+	return string(b)
+}
+
+// ToJSON converts a ChannelWithGroupChannels to a json string
+func (o *ChannelWithGroupChannels) ToJSON() string {
+	b, _ := json.Marshal(o)
+	return string(b)
+}
+
+func (g *GroupChannel) Validate() error {
+	if g == nil {
+		return NewError(ErrorCodeInvalidRequestBody, "invalid request body")
+	}
+
+	if !model.IsValidChannelIdentifier(g.Name) {
+		return NewError(ErrorCodeInvalidChannelName, "error: name is not valid")
+	}
+
+	if !IsValidMoodleID(g.GroupID) {
+		return NewError(ErrorCodeInvalidGroupID, "error: group_id is not valid")
+	}
+
+	if g.GroupType != "" && g.GroupType != GroupTypeGroup && g.GroupType != GroupTypeGrouping {
+		return NewError(ErrorCodeInvalidGroupType, "error: group_type can only be 'group' or 'grouping'")
+	}
+
+	if g.Type != "" && g.Type != model.CHANNEL_OPEN && g.Type != model.CHANNEL_PRIVATE {
+		return NewError(ErrorCodeInvalidChannelType, "error: type can only be 'O' or 'P'")
+	}
+
+	if len(g.Members) > ChannelMembersMaxBatchSize {
+		return NewError(ErrorCodeInvalidChannelMembers, "error: too many members")
+	}
+
+	for _, member := range g.Members {
+		if member.Action != "" && member.Action != ChannelMemberActionAdd {
+			return NewError(ErrorCodeInvalidAction, "error: members of a group channel can only be added")
+		}
+	}
+
+	return validateChannelDetails(g.DisplayName, g.Purpose, g.Header)
+}
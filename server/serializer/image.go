@@ -0,0 +1,87 @@
+package serializer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"strings"
+
+	// Register the image formats accepted for profile images
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// ProfileImageMaxSize is the maximum size in bytes of a profile image
+const ProfileImageMaxSize = 5 * 1024 * 1024
+
+var profileImageContentTypes = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+}
+
+// ProfileImage is the body of a request which sets the profile image of a user from base64 data
+type ProfileImage struct {
+	Image string `json:"image"`
+}
+
+func ProfileImageFromJSON(data io.Reader) *ProfileImage {
+	var i *ProfileImage
+	_ = json.NewDecoder(data).Decode(&i)
+	return i
+}
+
+// DecodeProfileImage decodes a base64 encoded profile image, which can also be sent as a data URL, and validates it
+func DecodeProfileImage(encoded string) ([]byte, error) {
+	if i := strings.Index(encoded, ";base64,"); strings.HasPrefix(encoded, "data:") && i >= 0 {
+		encoded = encoded[i+len(";base64,"):]
+	}
+
+	if len(encoded) > base64.StdEncoding.EncodedLen(ProfileImageMaxSize) {
+		return nil, NewError(ErrorCodeImageTooLarge, fmt.Sprintf("error: image is larger than %d bytes", ProfileImageMaxSize))
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, NewError(ErrorCodeInvalidImage, "error: image is not valid base64")
+	}
+
+	if err := ValidateProfileImage(data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// ValidateProfileImage checks that the data is a GIF, JPEG or PNG image which Mattermost accepts as a profile image
+func ValidateProfileImage(data []byte) error {
+	if len(data) == 0 {
+		return NewError(ErrorCodeInvalidImage, "error: image is empty")
+	}
+
+	if len(data) > ProfileImageMaxSize {
+		return NewError(ErrorCodeImageTooLarge, fmt.Sprintf("error: image is larger than %d bytes", ProfileImageMaxSize))
+	}
+
+	if contentType := http.DetectContentType(data); !profileImageContentTypes[contentType] {
+		return NewError(ErrorCodeInvalidImage, fmt.Sprintf("error: image type %s is not supported, only GIF, JPEG and PNG images are", contentType))
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return NewError(ErrorCodeInvalidImage, "error: image cannot be decoded")
+	}
+
+	if int64(config.Width)*int64(config.Height) > model.MaxImageSize {
+		return NewError(ErrorCodeImageTooLarge, "error: image dimensions are too large")
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package serializer
+
+import (
+	"encoding/json"
+)
+
+const (
+	JobStatusPending   = "pending"
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+
+	JobTypeUpdateChannelMembers    = "update_channel_members"
+	JobTypeReconcileChannelMembers = "reconcile_channel_members"
+	JobTypeDeactivateUser          = "deactivate_user"
+	JobTypeSendDeadlineReminder    = "send_deadline_reminder"
+	JobTypeHTTPRequest             = "http_request"
+
+	JobParamChannelID    = "channel_id"
+	JobParamSiteID       = "site_id"
+	JobParamDryRun       = "dry_run"
+	JobParamUserID       = "user_id"
+	JobParamDeadlineType = "deadline_type"
+	JobParamDeadlineID   = "deadline_id"
+	JobParamReminderID   = "reminder_id"
+)
+
+// Job is an operation which is processed in the background.
+// Its payload is the body of the request which created it, and its result is the body which the request would have returned.
+type Job struct {
+	ID            string            `json:"id"`
+	Type          string            `json:"type"`
+	Params        map[string]string `json:"params,omitempty"`
+	Payload       json.RawMessage   `json:"payload,omitempty"`
+	Status        string            `json:"status"`
+	Attempts      int               `json:"attempts"`
+	NextAttemptAt int64             `json:"next_attempt_at,omitempty"`
+	Result        json.RawMessage   `json:"result,omitempty"`
+	Error         string            `json:"error,omitempty"`
+	CreateAt      int64             `json:"create_at"`
+	UpdateAt      int64             `json:"update_at"`
+}
+
+// ToJSON converts a Job to a json string, leaving out its payload
+func (j *Job) ToJSON() string {
+	job := *j
+	job.Payload = nil
+	b, _ := json.Marshal(job)
+	return string(b)
+}
+
+// IsFinished checks if the job will not be processed anymore
+func (j *Job) IsFinished() bool {
+	return j.Status == JobStatusSucceeded || j.Status == JobStatusFailed
+}
+
+// HTTPRequest is the payload of a job replaying a request sent with the "async" query parameter
+type HTTPRequest struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Query   string            `json:"query,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    []byte            `json:"body,omitempty"`
+
+	// NoRetry is set for requests whose handler is not idempotent, such as creating a channel.
+	// They are not retried after a server error, as a retry could fail because of the changes the request already made.
+	NoRetry bool `json:"no_retry,omitempty"`
+}
+
+// HTTPResponse is the result of a job replaying a request, which is the response the request would have returned
+type HTTPResponse struct {
+	StatusCode int             `json:"status_code"`
+	Body       json.RawMessage `json:"body,omitempty"`
+}
@@ -0,0 +1,52 @@
+package serializer
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const moodleIDMaxLength = 255
+
+// Mapping links an entity in Moodle to the corresponding entity in Mattermost
+type Mapping struct {
+	MoodleID     string `json:"moodle_id"`
+	MattermostID string `json:"mattermost_id"`
+	// SiteID is the Moodle site of the course or user, which is empty for the mappings stored without a site
+	SiteID string `json:"site_id,omitempty"`
+}
+
+func MappingFromJSON(data io.Reader) *Mapping {
+	var m *Mapping
+	_ = json.NewDecoder(data).Decode(&m)
+	return m
+}
+
+// ToJSON converts a Mapping to a json string
+func (m *Mapping) ToJSON() string {
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+func (m *Mapping) Validate() error {
+	if m == nil {
+		return NewError(ErrorCodeInvalidRequestBody, "invalid request body")
+	}
+
+	if !IsValidMoodleID(m.MoodleID) {
+		return NewError(ErrorCodeInvalidMoodleID, "error: moodle_id is not valid")
+	}
+
+	if !model.IsValidId(m.MattermostID) {
+		return NewError(ErrorCodeInvalidMattermostID, "error: mattermost_id is not valid")
+	}
+
+	return nil
+}
+
+// IsValidMoodleID checks if the given string can be used as the ID of a Moodle entity
+func IsValidMoodleID(id string) bool {
+	return id != "" && len(id) <= moodleIDMaxLength && !strings.ContainsAny(id, " \t\r\n/")
+}
@@ -2,23 +2,46 @@ package serializer
 
 import (
 	"encoding/json"
-	"errors"
 	"io"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/mattermost/mattermost-server/v5/model"
 )
 
+// Keys of the timezone of a Mattermost user
+const (
+	timezoneKeyUseAutomatic = "useAutomaticTimezone"
+	timezoneKeyAutomatic    = "automaticTimezone"
+	timezoneKeyManual       = "manualTimezone"
+)
+
 type User struct {
-	ID          string `json:"id"`
-	Email       string `json:"email"`
-	Username    string `json:"username"`
-	TeamName    string `json:"team_name"`
-	AuthService string `json:"auth_service"`
-	AuthData    string `json:"auth_data,omitempty"`
-	FirstName   string `json:"first_name"`
-	LastName    string `json:"last_name"`
-	Nickname    string `json:"nickname"`
+	ID           string `json:"id"`
+	MoodleUserID string `json:"moodle_user_id,omitempty"`
+	Email        string `json:"email"`
+	Username     string `json:"username"`
+	TeamName     string `json:"team_name,omitempty"`
+	SiteID       string `json:"site_id,omitempty"`
+	CategoryName string `json:"category_name,omitempty"`
+	AuthService  string `json:"auth_service"`
+	AuthData     string `json:"auth_data,omitempty"`
+	FirstName    string `json:"first_name"`
+	LastName     string `json:"last_name"`
+	Nickname     string `json:"nickname"`
+
+	Locale   string    `json:"locale,omitempty"`
+	Timezone *Timezone `json:"timezone,omitempty"`
+	Position string    `json:"position,omitempty"`
+}
+
+// Timezone is the timezone of a user.
+// With an automatic timezone, the timezone detected by the user's browser is used instead of the manual one.
+type Timezone struct {
+	Automatic      bool   `json:"automatic"`
+	ManualTimezone string `json:"manual_timezone,omitempty"`
 }
 
 type UserPatch struct {
@@ -27,6 +50,17 @@ type UserPatch struct {
 	FirstName *string `json:"first_name"`
 	LastName  *string `json:"last_name"`
 	Nickname  *string `json:"nickname"`
+
+	Locale   *string   `json:"locale"`
+	Timezone *Timezone `json:"timezone"`
+	Position *string   `json:"position"`
+
+	// Changes of the auth service and auth data are applied separately, see ToUserAuth
+	AuthService *string `json:"auth_service"`
+	AuthData    *string `json:"auth_data"`
+
+	// ProfileImage is a base64 encoded GIF, JPEG or PNG image
+	ProfileImage *string `json:"profile_image"`
 }
 
 func UserFromJSON(data io.Reader) *User {
@@ -42,69 +76,147 @@ func UserPatchFromJSON(data io.Reader) *UserPatch {
 }
 
 func (u *User) ToMattermostUser() *model.User {
-	return &model.User{
+	user := &model.User{
 		Email:         u.Email,
-		AuthService:   u.AuthService,
-		AuthData:      &u.AuthData,
 		EmailVerified: true,
 		FirstName:     u.FirstName,
 		LastName:      u.LastName,
 		Username:      u.Username,
 		Nickname:      u.Nickname,
+		Locale:        u.Locale,
+		Position:      u.Position,
 	}
+
+	if u.Timezone != nil {
+		user.Timezone = u.Timezone.ToMattermostTimezone(nil)
+	}
+
+	// Users who sign in with email choose their password by resetting it, so they get a random one which is never shared
+	if u.AuthService == model.USER_AUTH_SERVICE_EMAIL {
+		user.Password = newRandomPassword()
+	} else {
+		user.AuthService = u.AuthService
+		user.AuthData = &u.AuthData
+	}
+
+	return user
+}
+
+// newRandomPassword returns a password which satisfies every password requirement that can be set on the server
+func newRandomPassword() string {
+	return (model.NewId() + "Aa1!" + model.NewId() + model.NewId())[:model.PASSWORD_MAXIMUM_LENGTH]
 }
 
 func (u *User) Validate() error {
 	if u == nil {
-		return errors.New("invalid request body")
+		return NewError(ErrorCodeInvalidRequestBody, "invalid request body")
 	}
 
 	if u.ID != "" && !model.IsValidId(u.ID) {
-		return errors.New("error: id is not valid")
+		return NewError(ErrorCodeInvalidUserID, "error: id is not valid")
 	}
 
 	u.Email = strings.ToLower(u.Email)
 	if !model.IsValidEmail(u.Email) {
-		return errors.New("error: email is not valid")
+		return NewError(ErrorCodeInvalidEmail, "error: email is not valid")
+	}
+
+	if u.MoodleUserID != "" && !IsValidMoodleID(u.MoodleUserID) {
+		return NewError(ErrorCodeInvalidMoodleUserID, "error: moodle_user_id is not valid")
 	}
 
-	if !model.IsValidTeamName(u.TeamName) {
-		return errors.New("error: team_name is not valid")
+	if u.TeamName == "" && u.SiteID == "" {
+		return NewError(ErrorCodeMissingTeam, "error: either team_name or site_id is required")
+	}
+
+	if u.TeamName != "" && !model.IsValidTeamName(u.TeamName) {
+		return NewError(ErrorCodeInvalidTeamName, "error: team_name is not valid")
+	}
+
+	if u.SiteID != "" && !IsValidMoodleID(u.SiteID) {
+		return NewError(ErrorCodeInvalidSiteID, "error: site_id is not valid")
 	}
 
 	if u.Username != "" && !model.IsValidUsername(u.Username) {
-		return errors.New("error: username is not valid")
+		return NewError(ErrorCodeInvalidUsername, "error: username is not valid")
 	}
 
+	// Whether the auth service is enabled on the server is checked separately
 	if u.AuthService == "" {
-		return errors.New("error: auth_service cannot be empty")
-	} else if u.AuthService != "ldap" && u.AuthService != "saml" {
-		return errors.New("error: auth_service can only be 'ldap' or 'saml'")
+		return NewError(ErrorCodeInvalidAuthService, "error: auth_service cannot be empty")
+	}
+
+	if u.AuthService != model.USER_AUTH_SERVICE_EMAIL && u.AuthData == "" {
+		return NewError(ErrorCodeInvalidAuthData, "error: auth_data cannot be empty")
+	}
+
+	if u.Locale != "" && !model.IsValidLocale(u.Locale) {
+		return NewError(ErrorCodeInvalidLocale, "error: locale is not valid")
+	}
+
+	if u.Timezone != nil {
+		if err := u.Timezone.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if !isValidPosition(u.Position) {
+		return NewError(ErrorCodeInvalidPosition, "error: position is too long")
+	}
+
+	return nil
+}
+
+func (t *Timezone) Validate() error {
+	if !t.Automatic && t.ManualTimezone == "" {
+		return NewError(ErrorCodeInvalidTimezone, "error: manual_timezone is required when the timezone is not automatic")
 	}
 
-	if u.AuthData == "" {
-		return errors.New("error: auth_data cannot be empty")
+	if t.ManualTimezone != "" {
+		if _, err := time.LoadLocation(t.ManualTimezone); err != nil {
+			return NewError(ErrorCodeInvalidTimezone, "error: manual_timezone is not a valid IANA timezone")
+		}
 	}
 
 	return nil
 }
 
+// ToMattermostTimezone applies the timezone to the given timezone of a Mattermost user.
+// The automatic timezone is left as it is, as it is set by the user's browser.
+func (t *Timezone) ToMattermostTimezone(timezone model.StringMap) model.StringMap {
+	updatedTimezone := model.StringMap{
+		timezoneKeyUseAutomatic: strconv.FormatBool(t.Automatic),
+		timezoneKeyAutomatic:    timezone[timezoneKeyAutomatic],
+		timezoneKeyManual:       timezone[timezoneKeyManual],
+	}
+
+	if t.ManualTimezone != "" {
+		updatedTimezone[timezoneKeyManual] = t.ManualTimezone
+	}
+
+	return updatedTimezone
+}
+
+func isValidPosition(position string) bool {
+	return utf8.RuneCountInString(position) <= model.USER_POSITION_MAX_RUNES
+}
+
 func (u *UserPatch) ToMattermostUser(user *model.User) (*model.User, error) {
 	if u == nil {
-		return nil, errors.New("invalid request body")
+		return nil, NewError(ErrorCodeInvalidRequestBody, "invalid request body")
 	}
 
 	if u.Email != nil {
 		email := strings.ToLower(*u.Email)
 		if !model.IsValidEmail(email) {
-			return nil, errors.New("error: email is not valid")
+			return nil, NewError(ErrorCodeInvalidEmail, "error: email is not valid")
 		}
 		user.Email = email
 	}
 
 	if u.Username != nil {
 		if !model.IsValidUsername(*u.Username) {
-			return nil, errors.New("error: username is not valid")
+			return nil, NewError(ErrorCodeInvalidUsername, "error: username is not valid")
 		}
 		user.Username = *u.Username
 	}
@@ -121,5 +233,71 @@ func (u *UserPatch) ToMattermostUser(user *model.User) (*model.User, error) {
 		user.Nickname = *u.Nickname
 	}
 
+	if u.Locale != nil {
+		if *u.Locale == "" || !model.IsValidLocale(*u.Locale) {
+			return nil, NewError(ErrorCodeInvalidLocale, "error: locale is not valid")
+		}
+		user.Locale = *u.Locale
+	}
+
+	if u.Timezone != nil {
+		if err := u.Timezone.Validate(); err != nil {
+			return nil, err
+		}
+		user.Timezone = u.Timezone.ToMattermostTimezone(user.Timezone)
+	}
+
+	if u.Position != nil {
+		if !isValidPosition(*u.Position) {
+			return nil, NewError(ErrorCodeInvalidPosition, "error: position is too long")
+		}
+		user.Position = *u.Position
+	}
+
 	return user, nil
 }
+
+// ChangesOnlyAuth checks if the patch changes nothing but the auth service and auth data of a user
+func (u *UserPatch) ChangesOnlyAuth() bool {
+	return u.Email == nil && u.Username == nil && u.FirstName == nil && u.LastName == nil && u.Nickname == nil &&
+		u.Locale == nil && u.Timezone == nil && u.Position == nil && u.ProfileImage == nil
+}
+
+// ToUserAuth returns the auth service and auth data which the user has after the patch, or nil if they do not change.
+// Mattermost users who sign in with email have an empty auth service, and users cannot be switched back to email.
+func (u *UserPatch) ToUserAuth(user *model.User) (*model.UserAuth, error) {
+	if u == nil || (u.AuthService == nil && u.AuthData == nil) {
+		return nil, nil
+	}
+
+	authService := user.AuthService
+	if u.AuthService != nil {
+		authService = *u.AuthService
+	}
+
+	authData := ""
+	if user.AuthData != nil {
+		authData = *user.AuthData
+	}
+	if u.AuthData != nil {
+		authData = *u.AuthData
+	}
+
+	switch {
+	case authService == "":
+		return nil, NewError(ErrorCodeInvalidAuthService, "error: auth_service cannot be empty")
+	case authService == model.USER_AUTH_SERVICE_EMAIL && user.AuthService == "" && (u.AuthData == nil || *u.AuthData == ""):
+		return nil, nil
+	case authService == model.USER_AUTH_SERVICE_EMAIL:
+		return nil, NewError(ErrorCodeInvalidAuthService, "error: users cannot be switched to the email auth service, and users who sign in with email have no auth_data")
+	case authData == "":
+		return nil, NewError(ErrorCodeInvalidAuthData, "error: auth_data cannot be empty")
+	case authService == user.AuthService && user.AuthData != nil && authData == *user.AuthData:
+		return nil, nil
+	}
+
+	return &model.UserAuth{
+		AuthService: authService,
+		AuthData:    &authData,
+	}, nil
+}
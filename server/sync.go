@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/moodle"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	// syncCheckInterval is how often the scheduler checks whether a scheduled sync is due
+	syncCheckInterval = time.Minute
+	// syncLockTTL is how long the sync lock is held without being refreshed, in case the server running the sync stops
+	syncLockTTL = 30 * time.Minute
+	// syncSummaryMaxFailedChannels is the maximum number of failed channels listed in the summary posted by the bot
+	syncSummaryMaxFailedChannels = 20
+)
+
+// syncRun is the summary of a scheduled sync of the course channels with their Moodle rosters
+type syncRun struct {
+	StartAt         int64    `json:"start_at"`
+	EndAt           int64    `json:"end_at"`
+	Channels        int      `json:"channels"`
+	SkippedChannels int      `json:"skipped_channels"`
+	Added           int      `json:"added"`
+	Removed         int      `json:"removed"`
+	RoleChanges     int      `json:"role_changes"`
+	Errors          int      `json:"errors"`
+	FailedChannels  []string `json:"failed_channels,omitempty"`
+}
+
+// channelSync is the outcome of the last sync of a course channel with its Moodle roster
+type channelSync struct {
+	SyncAt      int64  `json:"sync_at"`
+	Added       int    `json:"added"`
+	Removed     int    `json:"removed"`
+	RoleChanges int    `json:"role_changes"`
+	Errors      int    `json:"errors"`
+	Error       string `json:"error,omitempty"`
+}
+
+// errEmptyRoster is returned when syncing a channel whose Moodle course has no enrolled users
+var errEmptyRoster = errors.New("the Moodle course has no enrolled users")
+
+// channelSyncFailedMessage is recorded as the error of a failed sync of a channel, which is shown to channel admins.
+// The errors can contain details of the Moodle or Mattermost servers, so they are only logged.
+const channelSyncFailedMessage = "an error occurred. Please check the server logs for details."
+
+// startSyncScheduler starts checking in the background whether a scheduled sync is due.
+// Every server of a cluster checks, and the sync lock in the KV store makes sure a single one runs the sync, as jobs are claimed in jobs.go.
+// The cluster package of mattermost-plugin-api is not used, as the plugin only depends on the server plugin API, which has no scheduler.
+func (p *Plugin) startSyncScheduler() {
+	p.stopSync = make(chan struct{})
+	p.syncDone.Add(1)
+
+	go func() {
+		defer p.syncDone.Done()
+		ticker := time.NewTicker(syncCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.runScheduledSyncIfDue()
+			case <-p.stopSync:
+				return
+			}
+		}
+	}()
+}
+
+// stopSyncScheduler stops the scheduler, and the sync in progress after the channel being synced.
+func (p *Plugin) stopSyncScheduler() {
+	if p.stopSync == nil {
+		return
+	}
+
+	close(p.stopSync)
+	p.syncDone.Wait()
+	p.stopSync = nil
+}
+
+// runScheduledSyncIfDue runs a scheduled sync if the sync interval has passed since the last one started.
+// The sync is skipped if the previous one is still running, on this server or on another server of the cluster.
+// The summary of the sync is returned, or nil if it did not run.
+func (p *Plugin) runScheduledSyncIfDue() *syncRun {
+	interval := time.Duration(p.getConfiguration().SyncIntervalMinutes) * time.Minute
+	if interval <= 0 {
+		return nil
+	}
+
+	lastRun, err := p.getLastSyncRun()
+	if err != nil {
+		p.API.LogError("Failed to get the last scheduled sync.", "Error", err.Error())
+		return nil
+	}
+
+	if lastRun != nil && time.Since(time.Unix(0, lastRun.StartAt*int64(time.Millisecond))) < interval {
+		return nil
+	}
+
+	locked, err := p.lockSync()
+	if err != nil {
+		p.API.LogError("Failed to lock the scheduled sync.", "Error", err.Error())
+		return nil
+	}
+
+	if !locked {
+		p.API.LogDebug("Skipping the scheduled sync as the previous one is still running.")
+		return nil
+	}
+
+	defer p.unlockSync()
+
+	run, err := p.runSync()
+	if err != nil {
+		p.API.LogError("Failed to run the scheduled sync.", "Error", err.Error())
+		return nil
+	}
+
+	if err := p.storeLastSyncRun(run); err != nil {
+		p.API.LogError("Failed to store the scheduled sync.", "Error", err.Error())
+	}
+
+	p.postSyncSummary(run)
+	return run
+}
+
+// lockSync takes the sync lock, so that a single sync runs at a time across the servers of the cluster.
+// It returns false if the lock is held by a sync in progress.
+func (p *Plugin) lockSync() (bool, error) {
+	locked, appErr := p.API.KVSetWithOptions(constants.KeySyncLock, []byte(strconv.FormatInt(model.GetMillis(), 10)), model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: int64(syncLockTTL / time.Second),
+	})
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "failed to set the sync lock in KV store")
+	}
+
+	return locked, nil
+}
+
+func (p *Plugin) unlockSync() {
+	if appErr := p.API.KVDelete(constants.KeySyncLock); appErr != nil {
+		p.API.LogError("Failed to unlock the sync.", "Error", appErr.Error())
+	}
+}
+
+// runSync reconciles the members of every course channel with the roster of its Moodle course.
+// Nothing is returned if the sync was stopped before syncing every channel.
+func (p *Plugin) runSync() (*syncRun, error) {
+	run := &syncRun{
+		StartAt: model.GetMillis(),
+	}
+
+	client, err := p.getMoodleClient()
+	if err != nil {
+		return nil, err
+	}
+
+	mappings, err := p.listMappings(courseChannelMapping)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list course channels")
+	}
+
+	siteID := p.getConfiguration().MoodleSiteID
+	for _, mapping := range mappings {
+		select {
+		case <-p.stopSync:
+			return nil, errors.New("the sync was stopped")
+		default:
+		}
+
+		// The courses of other Moodle sites cannot be fetched with the Moodle URL and token
+		if mapping.SiteID != siteID {
+			continue
+		}
+
+		p.syncCourseChannel(client, mapping, run)
+
+		// Long syncs keep the lock for as long as they run
+		if appErr := p.API.KVSetWithExpiry(constants.KeySyncLock, []byte(strconv.FormatInt(model.GetMillis(), 10)), int64(syncLockTTL/time.Second)); appErr != nil {
+			p.API.LogWarn("Failed to refresh the scheduled sync lock.", "Error", appErr.Error())
+		}
+	}
+
+	run.EndAt = model.GetMillis()
+	return run, nil
+}
+
+// syncCourseChannel reconciles the members of the channel with the roster of its course and adds the outcome to the run.
+// Archived and deleted channels are skipped, and so are courses without enrolled users.
+func (p *Plugin) syncCourseChannel(client *moodle.Client, mapping *serializer.Mapping, run *syncRun) {
+	channel, appErr := p.API.GetChannel(mapping.MattermostID)
+	if appErr != nil && appErr.StatusCode == http.StatusNotFound {
+		run.SkippedChannels++
+		return
+	}
+	if appErr != nil {
+		p.addFailedSyncChannel(run, mapping.MattermostID, errors.Wrap(appErr, "failed to get channel"))
+		return
+	}
+
+	if channel.DeleteAt != 0 {
+		run.SkippedChannels++
+		return
+	}
+
+	reconciliation, err := p.syncChannel(client, mapping)
+	if errors.Is(err, errEmptyRoster) {
+		p.API.LogWarn("Skipping the sync of a course without enrolled users.", "CourseID", mapping.MoodleID, "ChannelID", channel.Id)
+		run.SkippedChannels++
+		return
+	}
+	if err != nil {
+		p.addFailedSyncChannel(run, channel.Name, err)
+		return
+	}
+
+	run.Channels++
+	run.Added += len(reconciliation.Added)
+	run.Removed += len(reconciliation.Removed)
+	run.RoleChanges += len(reconciliation.Promoted) + len(reconciliation.Demoted)
+	run.Errors += len(reconciliation.Errors)
+	if len(reconciliation.Errors) > 0 {
+		run.FailedChannels = append(run.FailedChannels, channel.Name)
+	}
+}
+
+// syncChannel reconciles the members of the channel with the roster of its Moodle course, and records the outcome for the channel.
+// Courses without enrolled users are not synced, as this most likely means the token cannot see them, and syncing them would empty the channel.
+func (p *Plugin) syncChannel(client *moodle.Client, mapping *serializer.Mapping) (*serializer.ChannelMembersReconciliation, error) {
+	channelID := mapping.MattermostID
+	reconciliation, err := p.reconcileChannelWithRoster(client, mapping)
+
+	record := &channelSync{
+		SyncAt: model.GetMillis(),
+	}
+	switch {
+	case errors.Is(err, errEmptyRoster):
+		record.Error = errEmptyRoster.Error()
+	case err != nil:
+		record.Error = channelSyncFailedMessage
+	default:
+		record.Added = len(reconciliation.Added)
+		record.Removed = len(reconciliation.Removed)
+		record.RoleChanges = len(reconciliation.Promoted) + len(reconciliation.Demoted)
+		record.Errors = len(reconciliation.Errors)
+	}
+
+	if storeErr := p.storeChannelSync(channelID, record); storeErr != nil {
+		p.API.LogWarn("Failed to store the sync of the channel.", "ChannelID", channelID, "Error", storeErr.Error())
+	}
+
+	return reconciliation, err
+}
+
+func (p *Plugin) reconcileChannelWithRoster(client *moodle.Client, mapping *serializer.Mapping) (*serializer.ChannelMembersReconciliation, error) {
+	users, err := client.GetEnrolledUsers(mapping.MoodleID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get the roster of course %s", mapping.MoodleID)
+	}
+
+	if len(users) == 0 {
+		return nil, errEmptyRoster
+	}
+
+	reconciliation, _, err := p.reconcileChannelMembers(mapping.SiteID, mapping.MattermostID, p.getRosterChannelMembers(users), true, false)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to reconcile channel members")
+	}
+
+	return reconciliation, nil
+}
+
+func (p *Plugin) addFailedSyncChannel(run *syncRun, channelName string, err error) {
+	p.API.LogError("Failed to sync course channel.", "Channel", channelName, "Error", err.Error())
+	run.Errors++
+	run.FailedChannels = append(run.FailedChannels, channelName)
+}
+
+// getRosterChannelMembers returns the expected members of a course channel for the users enrolled in the course.
+// Users get their primary Moodle role, which is mapped to Mattermost roles by the reconciliation. Users whose role is not in the role mapping
+// keep it too, so that the reconciliation leaves them as they are rather than changing their channel role. Users without any role get no role.
+func (p *Plugin) getRosterChannelMembers(users []moodle.EnrolledUser) serializer.ChannelMembers {
+	channelMembers := make(serializer.ChannelMembers, 0, len(users))
+	for i := range users {
+		channelMember := serializer.ChannelMember{
+			MoodleUserID: strconv.FormatInt(users[i].ID, 10),
+		}
+		if role := users[i].GetPrimaryRole(); role != nil {
+			channelMember.MoodleRole = role.ShortName
+		}
+
+		channelMembers = append(channelMembers, channelMember)
+	}
+
+	return channelMembers
+}
+
+func (p *Plugin) getLastSyncRun() (*syncRun, error) {
+	data, appErr := p.API.KVGet(constants.KeySyncLastRun)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get the last sync from KV store")
+	}
+
+	if data == nil {
+		return nil, nil
+	}
+
+	var run *syncRun
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal the last sync")
+	}
+
+	return run, nil
+}
+
+func (p *Plugin) getChannelSync(channelID string) (*channelSync, error) {
+	data, appErr := p.API.KVGet(constants.KeyPrefixChannelSync + channelID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get the sync of the channel from KV store")
+	}
+
+	if data == nil {
+		return nil, nil
+	}
+
+	var record *channelSync
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal the sync of the channel")
+	}
+
+	return record, nil
+}
+
+func (p *Plugin) storeChannelSync(channelID string, record *channelSync) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the sync of the channel")
+	}
+
+	if appErr := p.API.KVSet(constants.KeyPrefixChannelSync+channelID, data); appErr != nil {
+		return errors.Wrap(appErr, "failed to store the sync of the channel in KV store")
+	}
+
+	return nil
+}
+
+func (p *Plugin) storeLastSyncRun(run *syncRun) error {
+	data, err := json.Marshal(run)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal sync")
+	}
+
+	if appErr := p.API.KVSet(constants.KeySyncLastRun, data); appErr != nil {
+		return errors.Wrap(appErr, "failed to store sync in KV store")
+	}
+
+	return nil
+}
+
+// postSyncSummary posts the summary of the sync in the sync report channel, if there is one.
+func (p *Plugin) postSyncSummary(run *syncRun) {
+	channelID := p.getConfiguration().SyncReportChannelID
+	if channelID == "" {
+		return
+	}
+
+	if _, appErr := p.API.CreatePost(&model.Post{
+		ChannelId: channelID,
+		UserId:    p.botID,
+		Message:   getSyncSummaryMessage(run),
+	}); appErr != nil {
+		p.API.LogError("Failed to post the summary of the scheduled sync.", "Error", appErr.Error())
+	}
+}
+
+func getSyncSummaryMessage(run *syncRun) string {
+	duration := time.Duration(run.EndAt-run.StartAt) * time.Millisecond
+	lines := []string{
+		fmt.Sprintf("#### Moodle sync finished in %s", duration.Round(time.Second)),
+		fmt.Sprintf("- Course channels synced: %d", run.Channels),
+		fmt.Sprintf("- Course channels skipped: %d", run.SkippedChannels),
+		fmt.Sprintf("- Users added: %d", run.Added),
+		fmt.Sprintf("- Users removed: %d", run.Removed),
+		fmt.Sprintf("- Role changes: %d", run.RoleChanges),
+		fmt.Sprintf("- Errors: %d", run.Errors),
+	}
+
+	if len(run.FailedChannels) > 0 {
+		failedChannels := run.FailedChannels
+		if len(failedChannels) > syncSummaryMaxFailedChannels {
+			failedChannels = failedChannels[:syncSummaryMaxFailedChannels]
+		}
+
+		message := "Channels with errors: " + strings.Join(failedChannels, ", ")
+		if len(run.FailedChannels) > len(failedChannels) {
+			message += fmt.Sprintf(" and %d more", len(run.FailedChannels)-len(failedChannels))
+		}
+		lines = append(lines, "", message)
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/moodle"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils/testutils"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getMappingData(t *testing.T, moodleID, mattermostID string) []byte {
+	data, err := json.Marshal(&serializer.Mapping{MoodleID: moodleID, MattermostID: mattermostID})
+	require.NoError(t, err)
+	return data
+}
+
+func getSyncRunData(t *testing.T, run *syncRun) []byte {
+	data, err := json.Marshal(run)
+	require.NoError(t, err)
+	return data
+}
+
+func TestRunScheduledSyncIfDue(t *testing.T) {
+	channelID := testutils.GetID()
+	reportChannelID := model.NewId()
+	teacherID := model.NewId()
+	studentID := model.NewId()
+	formerStudentID := model.NewId()
+	unmappedUserID := model.NewId()
+	guestID := model.NewId()
+	courseKey := utils.GetKeyHash(constants.KeyPrefixCourse, "42")
+
+	moodleServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "42", r.FormValue("courseid"))
+		_ = json.NewEncoder(w).Encode([]moodle.EnrolledUser{
+			{ID: 7, Roles: []moodle.Role{{ShortName: "teacher", SortOrder: 4}}},
+			{ID: 8, Roles: []moodle.Role{{ShortName: "student", SortOrder: 5}}},
+			{ID: 10, Roles: []moodle.Role{{ShortName: "guest", SortOrder: 6}}},
+		})
+	}))
+	defer moodleServer.Close()
+
+	for name, test := range map[string]struct {
+		SyncIntervalMinutes int
+		SetupAPI            func(*plugintest.API) *plugintest.API
+		ExpectedRun         *syncRun
+	}{
+		"scheduled sync disabled": {
+			SyncIntervalMinutes: 0,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				return api
+			},
+		},
+		"previous sync too recent": {
+			SyncIntervalMinutes: 60,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", constants.KeySyncLastRun).Return(getSyncRunData(t, &syncRun{StartAt: model.GetMillis() - int64(time.Minute/time.Millisecond)}), nil)
+				return api
+			},
+		},
+		"previous sync still running": {
+			SyncIntervalMinutes: 60,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", constants.KeySyncLastRun).Return(getSyncRunData(t, &syncRun{StartAt: model.GetMillis() - int64(2*time.Hour/time.Millisecond)}), nil)
+				api.On("KVSetWithOptions", constants.KeySyncLock, mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(false, nil)
+				api.On("LogDebug", "Skipping the scheduled sync as the previous one is still running.").Return()
+				return api
+			},
+		},
+		"sync is due": {
+			SyncIntervalMinutes: 60,
+			SetupAPI: func(api *plugintest.API) *plugintest.API {
+				api.On("KVGet", constants.KeySyncLastRun).Return(nil, nil)
+				api.On("KVSetWithOptions", constants.KeySyncLock, mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(true, nil)
+				api.On("KVList", 0, constants.KVListPerPage).Return([]string{courseKey, constants.KeySyncLastRun}, nil)
+				api.On("KVGet", courseKey).Return(getMappingData(t, "42", channelID), nil)
+				api.On("GetChannel", channelID).Return(&model.Channel{Id: channelID, Name: "maths"}, nil)
+				api.On("KVGet", utils.GetKeyHash(constants.KeyPrefixMoodleUser, "7")).Return(getMappingData(t, "7", teacherID), nil)
+				api.On("KVGet", utils.GetKeyHash(constants.KeyPrefixMoodleUser, "8")).Return(getMappingData(t, "8", studentID), nil)
+				api.On("KVGet", utils.GetKeyHash(constants.KeyPrefixMoodleUser, "10")).Return(getMappingData(t, "10", guestID), nil)
+				api.On("GetChannelMembers", channelID, 0, utils.PerPageMaximum).Return(&model.ChannelMembers{
+					{ChannelId: channelID, UserId: studentID, SchemeUser: true},
+					{ChannelId: channelID, UserId: formerStudentID, SchemeUser: true},
+					{ChannelId: channelID, UserId: unmappedUserID, SchemeUser: true},
+					// The channel admin role of users whose Moodle role is not mapped is left as it is
+					{ChannelId: channelID, UserId: guestID, SchemeUser: true, SchemeAdmin: true},
+				}, nil)
+				api.On("KVGet", userMapping.getMattermostKey(formerStudentID)).Return(getMappingData(t, "9", formerStudentID), nil)
+				api.On("KVGet", userMapping.getMattermostKey(unmappedUserID)).Return(nil, nil)
+				api.On("GetUser", formerStudentID).Return(&model.User{Id: formerStudentID}, nil)
+				api.On("DeleteChannelMember", channelID, formerStudentID).Return(nil)
+				api.On("AddUserToChannel", channelID, teacherID, mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("UpdateChannelMemberRoles", channelID, teacherID, model.CHANNEL_ADMIN_ROLE_ID).Return(nil, nil)
+				api.On("GetUser", teacherID).Return(&model.User{Id: teacherID, Username: "teacher"}, nil)
+				api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool { return post.ChannelId == channelID })).Return(nil, nil)
+				api.On("KVSetWithExpiry", constants.KeySyncLock, mock.Anything, int64(syncLockTTL/time.Second)).Return(nil)
+				api.On("KVSet", constants.KeyPrefixChannelSync+channelID, mock.Anything).Return(nil)
+				api.On("KVSet", constants.KeySyncLastRun, mock.Anything).Return(nil)
+				api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool { return post.ChannelId == reportChannelID })).Return(nil, nil)
+				api.On("KVDelete", constants.KeySyncLock).Return(nil)
+				return api
+			},
+			ExpectedRun: &syncRun{
+				Channels:       1,
+				Added:          1,
+				Removed:        1,
+				Errors:         1,
+				FailedChannels: []string{"maths"},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			test.SetupAPI(api)
+			defer api.AssertExpectations(t)
+			p := setupTestPluginWithRoleMapping(t, api)
+
+			config := p.getConfiguration().Clone()
+			config.SyncIntervalMinutes = test.SyncIntervalMinutes
+			config.SyncReportChannelID = reportChannelID
+			config.MoodleURL = moodleServer.URL
+			config.MoodleToken = "moodletoken"
+			p.setConfiguration(config)
+
+			run := p.runScheduledSyncIfDue()
+			if test.ExpectedRun == nil {
+				assert.Nil(t, run)
+				return
+			}
+
+			require.NotNil(t, run)
+			assert.NotZero(t, run.StartAt)
+			assert.NotZero(t, run.EndAt)
+			run.StartAt, run.EndAt = 0, 0
+			assert.Equal(t, test.ExpectedRun, run)
+		})
+	}
+}
+
+func TestSyncCourseChannelSkipped(t *testing.T) {
+	for name, test := range map[string]struct {
+		Channel   *model.Channel
+		AppErr    *model.AppError
+		MoodleHit bool
+	}{
+		"channel deleted": {
+			AppErr: testutils.GetNotFoundAppError(),
+		},
+		"channel archived": {
+			Channel: &model.Channel{Id: testutils.GetID(), DeleteAt: model.GetMillis()},
+		},
+		"course without enrolled users": {
+			Channel:   &model.Channel{Id: testutils.GetID()},
+			MoodleHit: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			moodleHit := false
+			moodleServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				moodleHit = true
+				_, _ = w.Write([]byte("[]"))
+			}))
+			defer moodleServer.Close()
+
+			api := &plugintest.API{}
+			api.On("GetChannel", testutils.GetID()).Return(test.Channel, test.AppErr)
+			if test.MoodleHit {
+				api.On("KVSet", constants.KeyPrefixChannelSync+testutils.GetID(), mock.Anything).Return(nil)
+				api.On("LogWarn", testutils.GetMockArgumentsWithType("string", 5)...).Return()
+			}
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			run := &syncRun{}
+			p.syncCourseChannel(moodle.NewClient(moodleServer.URL, "moodletoken", nil), &serializer.Mapping{MoodleID: "42", MattermostID: testutils.GetID()}, run)
+			assert.Equal(t, &syncRun{SkippedChannels: 1}, run)
+			assert.Equal(t, test.MoodleHit, moodleHit)
+		})
+	}
+}
+
+func TestSyncCourseChannelFailed(t *testing.T) {
+	moodleServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"exception": "dml_read_exception", "errorcode": "dmlreadexception", "message": "Error reading from database"}`))
+	}))
+	defer moodleServer.Close()
+
+	var record *channelSync
+	api := &plugintest.API{}
+	api.On("GetChannel", testutils.GetID()).Return(&model.Channel{Id: testutils.GetID(), Name: "maths"}, nil)
+	api.On("KVSet", constants.KeyPrefixChannelSync+testutils.GetID(), mock.Anything).Run(func(args mock.Arguments) {
+		require.NoError(t, json.Unmarshal(args.Get(1).([]byte), &record))
+	}).Return(nil)
+	api.On("LogError", testutils.GetMockArgumentsWithType("string", 5)...).Return()
+	defer api.AssertExpectations(t)
+	p := setupTestPlugin(api)
+
+	run := &syncRun{}
+	p.syncCourseChannel(moodle.NewClient(moodleServer.URL, "moodletoken", nil), &serializer.Mapping{MoodleID: "42", MattermostID: testutils.GetID()}, run)
+	assert.Equal(t, &syncRun{Errors: 1, FailedChannels: []string{"maths"}}, run)
+	require.NotNil(t, record)
+	assert.Equal(t, channelSyncFailedMessage, record.Error)
+}
+
+func TestIsUnmappedUser(t *testing.T) {
+	userID := model.NewId()
+	for name, test := range map[string]struct {
+		Mapping  *serializer.Mapping
+		Expected bool
+	}{
+		"mapped on the site": {
+			Mapping:  &serializer.Mapping{MoodleID: "7", MattermostID: userID, SiteID: "site1"},
+			Expected: false,
+		},
+		"mapped on another site": {
+			Mapping:  &serializer.Mapping{MoodleID: "7", MattermostID: userID, SiteID: "site2"},
+			Expected: true,
+		},
+		"not mapped": {
+			Expected: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var data []byte
+			if test.Mapping != nil {
+				var err error
+				data, err = json.Marshal(test.Mapping)
+				require.NoError(t, err)
+			}
+
+			api := &plugintest.API{}
+			api.On("KVGet", userMapping.getMattermostKey(userID)).Return(data, nil)
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+
+			assert.Equal(t, test.Expected, p.isUnmappedUser("site1", userID))
+		})
+	}
+}
+
+func TestGetRosterChannelMembers(t *testing.T) {
+	p := setupTestPluginWithRoleMapping(t, &plugintest.API{})
+	channelMembers := p.getRosterChannelMembers([]moodle.EnrolledUser{
+		{ID: 7, Roles: []moodle.Role{{ShortName: "student", SortOrder: 5}, {ShortName: "teacher", SortOrder: 4}}},
+		{ID: 8, Roles: []moodle.Role{{ShortName: "guest", SortOrder: 6}}},
+		{ID: 9},
+	})
+
+	assert.Equal(t, serializer.ChannelMembers{
+		{MoodleUserID: "7", MoodleRole: "teacher"},
+		{MoodleUserID: "8", MoodleRole: "guest"},
+		{MoodleUserID: "9"},
+	}, channelMembers)
+}
+
+func TestGetSyncSummaryMessage(t *testing.T) {
+	run := &syncRun{
+		StartAt:         0,
+		EndAt:           int64(90 * time.Second / time.Millisecond),
+		Channels:        3,
+		SkippedChannels: 1,
+		Added:           4,
+		Removed:         2,
+		RoleChanges:     1,
+		Errors:          2,
+	}
+	for i := 0; i < syncSummaryMaxFailedChannels+2; i++ {
+		run.FailedChannels = append(run.FailedChannels, "channel"+strconv.Itoa(i))
+	}
+
+	message := getSyncSummaryMessage(run)
+	assert.Contains(t, message, "Moodle sync finished in 1m30s")
+	assert.Contains(t, message, "- Users added: 4")
+	assert.Contains(t, message, "- Role changes: 1")
+	assert.Contains(t, message, "- Errors: 2")
+	assert.Contains(t, message, "channel0, channel1")
+	assert.NotContains(t, message, "channel"+strconv.Itoa(syncSummaryMaxFailedChannels))
+	assert.Contains(t, message, "and 2 more")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// Placeholders which can be used in the display name template of provisioned teams
+const (
+	teamDisplayNamePlaceholderTeamName     = "{team_name}"
+	teamDisplayNamePlaceholderCategoryName = "{category_name}"
+)
+
+// getOrProvisionTeam returns the team with the given name.
+// If the team does not exist and team provisioning is enabled, the team is created and the bot is added to it.
+func (p *Plugin) getOrProvisionTeam(teamName, categoryName string) (*model.Team, int, error) {
+	team, appErr := p.API.GetTeamByName(teamName)
+	if appErr == nil {
+		return team, 0, nil
+	}
+
+	config := p.getConfiguration()
+	if appErr.StatusCode != http.StatusNotFound || !config.EnableTeamProvisioning {
+		return nil, appErr.StatusCode, errors.Wrap(appErr, "invalid team name")
+	}
+
+	team, appErr = p.API.CreateTeam(&model.Team{
+		Name:            teamName,
+		DisplayName:     getTeamDisplayName(config.TeamDisplayNameTemplate, teamName, categoryName),
+		Type:            config.ProvisionedTeamType,
+		AllowOpenInvite: config.ProvisionedTeamType == model.TEAM_OPEN,
+	})
+	if appErr != nil {
+		// Another request may have provisioned the team in the meantime
+		if existingTeam, getErr := p.API.GetTeamByName(teamName); getErr == nil {
+			return existingTeam, 0, nil
+		}
+
+		return nil, appErr.StatusCode, errors.Wrap(appErr, "failed to provision team")
+	}
+
+	if _, appErr = p.API.CreateTeamMember(team.Id, p.botID); appErr != nil {
+		return nil, appErr.StatusCode, errors.Wrap(appErr, "failed to add bot to team")
+	}
+
+	p.API.LogInfo("Provisioned team.", "TeamName", team.Name, "TeamID", team.Id)
+	return team, 0, nil
+}
+
+// getTeamDisplayName fills in the display name template of provisioned teams.
+// The category name falls back to the team name when Moodle does not send it.
+func getTeamDisplayName(template, teamName, categoryName string) string {
+	if categoryName == "" {
+		categoryName = teamName
+	}
+
+	displayName := strings.TrimSpace(strings.NewReplacer(
+		teamDisplayNamePlaceholderTeamName, teamName,
+		teamDisplayNamePlaceholderCategoryName, categoryName,
+	).Replace(template))
+	if displayName == "" {
+		return teamName
+	}
+
+	if utf8.RuneCountInString(displayName) > model.TEAM_DISPLAY_NAME_MAX_RUNES {
+		displayName = string([]rune(displayName)[:model.TEAM_DISPLAY_NAME_MAX_RUNES])
+	}
+
+	return displayName
+}
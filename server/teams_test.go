@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils/testutils"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetTeamDisplayName(t *testing.T) {
+	for name, test := range map[string]struct {
+		Template            string
+		TeamName            string
+		CategoryName        string
+		ExpectedDisplayName string
+	}{
+		"category name": {
+			Template:            "{category_name}",
+			TeamName:            "science",
+			CategoryName:        "Faculty of Science",
+			ExpectedDisplayName: "Faculty of Science",
+		},
+		"category name falls back to team name": {
+			Template:            "{category_name}",
+			TeamName:            "science",
+			ExpectedDisplayName: "science",
+		},
+		"both placeholders": {
+			Template:            "Moodle - {category_name} ({team_name})",
+			TeamName:            "science",
+			CategoryName:        "Science",
+			ExpectedDisplayName: "Moodle - Science (science)",
+		},
+		"empty result falls back to team name": {
+			Template:            "  ",
+			TeamName:            "science",
+			ExpectedDisplayName: "science",
+		},
+		"too long": {
+			Template:            "{category_name}",
+			TeamName:            "science",
+			CategoryName:        strings.Repeat("é", 100),
+			ExpectedDisplayName: strings.Repeat("é", model.TEAM_DISPLAY_NAME_MAX_RUNES),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.ExpectedDisplayName, getTeamDisplayName(test.Template, test.TeamName, test.CategoryName))
+		})
+	}
+}
+
+func TestCreateChannelWithTeamProvisioning(t *testing.T) {
+	requestURL := fmt.Sprintf("/api/v1/channels?secret=%s", testutils.GetSecret())
+	for name, test := range map[string]struct {
+		EnableTeamProvisioning bool
+		SetupAPI               func(*plugintest.API, *model.Team) *plugintest.API
+		ExpectedStatusCode     int
+	}{
+		"team provisioned": {
+			EnableTeamProvisioning: true,
+			SetupAPI: func(api *plugintest.API, team *model.Team) *plugintest.API {
+				modelChannel := testutils.GetModelChannel()
+				api.On("GetTeamByName", team.Name).Return(nil, testutils.GetNotFoundAppError())
+				api.On("CreateTeam", mock.MatchedBy(func(t *model.Team) bool {
+					return t.Name == team.Name && t.DisplayName == "Faculty of Science" && t.Type == model.TEAM_INVITE
+				})).Return(team, nil)
+				api.On("LogInfo", testutils.GetMockArgumentsWithType("string", 5)...).Return()
+				api.On("CreateTeamMember", team.Id, mock.AnythingOfType("string")).Return(nil, nil).Twice()
+				api.On("CreateChannel", mock.AnythingOfType("*model.Channel")).Return(modelChannel, nil)
+				api.On("AddChannelMember", modelChannel.Id, mock.AnythingOfType("string")).Return(nil, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusCreated,
+		},
+		"team provisioned by another request": {
+			EnableTeamProvisioning: true,
+			SetupAPI: func(api *plugintest.API, team *model.Team) *plugintest.API {
+				modelChannel := testutils.GetModelChannel()
+				api.On("GetTeamByName", team.Name).Return(nil, testutils.GetNotFoundAppError()).Once()
+				api.On("CreateTeam", mock.AnythingOfType("*model.Team")).Return(nil, testutils.GetBadRequestAppError())
+				api.On("GetTeamByName", team.Name).Return(team, nil).Once()
+				api.On("CreateChannel", mock.AnythingOfType("*model.Channel")).Return(modelChannel, nil)
+				api.On("CreateTeamMember", team.Id, mock.AnythingOfType("string")).Return(nil, nil)
+				api.On("AddChannelMember", modelChannel.Id, mock.AnythingOfType("string")).Return(nil, nil)
+				return api
+			},
+			ExpectedStatusCode: http.StatusCreated,
+		},
+		"failed to provision team": {
+			EnableTeamProvisioning: true,
+			SetupAPI: func(api *plugintest.API, team *model.Team) *plugintest.API {
+				api.On("GetTeamByName", team.Name).Return(nil, testutils.GetNotFoundAppError())
+				api.On("CreateTeam", mock.AnythingOfType("*model.Team")).Return(nil, testutils.GetInternalServerAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+		"team provisioning disabled": {
+			SetupAPI: func(api *plugintest.API, team *model.Team) *plugintest.API {
+				api.On("GetTeamByName", team.Name).Return(nil, testutils.GetNotFoundAppError())
+				api.On("LogError", testutils.GetMockArgumentsWithType("string", 1)...).Return()
+				return api
+			},
+			ExpectedStatusCode: http.StatusNotFound,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			channel := testutils.GetSerializerChannel()
+			channel.CategoryName = "Faculty of Science"
+			team := testutils.GetTeam()
+			team.Name = channel.TeamName
+
+			api := &plugintest.API{}
+			api.On("LogDebug", testutils.GetMockArgumentsWithType("string", 9)...).Return()
+			test.SetupAPI(api, team)
+			defer api.AssertExpectations(t)
+			p := setupTestPlugin(api)
+			config := p.getConfiguration().Clone()
+			config.EnableTeamProvisioning = test.EnableTeamProvisioning
+			config.TeamDisplayNameTemplate = teamDisplayNamePlaceholderCategoryName
+			config.ProvisionedTeamType = model.TEAM_INVITE
+			p.setConfiguration(config)
+
+			reqBody, err := json.Marshal(channel)
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, requestURL, bytes.NewBuffer(reqBody))
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			require.NotNil(t, result)
+			defer result.Body.Close()
+			assert.Equal(t, test.ExpectedStatusCode, result.StatusCode)
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// Strategies for picking the username of a new user when the one sent by Moodle belongs to another user
+const (
+	usernameCollisionStrategyFail     = "fail"
+	usernameCollisionStrategySuffix   = "suffix"
+	usernameCollisionStrategyTemplate = "template"
+
+	// usernameMaxSuffix is the largest numeric suffix tried before giving up
+	usernameMaxSuffix = 100
+)
+
+// resolveUsername returns the username to create the given user with.
+// If the username sent by Moodle belongs to another user, another one is picked according to the username collision strategy.
+func (p *Plugin) resolveUsername(userObj *serializer.User) (string, int, error) {
+	if userObj.Username == "" {
+		return "", 0, nil
+	}
+
+	taken, status, err := p.isUsernameTaken(userObj.Username)
+	if err != nil || !taken {
+		return userObj.Username, status, err
+	}
+
+	config := p.getConfiguration()
+	baseUsername := userObj.Username
+	switch config.UsernameCollisionStrategy {
+	case usernameCollisionStrategyTemplate:
+		if username := getUsernameFromTemplate(config.UsernameTemplate, userObj); username != "" && username != userObj.Username {
+			taken, status, err = p.isUsernameTaken(username)
+			if err != nil || !taken {
+				return username, status, err
+			}
+
+			baseUsername = username
+		}
+	case usernameCollisionStrategySuffix:
+	default:
+		return "", http.StatusConflict, serializer.NewError(serializer.ErrorCodeUsernameExists, fmt.Sprintf("username %s already belongs to another user", userObj.Username))
+	}
+
+	for i := 2; i <= usernameMaxSuffix; i++ {
+		suffix := strconv.Itoa(i)
+		username := baseUsername
+		if len(username)+len(suffix) > model.USER_NAME_MAX_LENGTH {
+			username = username[:model.USER_NAME_MAX_LENGTH-len(suffix)]
+		}
+		username += suffix
+
+		taken, status, err = p.isUsernameTaken(username)
+		if err != nil || !taken {
+			return username, status, err
+		}
+	}
+
+	return "", http.StatusConflict, serializer.NewError(serializer.ErrorCodeUsernameExists, fmt.Sprintf("no free username found for %s", userObj.Username))
+}
+
+func (p *Plugin) isUsernameTaken(username string) (bool, int, error) {
+	if _, appErr := p.API.GetUserByUsername(username); appErr != nil {
+		if appErr.StatusCode == http.StatusNotFound {
+			return false, 0, nil
+		}
+
+		return false, appErr.StatusCode, errors.Wrap(appErr, "failed to get user by username")
+	}
+
+	return true, 0, nil
+}
+
+// getUsernameFromTemplate fills in the username template with the fields of the user, and strips the characters which are not allowed in usernames.
+// It returns an empty string if no valid username can be made.
+func getUsernameFromTemplate(template string, userObj *serializer.User) string {
+	username := strings.NewReplacer(
+		"{username}", userObj.Username,
+		"{first_name}", userObj.FirstName,
+		"{last_name}", userObj.LastName,
+		"{moodle_user_id}", userObj.MoodleUserID,
+	).Replace(template)
+
+	var sb strings.Builder
+	for _, r := range strings.ToLower(username) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' || r == '-' || r == '_' {
+			sb.WriteRune(r)
+		}
+	}
+
+	// Usernames must start with a letter
+	username = strings.TrimLeft(sb.String(), "0123456789.-_")
+	if len(username) > model.USER_NAME_MAX_LENGTH {
+		username = username[:model.USER_NAME_MAX_LENGTH]
+	}
+
+	if !model.IsValidUsername(username) {
+		return ""
+	}
+
+	return username
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils/testutils"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetUsernameFromTemplate(t *testing.T) {
+	userObj := &serializer.User{
+		Username:     "jsmith",
+		FirstName:    "John",
+		LastName:     "Smith-Jones",
+		MoodleUserID: "42",
+	}
+
+	for name, test := range map[string]struct {
+		Template         string
+		ExpectedUsername string
+	}{
+		"first and last name": {
+			Template:         "{first_name}.{last_name}",
+			ExpectedUsername: "john.smith-jones",
+		},
+		"moodle user id": {
+			Template:         "{username}_{moodle_user_id}",
+			ExpectedUsername: "jsmith_42",
+		},
+		"invalid characters are stripped": {
+			Template:         "{first_name} {last_name}!",
+			ExpectedUsername: "johnsmith-jones",
+		},
+		"leading digits are stripped": {
+			Template:         "{moodle_user_id}{username}",
+			ExpectedUsername: "jsmith",
+		},
+		"too long": {
+			Template:         strings.Repeat("a", 100),
+			ExpectedUsername: strings.Repeat("a", model.USER_NAME_MAX_LENGTH),
+		},
+		"no valid username": {
+			Template:         "{moodle_user_id}",
+			ExpectedUsername: "",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.ExpectedUsername, getUsernameFromTemplate(test.Template, userObj))
+		})
+	}
+}
+
+func TestResolveUsername(t *testing.T) {
+	userObj := &serializer.User{
+		Username:  "jsmith",
+		FirstName: "John",
+		LastName:  "Smith",
+	}
+
+	for name, test := range map[string]struct {
+		Strategy           string
+		TakenUsernames     []string
+		ExpectedUsername   string
+		ExpectedStatusCode int
+	}{
+		"username is free": {
+			Strategy:         usernameCollisionStrategyFail,
+			ExpectedUsername: "jsmith",
+		},
+		"fail": {
+			Strategy:           usernameCollisionStrategyFail,
+			TakenUsernames:     []string{"jsmith"},
+			ExpectedStatusCode: http.StatusConflict,
+		},
+		"suffix": {
+			Strategy:         usernameCollisionStrategySuffix,
+			TakenUsernames:   []string{"jsmith", "jsmith2"},
+			ExpectedUsername: "jsmith3",
+		},
+		"template": {
+			Strategy:         usernameCollisionStrategyTemplate,
+			TakenUsernames:   []string{"jsmith"},
+			ExpectedUsername: "john.smith",
+		},
+		"template with suffix": {
+			Strategy:         usernameCollisionStrategyTemplate,
+			TakenUsernames:   []string{"jsmith", "john.smith"},
+			ExpectedUsername: "john.smith2",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			for _, username := range test.TakenUsernames {
+				api.On("GetUserByUsername", username).Return(&model.User{Username: username}, nil)
+			}
+			api.On("GetUserByUsername", test.ExpectedUsername).Return(nil, testutils.GetNotFoundAppError())
+			p := &Plugin{}
+			p.SetAPI(api)
+			p.setConfiguration(&configuration{
+				UsernameCollisionStrategy: test.Strategy,
+				UsernameTemplate:          "{first_name}.{last_name}",
+			})
+
+			username, status, err := p.resolveUsername(userObj)
+			assert.Equal(t, test.ExpectedUsername, username)
+			assert.Equal(t, test.ExpectedStatusCode, status)
+			if test.ExpectedStatusCode != 0 {
+				assert.Equal(t, serializer.ErrorCodeUsernameExists, getErrorCode(status, err))
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// GetKeyHash returns a hashed version of the given key, prefixed with the given prefix.
+// Plugin KV store keys are limited to 50 characters, so arbitrary length values must be hashed before use.
+func GetKeyHash(prefix, key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return prefix + hex.EncodeToString(hash[:])[:32]
+}
@@ -0,0 +1,236 @@
+package utils
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	whitespaceRegexp = regexp.MustCompile(`\s+`)
+	blankLinesRegexp = regexp.MustCompile(`\n{3,}`)
+	newlinesRegexp   = regexp.MustCompile(`\n{2,}`)
+	markdownEscaper  = strings.NewReplacer(`\`, `\\`, "`", "\\`", `*`, `\*`, `_`, `\_`, `~`, `\~`, `[`, `\[`, `]`, `\]`)
+	// The query and fragment of a URL are kept as they are sent, so the characters which would end a Markdown link are escaped in them too
+	urlEscaper = strings.NewReplacer("(", "%28", ")", "%29", " ", "%20")
+)
+
+// HTMLToMarkdown converts HTML, such as the body of a Moodle forum post, to the Markdown rendered by Mattermost.
+// Formatting which has no Markdown equivalent is dropped and only its text is kept.
+func HTMLToMarkdown(data string) string {
+	nodes, err := html.ParseFragment(strings.NewReader(data), &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body})
+	if err != nil {
+		return data
+	}
+
+	var b strings.Builder
+	for _, node := range nodes {
+		b.WriteString(convertNode(node))
+	}
+
+	return cleanMarkdown(b.String())
+}
+
+// EscapeMarkdown escapes the characters of plain text which Markdown would format
+func EscapeMarkdown(text string) string {
+	return markdownEscaper.Replace(text)
+}
+
+func convertChildren(node *html.Node) string {
+	var b strings.Builder
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		b.WriteString(convertNode(child))
+	}
+
+	return b.String()
+}
+
+func convertNode(node *html.Node) string {
+	switch node.Type {
+	case html.TextNode:
+		return EscapeMarkdown(whitespaceRegexp.ReplaceAllString(node.Data, " "))
+	case html.ElementNode:
+	default:
+		return ""
+	}
+
+	switch node.DataAtom {
+	case atom.Script, atom.Style, atom.Head, atom.Title:
+		return ""
+	case atom.Br:
+		return "\n"
+	case atom.Hr:
+		return "\n\n---\n\n"
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		level, _ := strconv.Atoi(node.Data[1:])
+		return "\n\n" + strings.Repeat("#", level) + " " + toSingleLine(convertChildren(node)) + "\n\n"
+	case atom.Strong, atom.B:
+		return wrapInline(convertChildren(node), "**")
+	case atom.Em, atom.I:
+		return wrapInline(convertChildren(node), "_")
+	case atom.Del, atom.S, atom.Strike:
+		return wrapInline(convertChildren(node), "~~")
+	case atom.Code, atom.Kbd, atom.Samp:
+		return "`" + strings.ReplaceAll(getText(node), "`", "'") + "`"
+	case atom.Pre:
+		return "\n\n```\n" + strings.Trim(getText(node), "\n") + "\n```\n\n"
+	case atom.A:
+		return convertLink(node)
+	case atom.Img:
+		return convertImage(node)
+	case atom.Ul, atom.Ol:
+		return "\n\n" + convertList(node) + "\n\n"
+	case atom.Blockquote:
+		lines := strings.Split(cleanMarkdown(convertChildren(node)), "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRight("> "+line, " ")
+		}
+		return "\n\n" + strings.Join(lines, "\n") + "\n\n"
+	case atom.Tr:
+		var cells []string
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			if child.DataAtom == atom.Td || child.DataAtom == atom.Th {
+				cells = append(cells, toSingleLine(convertChildren(child)))
+			}
+		}
+		return strings.Join(cells, " | ") + "\n"
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Table, atom.Figure, atom.Li, atom.Dl, atom.Dt, atom.Dd:
+		return "\n\n" + strings.TrimSpace(convertChildren(node)) + "\n\n"
+	}
+
+	return convertChildren(node)
+}
+
+// wrapInline surrounds the text with the formatting marker, leaving its outer whitespace out of the marker as Markdown requires
+func wrapInline(text, marker string) string {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return text
+	}
+
+	start := strings.Index(text, trimmed)
+	return text[:start] + marker + trimmed + marker + text[start+len(trimmed):]
+}
+
+func convertLink(node *html.Node) string {
+	text := toSingleLine(convertChildren(node))
+	href, err := EscapeURL(getAttribute(node, "href"))
+	if err != nil {
+		return text
+	}
+
+	if text == "" {
+		text = EscapeMarkdown(href)
+	}
+
+	return "[" + text + "](" + href + ")"
+}
+
+// convertImage links to the image rather than embedding it, as images uploaded to Moodle usually require to be logged in to Moodle
+func convertImage(node *html.Node) string {
+	src, err := EscapeURL(getAttribute(node, "src"))
+	if err != nil {
+		return ""
+	}
+
+	alt := strings.TrimSpace(getAttribute(node, "alt"))
+	if alt == "" {
+		alt = "image"
+	}
+
+	return "[" + EscapeMarkdown(alt) + "](" + src + ")"
+}
+
+// convertList converts the items of a list. Nested lists are indented under the item containing them.
+func convertList(node *html.Node) string {
+	var items []string
+	number := 1
+	if start, err := strconv.Atoi(getAttribute(node, "start")); err == nil {
+		number = start
+	}
+
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if child.DataAtom != atom.Li {
+			continue
+		}
+
+		marker := "- "
+		if node.DataAtom == atom.Ol {
+			marker = strconv.Itoa(number) + ". "
+			number++
+		}
+
+		lines := strings.Split(newlinesRegexp.ReplaceAllString(cleanMarkdown(convertChildren(child)), "\n"), "\n")
+		for i, line := range lines {
+			if i > 0 && line != "" {
+				lines[i] = strings.Repeat(" ", len(marker)) + line
+			}
+		}
+
+		items = append(items, marker+strings.Join(lines, "\n"))
+	}
+
+	return strings.Join(items, "\n")
+}
+
+// getText returns the text of the node as it is, for preformatted content which is not converted
+func getText(node *html.Node) string {
+	if node.Type == html.TextNode {
+		return node.Data
+	}
+
+	if node.DataAtom == atom.Br {
+		return "\n"
+	}
+
+	var b strings.Builder
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		b.WriteString(getText(child))
+	}
+
+	return b.String()
+}
+
+func getAttribute(node *html.Node, key string) string {
+	for _, attr := range node.Attr {
+		if attr.Key == key {
+			return strings.TrimSpace(attr.Val)
+		}
+	}
+
+	return ""
+}
+
+// EscapeURL percent-encodes a URL so that it can be the destination of a Markdown link.
+// Only absolute http and https URLs are accepted, so that links cannot run scripts or open other applications.
+func EscapeURL(value string) (string, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", err
+	}
+
+	if scheme := strings.ToLower(u.Scheme); (scheme != "http" && scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%q is not an absolute http or https URL", value)
+	}
+
+	return urlEscaper.Replace(u.String()), nil
+}
+
+func toSingleLine(text string) string {
+	return strings.TrimSpace(whitespaceRegexp.ReplaceAllString(text, " "))
+}
+
+// cleanMarkdown removes trailing spaces and extra blank lines left by the conversion of block elements
+func cleanMarkdown(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+
+	return strings.Trim(blankLinesRegexp.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"), "\n ")
+}
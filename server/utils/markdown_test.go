@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTMLToMarkdown(t *testing.T) {
+	for name, test := range map[string]struct {
+		HTML     string
+		Expected string
+	}{
+		"plain text": {
+			HTML:     "The exam is on Monday.",
+			Expected: "The exam is on Monday.",
+		},
+		"paragraphs and line breaks": {
+			HTML:     "<p>First   line<br>second line</p>\n<p>Second paragraph</p>",
+			Expected: "First line\nsecond line\n\nSecond paragraph",
+		},
+		"inline formatting": {
+			HTML:     "<p>This is <strong>important </strong>and <em>urgent</em>, run <code>make_all</code>.</p>",
+			Expected: "This is **important** and _urgent_, run `make_all`.",
+		},
+		"markdown characters in text": {
+			HTML:     "<p>Use snake_case and 2*3</p>",
+			Expected: `Use snake\_case and 2\*3`,
+		},
+		"heading": {
+			HTML:     "<h3>Week 1</h3><p>Reading</p>",
+			Expected: "### Week 1\n\nReading",
+		},
+		"links": {
+			HTML:     `<p><a href="https://moodle.example.com/mod/assign/view.php?id=1">Assignment</a> <a href="javascript:alert(1)">unsafe</a> <a href="https://example.com"></a></p>`,
+			Expected: "[Assignment](https://moodle.example.com/mod/assign/view.php?id=1) unsafe [https://example.com](https://example.com)",
+		},
+		"image": {
+			HTML:     `<p><img src="https://moodle.example.com/pluginfile.php/1/diagram.png" alt="Diagram"></p>`,
+			Expected: "[Diagram](https://moodle.example.com/pluginfile.php/1/diagram.png)",
+		},
+		"nested lists": {
+			HTML:     "<ul><li>Read chapter 1</li><li>Exercises<ol><li>Page 10</li><li>Page 12</li></ol></li></ul><p>Good luck</p>",
+			Expected: "- Read chapter 1\n- Exercises\n  1. Page 10\n  2. Page 12\n\nGood luck",
+		},
+		"blockquote": {
+			HTML:     "<blockquote><p>Quoted</p><p>text</p></blockquote>",
+			Expected: "> Quoted\n>\n> text",
+		},
+		"preformatted text": {
+			HTML:     "<pre>if x:\n    print(x)</pre>",
+			Expected: "```\nif x:\n    print(x)\n```",
+		},
+		"table": {
+			HTML:     "<table><tr><th>Day</th><th>Room</th></tr><tr><td>Monday</td><td>B12</td></tr></table>",
+			Expected: "Day | Room\nMonday | B12",
+		},
+		"scripts and entities": {
+			HTML:     "<script>alert(1)</script><p>Fish &amp; chips&nbsp;&lt;3</p>",
+			Expected: "Fish & chips\u00a0<3",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.Expected, HTMLToMarkdown(test.HTML))
+		})
+	}
+}
+
+func TestEscapeURL(t *testing.T) {
+	for name, test := range map[string]struct {
+		URL           string
+		Expected      string
+		ExpectedError bool
+	}{
+		"spaces and parentheses": {
+			URL:      "https://moodle.example.com/pluginfile.php/1/week 1 (draft).pdf",
+			Expected: "https://moodle.example.com/pluginfile.php/1/week%201%20%28draft%29.pdf",
+		},
+		"query": {
+			URL:      "https://moodle.example.com/mod/forum/discuss.php?d=12",
+			Expected: "https://moodle.example.com/mod/forum/discuss.php?d=12",
+		},
+		"parentheses in query": {
+			URL:      "http://moodle.example.com/search.php?q=(exam)",
+			Expected: "http://moodle.example.com/search.php?q=%28exam%29",
+		},
+		"javascript": {
+			URL:           "javascript:alert(1)",
+			ExpectedError: true,
+		},
+		"mailto": {
+			URL:           "mailto:teacher@example.com",
+			ExpectedError: true,
+		},
+		"relative": {
+			URL:           "/mod/forum/discuss.php?d=12",
+			ExpectedError: true,
+		},
+		"invalid": {
+			URL:           "https://moodle.example.com/%zz",
+			ExpectedError: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			escaped, err := EscapeURL(test.URL)
+			if test.ExpectedError {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.Expected, escaped)
+		})
+	}
+}
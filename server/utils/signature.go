@@ -0,0 +1,13 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// GetSignaturePayload returns the string signed by Moodle, which is made of the timestamp, nonce, method, path, query and body of the request:
+// "<timestamp>\n<nonce>\n<method>\n<path>\n<query>\n<body>". The query parameters are sorted by key, as url.Values.Encode does.
+// Signing the method, path and query prevents a signature captured from one request from being replayed against another endpoint.
+func GetSignaturePayload(r *http.Request, timestamp int64, nonce string, body []byte) []byte {
+	return append([]byte(fmt.Sprintf("%d\n%s\n%s\n%s\n%s\n", timestamp, nonce, r.Method, r.URL.Path, r.URL.Query().Encode())), body...)
+}
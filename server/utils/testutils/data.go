@@ -1,9 +1,16 @@
 package testutils
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"net/http"
+	"strconv"
 
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/constants"
 	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/serializer"
+	"github.com/Brightscout/x-mattermost-plugin-moodle-sync/server/utils"
 	"github.com/mattermost/mattermost-server/v5/api4"
 	"github.com/mattermost/mattermost-server/v5/model"
 )
@@ -43,6 +50,15 @@ func GetModelChannel() *model.Channel {
 	}
 }
 
+// GetConfig returns a server configuration with sign in with email and LDAP enabled
+func GetConfig() *model.Config {
+	config := &model.Config{}
+	config.SetDefaults()
+	config.LdapSettings.Enable = model.NewBool(true)
+	config.ServiceSettings.SiteURL = model.NewString("http://localhost:8065")
+	return config
+}
+
 func GetSerializerUser() serializer.User {
 	return serializer.User{
 		ID:          api4.GenerateTestId(),
@@ -96,3 +112,36 @@ func GetNotFoundAppError() *model.AppError {
 		StatusCode: http.StatusNotFound,
 	}
 }
+
+// SignRequest adds the headers of a request signed with the test secret
+func SignRequest(r *http.Request, body []byte, timestamp int64, nonce string) {
+	mac := hmac.New(sha256.New, []byte(GetSecret()))
+	_, _ = mac.Write(utils.GetSignaturePayload(r, timestamp, nonce, body))
+
+	r.Header.Set(constants.HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	r.Header.Set(constants.HeaderNonce, nonce)
+	r.Header.Set(constants.HeaderSignature, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func GetMappingJSON(moodleID, mattermostID string) []byte {
+	mapping := serializer.Mapping{
+		MoodleID:     moodleID,
+		MattermostID: mattermostID,
+	}
+	return []byte(mapping.ToJSON())
+}
+
+func GetJob(jobType string, payload serializer.ChannelMembers, result serializer.ChannelMemberResults) *serializer.Job {
+	job := &serializer.Job{
+		ID:     model.NewId(),
+		Type:   jobType,
+		Params: map[string]string{serializer.JobParamChannelID: GetID()},
+		Status: serializer.JobStatusPending,
+	}
+	job.Payload, _ = json.Marshal(payload)
+	if result != nil {
+		job.Result, _ = json.Marshal(result)
+	}
+
+	return job
+}